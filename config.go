@@ -0,0 +1,451 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gonews "github.com/mparaiso/gonews/core"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvironmentPrefix prefixes every environment variable read by the configuration loader
+const EnvironmentPrefix = "GONEWS_"
+
+// Configuration gathers the server options and the application options.
+// Values are resolved with the following precedence :
+// command line flags > GONEWS_* environment variables > YAML configuration file > defaults
+type Configuration struct {
+	Server            StartOptions `yaml:"server"`
+	gonews.AppOptions `yaml:",inline"`
+}
+
+// ConfigurationEntry is a configuration value that can be set
+// from a command line flag or an environment variable
+type ConfigurationEntry struct {
+	// Name is the flag name, the environment variable is EnvironmentPrefix + uppercased Name
+	Name  string
+	Usage string
+	// Value points to the configuration field
+	Value interface{}
+}
+
+// EnvironmentVariable returns the environment variable name of the entry
+func (entry ConfigurationEntry) EnvironmentVariable() string {
+	return EnvironmentPrefix + strings.ToUpper(entry.Name)
+}
+
+// Set parses raw and sets the configuration field.
+// A value starting with $ is read from the environment variable it names, i.e. -port=$PORT
+func (entry ConfigurationEntry) Set(raw string) error {
+	if len(raw) > 1 && raw[0] == '$' {
+		raw = os.Getenv(raw[1:])
+	}
+	var err error
+	switch value := entry.Value.(type) {
+	case *string:
+		*value = raw
+	case *bool:
+		*value, err = strconv.ParseBool(raw)
+	case *int:
+		*value, err = strconv.Atoi(raw)
+	case *float64:
+		*value, err = strconv.ParseFloat(raw, 64)
+	case *gonews.LogLevel:
+		var level int
+		level, err = strconv.Atoi(raw)
+		*value = gonews.LogLevel(level)
+	case *gonews.LogFormat:
+		*value = gonews.LogFormat(raw)
+	case *time.Duration:
+		*value, err = time.ParseDuration(raw)
+	default:
+		err = fmt.Errorf("unsupported type %T", entry.Value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value '%s' for %s : %s", raw, entry.Name, err)
+	}
+	return nil
+}
+
+// Entries returns all the configuration entries bound to the configuration fields
+func (configuration *Configuration) Entries() []ConfigurationEntry {
+	server, options := &configuration.Server, &configuration.ContainerOptions
+	return []ConfigurationEntry{
+		{"config", "Configuration file path", &server.ConfigurationFilePath},
+		{"debug", "Starts the application in Debug mode.", &options.Debug},
+		{"host", "Host address of the server, example : localhost", &server.Host},
+		{"port", "Server port, example: 8080", &server.Port},
+		{"env", "Current environment, examples: -env=developement , -env=test ", &options.Environment},
+		{"secret", "Secret key used for encryption, example -secret=\"my-secret-key\"", &options.Secret},
+		{"migrate", "migrate will execute an upward database migration when the application starts", &server.Migrate},
+		{"migrationpath", "Sets the directory where gonews db new creates migrations", &server.MigrationPath},
+		{"driver", "Sets the database driver. Example : -driver=sqlite3", &options.Driver},
+		{"datasource", "Sets the datasource. Example: -datasource=db.sqlite3", &options.DataSource},
+		{"loglevel", "A value between 0 and 6. Sets the logger verbosity level. Example: -loglevel 0 ", &options.LogLevel},
+		{"logformat", "text, json or logfmt. Sets the format of log records", &options.LogFormat},
+		{"socket", "Listen on a unix socket instead of host:port. Example: -socket=/var/run/gonews.sock", &server.Socket},
+		{"tlscert", "TLS certificate file, enables https when used with -tlskey. Example: -tlscert=cert.pem", &server.TLSCertFile},
+		{"tlskey", "TLS private key file, enables https when used with -tlscert. Example: -tlskey=key.pem", &server.TLSKeyFile},
+		{"httpredirect", "When TLS is enabled, address of a listener redirecting http to https. Example: -httpredirect=:80", &server.HTTPRedirectAddr},
+		{"readtimeout", "Maximum duration for reading a request. Example: -readtimeout=10s", &server.ReadTimeout},
+		{"writetimeout", "Maximum duration before timing out writing a response. Example: -writetimeout=30s", &server.WriteTimeout},
+		{"idletimeout", "Maximum time to wait for the next request on a keep-alive connection. Example: -idletimeout=2m", &server.IdleTimeout},
+		{"shutdowntimeout", "Maximum time to wait for in-flight requests on shutdown. Example: -shutdowntimeout=30s", &server.ShutdownTimeout},
+		{"shutdowndelay", "Time during which /readyz reports not ready before the shutdown starts. Example: -shutdowndelay=5s", &server.ShutdownDelay},
+		{"metricsaddr", "Address of a listener serving the prometheus metrics at /metrics. Example: -metricsaddr=127.0.0.1:9090", &server.MetricsAddr},
+		{"metricstoken", "Bearer token required to read the metrics, /metrics is served by the application if metricsaddr is empty", &options.MetricsToken},
+		{"publicdir", "Directory of static files. Example: -publicdir=public", &configuration.PublicDirectory},
+		{"templatedir", "Directory of templates. Example: -templatedir=templates", &options.TemplateDirectory},
+		{"templateext", "Extension of template files. Example: -templateext=tpl.html", &options.TemplateFileExtension},
+		{"title", "Title of the site", &options.Title},
+		{"slogan", "Slogan of the site", &options.Slogan},
+		{"description", "Description of the site", &options.Description},
+		{"storiesperpage", "Number of stories per page", &options.StoriesPerPage},
+		{"commentsperpage", "Number of comments per page", &options.CommentsPerPage},
+		{"commentmaxdepth", "Maximum depth of a comment thread", &options.CommentMaxDepth},
+		{"flagminkarma", "Karma needed to flag stories and comments", &options.FlagMinKarma},
+		{"flagthreshold", "Number of flags that hides a story or a comment, more flags are needed for items with a high score", &options.FlagThreshold},
+		{"vouchminkarma", "Karma needed to vouch for dead stories and comments", &options.VouchMinKarma},
+		{"downvoteminkarma", "Karma needed to downvote comments", &options.DownvoteMinKarma},
+		{"downvotemaxage", "Age after which comments can't be downvoted. Example: -downvotemaxage=24h", &options.DownvoteMaxAge},
+		{"favoriteweight", "Points a favorite adds to a story when ranking the front page, 0 to ignore favorites", &options.FavoriteWeight},
+		{"beststorieswindow", "How far back /best looks for stories. Example: -beststorieswindow=72h", &options.BestStoriesWindow},
+		{"activestorieswindow", "How far back /active looks for comments. Example: -activestorieswindow=48h", &options.ActiveStoriesWindow},
+		{"bestcommentswindow", "How far back /bestcomments looks for comments. Example: -bestcommentswindow=48h", &options.BestCommentsWindow},
+		{"unvotewindow", "How long users can remove or change their votes. Example: -unvotewindow=1h", &options.UnvoteWindow},
+		{"voteanalysisinterval", "How often the server looks for voting rings and sockpuppets, 0 to only analyze votes on demand. Example: -voteanalysisinterval=1h", &options.VoteAnalysis.Interval},
+		{"voteanalysiswindow", "How far back the vote analysis looks, older votes keep their weight. Example: -voteanalysiswindow=168h", &options.VoteAnalysis.Window},
+		{"voteringwindow", "Maximum time between the votes of users on an item for them to count as co-votes. Example: -voteringwindow=10m", &options.VoteAnalysis.RingWindow},
+		{"voteringminitems", "Number of items users co-vote on that makes them a voting ring", &options.VoteAnalysis.RingMinItems},
+		{"newaccountage", "Age under which accounts upvoting a single author are sockpuppets. Example: -newaccountage=72h", &options.VoteAnalysis.NewAccountAge},
+		{"sockpuppetminvotes", "Number of upvotes for a single author that makes a new account a sockpuppet", &options.VoteAnalysis.SockpuppetMinVotes},
+		{"suspiciousvoteweight", "How much a vote of a voting ring or a sockpuppet counts in rankings, between 0 and 1", &options.VoteAnalysis.SuspiciousVoteWeight},
+		{"sessionstore", "sql to store sessions in the database or cookie to store them in a signed cookie", &options.Session.Store},
+		{"sessionname", "Name of the session cookie", &options.Session.Name},
+		{"sessionpath", "Path of the session cookie", &options.Session.Path},
+		{"sessiondomain", "Domain of the session cookie, leave empty for the current host", &options.Session.Domain},
+		{"sessionmaxage", "Lifetime of the session cookie in seconds", &options.Session.MaxAge},
+		{"sessioncleanupinterval", "How often expired sessions are deleted from the database, 0 to keep them. Example: -sessioncleanupinterval=1h", &options.Session.CleanupInterval},
+		{"remembermemaxage", "Lifetime of the \"remember me\" login cookie in seconds", &options.Session.RememberMeMaxAge},
+		{"sessionsecure", "Only send the session cookie over https", &options.Session.Secure},
+		{"sessionhttponly", "Hide the session cookie from javascript", &options.Session.HTTPOnly},
+		{"smtpaddr", "host:port of the SMTP server sending notification emails, emails are only logged if empty. Example: -smtpaddr=smtp.example.com:587", &options.Mail.SMTPAddr},
+		{"smtpusername", "Username of the SMTP server", &options.Mail.SMTPUsername},
+		{"smtppassword", "Password of the SMTP server", &options.Mail.SMTPPassword},
+		{"mailfrom", "Sender address of notification emails", &options.Mail.From},
+		{"smtptimeout", "Maximum duration for sending an email. Example: -smtptimeout=10s", &options.Mail.SMTPTimeout},
+		{"mailqueuesize", "Number of notification emails waiting to be sent above which new ones are dropped", &options.Mail.QueueSize},
+		{"baseurl", "Public URL of the site, links in notification emails point to it. Example: -baseurl=https://news.example.com", &options.Mail.BaseURL},
+	}
+}
+
+// DefaultConfiguration returns the configuration defaults
+func DefaultConfiguration() *Configuration {
+	options := gonews.DefaultContainerOptions()
+	options.Secret = defaultSecret
+	return &Configuration{
+		Server: StartOptions{
+			ConfigurationFilePath: "gonews.yml",
+			Host:                  "0.0.0.0",
+			Port:                  "8080",
+			MigrationPath:         "migrations",
+			ReadTimeout:           10 * time.Second,
+			WriteTimeout:          30 * time.Second,
+			IdleTimeout:           120 * time.Second,
+			ShutdownTimeout:       DefaultShutdownTimeout,
+		},
+		AppOptions: gonews.AppOptions{ContainerOptions: options},
+	}
+}
+
+// NewConfigurationFlagSet returns a flag set declaring every configuration entry.
+// Flags are stored as raw strings and only applied by LoadConfiguration,
+// so the defaults printed by the flag set are the configuration defaults
+func NewConfigurationFlagSet(name string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(name, flag.ExitOnError)
+	defaults := DefaultConfiguration()
+	for _, entry := range defaults.Entries() {
+		if _, ok := entry.Value.(*bool); ok {
+			flagSet.Bool(entry.Name, *entry.Value.(*bool), entry.Usage)
+		} else {
+			flagSet.String(entry.Name, fmt.Sprint(reflectValue(entry.Value)), entry.Usage)
+		}
+	}
+	return flagSet
+}
+
+// LoadConfiguration parses the command line arguments and resolves the configuration
+func LoadConfiguration(flagSet *flag.FlagSet, arguments []string) (*Configuration, error) {
+	if err := flagSet.Parse(arguments); err != nil {
+		return nil, err
+	}
+	configuration := DefaultConfiguration()
+	entries := map[string]ConfigurationEntry{}
+	for _, entry := range configuration.Entries() {
+		entries[entry.Name] = entry
+	}
+	flags := map[string]string{}
+	flagSet.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	// the configuration file path must be known before the other values
+	configEntry, configFileIsExplicit := entries["config"], false
+	if raw, ok := os.LookupEnv(configEntry.EnvironmentVariable()); ok {
+		if err := configEntry.Set(raw); err != nil {
+			return nil, err
+		}
+		configFileIsExplicit = true
+	}
+	if raw, ok := flags[configEntry.Name]; ok {
+		if err := configEntry.Set(raw); err != nil {
+			return nil, err
+		}
+		configFileIsExplicit = true
+	}
+	// YAML
+	if path := configuration.Server.ConfigurationFilePath; path != "" {
+		fileBytes, err := ioutil.ReadFile(path)
+		if err != nil && (configFileIsExplicit || !os.IsNotExist(err)) {
+			return nil, fmt.Errorf("Error loading configuration file %s : %s", path, err)
+		}
+		if err == nil {
+			if err = yaml.Unmarshal(fileBytes, configuration); err != nil {
+				return nil, fmt.Errorf("Error reading configuration file %s : %s", path, err)
+			}
+			configuration.Server.ConfigurationFilePath = path
+		}
+	}
+	// environment variables, then flags
+	for _, entry := range configuration.Entries() {
+		if raw, ok := os.LookupEnv(entry.EnvironmentVariable()); ok {
+			if err := entry.Set(raw); err != nil {
+				return nil, fmt.Errorf("%s : %s", entry.EnvironmentVariable(), err)
+			}
+		}
+	}
+	for _, entry := range configuration.Entries() {
+		if raw, ok := flags[entry.Name]; ok {
+			if err := entry.Set(raw); err != nil {
+				return nil, err
+			}
+		}
+	}
+	configuration.Environment = configuration.ContainerOptions.Environment
+	return configuration, nil
+}
+
+// Validate returns errors for invalid values and warnings for insecure values
+func (configuration *Configuration) Validate() (errors []string, warnings []string) {
+	server, options := configuration.Server, configuration.ContainerOptions
+	isProduction := options.Environment == "production"
+	isTLS := server.TLSCertFile != "" && server.TLSKeyFile != ""
+
+	if server.Socket == "" && server.Port == "" {
+		errors = append(errors, "port should not be empty")
+	}
+	if (server.TLSCertFile == "") != (server.TLSKeyFile == "") {
+		errors = append(errors, "tlscert and tlskey should be provided together")
+	}
+	if server.HTTPRedirectAddr != "" && !isTLS {
+		errors = append(errors, "httpredirect requires tlscert and tlskey")
+	}
+	if server.MetricsAddr != "" && server.MetricsAddr == server.Host+":"+server.Port {
+		errors = append(errors, "metricsaddr should be different from the server address")
+	}
+	if options.MetricsToken != "" && len(options.MetricsToken) < 16 {
+		warnings = append(warnings, "metricstoken should be at least 16 characters long")
+	}
+	for _, setting := range []struct {
+		Name     string
+		Duration time.Duration
+	}{
+		{"readtimeout", server.ReadTimeout},
+		{"writetimeout", server.WriteTimeout},
+		{"idletimeout", server.IdleTimeout},
+		{"shutdowntimeout", server.ShutdownTimeout},
+		{"shutdowndelay", server.ShutdownDelay},
+		{"sessioncleanupinterval", options.Session.CleanupInterval},
+	} {
+		if setting.Duration < 0 {
+			errors = append(errors, setting.Name+" should not be negative")
+		}
+	}
+	if options.Driver == "" {
+		errors = append(errors, "driver should not be empty")
+	}
+	if options.DataSource == "" {
+		errors = append(errors, "datasource should not be empty")
+	}
+	if options.LogLevel < gonews.ALL || options.LogLevel > gonews.OFF {
+		errors = append(errors, fmt.Sprintf("loglevel should be between %d and %d", gonews.ALL, gonews.OFF))
+	}
+	switch options.LogFormat {
+	case gonews.LogFormatText, gonews.LogFormatJSON, gonews.LogFormatLogfmt:
+	default:
+		errors = append(errors, fmt.Sprintf("logformat '%s' should be text, json or logfmt", options.LogFormat))
+	}
+	if options.StoriesPerPage <= 0 {
+		errors = append(errors, "storiesperpage should be greater than 0")
+	}
+	if options.CommentsPerPage <= 0 {
+		errors = append(errors, "commentsperpage should be greater than 0")
+	}
+	if options.FlagThreshold <= 0 {
+		errors = append(errors, "flagthreshold should be greater than 0")
+	}
+	if options.CommentMaxDepth < 0 {
+		errors = append(errors, "commentmaxdepth should not be negative")
+	}
+	if options.FavoriteWeight < 0 {
+		errors = append(errors, "favoriteweight should not be negative")
+	}
+	for _, window := range []struct {
+		Name     string
+		Duration time.Duration
+	}{
+		{"beststorieswindow", options.BestStoriesWindow},
+		{"activestorieswindow", options.ActiveStoriesWindow},
+		{"bestcommentswindow", options.BestCommentsWindow},
+		{"unvotewindow", options.UnvoteWindow},
+		{"downvotemaxage", options.DownvoteMaxAge},
+		{"voteanalysiswindow", options.VoteAnalysis.Window},
+		{"voteringwindow", options.VoteAnalysis.RingWindow},
+		{"newaccountage", options.VoteAnalysis.NewAccountAge},
+	} {
+		if window.Duration <= 0 {
+			errors = append(errors, window.Name+" should be greater than 0")
+		}
+	}
+	if options.VoteAnalysis.Interval < 0 {
+		errors = append(errors, "voteanalysisinterval should not be negative")
+	}
+	if options.VoteAnalysis.RingMinItems < 2 {
+		errors = append(errors, "voteringminitems should be at least 2")
+	}
+	if options.VoteAnalysis.SockpuppetMinVotes < 2 {
+		errors = append(errors, "sockpuppetminvotes should be at least 2")
+	}
+	if weight := options.VoteAnalysis.SuspiciousVoteWeight; weight < 0 || weight > 1 {
+		errors = append(errors, "suspiciousvoteweight should be between 0 and 1")
+	}
+	if stat, err := os.Stat(options.TemplateDirectory); err != nil || !stat.IsDir() {
+		errors = append(errors, fmt.Sprintf("templatedir '%s' is not a directory", options.TemplateDirectory))
+	}
+	if options.Session.Name == "" {
+		errors = append(errors, "sessionname should not be empty")
+	}
+	if options.Session.Store != "sql" && options.Session.Store != "cookie" {
+		errors = append(errors, fmt.Sprintf("sessionstore '%s' should be sql or cookie", options.Session.Store))
+	}
+	if options.Session.MaxAge < 0 {
+		errors = append(errors, "sessionmaxage should not be negative")
+	}
+	if options.Session.RememberMeMaxAge <= 0 {
+		errors = append(errors, "remembermemaxage should be positive")
+	}
+	if options.Mail.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(options.Mail.SMTPAddr); err != nil {
+			errors = append(errors, fmt.Sprintf("smtpaddr '%s' should be host:port", options.Mail.SMTPAddr))
+		}
+		if options.Mail.From == "" {
+			errors = append(errors, "mailfrom should not be empty when smtpaddr is set")
+		}
+		if options.Mail.SMTPTimeout <= 0 {
+			errors = append(errors, "smtptimeout should be positive when smtpaddr is set")
+		}
+	}
+	if options.Mail.QueueSize <= 0 {
+		errors = append(errors, "mailqueuesize should be positive")
+	}
+	if baseURL, err := url.Parse(options.Mail.BaseURL); err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		errors = append(errors, fmt.Sprintf("baseurl '%s' should be an absolute http or https url", options.Mail.BaseURL))
+	}
+	// insecure values
+	switch {
+	case options.Secret == "":
+		errors = append(errors, "secret should not be empty")
+	case options.Secret == defaultSecret && isProduction:
+		errors = append(errors, "the default secret should not be used in production")
+	case options.Secret == defaultSecret:
+		warnings = append(warnings, "the default secret is used, please set a strong secret with -secret or GONEWS_SECRET")
+	case len(options.Secret) < 32:
+		warnings = append(warnings, "secret should be at least 32 characters long")
+	}
+	if options.Debug && isProduction {
+		warnings = append(warnings, "debug mode exposes internal informations and should not be enabled in production")
+	}
+	if !options.Session.HTTPOnly {
+		warnings = append(warnings, "sessionhttponly is disabled, the session cookie is readable by javascript")
+	}
+	if !options.Session.Secure && isProduction {
+		warnings = append(warnings, "sessionsecure is disabled, the session cookie can be sent over plain http")
+	}
+	if options.Session.Secure && !isTLS && !isProduction {
+		warnings = append(warnings, "sessionsecure is enabled without tls, login will not work over plain http")
+	}
+	if !isProduction {
+		warnings = append(warnings, fmt.Sprintf("You are using '%s' environment, please use option -env=production in production", options.Environment))
+	}
+	return
+}
+
+// String returns the configuration as YAML, with the secret, the metrics token and the SMTP password masked
+func (configuration Configuration) String() string {
+	if configuration.Secret != "" {
+		configuration.Secret = "********"
+	}
+	if configuration.MetricsToken != "" {
+		configuration.MetricsToken = "********"
+	}
+	if configuration.Mail.SMTPPassword != "" {
+		configuration.Mail.SMTPPassword = "********"
+	}
+	out, err := yaml.Marshal(configuration)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+func reflectValue(pointer interface{}) interface{} {
+	switch value := pointer.(type) {
+	case *string:
+		return *value
+	case *int:
+		return *value
+	case *float64:
+		return *value
+	case *gonews.LogLevel:
+		return int(*value)
+	case *gonews.LogFormat:
+		return string(*value)
+	case *time.Duration:
+		return *value
+	}
+	return ""
+}
@@ -0,0 +1,39 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfiguration_String(t *testing.T) {
+	configuration := DefaultConfiguration()
+	configuration.Secret = "a very secret secret"
+	configuration.MetricsToken = "supersecrettoken1234"
+	configuration.Mail.SMTPPassword = "an smtp password"
+	printed := configuration.String()
+	for _, secret := range []string{configuration.Secret, configuration.MetricsToken, configuration.Mail.SMTPPassword} {
+		if strings.Contains(printed, secret) {
+			t.Fatalf("the printed configuration contains '%s'", secret)
+		}
+	}
+	if !strings.Contains(printed, "metricstoken: '********'") {
+		t.Fatalf("the metrics token is not masked :\n%s", printed)
+	}
+}
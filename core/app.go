@@ -18,10 +18,15 @@
 package gonews
 
 import (
+	"database/sql"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"reflect"
+	"strings"
+
+	"github.com/gorilla/sessions"
 )
 
 // GetApp returns an application ready to be handled by a server
@@ -34,6 +39,65 @@ func GetApp(appOptions AppOptions) http.Handler {
 		}
 		appOptions.PublicDirectory = path.Join(wd, "public")
 	}
+	// The default logger is shared by all requests, each request gets
+	// a copy of it with the request id field
+	if appOptions.ContainerOptions.LoggerFactory == nil {
+		level := appOptions.ContainerOptions.LogLevel
+		if appOptions.ContainerOptions.Debug {
+			level = ALL
+		}
+		logger, err := NewLogger(os.Stdout, level, appOptions.ContainerOptions.LogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appOptions.ContainerOptions.LoggerFactory = func() (LoggerInterface, error) {
+			return logger, nil
+		}
+	}
+	// Metrics are collected even if they are not served by the application,
+	// they can be served on another address with MetricsHandler
+	if appOptions.ContainerOptions.Metrics == nil {
+		appOptions.ContainerOptions.Metrics = NewMetrics()
+	}
+	if appOptions.ContainerOptions.Readiness == nil {
+		appOptions.ContainerOptions.Readiness = &Readiness{}
+	}
+	// A single mail queue sends the emails of all requests
+	if appOptions.ContainerOptions.Mail.Queue == nil {
+		appOptions.ContainerOptions.Mail.Queue = NewMailQueue(appOptions.ContainerOptions.Mail.QueueSize)
+	}
+	// A single connection pool is shared by all requests
+	if appOptions.ContainerOptions.ConnectionFactory == nil {
+		connection, connectionErr := sql.Open(appOptions.ContainerOptions.Driver, appOptions.ContainerOptions.DataSource)
+		appOptions.ContainerOptions.ConnectionFactory = func() (*sql.DB, error) {
+			return connection, connectionErr
+		}
+	}
+	db, err := appOptions.ContainerOptions.ConnectionFactory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	appOptions.ContainerOptions.Metrics.SetDB(db)
+	// The session store is shared by all requests
+	if appOptions.ContainerOptions.Session.StoreFactory == nil {
+		var store sessions.Store
+		switch appOptions.ContainerOptions.Session.Store {
+		case "sql":
+			logger, err := appOptions.ContainerOptions.LoggerFactory()
+			if err != nil {
+				log.Fatal(err)
+			}
+			store = NewSQLStore(&SessionRepository{db, logger, appOptions.ContainerOptions.Metrics},
+				appOptions.ContainerOptions.Session.CookieOptions())
+		default:
+			cookieStore := sessions.NewCookieStore([]byte(appOptions.ContainerOptions.Secret))
+			cookieStore.Options = appOptions.ContainerOptions.Session.CookieOptions()
+			store = cookieStore
+		}
+		appOptions.ContainerOptions.Session.StoreFactory = func() (sessions.Store, error) {
+			return store, nil
+		}
+	}
 	// The containerFactory will be used to create a new container
 	// for each request, the container is then passed to all middlewares in the stack
 	if appOptions.ContainerFactory == nil {
@@ -50,9 +114,11 @@ func GetApp(appOptions AppOptions) http.Handler {
 
 			container.CSRFGeneratorProvider = NewDefaultCSRFGeneratorProvider(container, container)
 
-			container.TemplateProvider = NewDefaultTemplateProvider(container.ContainerOptions.TemplateDirectory,
+			templateProvider := NewDefaultTemplateProvider(container.ContainerOptions.TemplateDirectory,
 				container.ContainerOptions.TemplateFileExtension,
 				container.ContainerOptions.Debug, container)
+			templateProvider.Metrics = container.ContainerOptions.Metrics
+			container.TemplateProvider = templateProvider
 
 			container.FormDecoderProvider = NewDefaultFormDecoderProvider(NewDefaultFormDecoder())
 
@@ -63,8 +129,13 @@ func GetApp(appOptions AppOptions) http.Handler {
 	DefaultStack := GetDefaultStack(appOptions.ContainerFactory)
 
 	Default := DefaultStack.Clone().Build()
+	// Used for probes, which need neither sessions nor users
+	Probe := (&MiddlewareQueue{Middlewares: []Middleware{RequestIDMiddleware, MetricsMiddleware},
+		ContainerFactory: appOptions.ContainerFactory}).Build()
 	// Usef for authenticated routes
 	AuthenticatedUsersOnly := DefaultStack.Clone().Push(AuthenticatedUserOnlyMiddleware).Build()
+	// Used for administration routes
+	AdministratorsOnly := DefaultStack.Clone().Push(AuthenticatedUserOnlyMiddleware).Push(AdministratorOnlyMiddleware).Build()
 
 	app := http.NewServeMux()
 	routes := Route{}
@@ -76,6 +147,24 @@ func GetApp(appOptions AppOptions) http.Handler {
 
 	app.HandleFunc(routes.NewStories(), Default(NewStoriesController))
 
+	app.HandleFunc(routes.Front(), Default(FrontController))
+
+	app.HandleFunc(routes.Past(), Default(PastController))
+
+	app.HandleFunc(routes.BestStories(), Default(BestStoriesController))
+
+	app.HandleFunc(routes.ActiveStories(), Default(ActiveStoriesController))
+
+	app.HandleFunc(routes.BestComments(), Default(BestCommentsController))
+
+	app.HandleFunc(routes.Leaders(), Default(LeadersController))
+
+	app.HandleFunc(routes.AskStories(), Default(AskStoriesController))
+
+	app.HandleFunc(routes.ShowStories(), Default(ShowStoriesController))
+
+	app.HandleFunc(routes.JobStories(), Default(JobStoriesController))
+
 	app.HandleFunc(routes.StoryByID(), Default(StoryByIDController))
 
 	app.HandleFunc(routes.Reply(), AuthenticatedUsersOnly(ReplyController))
@@ -96,6 +185,40 @@ func GetApp(appOptions AppOptions) http.Handler {
 
 	app.HandleFunc(routes.Registration(), Default(PostOnlyMiddleware, RegistrationController))
 
+	app.HandleFunc(routes.Sessions(), AuthenticatedUsersOnly(SessionsController))
+
+	app.HandleFunc(routes.Flag(), AuthenticatedUsersOnly(FlagController))
+
+	app.HandleFunc(routes.FlagQueue(), AdministratorsOnly(FlagQueueController))
+
+	app.HandleFunc(routes.Vouch(), AuthenticatedUsersOnly(VouchController))
+
+	app.HandleFunc(routes.ModerationLog(), AdministratorsOnly(ModerationLogController))
+
+	app.HandleFunc(routes.DomainRules(), AdministratorsOnly(DomainRulesController))
+
+	app.HandleFunc(routes.VoteAnalysis(), AdministratorsOnly(VoteAnalysisController))
+
+	app.HandleFunc(routes.Inbox(), AuthenticatedUsersOnly(InboxController))
+
+	app.HandleFunc(routes.Vote(), AuthenticatedUsersOnly(VoteController))
+
+	app.HandleFunc(routes.Favorite(), AuthenticatedUsersOnly(FavoriteController))
+
+	app.HandleFunc(routes.Favorites(), Default(FavoritesController))
+
+	app.HandleFunc(routes.Hide(), AuthenticatedUsersOnly(HideController))
+
+	app.HandleFunc(routes.HiddenStories(), AuthenticatedUsersOnly(HiddenStoriesController))
+
+	app.HandleFunc(routes.Health(), Probe(HealthController))
+
+	app.HandleFunc(routes.Readiness(), Probe(ReadinessController))
+
+	if appOptions.ContainerOptions.MetricsToken != "" {
+		app.Handle(routes.Metrics(), MetricsHandler(appOptions.ContainerOptions.Metrics, appOptions.ContainerOptions.MetricsToken))
+	}
+
 	app.Handle(routes.Public(), http.StripPrefix(routes.Public(), http.FileServer(http.Dir(appOptions.PublicDirectory))))
 
 	return app
@@ -107,8 +230,10 @@ func GetDefaultStack(factory ContainerFactory) *MiddlewareQueue {
 	// before being handled by a controller (which is also a middleware FYI )
 	return &MiddlewareQueue{
 		Middlewares: []Middleware{
+			RequestIDMiddleware,   // Identifies the request in logs and in the X-Request-ID header
+			MetricsMiddleware,     // Counts requests and measures their latency by route
 			StopWatchMiddleware,   // Times how long it takes for the request to be handled
-			LoggerMiddleware,      // Logs each request using the common log format
+			LoggerMiddleware,      // Logs each request with its status, size and duration
 			SessionMiddleware,     // Initializes the session
 			RefreshUserMiddleware, // Refresh an authenticated user if user.ID exists in session
 			LoadUserStoryAndCommentVotesMiddleware,
@@ -123,7 +248,7 @@ type AppOptions struct {
 	// Current App Environment : development,production,staging,testing
 	Environment string
 	ContainerOptions
-	ContainerFactory func() *Container
+	ContainerFactory func() *Container `yaml:"-"`
 }
 
 // Route configures URIs
@@ -135,6 +260,22 @@ func (Route) StoriesByScore() string { return "/" }
 // NewStories URI displays stories by age
 func (Route) NewStories() string { return "/newest" }
 
+// Front displays stories of a day, Past those of yesterday
+func (Route) Front() string { return "/front" }
+func (Route) Past() string  { return "/past" }
+
+// BestStories, ActiveStories, BestComments and Leaders are rankings over a time window,
+// except Leaders which ranks users by karma
+func (Route) BestStories() string   { return "/best" }
+func (Route) ActiveStories() string { return "/active" }
+func (Route) BestComments() string  { return "/bestcomments" }
+func (Route) Leaders() string       { return "/leaders" }
+
+// AskStories, ShowStories and JobStories URIs display stories by type
+func (Route) AskStories() string  { return "/ask" }
+func (Route) ShowStories() string { return "/show" }
+func (Route) JobStories() string  { return "/jobs" }
+
 // NewComments URI displays comments by age
 func (Route) NewComments() string     { return "/newcomments" }
 func (Route) StoryByID() string       { return "/item" }
@@ -148,4 +289,43 @@ func (Route) Public() string          { return "/public/" }
 func (Route) Logout() string          { return "/logout" }
 func (Route) UserProfile() string     { return "/user" }
 func (Route) SubmitStory() string     { return "/submit" }
-func (Route) CastStoryVote() string   { return "/vote/item" }
+func (Route) Vote() string            { return "/vote" }
+func (Route) Sessions() string        { return "/sessions" }
+func (Route) Flag() string            { return "/flag" }
+func (Route) FlagQueue() string       { return "/flagged" }
+func (Route) Vouch() string           { return "/vouch" }
+func (Route) ModerationLog() string   { return "/moderation" }
+func (Route) DomainRules() string     { return "/domains" }
+func (Route) VoteAnalysis() string    { return "/votes" }
+func (Route) Inbox() string           { return "/inbox" }
+func (Route) Favorite() string        { return "/fave" }
+func (Route) Favorites() string       { return "/favorites" }
+func (Route) Hide() string            { return "/hide" }
+func (Route) HiddenStories() string   { return "/hidden" }
+func (Route) Metrics() string         { return "/metrics" }
+func (Route) Health() string          { return "/healthz" }
+func (Route) Readiness() string       { return "/readyz" }
+
+// routeNames maps route URIs to route names, i.e. "/newest" to "NewStories"
+var routeNames = func() map[string]string {
+	names := map[string]string{}
+	value := reflect.ValueOf(Route{})
+	for i := 0; i < value.NumMethod(); i++ {
+		method := value.Type().Method(i)
+		if method.Type.NumIn() == 1 && method.Type.NumOut() == 1 && method.Type.Out(0).Kind() == reflect.String {
+			names[value.Method(i).Call(nil)[0].String()] = method.Name
+		}
+	}
+	return names
+}()
+
+// Name returns the name of the route matching a path, "NotFound" if no route matches
+func (Route) Name(path string) string {
+	if name, ok := routeNames[path]; ok {
+		return name
+	}
+	if strings.HasPrefix(path, Route{}.Public()) {
+		return routeNames[Route{}.Public()]
+	}
+	return "NotFound"
+}
@@ -18,12 +18,14 @@
 package gonews_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/mparaiso/gonews/core"
@@ -141,6 +143,24 @@ func TestRequestingCommentsByUser(t *testing.T) {
 	}
 }
 
+// Scenario: REQUESTING COMMENTS BY USER WITH THEIR REPLIES
+// Given a server
+// When /threads?id=4 is requested
+// Every comment of the user should be displayed
+// The replies to the comments of the user should be displayed below them
+func TestRequestingCommentsByUserWithReplies(t *testing.T) {
+	server := GetServer(t)
+	defer server.Close()
+	response, err := http.Get(server.URL + gonews.Route{}.AuthorComments() + "?id=4")
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find("main .comments").First().Children().Filter(".comment").Length(), 4, "comments of the user")
+	reply := doc.Find(".comment[data-comment-id='8'] + .children .comment[data-comment-id='10']")
+	Expect(t, reply.Length(), 1, "reply to comment 8")
+	Expect(t, doc.Find(".comment[data-comment-id='10'] + .children .comment[data-comment-id='11']").Length(), 1, "reply to the reply")
+}
+
 // Scenario: REQUESTING A STORY BY ID
 // Given a server
 // When /item?id=1 is requested
@@ -727,6 +747,134 @@ func TestDisplayingNewestStoriesPage(t *testing.T) {
 	Expect(t, commentID, fmt.Sprintf("%d", id), ".thread[data-thread-id]")
 }
 
+// Scenario: LISTING STORIES BY TYPE
+// Given ask, show and job stories
+// The /ask and /show pages should only list stories of their type
+// Text posts should link to their story page
+// Jobs should not display votes and should not accept comments
+// Users who are not administrators should not be able to post jobs
+func TestStoriesByType(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	ask := &gonews.Thread{Title: "Ask GN: what is your editor?", Content: "Which editor do you use to write go code ?", AuthorID: 2}
+	show := &gonews.Thread{Title: "Show GN: a terminal game", URL: "http://game.acme/", AuthorID: 3}
+	job := &gonews.Thread{Title: "Acme is hiring gophers", URL: "http://jobs.acme/", Type: gonews.StoryTypeJob, AuthorID: 1}
+	for _, thread := range []*gonews.Thread{ask, show, job} {
+		Expect(t, threads.Create(thread), nil)
+	}
+	Expect(t, ask.Type, gonews.StoryTypeAsk, "ask.Type")
+	Expect(t, show.Type, gonews.StoryTypeShow, "show.Type")
+
+	for route, thread := range map[string]*gonews.Thread{
+		gonews.Route{}.AskStories(): ask, gonews.Route{}.ShowStories(): show, gonews.Route{}.JobStories(): job,
+	} {
+		response, err := http.Get(server.URL + route)
+		Expect(t, err, nil)
+		Expect(t, response.StatusCode, http.StatusOK, route)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		Expect(t, doc.Find(".thread").Length(), 1, route+" .thread length")
+		Expect(t, doc.Find(".thread").AttrOr("data-thread-id", ""), fmt.Sprint(thread.ID), route+" .thread[data-thread-id]")
+		if thread == ask {
+			Expect(t, doc.Find(".thread-title").AttrOr("href", ""), fmt.Sprintf("/item?id=%d", ask.ID), "text post link")
+		}
+		if thread == job {
+			Expect(t, doc.Find(".vote").Length(), 0, "job .vote length")
+		}
+	}
+
+	response, err := http.Get(fmt.Sprintf("%s/item?id=%d", server.URL, job.ID))
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find("form[name='comment']").Length(), 0, "job comment form length")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Reply(), url.Values{
+		"comment_content": {"is it a remote position ?"}, "comment_thread_id": {fmt.Sprint(job.ID)},
+		"comment_parent_id": {"0"}, "comment_goto": {fmt.Sprintf("/item?id=%d", job.ID)},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusForbidden, "commenting a job")
+
+	response, err = http.Get(server.URL + gonews.Route{}.SubmitStory())
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find("input[name='submission_job']").Length(), 0, "job checkbox for a user")
+	csrf, _ := doc.Find("#submission_csrf").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.SubmitStory(), url.Values{
+		"submission_title": {"Gonews is hiring"}, "submission_url": {"http://gonews.acme/jobs"},
+		"submission_csrf": {csrf}, "submission_job": {"true"},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusBadRequest, "posting a job as a user")
+	var count int
+	Expect(t, db.QueryRow("SELECT COUNT(*) FROM threads WHERE type = 'job' AND author_id = ? ;", user.ID).Scan(&count), nil)
+	Expect(t, count, 0, "jobs posted by the user")
+}
+
+// Scenario: FLAGGING A STORY
+// Given a logged in user without karma
+// The user should not be allowed to flag a story
+// Given the user is an administrator and a story already has flags
+// When the user flags the story
+// The story should be hidden from the homepage and marked as [flagged]
+// When the administrator restores the story from the flag queue
+// The story should be listed again
+func TestFlaggingAStory(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	storyID := 13
+	flagURL := fmt.Sprintf("%s%s?kind=story&id=%d", server.URL, gonews.Route{}.Flag(), storyID)
+	isListed := func() bool {
+		response, err := http.Get(server.URL + gonews.Route{}.StoriesByScore())
+		Expect(t, err, nil)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		return doc.Find(fmt.Sprintf(".thread[data-thread-id='%d']", storyID)).Length() == 1
+	}
+
+	response, err := http.Get(flagURL)
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusForbidden, "flagging without karma")
+
+	_, err = db.Exec("INSERT INTO users_roles(user_id,role_id) SELECT ?, id FROM roles WHERE name = ? ;", user.ID, gonews.RoleAdministrator)
+	Expect(t, err, nil)
+	_, err = db.Exec("INSERT INTO thread_flags(thread_id,user_id) VALUES(?1,4),(?1,5);", storyID)
+	Expect(t, err, nil)
+	response, err = http.Get(flagURL)
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='flag_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Flag(), url.Values{
+		"flag_csrf": {csrf}, "kind": {"story"}, "id": {fmt.Sprint(storyID)},
+	})
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".thread-header .flagged").Length(), 1, "[flagged] on the story page")
+	Expect(t, isListed(), false, "flagged story listed")
+
+	response, err = http.Get(server.URL + gonews.Route{}.FlagQueue())
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(fmt.Sprintf(".flagged-story[data-thread-id='%d']", storyID)).Length(), 1, "story in the flag queue")
+	csrf, _ = doc.Find("input[name='flagqueue_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.FlagQueue(), url.Values{
+		"flagqueue_csrf": {csrf}, "kind": {"story"}, "id": {fmt.Sprint(storyID)}, "action": {"restore"},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, isListed(), true, "restored story listed")
+}
+
 // Scenario: UPVOTING A STORY
 // Given a server
 // When an authenticated user requests the homepage
@@ -784,3 +932,612 @@ func TestDisplayingNewestStoriesPage(t *testing.T) {
 // 	t.Log("The user should have created a new thread_vote")
 // 	Expect(t, newThreadVoteCount, threadVoteCount+1, "thread_votes count")
 // }
+
+// Scenario: DEAD STORIES
+// Given a logged in user who is shadowbanned
+// When the user submits a story
+// The story should be dead, listed for the user but not for anonymous visitors
+// The user should not be allowed to vouch for the story
+// Given the user is an administrator and another story is dead
+// When the user vouches for the story
+// The story should be listed for anonymous visitors
+func TestDeadStories(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	anonymous := &http.Client{}
+	isListed := func(client *http.Client, id int64) bool {
+		response, err := client.Get(server.URL + gonews.Route{}.NewStories())
+		Expect(t, err, nil)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		return doc.Find(fmt.Sprintf(".thread[data-thread-id='%d']", id)).Length() == 1
+	}
+
+	_, err = db.Exec("UPDATE users SET shadowbanned = 1 WHERE id = ? ;", user.ID)
+	Expect(t, err, nil)
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	story := &gonews.Thread{Title: "A dead story", URL: "http://dead.acme", AuthorID: user.ID}
+	Expect(t, threads.Create(story), nil)
+	Expect(t, isListed(http.DefaultClient, story.ID), true, "dead story listed for its author")
+	Expect(t, isListed(anonymous, story.ID), false, "dead story listed for anonymous visitors")
+	response, err := anonymous.Get(fmt.Sprintf("%s%s?id=%d", server.URL, gonews.Route{}.StoryByID(), story.ID))
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusNotFound, "dead story page for anonymous visitors")
+	response, err = http.Get(fmt.Sprintf("%s%s?kind=story&id=%d", server.URL, gonews.Route{}.Vouch(), story.ID))
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusForbidden, "vouching for an own story")
+
+	_, err = db.Exec("INSERT INTO users_roles(user_id,role_id) SELECT ?, id FROM roles WHERE name = ? ;", user.ID, gonews.RoleAdministrator)
+	Expect(t, err, nil)
+	other := &gonews.Thread{Title: "Another dead story", URL: "http://another-dead.acme", AuthorID: 2}
+	Expect(t, threads.Create(other), nil)
+	Expect(t, threads.SetDead(other.ID, true), nil)
+	Expect(t, isListed(anonymous, other.ID), false, "dead story listed for anonymous visitors")
+	response, err = http.Get(fmt.Sprintf("%s%s?kind=story&id=%d", server.URL, gonews.Route{}.Vouch(), other.ID))
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='vouch_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Vouch(), url.Values{
+		"vouch_csrf": {csrf}, "kind": {"story"}, "id": {fmt.Sprint(other.ID)},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusOK, "vouching for a dead story")
+	Expect(t, isListed(anonymous, other.ID), true, "vouched story listed for anonymous visitors")
+}
+
+// Scenario: SHOWDEAD PREFERENCE
+// Given a logged in user
+// When the user enables showdead on the profile page
+// Dead stories of other users should be listed for the user
+func TestShowDeadPreference(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	_, err = db.Exec("UPDATE threads SET dead = 1 WHERE id = 2 ;")
+	Expect(t, err, nil)
+	profile := fmt.Sprintf("%s%s?id=%d", server.URL, gonews.Route{}.UserProfile(), user.ID)
+	response, err := http.Get(profile)
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find("input[name='shadowbanned']").Length(), 0, "shadowban checkbox on the own profile")
+	csrf, _ := doc.Find("input[name='profile_csrf']").Attr("value")
+	response, err = http.PostForm(profile, url.Values{"profile_csrf": {csrf}, "showdead": {"1"}})
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find("input[name='showdead']:checked").Length(), 1, "showdead checked")
+	response, err = http.Get(server.URL + gonews.Route{}.NewStories())
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".thread[data-thread-id='2'] .dead").Length(), 1, "dead story listed as [dead]")
+}
+
+// Scenario: MODERATION LOG
+// Given a logged in administrator
+// When the administrator kills a story from the flag queue with a reason
+// The action should be listed in the moderation log with the reason
+// When the moderation log is filtered by another action
+// The action should not be listed
+func TestModerationLog(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	_, err = db.Exec("INSERT INTO users_roles(user_id,role_id) SELECT ?, id FROM roles WHERE name = ? ;", user.ID, gonews.RoleAdministrator)
+	Expect(t, err, nil)
+	_, err = db.Exec("INSERT INTO thread_flags(thread_id,user_id) VALUES(3,4);")
+	Expect(t, err, nil)
+	response, err := http.Get(server.URL + gonews.Route{}.FlagQueue())
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='flagqueue_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.FlagQueue(), url.Values{
+		"flagqueue_csrf": {csrf}, "kind": {"story"}, "id": {"3"}, "action": {"kill"}, "reason": {"off topic"},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusOK, "killing a story")
+
+	response, err = http.Get(server.URL + gonews.Route{}.ModerationLog() + "?type=story&id=3")
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	entries := doc.Find(".moderation-log-entry")
+	Expect(t, entries.Length(), 1, "moderation log entries")
+	Expect(t, entries.Find(".action").Text(), "kill", "action")
+	Expect(t, strings.Contains(entries.Text(), "off topic"), true, "reason in the moderation log")
+	Expect(t, strings.Contains(entries.Text(), user.Username), true, "actor in the moderation log")
+
+	response, err = http.Get(server.URL + gonews.Route{}.ModerationLog() + "?action=delete")
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".moderation-log-entry").Length(), 0, "moderation log entries filtered by action")
+
+	// actions are not applied when they can't be logged
+	_, err = db.Exec("CREATE TRIGGER moderation_log_failure BEFORE INSERT ON moderation_log BEGIN SELECT RAISE(ABORT, 'log unavailable'); END;")
+	Expect(t, err, nil)
+	response, err = http.PostForm(server.URL+gonews.Route{}.FlagQueue(), url.Values{
+		"flagqueue_csrf": {csrf}, "kind": {"story"}, "id": {"4"}, "action": {"kill"},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusInternalServerError, "killing a story without moderation log")
+	var dead bool
+	Expect(t, db.QueryRow("SELECT dead FROM threads WHERE id = 4 ;").Scan(&dead), nil)
+	Expect(t, dead, false, "story killed without moderation log")
+}
+
+// Scenario: DOMAIN RULES
+// Given a logged in administrator
+// When the administrator bans a domain and penalizes another one
+// A story from the banned domain should not be accepted
+// Stories from the penalized domain should be ranked last
+// The status of the domains should be displayed on their story listings
+func TestDomainRules(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	_, err = db.Exec("INSERT INTO users_roles(user_id,role_id) SELECT ?, id FROM roles WHERE name = ? ;", user.ID, gonews.RoleAdministrator)
+	Expect(t, err, nil)
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	penalized := &gonews.Thread{Title: "A story from a penalized domain", URL: "http://www.clickbait.acme/top-10", AuthorID: 2}
+	Expect(t, threads.Create(penalized), nil)
+
+	response, err := http.Get(server.URL + gonews.Route{}.DomainRules())
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='domainrules_csrf']").Attr("value")
+	for _, rule := range []url.Values{
+		{"pattern": {"spam.acme"}, "rule": {gonews.DomainRuleBanned}, "reason": {"link farm"}},
+		{"pattern": {"clickbait.acme"}, "rule": {gonews.DomainRulePenalized}},
+	} {
+		rule.Set("domainrules_csrf", csrf)
+		rule.Set("action", "save")
+		response, err = http.PostForm(server.URL+gonews.Route{}.DomainRules(), rule)
+		Expect(t, err, nil)
+		doc, err = goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+	}
+	Expect(t, doc.Find(".domain-rule").Length(), 2, "domain rules")
+
+	response, err = http.Get(server.URL + gonews.Route{}.SubmitStory())
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ = doc.Find("#submission_csrf").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.SubmitStory(), url.Values{
+		"submission_title": {"Cheap watches"}, "submission_csrf": {csrf}, "submission_url": {"http://shop.spam.acme/watches"},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusBadRequest, "submitting a story from a banned domain")
+
+	response, err = http.Get(server.URL + gonews.Route{}.StoriesByScore())
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	last, _ := doc.Find(".thread").Last().Attr("data-thread-id")
+	Expect(t, last, fmt.Sprint(penalized.ID), "penalized story ranked last")
+
+	response, err = http.Get(server.URL + gonews.Route{}.StoriesByDomain() + "?site=clickbait.acme")
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".domain-rule .rule").Text(), gonews.DomainRulePenalized, "domain status")
+}
+
+// Scenario: INBOX
+// Given a logged in user who submitted a story
+// When another user comments on the story
+// The number of unread notifications should be displayed in the navbar
+// The comment should be listed in the inbox of the user
+// When the user marks the notification as read
+// The number of unread notifications should not be displayed
+func TestInbox(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	thread := &gonews.Thread{Title: "My story", URL: "http://my-story.acme", AuthorID: user.ID}
+	Expect(t, (&gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}).Create(thread), nil)
+	comment := &gonews.Comment{ThreadID: thread.ID, AuthorID: 2, Content: "Nice story"}
+	Expect(t, (&gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}).Create(comment), nil)
+
+	response, err := http.Get(server.URL + gonews.Route{}.Inbox())
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".unread-notifications").Text(), "1", "unread notifications")
+	Expect(t, doc.Find(".notification.unread").Length(), 1, "unread notifications in the inbox")
+	Expect(t, strings.Contains(doc.Find(".notification .content").Text(), "Nice story"), true, "comment in the inbox")
+	csrf, _ := doc.Find("form[name='mark_as_read'] input[name='inbox_csrf']").Attr("value")
+	id, _ := doc.Find("form[name='mark_as_read'] input[name='id']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Inbox(), url.Values{"inbox_csrf": {csrf}, "id": {id}})
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".unread-notifications").Length(), 0, "unread notifications after mark as read")
+	Expect(t, doc.Find(".notification").Length(), 1, "read notifications in the inbox")
+}
+
+type mail struct {
+	to, subject, body string
+}
+
+// mailerStub sends the emails to a channel
+type mailerStub chan mail
+
+func (mailer mailerStub) Send(to, subject, body string) error {
+	mailer <- mail{to, subject, body}
+	return nil
+}
+
+// Scenario: EMAIL NOTIFICATIONS
+// Given a user who enabled email notifications
+// When a logged in user replies to a comment of the user
+// The reply should be sent to the user by email
+// The links of the email should point to the configured base url
+func TestEmailNotifications(t *testing.T) {
+	db, mailer := GetDB(t), make(mailerStub, 1)
+	options := GetContainerOptions(db)
+	options.Mail.MailerFactory = func() (gonews.Mailer, error) { return mailer, nil }
+	options.Mail.BaseURL = "https://news.example.com/"
+	_, server, _, err := LoginUserOnServer(t, db, GetServerWithOptions(t, db, options))
+	Expect(t, err, nil)
+	defer server.Close()
+	// comment 1 is written by janedoe
+	_, err = db.Exec("UPDATE users SET email_notifications = 1 WHERE id = 2 ;")
+	Expect(t, err, nil)
+	response, err := http.Get(server.URL + gonews.Route{}.Reply() + "?id=1&goto=/item?id=1")
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='comment_csrf']").Attr("value")
+	request, err := http.NewRequest("POST", server.URL+gonews.Route{}.Reply(), strings.NewReader(url.Values{
+		"comment_content":   {"a reply to janedoe"},
+		"comment_csrf":      {csrf},
+		"comment_parent_id": {"1"},
+		"comment_goto":      {"/item?id=1"},
+		"comment_thread_id": {"1"},
+	}.Encode()))
+	Expect(t, err, nil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// the cookie jar would look the session cookie up by the spoofed host
+	request.Host = "phishing.example.com"
+	for _, cookie := range http.DefaultClient.Jar.Cookies(request.URL) {
+		request.AddCookie(cookie)
+	}
+	response, err = (&http.Client{}).Do(request)
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, 200, "status")
+	select {
+	case sent := <-mailer:
+		Expect(t, sent.to, "jane.doe@gonews.acme", "recipient")
+		Expect(t, strings.HasPrefix(sent.subject, "mike_doe replied to your comment"), true, "subject "+sent.subject)
+		Expect(t, strings.Contains(sent.body, "https://news.example.com/item?id=1#"), true, "link to the comment "+sent.body)
+		Expect(t, strings.Contains(sent.body, "phishing.example.com"), false, "link to the request host "+sent.body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the notification email was not sent")
+	}
+}
+
+// Scenario: FAVORITES
+// Given a logged in user
+// When the user saves a story to the user's favorites
+// The story should be listed in the favorites of the user
+// The story should be in the JSON export of the favorites
+// The favorites of a user who made them private should not be listed
+func TestFavorites(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	response, err := http.Get(server.URL + gonews.Route{}.Favorite() + "?kind=story&id=1")
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='favorite_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Favorite(), url.Values{
+		"favorite_csrf": {csrf}, "kind": {"story"}, "id": {"1"}, "goto": {"/"},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, 200, "status")
+
+	favorites := fmt.Sprintf("%s%s?id=%d", server.URL, gonews.Route{}.Favorites(), user.ID)
+	response, err = http.Get(favorites)
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".thread[data-thread-id='1']").Length(), 1, "favorite story")
+
+	response, err = http.Get(favorites + "&format=json")
+	Expect(t, err, nil)
+	defer response.Body.Close()
+	Expect(t, response.Header.Get("Content-Type"), "application/json", "Content-Type")
+	var export struct {
+		Stories []struct{ ID int64 }
+	}
+	Expect(t, json.NewDecoder(response.Body).Decode(&export), nil)
+	Expect(t, len(export.Stories), 1, "exported stories")
+	Expect(t, export.Stories[0].ID, int64(1), "exported story")
+
+	_, err = db.Exec("UPDATE users SET public_favorites = 0 WHERE id = 2 ;")
+	Expect(t, err, nil)
+	response, err = http.Get(server.URL + gonews.Route{}.Favorites() + "?id=2")
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusForbidden, "private favorites")
+}
+
+// Scenario: HIDING A STORY
+// Given a logged in user
+// When the user hides a story
+// The story should not be listed on the front page
+// The story should be listed on the hidden stories page
+// When the user un-hides the story
+// The story should be listed on the front page again
+func TestHidingAStory(t *testing.T) {
+	_, server, _, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	isListed := func() bool {
+		response, err := http.Get(server.URL + gonews.Route{}.StoriesByScore())
+		Expect(t, err, nil)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		return doc.Find(".thread[data-thread-id='1']").Length() == 1
+	}
+	Expect(t, isListed(), true, "story listed before hiding it")
+	response, err := http.Get(server.URL + gonews.Route{}.Hide() + "?id=1")
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='hide_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Hide(), url.Values{"hide_csrf": {csrf}, "id": {"1"}})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, 200, "status")
+	Expect(t, isListed(), false, "hidden story listed")
+
+	response, err = http.Get(server.URL + gonews.Route{}.HiddenStories())
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".hidden-stories .thread[data-thread-id='1']").Length(), 1, "story on the hidden stories page")
+	csrf, _ = doc.Find("input[name='hidden_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.HiddenStories(), url.Values{"hidden_csrf": {csrf}, "id": {"1"}})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, isListed(), true, "story listed after un-hiding it")
+}
+
+// Scenario: FRONT PAGE OF A DAY
+// Given stories submitted yesterday
+// When a visitor requests the front page of yesterday
+// The stories of yesterday should be listed, and only them
+// The page should not be cached since scores still change
+// When a visitor requests /past
+// The same stories should be listed
+// When a visitor requests the front page of an older day
+// The stories of that day should be listed and the page cached indefinitely
+func TestFrontPageOfADay(t *testing.T) {
+	db := GetDB(t)
+	server := GetServer(t, db)
+	defer server.Close()
+	_, err := db.Exec("UPDATE threads SET created = date('now','-1 day') || ' 12:00:00' WHERE id IN (2,3) ;")
+	Expect(t, err, nil)
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	for _, path := range []string{gonews.Route{}.Front() + "?day=" + yesterday, gonews.Route{}.Front(), gonews.Route{}.Past()} {
+		response, err := http.Get(server.URL + path)
+		Expect(t, err, nil)
+		Expect(t, response.StatusCode, 200, path)
+		Expect(t, response.Header.Get("Cache-Control"), "", "Cache-Control of "+path)
+		Expect(t, response.Header.Get("Vary"), "Cookie", "Vary of "+path)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		Expect(t, doc.Find(".threads .thread").Length(), 2, "stories of "+path)
+		Expect(t, doc.Find(".thread[data-thread-id='2']").Length(), 1, "story 2 on "+path)
+		Expect(t, doc.Find(".front-day .next-day").Length(), 1, "link to the next day on "+path)
+	}
+	// stories submitted at the edges of a day
+	_, err = db.Exec("UPDATE threads SET created = date('now','-3 day') || ' 00:00:00' WHERE id = 2 ;")
+	Expect(t, err, nil)
+	_, err = db.Exec("UPDATE threads SET created = date('now','-3 day') || ' 23:59:59' WHERE id = 3 ;")
+	Expect(t, err, nil)
+	_, err = db.Exec("UPDATE threads SET created = date('now','-2 day') || ' 00:00:00' WHERE id = 4 ;")
+	Expect(t, err, nil)
+	older := time.Now().UTC().AddDate(0, 0, -3).Format("2006-01-02")
+	response, err := http.Get(server.URL + gonews.Route{}.Front() + "?day=" + older)
+	Expect(t, err, nil)
+	Expect(t, response.Header.Get("Cache-Control"), "public, max-age=31536000, immutable", "Cache-Control of "+older)
+	Expect(t, response.Header.Get("Set-Cookie"), "", "Set-Cookie of "+older)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".threads .thread").Length(), 2, "stories of "+older)
+	Expect(t, doc.Find(".thread[data-thread-id='4']").Length(), 0, "story of the next day on "+older)
+	response, err = http.Get(server.URL + gonews.Route{}.Front() + "?day=" + time.Now().UTC().Format("2006-01-02"))
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, 200, "today")
+	Expect(t, response.Header.Get("Cache-Control"), "", "Cache-Control of today")
+	for day, status := range map[string]int{
+		"yesterday": http.StatusBadRequest,
+		time.Now().UTC().AddDate(0, 0, 2).Format("2006-01-02"): http.StatusNotFound,
+	} {
+		response, err := http.Get(server.URL + gonews.Route{}.Front() + "?day=" + day)
+		Expect(t, err, nil)
+		response.Body.Close()
+		Expect(t, response.StatusCode, status, day)
+	}
+}
+
+// Scenario: LISTINGS
+// Given a visitor
+// When the visitor requests the best, active, best comments and leaders listings
+// Each listing should be displayed
+func TestListings(t *testing.T) {
+	server := GetServer(t)
+	defer server.Close()
+	for path, selector := range map[string]string{
+		gonews.Route{}.BestStories():   ".threads .thread",
+		gonews.Route{}.ActiveStories(): ".threads .thread",
+		gonews.Route{}.BestComments():  ".comments .comment",
+		gonews.Route{}.Leaders():       ".leaders .leader",
+	} {
+		response, err := http.Get(server.URL + path)
+		Expect(t, err, nil)
+		Expect(t, response.StatusCode, 200, path)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		Expect(t, doc.Find(selector).Length() > 0, true, "items of "+path)
+	}
+}
+
+// Scenario: SORTING COMMENTS
+// Given a story with comments
+// When a visitor requests the story sorted by new or old
+// The comments of each group of siblings should be sorted accordingly
+func TestCommentSort(t *testing.T) {
+	db := GetDB(t)
+	server := GetServer(t, db)
+	defer server.Close()
+	_, err := db.Exec("UPDATE comments SET created = datetime('now','-1 hour') WHERE id = 8 ;")
+	Expect(t, err, nil)
+	for order, first := range map[string]string{"new": "7", "old": "8"} {
+		response, err := http.Get(server.URL + gonews.Route{}.StoryByID() + "?id=5&sort=" + order)
+		Expect(t, err, nil)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		id, _ := doc.Find(".comments > .comment").First().Attr("data-comment-id")
+		Expect(t, id, first, "first comment sorted by "+order)
+		Expect(t, doc.Find(".comment-sort .current-sort").Text(), order, "current sort")
+	}
+	response, err := http.Get(server.URL + gonews.Route{}.StoryByID() + "?id=5&sort=unknown")
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".comment-sort .current-sort").Text(), "top", "default sort")
+}
+
+// Scenario: VOTING AND UNVOTING
+// Given a logged in user
+// When the user upvotes a story
+// The score of the story should increase
+// When the user removes the vote
+// The score of the story should be restored
+// The user should not be allowed to remove the vote of the author
+func TestVotingAndUnvoting(t *testing.T) {
+	db, server, _, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	score := func() (score int) {
+		Expect(t, db.QueryRow("SELECT Score FROM threads_view WHERE ID = 2 ;").Scan(&score), nil)
+		return
+	}
+	before := score()
+	for _, fixture := range []struct {
+		How   string
+		Score int
+	}{{"up", before + 1}, {"un", before}} {
+		response, err := http.Get(server.URL + gonews.Route{}.Vote() + "?kind=story&id=2")
+		Expect(t, err, nil)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		Expect(t, doc.Find("form[name='vote'] [name='how']").AttrOr("value", ""), fixture.How, "vote offered")
+		csrf, _ := doc.Find("input[name='vote_csrf']").Attr("value")
+		response, err = http.PostForm(server.URL+gonews.Route{}.Vote(), url.Values{"vote_csrf": {csrf}, "kind": {"story"}, "id": {"2"}, "how": {fixture.How}})
+		Expect(t, err, nil)
+		response.Body.Close()
+		Expect(t, response.StatusCode, 200, "status")
+		Expect(t, score(), fixture.Score, "score after "+fixture.How)
+	}
+	_, err = db.Exec("UPDATE threads SET author_id = (SELECT id FROM users WHERE username = 'mike_doe') WHERE id = 3 ;")
+	Expect(t, err, nil)
+	response, err := http.Get(server.URL + gonews.Route{}.Vote() + "?kind=story&id=3")
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='vote_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Vote(), url.Values{"vote_csrf": {csrf}, "kind": {"story"}, "id": {"3"}, "how": {"un"}})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusForbidden, "unvoting an own story")
+}
+
+// Scenario: DOWNVOTING COMMENTS
+// Given a logged in user without enough karma
+// The user should not be allowed to downvote comments
+// Given a logged in user with enough karma
+// When the user downvotes a comment
+// The comment should be greyed out
+// The user should not be allowed to downvote replies to the user's comments nor old comments
+func TestDownvotingComments(t *testing.T) {
+	db := GetDB(t)
+	options := GetContainerOptions(db)
+	options.DownvoteMinKarma = 1
+	server := GetServerWithOptions(t, db, options)
+	defer server.Close()
+	_, _, user, err := LoginUserOnServer(t, db, server)
+	Expect(t, err, nil)
+	downvote := func(id string) int {
+		response, err := http.Get(server.URL + gonews.Route{}.Vote() + "?kind=comment&id=" + id)
+		Expect(t, err, nil)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		csrf, _ := doc.Find("input[name='vote_csrf']").Attr("value")
+		response, err = http.PostForm(server.URL+gonews.Route{}.Vote(), url.Values{"vote_csrf": {csrf}, "kind": {"comment"}, "id": {id}, "how": {"down"}})
+		Expect(t, err, nil)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	Expect(t, downvote("7"), http.StatusForbidden, "downvoting without karma")
+	_, err = db.Exec("UPDATE users SET karma = 10 WHERE id = ? ;", user.ID)
+	Expect(t, err, nil)
+	Expect(t, downvote("7"), 200, "downvoting a comment")
+	response, err := http.Get(server.URL + gonews.Route{}.StoryByID() + "?id=5")
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".comment.faded-1[data-comment-id='7']").Length(), 1, "downvoted comment greyed out")
+
+	_, err = db.Exec("UPDATE comments SET author_id = ? WHERE id = 8 ;", user.ID)
+	Expect(t, err, nil)
+	Expect(t, downvote("10"), http.StatusForbidden, "downvoting a reply to an own comment")
+	_, err = db.Exec("UPDATE comments SET created = datetime('now','-2 days') WHERE id = 9 ;")
+	Expect(t, err, nil)
+	Expect(t, downvote("9"), http.StatusForbidden, "downvoting an old comment")
+	Expect(t, downvote("1"), 200, "downvoting another comment")
+}
+
+func TestVoteAnalysisPage(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	response, err := http.Get(server.URL + gonews.Route{}.VoteAnalysis())
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusForbidden, "vote analysis for users")
+	_, err = db.Exec("INSERT INTO users_roles(user_id,role_id) SELECT ?, id FROM roles WHERE name = ? ;", user.ID, gonews.RoleAdministrator)
+	Expect(t, err, nil)
+
+	response, err = http.Get(server.URL + gonews.Route{}.VoteAnalysis())
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".vote-report-summary").Length(), 0, "report before the first analysis")
+	csrf, _ := doc.Find("input[name='votes_csrf']").Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.VoteAnalysis(), url.Values{"votes_csrf": {csrf}})
+	Expect(t, err, nil)
+	doc, err = goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".vote-report-summary").Length(), 1, "report of the analysis")
+}
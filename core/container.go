@@ -26,6 +26,10 @@ import (
 
 	"errors"
 
+	"strings"
+
+	"time"
+
 	"github.com/gorilla/sessions"
 )
 
@@ -34,16 +38,25 @@ type Any interface{}
 
 // Container contains all the application dependencies
 type Container struct {
-	ContainerOptions      ContainerOptions
-	db                    *sql.DB
-	logger                LoggerInterface
-	threadRepository      *ThreadRepository
-	userRepository        *UserRepository
-	commentRepository     *CommentRepository
-	threadVoteRepository  *ThreadVoteRepository
-	commentVoteRepository *CommentVoteRepository
+	ContainerOptions        ContainerOptions
+	db                      *sql.DB
+	logger                  LoggerInterface
+	threadRepository        *ThreadRepository
+	userRepository          *UserRepository
+	commentRepository       *CommentRepository
+	threadVoteRepository    *ThreadVoteRepository
+	commentVoteRepository   *CommentVoteRepository
+	sessionRepository       *SessionRepository
+	rememberTokenRepository *RememberTokenRepository
+	flagRepository          *FlagRepository
+	moderationLogRepository *ModerationLogRepository
+	domainRuleRepository    *DomainRuleRepository
+	notificationRepository  *NotificationRepository
+	favoriteRepository      *FavoriteRepository
+	voteAnalyzer            *VoteAnalyzer
 
 	template TemplateEngine
+	mailer   Mailer
 
 	sessionStore sessions.Store
 	request      *http.Request
@@ -55,8 +68,9 @@ type Container struct {
 	LoggerProvider
 	FormDecoderProvider
 
-	user  *User
-	route *Route
+	user      *User
+	route     *Route
+	requestID string
 }
 
 // Debug returns true if debug mode
@@ -94,9 +108,19 @@ func (c *Container) HasAuthenticatedUser() bool {
 	return c.user != nil
 }
 
-// SetCurrentUser sets the authenticated user
+// SetCurrentUser sets the authenticated user, who is
+// the viewer of the thread, comment and favorite listings
 func (c *Container) SetCurrentUser(u *User) {
 	c.user = u
+	if c.threadRepository != nil {
+		c.threadRepository.Viewer = u
+	}
+	if c.commentRepository != nil {
+		c.commentRepository.Viewer = u
+	}
+	if c.favoriteRepository != nil {
+		c.favoriteRepository.Viewer = u
+	}
 }
 
 // CurrentUser returns an authenticated user
@@ -104,6 +128,16 @@ func (c *Container) CurrentUser() *User {
 	return c.user
 }
 
+// SetRequestID sets the id of the current request
+func (c *Container) SetRequestID(id string) {
+	c.requestID = id
+}
+
+// RequestID returns the id of the current request
+func (c *Container) RequestID() string {
+	return c.requestID
+}
+
 // GetSecret returns the secret key
 func (c *Container) GetSecret() string {
 	return c.ContainerOptions.Secret
@@ -134,7 +168,8 @@ func (c *Container) GetThreadRepository() (*ThreadRepository, error) {
 		if err != nil {
 			return nil, err
 		}
-		c.threadRepository = &ThreadRepository{DB: db, Logger: c.MustGetLogger()}
+		c.threadRepository = &ThreadRepository{DB: db, Logger: c.MustGetLogger(), Metrics: c.ContainerOptions.Metrics, Viewer: c.user,
+			FavoriteWeight: c.ContainerOptions.FavoriteWeight}
 	}
 	return c.threadRepository, nil
 }
@@ -159,7 +194,7 @@ func (c *Container) GetUserRepository() (*UserRepository, error) {
 		if err != nil {
 			return nil, err
 		}
-		c.userRepository = &UserRepository{db, logger}
+		c.userRepository = &UserRepository{db, logger, c.ContainerOptions.Metrics}
 	}
 	return c.userRepository, nil
 }
@@ -185,7 +220,7 @@ func (c *Container) GetCommentRepository() (*CommentRepository, error) {
 		if err == nil {
 			logger, err = c.GetLogger()
 			if err == nil {
-				c.commentRepository = &CommentRepository{db, logger}
+				c.commentRepository = &CommentRepository{db, logger, c.ContainerOptions.Metrics, c.user}
 			}
 		}
 	}
@@ -213,7 +248,7 @@ func (c *Container) GetThreadVoteRepository() (*ThreadVoteRepository, error) {
 		if err == nil {
 			logger, err = c.GetLogger()
 			if err == nil {
-				c.threadVoteRepository = &ThreadVoteRepository{db, logger}
+				c.threadVoteRepository = &ThreadVoteRepository{db, logger, c.ContainerOptions.Metrics}
 			}
 		}
 	}
@@ -241,13 +276,305 @@ func (c *Container) GetCommentVoteRepository() (*CommentVoteRepository, error) {
 		if err == nil {
 			logger, err = c.GetLogger()
 			if err == nil {
-				c.commentVoteRepository = &CommentVoteRepository{db, logger}
+				c.commentVoteRepository = &CommentVoteRepository{db, logger, c.ContainerOptions.Metrics}
 			}
 		}
 	}
 	return c.commentVoteRepository, err
 }
 
+// GetSessionRepository returns the repository of server side sessions
+func (c *Container) GetSessionRepository() (*SessionRepository, error) {
+	if c.sessionRepository == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.sessionRepository = &SessionRepository{db, logger, c.ContainerOptions.Metrics}
+	}
+	return c.sessionRepository, nil
+}
+
+// MustGetSessionRepository panics on error
+func (c *Container) MustGetSessionRepository() *SessionRepository {
+	r, err := c.GetSessionRepository()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// GetRememberTokenRepository returns the repository of "remember me" tokens
+func (c *Container) GetRememberTokenRepository() (*RememberTokenRepository, error) {
+	if c.rememberTokenRepository == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.rememberTokenRepository = &RememberTokenRepository{db, logger, c.ContainerOptions.Metrics}
+	}
+	return c.rememberTokenRepository, nil
+}
+
+// GetFlagRepository returns the repository of flags
+func (c *Container) GetFlagRepository() (*FlagRepository, error) {
+	if c.flagRepository == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.flagRepository = &FlagRepository{db, logger, c.ContainerOptions.Metrics}
+	}
+	return c.flagRepository, nil
+}
+
+// MustGetFlagRepository panics on error
+func (c *Container) MustGetFlagRepository() *FlagRepository {
+	r, err := c.GetFlagRepository()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// GetModerationLogRepository returns the repository of moderation actions
+func (c *Container) GetModerationLogRepository() (*ModerationLogRepository, error) {
+	if c.moderationLogRepository == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.moderationLogRepository = &ModerationLogRepository{db, logger, c.ContainerOptions.Metrics}
+	}
+	return c.moderationLogRepository, nil
+}
+
+// MustGetModerationLogRepository panics on error
+func (c *Container) MustGetModerationLogRepository() *ModerationLogRepository {
+	r, err := c.GetModerationLogRepository()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// GetDomainRuleRepository returns the repository of domain rules
+func (c *Container) GetDomainRuleRepository() (*DomainRuleRepository, error) {
+	if c.domainRuleRepository == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.domainRuleRepository = &DomainRuleRepository{db, logger, c.ContainerOptions.Metrics}
+	}
+	return c.domainRuleRepository, nil
+}
+
+// MustGetDomainRuleRepository panics on error
+func (c *Container) MustGetDomainRuleRepository() *DomainRuleRepository {
+	r, err := c.GetDomainRuleRepository()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// GetNotificationRepository returns the repository of notifications
+func (c *Container) GetNotificationRepository() (*NotificationRepository, error) {
+	if c.notificationRepository == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.notificationRepository = &NotificationRepository{db, logger, c.ContainerOptions.Metrics}
+	}
+	return c.notificationRepository, nil
+}
+
+// MustGetNotificationRepository panics on error
+func (c *Container) MustGetNotificationRepository() *NotificationRepository {
+	r, err := c.GetNotificationRepository()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// GetFavoriteRepository returns the repository of favorites
+func (c *Container) GetFavoriteRepository() (*FavoriteRepository, error) {
+	if c.favoriteRepository == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.favoriteRepository = &FavoriteRepository{db, logger, c.ContainerOptions.Metrics, c.user}
+	}
+	return c.favoriteRepository, nil
+}
+
+// MustGetFavoriteRepository panics on error
+func (c *Container) MustGetFavoriteRepository() *FavoriteRepository {
+	r, err := c.GetFavoriteRepository()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// GetVoteAnalyzer returns the analyzer of votes
+func (c *Container) GetVoteAnalyzer() (*VoteAnalyzer, error) {
+	if c.voteAnalyzer == nil {
+		db, err := c.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		logger, err := c.GetLogger()
+		if err != nil {
+			return nil, err
+		}
+		c.voteAnalyzer = &VoteAnalyzer{db, logger, c.ContainerOptions.Metrics}
+	}
+	return c.voteAnalyzer, nil
+}
+
+// MustGetVoteAnalyzer panics on error
+func (c *Container) MustGetVoteAnalyzer() *VoteAnalyzer {
+	analyzer, err := c.GetVoteAnalyzer()
+	if err != nil {
+		panic(err)
+	}
+	return analyzer
+}
+
+// GetMailer returns the mailer, emails are logged if no SMTP server is configured
+func (c *Container) GetMailer() (Mailer, error) {
+	if c.mailer == nil {
+		options := c.ContainerOptions.Mail
+		switch {
+		case options.MailerFactory != nil:
+			mailer, err := options.MailerFactory()
+			if err != nil {
+				return nil, err
+			}
+			c.mailer = mailer
+		case options.SMTPAddr != "":
+			c.mailer = &SMTPMailer{options.SMTPAddr, options.SMTPUsername, options.SMTPPassword, options.From, options.SMTPTimeout}
+		default:
+			logger, err := c.GetLogger()
+			if err != nil {
+				return nil, err
+			}
+			c.mailer = &LogMailer{logger}
+		}
+	}
+	return c.mailer, nil
+}
+
+// MustGetMailer panics on error
+func (c *Container) MustGetMailer() Mailer {
+	mailer, err := c.GetMailer()
+	if err != nil {
+		panic(err)
+	}
+	return mailer
+}
+
+// NotifyByEmail emails the notification created for a comment to its recipient,
+// if the recipient enabled email notifications. The email is sent in the background
+// by Mail.Queue and failures are only logged since the comment is already stored.
+// Links are built from Mail.BaseURL and never from the request, whose Host header
+// is chosen by the client
+func (c *Container) NotifyByEmail(comment *Comment) {
+	notification, err := c.MustGetNotificationRepository().GetByCommentID(comment.ID)
+	if err != nil || notification == nil {
+		if err != nil {
+			c.MustGetLogger().Error("Container", "notification", err)
+		}
+		return
+	}
+	recipient, err := c.MustGetUserRepository().GetByID(notification.UserID)
+	if err != nil || recipient == nil || !recipient.EmailNotifications {
+		if err != nil {
+			c.MustGetLogger().Error("Container", "notification", err)
+		}
+		return
+	}
+	subject := fmt.Sprintf("%s commented on %s", notification.Comment.AuthorName, notification.Comment.ThreadTitle)
+	if notification.IsReply() {
+		subject = fmt.Sprintf("%s replied to your comment on %s", notification.Comment.AuthorName, notification.Comment.ThreadTitle)
+	}
+	base := strings.TrimSuffix(c.GetOptions().Mail.BaseURL, "/")
+	body := fmt.Sprintf("%s\n\n%s%s?id=%d#%d\n\nRead your notifications at %s%s", comment.Content,
+		base, c.GetRoutes().StoryByID(), comment.ThreadID, comment.ID, base, c.GetRoutes().Inbox())
+	logger := c.MustGetLogger()
+	err = c.GetOptions().Mail.Queue.Push(c.MustGetMailer(), recipient.Email, subject, body, func(err error) {
+		if err != nil {
+			logger.Error("Container", "notification", err)
+		}
+	})
+	if err != nil {
+		logger.Error("Container", "notification", err)
+	}
+}
+
+// LogModeration records a moderation action of the current user on a target,
+// before and after are snapshots of the target, nil if it did not exist.
+// Controllers call it before applying each moderation action so that
+// an action is never applied without being logged
+func (c *Container) LogModeration(action, targetType string, targetID int64, reason string, before, after interface{}) error {
+	actor := c.CurrentUser()
+	if actor == nil {
+		return errors.New("moderation actions need an authenticated user")
+	}
+	entry, err := NewModerationLogEntry(actor.ID, actor.Username, action, targetType, targetID, reason, before, after)
+	if err == nil {
+		err = c.MustGetModerationLogRepository().Create(entry)
+	}
+	if err != nil {
+		c.MustGetLogger().Error("Container", "moderation log", err)
+		return err
+	}
+	c.MustGetLogger().Info(fmt.Sprintf("moderation: %s %s %s %d", actor.Username, action, targetType, targetID))
+	return nil
+}
+
+// MustGetRememberTokenRepository panics on error
+func (c *Container) MustGetRememberTokenRepository() *RememberTokenRepository {
+	r, err := c.GetRememberTokenRepository()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
 // MustGetCommentVoteRepository can panic on error
 func (c *Container) MustGetCommentVoteRepository() *CommentVoteRepository {
 	cvr, err := c.GetCommentVoteRepository()
@@ -350,40 +677,89 @@ type ContainerOptions struct {
 	TemplateFileExtension string
 	Debug bool
 	LogLevel
+	LogFormat
 	// Maximum Depth of a comment thread
 	CommentMaxDepth,
 	CommentsPerPage,
 	StoriesPerPage int
-	Session struct {
-		Name         string
-		StoreFactory func() (sessions.Store, error)
+	// FlagMinKarma is the karma needed to flag items, FlagThreshold the
+	// number of flags that hides an item
+	FlagMinKarma,
+	FlagThreshold int
+	// VouchMinKarma is the karma needed to vouch for dead items
+	VouchMinKarma int
+	// DownvoteMinKarma is the karma needed to downvote comments, comments
+	// older than DownvoteMaxAge can't be downvoted
+	DownvoteMinKarma int
+	DownvoteMaxAge   time.Duration
+	// FavoriteWeight is the number of points a favorite adds to a story
+	// when ranking the front page, favorites are ignored if 0
+	FavoriteWeight int
+	// BestStoriesWindow, ActiveStoriesWindow and BestCommentsWindow are how
+	// far back /best, /active and /bestcomments look
+	BestStoriesWindow,
+	ActiveStoriesWindow,
+	BestCommentsWindow time.Duration
+	// UnvoteWindow is how long users can remove or change their votes
+	UnvoteWindow      time.Duration
+	VoteAnalysis      VoteAnalysisOptions
+	Session           SessionOptions
+	Mail              MailOptions
+	ConnectionFactory func() (*sql.DB, error)         `yaml:"-"`
+	LoggerFactory     func() (LoggerInterface, error) `yaml:"-"`
+	// Metrics are shared by all containers, /metrics is served by the
+	// application only if MetricsToken is set
+	Metrics      *Metrics `yaml:"-"`
+	MetricsToken string
+	// Readiness is turned off by the server during a graceful shutdown
+	Readiness     *Readiness `yaml:"-"`
+	csrfGenerator CSRFGenerator
+	user          *User
+}
+
+// SessionOptions configures the session and its cookie
+type SessionOptions struct {
+	Name,
+	Path,
+	Domain string
+	// MaxAge is the cookie lifetime in seconds
+	MaxAge int
+	Secure,
+	HTTPOnly bool
+	// RememberMeMaxAge is the lifetime in seconds of "remember me" logins
+	RememberMeMaxAge int
+	// Store is "sql" to store sessions in the database or "cookie"
+	// to store them in a cookie signed with ContainerOptions.Secret
+	Store string
+	// CleanupInterval is how often the server deletes expired sessions from the database
+	CleanupInterval time.Duration
+	// StoreFactory creates the session store, if nil the store is created
+	// according to Store
+	StoreFactory func() (sessions.Store, error) `yaml:"-"`
+}
+
+// CookieOptions returns the options of the session cookie
+func (options SessionOptions) CookieOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     options.Path,
+		Domain:   options.Domain,
+		MaxAge:   options.MaxAge,
+		Secure:   options.Secure,
+		HttpOnly: options.HTTPOnly,
 	}
-	ConnectionFactory func() (*sql.DB, error)
-	LoggerFactory     func() (LoggerInterface, error)
-	csrfGenerator     CSRFGenerator
-	user              *User
 }
 
 // DefaultContainerOptions returns the default ContainerOptions
 // A closure is used to generate the function which allows us
-// to have a few global variables ,like the session store or the db
+// to have a few global variables ,like the db
 var DefaultContainerOptions = func() func() ContainerOptions {
-	//secret := securecookie.GenerateRandomKey(64)
 	connection, connectionErr := sql.Open("sqlite3", "db.sqlite3")
-	secret := []byte("some secret key for debugging purposes")
-	sessionCookieStore := sessions.NewCookieStore(secret)
-	sessionCookieStore.Options = &sessions.Options{
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		MaxAge:   60 * 60 * 24,
-		Domain:   "localhost",
-	}
 
 	return func() ContainerOptions {
 		options := ContainerOptions{
 			Debug:                 false,
 			LogLevel:              INFO,
+			LogFormat:             LogFormatText,
 			Title:                 "gonews",
 			Environment:           "development",
 			Slogan:                "the news site for gophers",
@@ -392,18 +768,42 @@ var DefaultContainerOptions = func() func() ContainerOptions {
 			Driver:                "sqlite3",
 			TemplateDirectory:     "templates",
 			TemplateFileExtension: "tpl.html",
-			Secret:                string(secret),
+			Secret:                "some secret key for debugging purposes",
 			CommentMaxDepth:       5,
 			StoriesPerPage:        30,
 			CommentsPerPage:       100,
-			Session: struct {
-				Name         string
-				StoreFactory func() (sessions.Store, error)
-			}{
-				Name: "go-news",
-				StoreFactory: func() (sessions.Store, error) {
-					return sessionCookieStore, nil
-				},
+			FlagMinKarma:          30,
+			FlagThreshold:         3,
+			VouchMinKarma:         30,
+			DownvoteMinKarma:      500,
+			DownvoteMaxAge:        24 * time.Hour,
+			BestStoriesWindow:     72 * time.Hour,
+			ActiveStoriesWindow:   48 * time.Hour,
+			BestCommentsWindow:    48 * time.Hour,
+			UnvoteWindow:          time.Hour,
+			VoteAnalysis: VoteAnalysisOptions{
+				Interval:             time.Hour,
+				Window:               7 * 24 * time.Hour,
+				RingWindow:           10 * time.Minute,
+				RingMinItems:         3,
+				NewAccountAge:        72 * time.Hour,
+				SockpuppetMinVotes:   3,
+				SuspiciousVoteWeight: 0.1,
+			},
+			Session: SessionOptions{
+				Store:            "sql",
+				RememberMeMaxAge: 30 * 24 * 3600,
+				CleanupInterval:  time.Hour,
+				Name:             "go-news",
+				Path:             "/",
+				MaxAge:           60 * 60 * 24,
+				HTTPOnly:         true,
+			},
+			Mail: MailOptions{
+				From:        "gonews@localhost",
+				SMTPTimeout: 10 * time.Second,
+				BaseURL:     "http://localhost:8080",
+				QueueSize:   100,
 			},
 			ConnectionFactory: func() (*sql.DB, error) {
 				return connection, connectionErr
@@ -19,11 +19,14 @@ package gonews
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // ThreadIndexController displays a list of links
@@ -85,13 +88,20 @@ func StoriesByDomainController(c *Container, rw http.ResponseWriter, r *http.Req
 	if len(threads) == limit {
 		nextPage = query.Page + 1
 	}
+	// administrators see the rule applying to the domain
+	var rule *DomainRule
+	if err == nil && c.HasAuthenticatedUser() && c.CurrentUser().IsAdministrator() {
+		rule, err = c.MustGetDomainRuleRepository().Match("http://" + query.Site + "/")
+	}
 	if err == nil {
 		err = c.MustGetTemplate().ExecuteTemplate(rw, "thread_list.tpl.html", map[string]interface{}{
-			"Threads":  threads,
-			"Title":    "Stories by domain " + query.Site,
-			"NextPage": nextPage,
-			"Page":     query.Page,
-			"Offset":   offset,
+			"Threads":    threads,
+			"Title":      "Stories by domain " + query.Site,
+			"NextPage":   nextPage,
+			"Page":       query.Page,
+			"Offset":     offset,
+			"Site":       query.Site,
+			"DomainRule": rule,
 		})
 	}
 	if err != nil {
@@ -99,25 +109,41 @@ func StoriesByDomainController(c *Container, rw http.ResponseWriter, r *http.Req
 	}
 }
 
-// CommentsByAuthorController displays comments by author
+// CommentsByAuthorController displays comments by author, each followed by its replies
 func AuthorCommentsController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
-	id, err := strconv.ParseInt(c.Request().URL.Query().Get("id"), 10, 64)
-	if err != nil {
+	var (
+		query struct {
+			Page     int   `schema:"p"`
+			AuthorID int64 `schema:"id"`
+		}
+		limit = c.GetCommentsPerPage()
+	)
+	if err := c.GetFormDecoder().Decode(&query, r.URL.Query()); err != nil {
 		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
 		return
 	}
 	var (
-		author   *User
-		comments Comments
+		author           *User
+		comments         Comments
+		offset, nextPage = query.Page * limit, query.Page
 	)
-	author, err = c.MustGetUserRepository().GetByID(id)
+	author, err := c.MustGetUserRepository().GetByID(query.AuthorID)
+	if err == nil && author == nil {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
 	if err == nil {
-		comments, err = c.MustGetCommentRepository().GetCommentsByAuthorID(id)
+		comments, err = c.MustGetCommentRepository().GetThreadsByAuthorID(author.ID, c.GetOptions().CommentMaxDepth, limit, offset)
+		if len(comments) == limit {
+			nextPage++
+		}
 		if err == nil {
 			err = c.MustGetTemplate().ExecuteTemplate(rw, "comments_list.tpl.html", map[string]interface{}{
 				"Comments": comments,
 				"Author":   author,
 				"Title":    fmt.Sprintf("%s's comments", author.Username),
+				"Page":     query.Page,
+				"NextPage": nextPage,
 			})
 		}
 	}
@@ -185,6 +211,11 @@ func StoryByIDController(c *Container, rw http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	// comments are sorted by rank unless ?sort=new or ?sort=old
+	order := r.URL.Query().Get("sort")
+	if !IsCommentSort(order) {
+		order = CommentSortTop
+	}
 	thread, err := c.MustGetThreadRepository().GetByIDWithComments(int(id))
 	if err != nil {
 		c.HTTPError(rw, r, 500, err)
@@ -202,6 +233,9 @@ func StoryByIDController(c *Container, rw http.ResponseWriter, r *http.Request,
 	commentForm.SetModel(comment)
 	err = c.MustGetTemplate().ExecuteTemplate(rw, "thread_show.tpl.html", map[string]interface{}{
 		"Thread":      thread,
+		"Comments":    thread.Comments.GetSortedTree(order, time.Now()),
+		"Sort":        order,
+		"SortOrders":  []string{CommentSortTop, CommentSortNew, CommentSortOld},
 		"CommentForm": commentForm,
 	})
 	if err != nil {
@@ -213,6 +247,14 @@ func StoryByIDController(c *Container, rw http.ResponseWriter, r *http.Request,
 // LogoutController logs out a user
 func LogoutController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
 	c.MustGetSession().Delete("user.ID")
+	if err := ForgetRememberToken(c); err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if err := c.MustGetSession().Regenerate(); err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
 	c.HTTPRedirect("/", 302)
 }
 
@@ -255,9 +297,22 @@ func LoginController(c *Container, rw http.ResponseWriter, r *http.Request, next
 			candidate, err = userRepository.GetOneByUsername(user.Username)
 			if err == nil && candidate != nil {
 				err = candidate.Authenticate(user.Password)
-				if err == nil {
-					// authenticated
+				if err == nil && candidate.Banned {
+					err = fmt.Errorf("banned user %d tried to login", candidate.ID)
+					loginErrorMessage = "This account has been banned"
+				} else if err == nil {
+					// authenticated, the session gets a new id to prevent session fixation
+					if err := c.MustGetSession().Regenerate(); err != nil {
+						c.HTTPError(rw, r, 500, err)
+						return
+					}
 					c.MustGetSession().Set("user.ID", candidate.ID)
+					if loginForm.RememberMe {
+						if err := IssueRememberToken(c, candidate.ID); err != nil {
+							c.HTTPError(rw, r, 500, err)
+							return
+						}
+					}
 					c.HTTPRedirect("/", 302)
 					return
 				}
@@ -338,7 +393,48 @@ func UserProfileController(c *Container, rw http.ResponseWriter, r *http.Request
 		c.HTTPError(rw, r, 404, errors.New(http.StatusText(404)))
 		return
 	}
-	err = c.MustGetTemplate().ExecuteTemplate(rw, "user_profile.tpl.html", map[string]interface{}{"User": user})
+	current := c.CurrentUser()
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("profile_csrf"), "profile") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		// users set their preferences, administrators shadowban other users
+		before, action := *user, ""
+		switch {
+		case current != nil && current.ID == user.ID:
+			user.ShowDead = r.PostFormValue("showdead") != ""
+			user.EmailNotifications = r.PostFormValue("email_notifications") != ""
+			user.PublicFavorites = r.PostFormValue("public_favorites") != ""
+		case current != nil && current.IsAdministrator():
+			user.Shadowbanned = r.PostFormValue("shadowbanned") != ""
+			if user.Shadowbanned != before.Shadowbanned {
+				action = map[bool]string{true: "shadowban", false: "unshadowban"}[user.Shadowbanned]
+			}
+		default:
+			c.HTTPError(rw, r, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			return
+		}
+		if action != "" {
+			// the moderation log is written first so that no shadowban goes unlogged
+			err = c.LogModeration(action, ModerationTargetUser, user.ID, r.PostFormValue("reason"), &before, user)
+		}
+		if err == nil {
+			err = c.MustGetUserRepository().Save(user)
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash("The profile has been updated", "success")
+		c.HTTPRedirect(fmt.Sprintf("%s?id=%d", c.GetRoutes().UserProfile(), user.ID), http.StatusSeeOther)
+		return
+	}
+	data := map[string]interface{}{"User": user}
+	if current != nil && (current.ID == user.ID || current.IsAdministrator()) {
+		data["CSRF"] = c.MustGetCSRFGenerator().Generate("profile")
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "user_profile.tpl.html", data)
 	if err != nil {
 		c.HTTPError(rw, r, http.StatusInternalServerError, err)
 	}
@@ -368,11 +464,14 @@ func SubmitStoryController(c *Container, rw http.ResponseWriter, r *http.Request
 			c.HTTPError(rw, r, 500, err)
 			return
 		}
-		submissionFormValidator := &SubmissionFormValidator{c.MustGetCSRFGenerator()}
+		submissionFormValidator := &SubmissionFormValidator{CSRFGenerator: c.MustGetCSRFGenerator(),
+			CanPostJobs: user.IsAdministrator(), DomainRules: c.MustGetDomainRuleRepository()}
 		err = submissionFormValidator.Validate(submissionForm)
 		if err == nil {
 			thread := submissionForm.Model()
 			thread.AuthorID = user.ID
+			// stories of dead domains are only listed for their author
+			thread.Dead = submissionFormValidator.DomainRule != nil && submissionFormValidator.DomainRule.Rule == DomainRuleDead
 			err = c.MustGetThreadRepository().Create(thread)
 			if err == nil {
 				c.MustGetSession().AddFlash("Story successfully created!", "success")
@@ -439,12 +538,26 @@ func ReplyController(c *Container, rw http.ResponseWriter, r *http.Request, next
 			c.HTTPError(rw, r, 500, err)
 			return
 		}
+		thread, err := c.MustGetThreadRepository().GetByID(form.Model().ThreadID)
+		if err != nil {
+			c.HTTPError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		if thread == nil {
+			c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+		if thread.CommentsDisabled() {
+			c.HTTPError(rw, r, http.StatusForbidden, "Comments are disabled for this story")
+			return
+		}
 		formValidator := &CommentFormValidator{c.MustGetCSRFGenerator()}
 		err = formValidator.Validate(form)
 		if err == nil {
 			comment := form.Model()
 			err = c.MustGetCommentRepository().Create(comment)
 			if err == nil {
+				c.NotifyByEmail(comment)
 				c.MustGetSession().AddFlash("Comment sucessfully created.", "success")
 				c.HTTPRedirect(fmt.Sprintf("%s#%d", form.Goto, comment.ID), 302)
 				return
@@ -519,7 +632,1163 @@ func NewStoriesController(c *Container, rw http.ResponseWriter, r *http.Request,
 	}
 }
 
+// FrontController displays the stories submitted on a day, ranked by their final score.
+// The day defaults to yesterday. Anonymous pages of the days before yesterday don't change
+// anymore and are cached indefinitely
+func FrontController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	var query struct {
+		Page int `schema:"p"`
+		Day  string
+	}
+	err := c.GetFormDecoder().Decode(&query, r.URL.Query())
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	day := today.AddDate(0, 0, -1)
+	if query.Day != "" {
+		if day, err = time.Parse("2006-01-02", query.Day); err != nil {
+			c.HTTPError(rw, r, http.StatusBadRequest, fmt.Sprintf("Invalid day %s, expected YYYY-MM-DD", query.Day))
+			return
+		}
+	}
+	if day.After(today) {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	storiesByDay(c, rw, r, day, today, query.Page)
+}
+
+// PastController displays the stories submitted yesterday, like /front
+func PastController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	var query struct {
+		Page int `schema:"p"`
+	}
+	if err := c.GetFormDecoder().Decode(&query, r.URL.Query()); err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	storiesByDay(c, rw, r, today.AddDate(0, 0, -1), today, query.Page)
+}
+
+// storiesByDay displays a page of the stories submitted on a day
+func storiesByDay(c *Container, rw http.ResponseWriter, r *http.Request, day, today time.Time, page int) {
+	limit := c.GetStoriesPerPage()
+	var offset, nextPage = page * limit, page
+
+	stories, err := c.MustGetThreadRepository().GetByDay(day, limit, offset)
+	if len(stories) == limit {
+		nextPage += 1
+	}
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	var nextDay string
+	if day.Before(today) {
+		nextDay = day.AddDate(0, 0, 1).Format("2006-01-02")
+	}
+	// the page of a visitor who logs in differs from the cached anonymous page
+	rw.Header().Set("Vary", "Cookie")
+	// scores of today and yesterday still change, stories of older days are final so
+	// their anonymous pages can be cached by anyone. Pages of authenticated users show
+	// their hidden stories and account and are never cached
+	if day.Before(today.AddDate(0, 0, -1)) && !c.HasAuthenticatedUser() {
+		rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "thread_list.tpl.html", map[string]interface{}{
+		"Title":       "Front page of " + day.Format("January 2, 2006"),
+		"Threads":     stories,
+		"Page":        page,
+		"NextPage":    nextPage,
+		"Offset":      offset,
+		"Day":         day.Format("2006-01-02"),
+		"PreviousDay": day.AddDate(0, 0, -1).Format("2006-01-02"),
+		"NextDay":     nextDay,
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// SessionsController lists the active sessions of the current user,
+// who can revoke one session or all of them
+func SessionsController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	store, err := c.GetSessionStore()
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if _, ok := store.(*SQLStore); !ok {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	user, session := c.CurrentUser(), c.MustGetSession()
+	currentID := ""
+	if session.ID() != "" {
+		currentID = HashSessionID(session.ID())
+	}
+	sessionRepository := c.MustGetSessionRepository()
+	records, err := sessionRepository.GetByUserID(user.ID)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("sessions_csrf"), "sessions") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		id, revokeCurrent := r.PostFormValue("session_id"), false
+		switch {
+		case r.PostFormValue("all") != "":
+			if _, err = sessionRepository.DeleteByUserID(user.ID); err == nil {
+				err = c.MustGetRememberTokenRepository().DeleteByUserID(user.ID)
+			}
+			revokeCurrent = true
+		case id == currentID:
+			revokeCurrent = true
+		default:
+			for _, record := range records {
+				if record.ID == id {
+					err = sessionRepository.Delete(id)
+				}
+			}
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		if revokeCurrent {
+			// the current session is deleted when the response is written
+			options := *session.Options()
+			options.MaxAge = -1
+			session.SetOptions(&options)
+			c.HTTPRedirect(c.GetRoutes().StoriesByScore(), http.StatusSeeOther)
+			return
+		}
+		session.AddFlash("The session has been revoked", "success")
+		c.HTTPRedirect(c.GetRoutes().Sessions(), http.StatusSeeOther)
+		return
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "sessions.tpl.html", map[string]interface{}{
+		"Title":     "Active sessions",
+		"Sessions":  records,
+		"CurrentID": currentID,
+		"CSRF":      c.MustGetCSRFGenerator().Generate("sessions"),
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
 // NotFoundController is a standard 404 page
 func NotFoundController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
 	c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
 }
+
+// AskStoriesController displays ask stories
+func AskStoriesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	storiesByType(c, rw, r, StoryTypeAsk, "Ask")
+}
+
+// ShowStoriesController displays show stories
+func ShowStoriesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	storiesByType(c, rw, r, StoryTypeShow, "Show")
+}
+
+// JobStoriesController displays jobs
+func JobStoriesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	storiesByType(c, rw, r, StoryTypeJob, "Jobs")
+}
+
+// storiesByType displays a page of stories of a type
+func storiesByType(c *Container, rw http.ResponseWriter, r *http.Request, storyType, title string) {
+	storiesPage(c, rw, r, title, func(limit, offset int) (Threads, error) {
+		return c.MustGetThreadRepository().GetByType(storyType, limit, offset)
+	})
+}
+
+// BestStoriesController displays the stories with the highest scores of the last BestStoriesWindow
+func BestStoriesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	since := time.Now().Add(-c.GetOptions().BestStoriesWindow)
+	storiesPage(c, rw, r, "Best Stories", func(limit, offset int) (Threads, error) {
+		return c.MustGetThreadRepository().GetBest(since, limit, offset)
+	})
+}
+
+// ActiveStoriesController displays the stories commented during the last ActiveStoriesWindow,
+// the most recently commented first
+func ActiveStoriesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	since := time.Now().Add(-c.GetOptions().ActiveStoriesWindow)
+	storiesPage(c, rw, r, "Active Stories", func(limit, offset int) (Threads, error) {
+		return c.MustGetThreadRepository().GetActive(since, limit, offset)
+	})
+}
+
+// storiesPage displays a page of stories returned by get
+func storiesPage(c *Container, rw http.ResponseWriter, r *http.Request, title string, get func(limit, offset int) (Threads, error)) {
+	var (
+		query struct {
+			Page int `schema:"p"`
+		}
+		limit = c.GetStoriesPerPage()
+	)
+	err := c.GetFormDecoder().Decode(&query, r.URL.Query())
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	var offset, nextPage = query.Page * limit, query.Page
+
+	stories, err := get(limit, offset)
+	if len(stories) == limit {
+		nextPage++
+	}
+	if err == nil {
+		err = c.MustGetTemplate().ExecuteTemplate(rw, "thread_list.tpl.html", map[string]interface{}{
+			"Title":    title,
+			"Threads":  stories,
+			"Page":     query.Page,
+			"NextPage": nextPage,
+			"Offset":   offset,
+		})
+	}
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// BestCommentsController displays the comments with the highest scores of the last BestCommentsWindow
+func BestCommentsController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	var (
+		query struct {
+			Page int `schema:"p"`
+		}
+		limit = c.GetCommentsPerPage()
+	)
+	err := c.GetFormDecoder().Decode(&query, r.URL.Query())
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	var offset, nextPage = query.Page * limit, query.Page
+
+	comments, err := c.MustGetCommentRepository().GetBest(time.Now().Add(-c.GetOptions().BestCommentsWindow), limit, offset)
+	if len(comments) == limit {
+		nextPage++
+	}
+	if err == nil {
+		err = c.MustGetTemplate().ExecuteTemplate(rw, "newcomments.tpl.html", map[string]interface{}{
+			"Title":    "Best Comments",
+			"Comments": comments,
+			"Page":     query.Page,
+			"NextPage": nextPage,
+		})
+	}
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// LeadersController displays the users with the most karma
+func LeadersController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	var (
+		query struct {
+			Page int `schema:"p"`
+		}
+		limit = c.GetStoriesPerPage()
+	)
+	err := c.GetFormDecoder().Decode(&query, r.URL.Query())
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	var offset, nextPage = query.Page * limit, query.Page
+
+	users, err := c.MustGetUserRepository().GetLeaders(limit, offset)
+	if len(users) == limit {
+		nextPage++
+	}
+	if err == nil {
+		err = c.MustGetTemplate().ExecuteTemplate(rw, "leaders.tpl.html", map[string]interface{}{
+			"Title":    "Leaders",
+			"Users":    users,
+			"Page":     query.Page,
+			"NextPage": nextPage,
+			"Offset":   offset,
+		})
+	}
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// safeGoto returns a local path to redirect to, or fallback
+func safeGoto(path, fallback string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return fallback
+	}
+	return path
+}
+
+// item is a story or a comment moderation actions apply to
+type item struct {
+	Title              string
+	AuthorID, ThreadID int64
+	Dead               bool
+}
+
+// getItem returns a story or a comment, dead or not, or nil if not found
+func getItem(c *Container, kind string, id int64) (*item, error) {
+	if kind == FlagKindStory {
+		thread, err := c.MustGetThreadRepository().GetByID(id)
+		if err != nil || thread == nil {
+			return nil, err
+		}
+		return &item{thread.Title, thread.AuthorID, thread.ID, thread.Dead}, nil
+	}
+	comment, err := c.MustGetCommentRepository().GetByID(id)
+	if err != nil || comment == nil {
+		return nil, err
+	}
+	return &item{comment.Content, comment.AuthorID, comment.ThreadID, comment.Dead}, nil
+}
+
+// getSnapshot returns a story or a comment for the moderation log, nil if not found
+func getSnapshot(c *Container, kind string, id int64) (interface{}, error) {
+	if kind == FlagKindStory {
+		if thread, err := c.MustGetThreadRepository().GetByID(id); thread != nil || err != nil {
+			return thread, err
+		}
+		return nil, nil
+	}
+	if comment, err := c.MustGetCommentRepository().GetByID(id); comment != nil || err != nil {
+		return comment, err
+	}
+	return nil, nil
+}
+
+// moderatedSnapshot returns the snapshot of a story or a comment once a moderation
+// action is applied, nil for deleted items. Moderation actions are logged before they
+// are applied so that a failure to log leaves the item unchanged
+func moderatedSnapshot(before interface{}, action string) interface{} {
+	var (
+		after     interface{}
+		dead      *bool
+		flagged   *bool
+		flagCount *int
+	)
+	switch item := before.(type) {
+	case *Thread:
+		thread := *item
+		after, dead, flagged, flagCount = &thread, &thread.Dead, &thread.Flagged, &thread.FlagCount
+	case *Comment:
+		comment := *item
+		after, dead, flagged, flagCount = &comment, &comment.Dead, &comment.Flagged, &comment.FlagCount
+	default:
+		return nil
+	}
+	switch action {
+	case "delete":
+		return nil
+	case "kill":
+		*dead = true
+	case "vouch":
+		*dead = false
+	case "restore":
+		*dead, *flagged, *flagCount = false, false, 0
+	}
+	return after
+}
+
+// setDead kills or revives a story or a comment
+func setDead(c *Container, kind string, id int64, dead bool) error {
+	if kind == FlagKindStory {
+		return c.MustGetThreadRepository().SetDead(id, dead)
+	}
+	return c.MustGetCommentRepository().SetDead(id, dead)
+}
+
+// getVote returns the score of the vote of a user on a story or a comment, 0 without vote
+func getVote(c *Container, kind string, id, userID int64) (int, error) {
+	if kind == FlagKindStory {
+		return c.MustGetThreadVoteRepository().GetScore(id, userID)
+	}
+	return c.MustGetCommentVoteRepository().GetScore(id, userID)
+}
+
+// cannotDownvote returns why a user can't downvote a comment, an empty string if the user can.
+// Users need DownvoteMinKarma, can't downvote replies to their comments nor comments older than DownvoteMaxAge
+func cannotDownvote(c *Container, user *User, id int64) (string, error) {
+	options := c.GetOptions()
+	if user.Karma < options.DownvoteMinKarma && !user.IsAdministrator() {
+		return fmt.Sprintf("You need %d karma to downvote comments", options.DownvoteMinKarma), nil
+	}
+	comments := c.MustGetCommentRepository()
+	comment, err := comments.GetByID(id)
+	if err != nil || comment == nil {
+		return "", err
+	}
+	if time.Since(comment.Created) > options.DownvoteMaxAge {
+		return fmt.Sprintf("Comments older than %s can't be downvoted", options.DownvoteMaxAge), nil
+	}
+	if comment.ParentID != 0 {
+		parent, err := comments.GetByID(comment.ParentID)
+		if err != nil {
+			return "", err
+		}
+		if parent != nil && parent.AuthorID == user.ID {
+			return "You cannot downvote replies to your comments", nil
+		}
+	}
+	return "", nil
+}
+
+// vote casts or changes the vote of a user on a story or a comment, a score of 0 removes the vote
+func vote(c *Container, kind string, id, userID int64, score int) error {
+	window := c.GetOptions().UnvoteWindow
+	if kind == FlagKindStory {
+		if score == 0 {
+			return c.MustGetThreadVoteRepository().Unvote(id, userID, window)
+		}
+		return c.MustGetThreadVoteRepository().Vote(id, userID, score, window)
+	}
+	if score == 0 {
+		return c.MustGetCommentVoteRepository().Unvote(id, userID, window)
+	}
+	return c.MustGetCommentVoteRepository().Vote(id, userID, score, window)
+}
+
+// FlagController flags or unflags a story or a comment after a confirmation
+func FlagController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	user, kind := c.CurrentUser(), r.FormValue("kind")
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || (kind != FlagKindStory && kind != FlagKindComment) {
+		c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	item, err := getItem(c, kind, id)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if item == nil {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	switch {
+	case item.AuthorID == user.ID:
+		c.HTTPError(rw, r, http.StatusForbidden, "You cannot flag your own items")
+		return
+	case user.Karma < c.GetOptions().FlagMinKarma && !user.IsAdministrator():
+		c.HTTPError(rw, r, http.StatusForbidden, fmt.Sprintf("You need %d karma to flag items", c.GetOptions().FlagMinKarma))
+		return
+	}
+	flags := c.MustGetFlagRepository()
+	hasFlagged, err := flags.HasFlagged(kind, id, user.ID)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	goTo := safeGoto(r.FormValue("goto"), fmt.Sprintf("%s?id=%d", c.GetRoutes().StoryByID(), item.ThreadID))
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("flag_csrf"), "flag") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		message := "The item has been flagged"
+		if hasFlagged {
+			err, message = flags.Unflag(kind, id, user.ID, c.GetOptions().FlagThreshold), "The item has been unflagged"
+		} else {
+			err = flags.Flag(kind, id, user.ID, c.GetOptions().FlagThreshold)
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash(message, "success")
+		c.HTTPRedirect(goTo, http.StatusSeeOther)
+		return
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "flag.tpl.html", map[string]interface{}{
+		"Title":      "Flag",
+		"Kind":       kind,
+		"ID":         id,
+		"ItemTitle":  item.Title,
+		"HasFlagged": hasFlagged,
+		"Goto":       goTo,
+		"CSRF":       c.MustGetCSRFGenerator().Generate("flag"),
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// FlagQueueController lists flagged and dead items for administrators,
+// who restore, kill or delete them
+func FlagQueueController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("flagqueue_csrf"), "flagqueue") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		kind := r.PostFormValue("kind")
+		id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil || (kind != FlagKindStory && kind != FlagKindComment) {
+			c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		before, err := getSnapshot(c, kind, id)
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		if before == nil {
+			c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+		action := r.PostFormValue("action")
+		if action != "restore" && action != "kill" && action != "delete" {
+			c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		// the moderation log is written first so that no action goes unlogged
+		err = c.LogModeration(action, kind, id, r.PostFormValue("reason"), before, moderatedSnapshot(before, action))
+		if err == nil {
+			switch action {
+			case "restore":
+				if err = c.MustGetFlagRepository().Restore(kind, id); err == nil {
+					err = setDead(c, kind, id, false)
+				}
+			case "kill":
+				err = setDead(c, kind, id, true)
+			case "delete":
+				if kind == FlagKindStory {
+					err = c.MustGetThreadRepository().Delete(id)
+				} else {
+					err = c.MustGetCommentRepository().Delete(id)
+				}
+			}
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash(fmt.Sprintf("The %s has been %s", kind, map[string]string{
+			"restore": "restored", "kill": "killed", "delete": "deleted"}[r.PostFormValue("action")]), "success")
+		c.HTTPRedirect(c.GetRoutes().FlagQueue(), http.StatusSeeOther)
+		return
+	}
+	threads, err := c.MustGetThreadRepository().GetFlagged(c.GetStoriesPerPage(), 0)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	comments, err := c.MustGetCommentRepository().GetFlagged(c.GetCommentsPerPage(), 0)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "flag_queue.tpl.html", map[string]interface{}{
+		"Title":    "Flagged items",
+		"Threads":  threads,
+		"Comments": comments,
+		"CSRF":     c.MustGetCSRFGenerator().Generate("flagqueue"),
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// VouchController revives a dead story or comment after a confirmation
+func VouchController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	user, kind := c.CurrentUser(), r.FormValue("kind")
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || (kind != FlagKindStory && kind != FlagKindComment) {
+		c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	item, err := getItem(c, kind, id)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if item == nil || !item.Dead {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	switch {
+	case item.AuthorID == user.ID:
+		c.HTTPError(rw, r, http.StatusForbidden, "You cannot vouch for your own items")
+		return
+	case user.Karma < c.GetOptions().VouchMinKarma && !user.IsAdministrator():
+		c.HTTPError(rw, r, http.StatusForbidden, fmt.Sprintf("You need %d karma to vouch for items", c.GetOptions().VouchMinKarma))
+		return
+	}
+	goTo := safeGoto(r.FormValue("goto"), fmt.Sprintf("%s?id=%d", c.GetRoutes().StoryByID(), item.ThreadID))
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("vouch_csrf"), "vouch") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		before, err := getSnapshot(c, kind, id)
+		if err == nil {
+			err = c.LogModeration("vouch", kind, id, "", before, moderatedSnapshot(before, "vouch"))
+		}
+		if err == nil {
+			err = setDead(c, kind, id, false)
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash("The item has been vouched for", "success")
+		c.HTTPRedirect(goTo, http.StatusSeeOther)
+		return
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "vouch.tpl.html", map[string]interface{}{
+		"Title":     "Vouch",
+		"Kind":      kind,
+		"ID":        id,
+		"ItemTitle": item.Title,
+		"Goto":      goTo,
+		"CSRF":      c.MustGetCSRFGenerator().Generate("vouch"),
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// ModerationLogController lists moderation actions for administrators, filtered
+// by actor, action and target
+func ModerationLogController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	var (
+		query struct {
+			ModerationLogFilter
+			Page int `schema:"p"`
+		}
+		limit = c.GetStoriesPerPage()
+	)
+	if err := c.GetFormDecoder().Decode(&query, r.URL.Query()); err != nil {
+		c.HTTPError(rw, r, http.StatusBadRequest, err)
+		return
+	}
+	var offset, nextPage = query.Page * limit, query.Page
+	entries, err := c.MustGetModerationLogRepository().Find(query.ModerationLogFilter, limit, offset)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if len(entries) == limit {
+		nextPage++
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "moderation_log.tpl.html", map[string]interface{}{
+		"Title":    "Moderation log",
+		"Entries":  entries,
+		"Filter":   query.ModerationLogFilter,
+		"Page":     query.Page,
+		"NextPage": nextPage,
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// DomainRulesController lists domain rules for administrators, who create,
+// replace or delete them
+func DomainRulesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	rules := c.MustGetDomainRuleRepository()
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("domainrules_csrf"), "domainrules") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		var (
+			err     error
+			actor   = c.CurrentUser()
+			reason  = r.PostFormValue("reason")
+			logRule = func(action string, id int64, before, after *DomainRule) (*ModerationLogEntry, error) {
+				return NewModerationLogEntry(actor.ID, actor.Username, action, ModerationTargetDomainRule, id, reason, before, after)
+			}
+		)
+		// rules and their moderation log entries are written in the same transaction
+		switch r.PostFormValue("action") {
+		case "save":
+			rule := &DomainRule{Pattern: strings.TrimSpace(r.PostFormValue("pattern")), IsRegex: r.PostFormValue("regex") != "",
+				Rule: r.PostFormValue("rule"), Reason: reason}
+			if err = rule.Validate(); err != nil {
+				c.MustGetSession().AddFlash(err.Error(), "error")
+				c.HTTPRedirect(c.GetRoutes().DomainRules(), http.StatusSeeOther)
+				return
+			}
+			err = rules.SaveAll([]*DomainRule{rule}, c.MustGetModerationLogRepository(), func(rule *DomainRule) (*ModerationLogEntry, error) {
+				return logRule("domain-rule-save", rule.ID, nil, rule)
+			})
+		case "delete":
+			id, _ := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+			var (
+				before *DomainRule
+				entry  *ModerationLogEntry
+			)
+			if before, err = rules.GetByID(id); err == nil && before == nil {
+				c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+				return
+			}
+			if err == nil {
+				entry, err = logRule("domain-rule-delete", id, before, nil)
+			}
+			if err == nil {
+				err = rules.DeleteWithLog(id, c.MustGetModerationLogRepository(), entry)
+			}
+		default:
+			c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash("The domain rules have been updated", "success")
+		c.HTTPRedirect(c.GetRoutes().DomainRules(), http.StatusSeeOther)
+		return
+	}
+	all, err := rules.GetAll()
+	if err == nil {
+		err = c.MustGetTemplate().ExecuteTemplate(rw, "domain_rules.tpl.html", map[string]interface{}{
+			"Title": "Domain rules",
+			"Rules": all,
+			"CSRF":  c.MustGetCSRFGenerator().Generate("domainrules"),
+		})
+	}
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// VoteAnalysisController shows administrators the latest report of the vote analysis,
+// the voting rings and the sockpuppets, and analyzes the votes on demand
+func VoteAnalysisController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	analyzer, options := c.MustGetVoteAnalyzer(), c.ContainerOptions.VoteAnalysis
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("votes_csrf"), "votes") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		report, err := analyzer.Run(r.Context(), options)
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash(fmt.Sprintf("The votes have been analyzed, %d suspicious votes found", len(report.Votes)), "success")
+		c.HTTPRedirect(c.GetRoutes().VoteAnalysis(), http.StatusSeeOther)
+		return
+	}
+	report, err := analyzer.GetLatestReport()
+	if err == nil {
+		err = c.MustGetTemplate().ExecuteTemplate(rw, "votes.tpl.html", map[string]interface{}{
+			"Title":   "Vote analysis",
+			"Report":  report,
+			"Options": options,
+			"CSRF":    c.MustGetCSRFGenerator().Generate("votes"),
+		})
+	}
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// InboxController lists the replies to the comments and stories of the current user,
+// who marks them as read one by one or all at once
+func InboxController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	user, notifications := c.CurrentUser(), c.MustGetNotificationRepository()
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("inbox_csrf"), "inbox") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		var err error
+		if r.PostFormValue("all") != "" {
+			err = notifications.MarkAllAsRead(user.ID)
+		} else {
+			id, parseErr := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+			if parseErr != nil {
+				c.HTTPError(rw, r, http.StatusBadRequest, parseErr)
+				return
+			}
+			err = notifications.MarkAsRead(user.ID, id)
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.HTTPRedirect(c.GetRoutes().Inbox(), http.StatusSeeOther)
+		return
+	}
+	var (
+		query struct {
+			Page int `schema:"p"`
+		}
+		limit = c.GetStoriesPerPage()
+	)
+	if err := c.GetFormDecoder().Decode(&query, r.URL.Query()); err != nil {
+		c.HTTPError(rw, r, http.StatusBadRequest, err)
+		return
+	}
+	var offset, nextPage = query.Page * limit, query.Page
+	entries, err := notifications.GetByUserID(user.ID, limit, offset)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if len(entries) == limit {
+		nextPage++
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "inbox.tpl.html", map[string]interface{}{
+		"Title":         "Inbox",
+		"Notifications": entries,
+		"CSRF":          c.MustGetCSRFGenerator().Generate("inbox"),
+		"Page":          query.Page,
+		"NextPage":      nextPage,
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// FavoriteController saves a story or a comment to the favorites of the current user,
+// or removes it, after a confirmation
+func FavoriteController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	user, kind := c.CurrentUser(), r.FormValue("kind")
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || (kind != FlagKindStory && kind != FlagKindComment) {
+		c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	item, err := getItem(c, kind, id)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if item == nil {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	favorites := c.MustGetFavoriteRepository()
+	hasFavorited, err := favorites.HasFavorited(kind, id, user.ID)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	goTo := safeGoto(r.FormValue("goto"), fmt.Sprintf("%s?id=%d", c.GetRoutes().StoryByID(), item.ThreadID))
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("favorite_csrf"), "favorite") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		message := "The item has been saved to your favorites"
+		if hasFavorited {
+			err, message = favorites.Unfavorite(kind, id, user.ID), "The item has been removed from your favorites"
+		} else {
+			err = favorites.Favorite(kind, id, user.ID)
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash(message, "success")
+		c.HTTPRedirect(goTo, http.StatusSeeOther)
+		return
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "favorite.tpl.html", map[string]interface{}{
+		"Title":        "Favorite",
+		"Kind":         kind,
+		"ID":           id,
+		"ItemTitle":    item.Title,
+		"HasFavorited": hasFavorited,
+		"Goto":         goTo,
+		"CSRF":         c.MustGetCSRFGenerator().Generate("favorite"),
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// VoteController upvotes a story or a comment, downvotes a comment, or removes the vote
+// of the current user during the unvote window, after a confirmation
+func VoteController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	user, kind := c.CurrentUser(), r.FormValue("kind")
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || (kind != FlagKindStory && kind != FlagKindComment) {
+		c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	item, err := getItem(c, kind, id)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if item == nil {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	score, err := getVote(c, kind, id, user.ID)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	goTo := safeGoto(r.FormValue("goto"), fmt.Sprintf("%s?id=%d", c.GetRoutes().StoryByID(), item.ThreadID))
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("vote_csrf"), "vote") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		message := "Your vote has been saved"
+		switch r.PostFormValue("how") {
+		case VoteUp:
+			if item.Dead {
+				c.HTTPError(rw, r, http.StatusForbidden, "Dead items can't be voted on")
+				return
+			}
+			err = vote(c, kind, id, user.ID, 1)
+		case VoteDown:
+			if kind != FlagKindComment || item.Dead {
+				c.HTTPError(rw, r, http.StatusForbidden, "Only comments can be downvoted")
+				return
+			}
+			var reason string
+			if reason, err = cannotDownvote(c, user, id); err == nil && reason != "" {
+				c.HTTPError(rw, r, http.StatusForbidden, reason)
+				return
+			}
+			if err == nil {
+				err = vote(c, kind, id, user.ID, -1)
+			}
+		case VoteUn:
+			err, message = vote(c, kind, id, user.ID, 0), "Your vote has been removed"
+		default:
+			c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		switch err {
+		case nil:
+		case ErrSelfVote, ErrVoteWindow, ErrNoVote:
+			c.HTTPError(rw, r, http.StatusForbidden, err.Error())
+			return
+		default:
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash(message, "success")
+		c.HTTPRedirect(goTo, http.StatusSeeOther)
+		return
+	}
+	canDownvote := false
+	if kind == FlagKindComment && !item.Dead {
+		reason, err := cannotDownvote(c, user, id)
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		canDownvote = reason == ""
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "vote.tpl.html", map[string]interface{}{
+		"Title":       "Vote",
+		"Kind":        kind,
+		"ID":          id,
+		"ItemTitle":   item.Title,
+		"Score":       score,
+		"IsAuthor":    item.AuthorID == user.ID,
+		"CanDownvote": canDownvote,
+		"Goto":        goTo,
+		"CSRF":        c.MustGetCSRFGenerator().Generate("vote"),
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// FavoritesController lists the favorite stories, or comments, of a user, unless
+// the user made them private. format=json exports every favorite of the user
+func FavoritesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	var (
+		query struct {
+			Page     int    `schema:"p"`
+			UserID   int64  `schema:"id"`
+			Comments string `schema:"comments"`
+			Format   string `schema:"format"`
+		}
+		limit = c.GetStoriesPerPage()
+	)
+	if err := c.GetFormDecoder().Decode(&query, r.URL.Query()); err != nil {
+		c.HTTPError(rw, r, http.StatusBadRequest, err)
+		return
+	}
+	user, err := c.MustGetUserRepository().GetByID(query.UserID)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if user == nil {
+		c.HTTPError(rw, r, http.StatusNotFound, fmt.Sprintf("User with id %d not found", query.UserID))
+		return
+	}
+	current := c.CurrentUser()
+	if !user.PublicFavorites && (current == nil || (current.ID != user.ID && !current.IsAdministrator())) {
+		c.HTTPError(rw, r, http.StatusForbidden, "The favorites of this user are private")
+		return
+	}
+	favorites := c.MustGetFavoriteRepository()
+	if query.Format == "json" {
+		var export struct {
+			User     string
+			Stories  Threads
+			Comments Comments
+		}
+		export.User = user.Username
+		export.Stories, err = favorites.GetStoriesByUserID(user.ID, -1, 0)
+		if err == nil {
+			export.Comments, err = favorites.GetCommentsByUserID(user.ID, -1, 0)
+		}
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"favorites-%s.json\"", user.Username))
+		if err = json.NewEncoder(rw).Encode(export); err != nil {
+			c.MustGetLogger().Error("FavoritesController", err)
+		}
+		return
+	}
+	var (
+		offset, nextPage = query.Page * limit, query.Page
+		threads          Threads
+		comments         Comments
+		count            int
+	)
+	if query.Comments != "" {
+		comments, err = favorites.GetCommentsByUserID(user.ID, limit, offset)
+		count = len(comments)
+	} else {
+		threads, err = favorites.GetStoriesByUserID(user.ID, limit, offset)
+		count = len(threads)
+	}
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if count == limit {
+		nextPage++
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "favorites.tpl.html", map[string]interface{}{
+		"Title":        fmt.Sprintf("%s's favorites", user.Username),
+		"User":         user,
+		"ShowComments": query.Comments != "",
+		"Threads":      threads,
+		"Comments":     comments,
+		"Page":         query.Page,
+		"NextPage":     nextPage,
+		"Offset":       offset,
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// HideController hides a story from the listings of the current user after a confirmation
+func HideController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	user := c.CurrentUser()
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		c.HTTPError(rw, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	threads := c.MustGetThreadRepository()
+	thread, err := threads.GetByID(id)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if thread == nil {
+		c.HTTPError(rw, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	goTo := safeGoto(r.FormValue("goto"), c.GetRoutes().StoriesByScore())
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("hide_csrf"), "hide") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		if err = threads.Hide(thread.ID, user.ID); err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash("The story has been hidden", "success")
+		c.HTTPRedirect(goTo, http.StatusSeeOther)
+		return
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "hide.tpl.html", map[string]interface{}{
+		"Title":  "Hide",
+		"Thread": thread,
+		"Goto":   goTo,
+		"CSRF":   c.MustGetCSRFGenerator().Generate("hide"),
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
+
+// HiddenStoriesController lists the stories the current user hid, which the user can un-hide
+func HiddenStoriesController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	user, threads := c.CurrentUser(), c.MustGetThreadRepository()
+	if r.Method == "POST" {
+		if !c.MustGetCSRFGenerator().Valid(r.PostFormValue("hidden_csrf"), "hidden") {
+			c.HTTPError(rw, r, http.StatusBadRequest, "Invalid CSRF token")
+			return
+		}
+		id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil {
+			c.HTTPError(rw, r, http.StatusBadRequest, err)
+			return
+		}
+		if err = threads.Unhide(id, user.ID); err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.MustGetSession().AddFlash("The story is listed again", "success")
+		c.HTTPRedirect(c.GetRoutes().HiddenStories(), http.StatusSeeOther)
+		return
+	}
+	var (
+		query struct {
+			Page int `schema:"p"`
+		}
+		limit = c.GetStoriesPerPage()
+	)
+	if err := c.GetFormDecoder().Decode(&query, r.URL.Query()); err != nil {
+		c.HTTPError(rw, r, http.StatusBadRequest, err)
+		return
+	}
+	var offset, nextPage = query.Page * limit, query.Page
+	hidden, err := threads.GetHiddenByUserID(user.ID, limit, offset)
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+		return
+	}
+	if len(hidden) == limit {
+		nextPage++
+	}
+	err = c.MustGetTemplate().ExecuteTemplate(rw, "hidden.tpl.html", map[string]interface{}{
+		"Title":    "Hidden stories",
+		"Threads":  hidden,
+		"CSRF":     c.MustGetCSRFGenerator().Generate("hidden"),
+		"Page":     query.Page,
+		"NextPage": nextPage,
+	})
+	if err != nil {
+		c.HTTPError(rw, r, 500, err)
+	}
+}
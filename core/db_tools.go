@@ -18,6 +18,7 @@
 package gonews
 
 import (
+	"database/sql"
 	"fmt"
 	"reflect"
 )
@@ -36,6 +37,12 @@ type Scanner interface {
 	Scan(destination ...interface{}) error
 }
 
+// executor runs statements, it is implemented by *sql.DB and *sql.Tx
+type executor interface {
+	Exec(query string, arguments ...interface{}) (sql.Result, error)
+	QueryRow(query string, arguments ...interface{}) *sql.Row
+}
+
 // MapRowsToSliceOfSlices maps db rows to a slice of slices
 func MapRowsToSliceOfSlices(scanner RowsScanner, Slices *[][]interface{}) error {
 	defer scanner.Close()
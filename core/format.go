@@ -0,0 +1,217 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Contents of stories and comments are formatted like hacker news :
+// blank lines separate paragraphs, text surrounded by asterisks is italicized,
+// lines indented by 2 spaces or more after a blank line are code and urls are links.
+
+// maxLinkTextLength is the length after which the text of a link is truncated
+const maxLinkTextLength = 60
+
+var (
+	urlPattern    = regexp.MustCompile(`https?://[^\s<>"'\x00]+`)
+	italicPattern = regexp.MustCompile(`\*([^\s*](?:[^*]*[^\s*])?)\*`)
+	placeholder   = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// RenderContent formats a content and sanitizes the result, it is
+// executed once when a content is written, the html is cached in the database
+func RenderContent(content string) template.HTML {
+	return template.HTML(SanitizeHTML(FormatContent(content)))
+}
+
+// FormatContent converts a plain text content to html
+func FormatContent(content string) string {
+	content = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "").Replace(content)
+	lines := strings.Split(content, "\n")
+	isBlank := func(line string) bool { return strings.TrimSpace(line) == "" }
+	isIndented := func(line string) bool {
+		return strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t")
+	}
+	buffer := new(bytes.Buffer)
+	for i := 0; i < len(lines); {
+		switch {
+		case isBlank(lines[i]):
+			i++
+		case isIndented(lines[i]):
+			// a code block goes on as long as lines are indented, blank lines included
+			code := []string{}
+			for ; i < len(lines) && (isIndented(lines[i]) || isBlank(lines[i])); i++ {
+				code = append(code, lines[i])
+			}
+			for isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			buffer.WriteString("<pre><code>")
+			for j, line := range code {
+				if j > 0 {
+					buffer.WriteString("\n")
+				}
+				buffer.WriteString(html.EscapeString(strings.TrimPrefix(strings.TrimPrefix(line, "  "), "\t")))
+			}
+			buffer.WriteString("</code></pre>")
+		default:
+			paragraph := []string{}
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				paragraph = append(paragraph, strings.TrimSpace(lines[i]))
+			}
+			buffer.WriteString("<p>")
+			buffer.WriteString(formatParagraph(strings.Join(paragraph, "\n")))
+			buffer.WriteString("</p>")
+		}
+	}
+	return buffer.String()
+}
+
+// formatParagraph escapes a paragraph, links urls and italicizes text surrounded by asterisks
+func formatParagraph(paragraph string) string {
+	// urls are replaced by placeholders so asterisks in urls are not taken for italics
+	links := []string{}
+	paragraph = urlPattern.ReplaceAllStringFunc(paragraph, func(match string) string {
+		link, rest := trimURL(match)
+		text := link
+		// the text is cut on a character boundary, urls may not be ascii
+		if runes := []rune(text); len(runes) > maxLinkTextLength {
+			text = string(runes[:maxLinkTextLength]) + "..."
+		}
+		links = append(links, fmt.Sprintf(`<a href="%s" rel="nofollow ugc">%s</a>`, html.EscapeString(link), html.EscapeString(text)))
+		return fmt.Sprintf("\x00%d\x00", len(links)-1) + rest
+	})
+	paragraph = italicPattern.ReplaceAllString(html.EscapeString(paragraph), "<i>$1</i>")
+	return placeholder.ReplaceAllStringFunc(paragraph, func(match string) string {
+		var index int
+		fmt.Sscanf(strings.Trim(match, "\x00"), "%d", &index)
+		return links[index]
+	})
+}
+
+// trimURL removes the trailing punctuation that is likely not part of an url,
+// closing parentheses are kept when they are balanced in the url
+func trimURL(match string) (link, rest string) {
+	link = match
+	for len(link) > 0 {
+		last := link[len(link)-1]
+		if strings.IndexByte(".,;:!?*", last) >= 0 ||
+			(last == ')' && strings.Count(link, "(") < strings.Count(link, ")")) {
+			link = link[:len(link)-1]
+			continue
+		}
+		break
+	}
+	return link, match[len(link):]
+}
+
+// allowedElements are the elements FormatContent produces, SanitizeHTML removes all the others
+var allowedElements = map[string]bool{"p": true, "i": true, "pre": true, "code": true, "a": true}
+
+// SanitizeHTML only keeps the elements produced by FormatContent and links to http or https urls,
+// all attributes except href are removed, the rel attribute of links is set to "nofollow ugc".
+// The text of removed elements is kept, except for the content of script and style elements.
+func SanitizeHTML(input string) string {
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(input))
+	buffer := new(bytes.Buffer)
+	open := []string{}
+	skipping := ""
+	for {
+		switch tokenizer.Next() {
+		case xhtml.ErrorToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				buffer.WriteString("</" + open[i] + ">")
+			}
+			return buffer.String()
+		case xhtml.TextToken:
+			if skipping == "" {
+				buffer.WriteString(html.EscapeString(string(tokenizer.Text())))
+			}
+		case xhtml.StartTagToken:
+			token := tokenizer.Token()
+			if skipping != "" {
+				continue
+			}
+			switch {
+			case token.Data == "script" || token.Data == "style":
+				skipping = token.Data
+			case allowedElements[token.Data]:
+				if token.Data == "a" {
+					if isOpen(open, "a") {
+						continue
+					}
+					href, ok := safeHref(token.Attr)
+					if !ok {
+						continue
+					}
+					buffer.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow ugc">`)
+				} else {
+					buffer.WriteString("<" + token.Data + ">")
+				}
+				open = append(open, token.Data)
+			}
+		case xhtml.EndTagToken:
+			token := tokenizer.Token()
+			if skipping != "" {
+				if token.Data == skipping {
+					skipping = ""
+				}
+				continue
+			}
+			// only the innermost open element can be closed
+			if len(open) > 0 && open[len(open)-1] == token.Data {
+				buffer.WriteString("</" + token.Data + ">")
+				open = open[:len(open)-1]
+			}
+		}
+		// self closing tags, comments and doctypes are removed
+	}
+}
+
+func isOpen(open []string, element string) bool {
+	for _, name := range open {
+		if name == element {
+			return true
+		}
+	}
+	return false
+}
+
+// safeHref returns the href attribute if it is an absolute http or https url
+func safeHref(attributes []xhtml.Attribute) (string, bool) {
+	for _, attribute := range attributes {
+		if attribute.Key != "href" {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(attribute.Val))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", false
+		}
+		return u.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,188 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mparaiso/gonews/core"
+	"golang.org/x/net/html"
+)
+
+func TestFormatContent(t *testing.T) {
+	for _, fixture := range []struct{ Content, Expected string }{
+		{"", ""},
+		{"hello", "<p>hello</p>"},
+		{"first\nsame paragraph\n\nsecond", "<p>first\nsame paragraph</p><p>second</p>"},
+		{"first\r\n\r\n\r\nsecond", "<p>first</p><p>second</p>"},
+		{"this is *important*", "<p>this is <i>important</i></p>"},
+		{"2 * 3 * 4", "<p>2 * 3 * 4</p>"},
+		{"*not closed", "<p>*not closed</p>"},
+		{"example:\n\n  if a < b {\n    return\n  }\n\nafter", "<p>example:</p><pre><code>if a &lt; b {\n  return\n}</code></pre><p>after</p>"},
+		{"  *code* http://a.acme", "<pre><code>*code* http://a.acme</code></pre>"},
+		{"see http://golang.org/doc.", `<p>see <a href="http://golang.org/doc" rel="nofollow ugc">http://golang.org/doc</a>.</p>`},
+		{"(https://en.wikipedia.org/wiki/Go_(programming_language))",
+			`<p>(<a href="https://en.wikipedia.org/wiki/Go_(programming_language)" rel="nofollow ugc">https://en.wikipedia.org/wiki/Go_(programming_language)</a>)</p>`},
+		{"*http://a.acme/x*", `<p><i><a href="http://a.acme/x" rel="nofollow ugc">http://a.acme/x</a></i></p>`},
+		{"http://a.acme/?a=1&b=2", `<p><a href="http://a.acme/?a=1&amp;b=2" rel="nofollow ugc">http://a.acme/?a=1&amp;b=2</a></p>`},
+		{"http://a.acme/" + strings.Repeat("a", 70), `<p><a href="http://a.acme/` + strings.Repeat("a", 70) + `" rel="nofollow ugc">http://a.acme/` + strings.Repeat("a", 46) + `...</a></p>`},
+		{"<b>bold</b> & 'quotes'", "<p>&lt;b&gt;bold&lt;/b&gt; &amp; &#39;quotes&#39;</p>"},
+	} {
+		Expect(t, gonews.FormatContent(fixture.Content), fixture.Expected, fmt.Sprintf("FormatContent(%q)", fixture.Content))
+		Expect(t, string(gonews.RenderContent(fixture.Content)), fixture.Expected, fmt.Sprintf("RenderContent(%q)", fixture.Content))
+	}
+	// long link texts are cut on a character boundary, the sanitizer escapes the href
+	link := "https://ja.wikipedia.org/wiki/" + strings.Repeat("日本語", 14)
+	text := `rel="nofollow ugc">https://ja.wikipedia.org/wiki/` + strings.Repeat("日本語", 10) + `...</a>`
+	Expect(t, strings.Contains(gonews.FormatContent(link), text), true, "FormatContent of a non ascii url")
+	Expect(t, strings.Contains(string(gonews.RenderContent(link)), text), true, "RenderContent of a non ascii url")
+}
+
+// xssCorpus are payloads that should never produce active content,
+// either written as a content or passed directly to the sanitizer
+var xssCorpus = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=http://xss.acme/xss.js></SCRIPT>`,
+	`<scr<script>ipt>alert(1)</scr</script>ipt>`,
+	`<img src=x onerror=alert(1)>`,
+	`<img src="javascript:alert(1)">`,
+	`<svg/onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<math><mi xlink:href="javascript:alert(1)">x</mi></math>`,
+	`<body onload=alert(1)>`,
+	`<iframe src="javascript:alert(1)"></iframe>`,
+	`<iframe srcdoc="<script>alert(1)</script>"></iframe>`,
+	`<object data="javascript:alert(1)"></object>`,
+	`<embed src="javascript:alert(1)">`,
+	`<a href="javascript:alert(1)">click</a>`,
+	`<a href="JaVaScRiPt:alert(1)">click</a>`,
+	`<a href="  javascript:alert(1)">click</a>`,
+	`<a href="java&#x09;script:alert(1)">click</a>`,
+	`<a href="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">click</a>`,
+	`<a href="vbscript:msgbox(1)">click</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">click</a>`,
+	`<a href="//xss.acme">protocol relative</a>`,
+	`<a href="http://a.acme" onclick="alert(1)">click</a>`,
+	`<a href="http://a.acme" style="position:fixed;top:0">click</a>`,
+	`<a href="http://a.acme" target="_blank" rel="opener">click</a>`,
+	`<a href='http://a.acme"onmouseover="alert(1)'>click</a>`,
+	`<p onmouseover="alert(1)">text</p>`,
+	`<i style="background:url(javascript:alert(1))">text</i>`,
+	`<style>body{background:url("javascript:alert(1)")}</style>`,
+	`<link rel=stylesheet href="http://xss.acme/xss.css">`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="http://xss.acme/">`,
+	`<form action="http://xss.acme"><input type=submit></form>`,
+	`<button formaction="javascript:alert(1)">x</button>`,
+	`<details open ontoggle=alert(1)>`,
+	`<video><source onerror="alert(1)"></video>`,
+	`<table background="javascript:alert(1)">`,
+	`<div style="width:expression(alert(1))">`,
+	`<!--<script>alert(1)</script>-->`,
+	`<![CDATA[<script>alert(1)</script>]]>`,
+	`<textarea><script>alert(1)</script></textarea>`,
+	`<title><script>alert(1)</script></title>`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`,
+	`<xmp><img src=x onerror=alert(1)></xmp>`,
+	`<p><a href="http://a.acme"><a href="javascript:alert(1)">nested</a></a></p>`,
+	`<</p>script>alert(1)<</p>/script>`,
+	`<scr` + "\x00" + `ipt>alert(1)</script>`,
+	`"><script>alert(1)</script>`,
+	`'><img src=x onerror=alert(1)>`,
+	`http://a.acme/"><script>alert(1)</script>`,
+	`http://a.acme/' onmouseover='alert(1)`,
+	`http://a.acme/<img/src/onerror=alert(1)>`,
+	`javascript:alert(1)`,
+	`*<img src=x onerror=alert(1)>*`,
+	"  <script>alert(1)</script>",
+	`</code></pre><script>alert(1)</script>`,
+	`<pre><code><script>alert(1)</script></code></pre>`,
+	`<p><i><unclosed`,
+	`<a href="http://a.acme">unclosed`,
+}
+
+// expectSafeHTML fails if the html contains an element, an attribute or a link that is not allowed
+func expectSafeHTML(t *testing.T, input, output string) {
+	tokenizer := html.NewTokenizer(strings.NewReader(output))
+	depth := map[string]int{}
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.StartTagToken:
+			depth[token.Data]++
+			switch token.Data {
+			case "p", "i", "pre", "code":
+				if len(token.Attr) != 0 {
+					t.Errorf("%q : unexpected attributes in %q", input, output)
+				}
+			case "a":
+				if len(token.Attr) != 2 || token.Attr[0].Key != "href" || token.Attr[1].Key != "rel" || token.Attr[1].Val != "nofollow ugc" {
+					t.Errorf("%q : unexpected link attributes in %q", input, output)
+				} else if u, err := url.Parse(token.Attr[0].Val); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					t.Errorf("%q : unexpected href in %q", input, output)
+				}
+			default:
+				t.Errorf("%q : unexpected element %s in %q", input, token.Data, output)
+			}
+		case html.EndTagToken:
+			depth[token.Data]--
+		case html.SelfClosingTagToken, html.CommentToken, html.DoctypeToken:
+			t.Errorf("%q : unexpected token %s in %q", input, token, output)
+		}
+	}
+	for element, n := range depth {
+		if n != 0 {
+			t.Errorf("%q : unbalanced element %s in %q", input, element, output)
+		}
+	}
+	if strings.Contains(strings.ToLower(output), "<script") {
+		t.Errorf("%q : script in %q", input, output)
+	}
+}
+
+func TestRenderContent_XSS(t *testing.T) {
+	for _, payload := range xssCorpus {
+		expectSafeHTML(t, payload, string(gonews.RenderContent(payload)))
+		expectSafeHTML(t, payload, gonews.SanitizeHTML(payload))
+		// payloads embedded in a formatted content
+		content := "before\n\n" + payload + "\n\n  " + payload + "\n\n*" + payload + "* http://a.acme/" + payload
+		expectSafeHTML(t, content, string(gonews.RenderContent(content)))
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	for _, fixture := range []struct{ HTML, Expected string }{
+		{`<p>text</p>`, `<p>text</p>`},
+		{`<p class="x">a <b>b</b> <i>c</i></p>`, `<p>a b <i>c</i></p>`},
+		{`<script>alert(1)</script>text`, `text`},
+		{`<a href="https://a.acme/?q=1&amp;r=2" onclick="x">link</a>`, `<a href="https://a.acme/?q=1&amp;r=2" rel="nofollow ugc">link</a>`},
+		{`<a href="javascript:alert(1)">link</a>`, `link`},
+		{`<p><i>unclosed`, `<p><i>unclosed</i></p>`},
+		{`text</p></i>`, `text`},
+		{`<img src=x onerror=alert(1)>&lt;`, `&lt;`},
+	} {
+		Expect(t, gonews.SanitizeHTML(fixture.HTML), fixture.Expected, fmt.Sprintf("SanitizeHTML(%q)", fixture.HTML))
+	}
+}
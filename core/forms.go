@@ -102,9 +102,11 @@ type LoginForm struct {
 	CSRF     string `schema:"login_csrf"`
 	Username string `schema:"login_username"`
 	Password string `schema:"login_password"`
-	Submit   string `schema:"login_submit"`
-	Errors   map[string][]string
-	model    *User
+	// RememberMe keeps the user logged in across sessions
+	RememberMe bool   `schema:"login_remember_me"`
+	Submit     string `schema:"login_submit"`
+	Errors     map[string][]string
+	model      *User
 }
 
 // HandleRequest deserialize the request body into a form struct
@@ -130,9 +132,11 @@ type SubmissionForm struct {
 	Title   string `schema:"submission_title"`
 	URL     string `schema:"submission_url"`
 	Content string `schema:"submission_content"`
-	Submit  string `schema:"submission_submit"`
-	Errors  map[string][]string
-	model   *Thread
+	// Job is set by administrators to post a job
+	Job    bool   `schema:"submission_job"`
+	Submit string `schema:"submission_submit"`
+	Errors map[string][]string
+	model  *Thread
 }
 
 // HandleRequest deserialize the request body into a form struct
@@ -158,6 +162,10 @@ func (form *SubmissionForm) Model() *Thread {
 		form.model.Title = form.Title
 		form.model.Content = form.Content
 		form.model.URL = form.URL
+		form.model.Type = DetectStoryType(form.Title)
+		if form.Job {
+			form.model.Type = StoryTypeJob
+		}
 	}
 	return form.model
 }
@@ -0,0 +1,132 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mparaiso/gonews/migrations"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// Readiness tells whether the application should receive traffic,
+// it is shared by all containers and turned off during a graceful shutdown
+type Readiness struct {
+	shuttingDown int32
+}
+
+// SetShuttingDown marks the application as not ready
+func (readiness *Readiness) SetShuttingDown() {
+	if readiness != nil {
+		atomic.StoreInt32(&readiness.shuttingDown, 1)
+	}
+}
+
+// IsShuttingDown returns true once SetShuttingDown has been called
+func (readiness *Readiness) IsShuttingDown() bool {
+	return readiness != nil && atomic.LoadInt32(&readiness.shuttingDown) == 1
+}
+
+// HealthController reports that the process is alive
+func HealthController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	writeHealth(rw, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// ReadinessController reports whether the application can serve requests :
+// the database answers, templates compile and migrations are up to date
+func ReadinessController(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	checks := map[string]string{}
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			ready = false
+			checks[name] = err.Error()
+		} else {
+			checks[name] = "ok"
+		}
+	}
+	if c.GetOptions().Readiness.IsShuttingDown() {
+		check("shutdown", fmt.Errorf("shutting down"))
+	}
+	check("database", checkDatabase(c))
+	_, err := c.GetTemplate()
+	check("templates", err)
+	check("migrations", checkMigrations(c))
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	writeHealth(rw, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+func checkDatabase(c *Container) error {
+	db, err := c.GetConnection()
+	if err != nil {
+		return err
+	}
+	if err = db.PingContext(c.Request().Context()); err != nil {
+		return err
+	}
+	var count int
+	return db.QueryRowContext(c.Request().Context(), "SELECT COUNT(*) FROM (SELECT ID FROM threads_view LIMIT 1);").Scan(&count)
+}
+
+// checkMigrations returns an error if a migration has not been applied
+func checkMigrations(c *Container) error {
+	db, err := c.GetConnection()
+	if err != nil {
+		return err
+	}
+	source, err := migrations.Source(c.GetOptions().Driver)
+	if err != nil {
+		return err
+	}
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+	records, err := sqlmigrate.GetMigrationRecords(db, c.GetOptions().Driver)
+	if err != nil {
+		return err
+	}
+	applied := map[string]bool{}
+	for _, record := range records {
+		applied[record.Id] = true
+	}
+	pending := 0
+	for _, migration := range all {
+		if !applied[migration.Id] {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d pending migrations", pending)
+	}
+	return nil
+}
+
+func writeHealth(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(body)
+}
@@ -0,0 +1,68 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/mparaiso/gonews/core"
+)
+
+// Scenario: PROBING THE APPLICATION
+// Given a server
+// When /healthz is requested
+// It should respond with status 200
+// When /readyz is requested
+// It should respond with status 200 and all checks should be ok
+// When the server is shutting down
+// /readyz should respond with status 503
+func TestHealthAndReadiness(t *testing.T) {
+	db := GetDB(t)
+	options := GetContainerOptions(db)
+	options.Readiness = &gonews.Readiness{}
+	server := GetServerWithOptions(t, db, options)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + gonews.Route{}.Health())
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusOK)
+
+	readiness := func() (int, map[string]interface{}) {
+		response, err := http.Get(server.URL + gonews.Route{}.Readiness())
+		Expect(t, err, nil)
+		defer response.Body.Close()
+		body := map[string]interface{}{}
+		Expect(t, json.NewDecoder(response.Body).Decode(&body), nil)
+		return response.StatusCode, body
+	}
+	status, body := readiness()
+	Expect(t, status, http.StatusOK, fmt.Sprint(body))
+	checks := body["checks"].(map[string]interface{})
+	for _, check := range []string{"database", "templates", "migrations"} {
+		Expect(t, checks[check], "ok", check)
+	}
+
+	options.Readiness.SetShuttingDown()
+	status, body = readiness()
+	Expect(t, status, http.StatusServiceUnavailable)
+	Expect(t, body["status"], "not ready")
+}
@@ -22,3 +22,8 @@ type UserFinder interface {
 	GetOneByEmail(string) (*User, error)
 	GetOneByUsername(string) (*User, error)
 }
+
+// DomainRuleMatcher finds the rule applying to an url
+type DomainRuleMatcher interface {
+	Match(url string) (*DomainRule, error)
+}
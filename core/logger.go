@@ -18,9 +18,14 @@
 package gonews
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
-	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +35,11 @@ type LoggerInterface interface {
 	Info(messages ...interface{})
 	Error(messages ...interface{})
 	ErrorWithStack(messages ...interface{})
+	// Log logs a message followed by key/value pairs :
+	// logger.Log(INFO, "user created", "id", user.ID)
+	Log(level LogLevel, message string, fields ...interface{})
+	// With returns a logger that adds the key/value pairs to each record
+	With(fields ...interface{}) LoggerInterface
 }
 
 const time_format = "2006-01-02 15:04:05"
@@ -47,51 +57,222 @@ const (
 	OFF
 )
 
-// Logger is a logger
+// String returns the name of the level
+func (level LogLevel) String() string {
+	switch level {
+	case ALL:
+		return "all"
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case WARN:
+		return "warn"
+	case ERROR:
+		return "error"
+	case FATAL:
+		return "fatal"
+	case OFF:
+		return "off"
+	}
+	return strconv.Itoa(int(level))
+}
+
+// LogFormat is the format of the log records
+type LogFormat string
+
+const (
+	// LogFormatText writes human readable records
+	LogFormatText LogFormat = "text"
+	// LogFormatJSON writes one JSON object per line
+	LogFormatJSON LogFormat = "json"
+	// LogFormatLogfmt writes one line of key=value pairs per record
+	LogFormatLogfmt LogFormat = "logfmt"
+)
+
+// Logger is a leveled logger writing records in a LogFormat
 type Logger struct {
-	*log.Logger
-	level LogLevel
+	out    io.Writer
+	mutex  *sync.Mutex
+	level  LogLevel
+	format LogFormat
+	fields []interface{}
 }
 
-// NewDefaultLogger returns a logger using the default log package
+// NewDefaultLogger returns a text logger writing to the standard output
 func NewDefaultLogger(level LogLevel) *Logger {
-	return &Logger{log.New(os.Stdout, "", 0), level}
+	logger, _ := NewLogger(os.Stdout, level, LogFormatText)
+	return logger
+}
+
+// NewLogger returns a logger writing to out, format defaults to text
+func NewLogger(out io.Writer, level LogLevel, format LogFormat) (*Logger, error) {
+	switch format {
+	case "":
+		format = LogFormatText
+	case LogFormatText, LogFormatJSON, LogFormatLogfmt:
+	default:
+		return nil, fmt.Errorf("not a valid log format : '%s'", format)
+	}
+	return &Logger{out: out, mutex: new(sync.Mutex), level: level, format: format}, nil
 }
 
 func (l *Logger) SetLevel(level LogLevel) {
 	l.level = level
 }
 
+// With returns a copy of the logger with additional fields
+func (l *Logger) With(fields ...interface{}) LoggerInterface {
+	logger := *l
+	logger.fields = append(append([]interface{}{}, l.fields...), fields...)
+	return &logger
+}
+
 // Debug logs a debugging message
 func (l *Logger) Debug(messages ...interface{}) {
-	if l.level <= DEBUG {
-		l.Logger.Print(append([]interface{}{"\r[DEBUG] ", time.Now().Format(time_format), "\n\t"}, messages...)...)
-	}
+	l.Log(DEBUG, fmt.Sprint(messages...))
 }
 
 // Info logs an info message
 func (l *Logger) Info(messages ...interface{}) {
-	if l.level <= INFO {
-		l.Logger.Print(append([]interface{}{"\r[INFO] ", time.Now().Format(time_format), "\n\t"}, messages...)...)
-	}
+	l.Log(INFO, fmt.Sprint(messages...))
 }
 
 // Error logs an error message
 func (l *Logger) Error(messages ...interface{}) {
-	if l.level <= ERROR {
-		l.Logger.Print(append([]interface{}{"\r[ERROR] ", time.Now().Format(time_format), "\t"}, messages...)...)
+	l.Log(ERROR, fmt.Sprint(messages...))
+}
+
+// ErrorWithStack logs an error message with the stack trace of the current goroutine
+func (l *Logger) ErrorWithStack(messages ...interface{}) {
+	l.Log(ERROR, fmt.Sprint(messages...), "stack", string(debug.Stack()))
+}
+
+// Log writes a record if level is enabled
+func (l *Logger) Log(level LogLevel, message string, fields ...interface{}) {
+	if level < l.level || l.level == OFF {
+		return
+	}
+	fields = append(append([]interface{}{}, l.fields...), fields...)
+	var record string
+	switch l.format {
+	case LogFormatJSON:
+		record = l.formatJSON(level, message, fields)
+	case LogFormatLogfmt:
+		record = l.formatLogfmt(level, message, fields)
+	default:
+		record = l.formatText(level, message, fields)
 	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.out, record)
+}
 
+func (l *Logger) formatText(level LogLevel, message string, fields []interface{}) string {
+	var stack string
+	buffer := &strings.Builder{}
+	fmt.Fprintf(buffer, "\r[%s] %s\n\t%s", strings.ToUpper(level.String()), time.Now().Format(time_format), message)
+	eachField(fields, func(key string, value interface{}) {
+		if key == "stack" {
+			stack = fmt.Sprint(value)
+			return
+		}
+		fmt.Fprintf(buffer, " %s=%s", key, logfmtValue(value))
+	})
+	buffer.WriteString("\n")
+	if stack != "" {
+		buffer.WriteString(stack)
+	}
+	return buffer.String()
 }
 
-// ErrorWithStack displays a stack trace
-func (l *Logger) ErrorWithStack(messages ...interface{}) {
-	if l.level <= ERROR {
-		l.Error(messages...)
-		// @see http://stackoverflow.com/questions/19094099/how-to-dump-goroutine-stacktraces/19712747#19712747
-		buffer := make([]byte, 1<<16)
-		runtime.Stack(buffer, false)
-		//print 6 lines max
-		l.Logger.Printf("\r[ERROR] %s \r\t%s", time.Now().Format(time_format), buffer)
+func (l *Logger) formatJSON(level LogLevel, message string, fields []interface{}) string {
+	buffer := &strings.Builder{}
+	write := func(key string, value interface{}) {
+		if buffer.Len() == 0 {
+			buffer.WriteString("{")
+		} else {
+			buffer.WriteString(",")
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(jsonValue(value))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buffer.Write(k)
+		buffer.WriteString(":")
+		buffer.Write(v)
+	}
+	write("time", time.Now().Format(time.RFC3339Nano))
+	write("level", level.String())
+	write("msg", message)
+	eachField(fields, write)
+	buffer.WriteString("}\n")
+	return buffer.String()
+}
+
+func (l *Logger) formatLogfmt(level LogLevel, message string, fields []interface{}) string {
+	buffer := &strings.Builder{}
+	write := func(key string, value interface{}) {
+		if buffer.Len() > 0 {
+			buffer.WriteString(" ")
+		}
+		buffer.WriteString(strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '=' || r == '"' {
+				return '_'
+			}
+			return r
+		}, key))
+		buffer.WriteString("=")
+		buffer.WriteString(logfmtValue(value))
+	}
+	write("time", time.Now().Format(time.RFC3339Nano))
+	write("level", level.String())
+	write("msg", message)
+	eachField(fields, write)
+	buffer.WriteString("\n")
+	return buffer.String()
+}
+
+// eachField calls callback for each key/value pair,
+// a missing value is logged as null
+func eachField(fields []interface{}, callback func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{}
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		callback(key, value)
+	}
+}
+
+// jsonValue converts errors and durations which do not marshal to readable JSON
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return value
+}
+
+// logfmtValue quotes values containing spaces, quotes, = or control characters
+func logfmtValue(value interface{}) string {
+	var s string
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		s = value
+	default:
+		s = fmt.Sprint(jsonValue(value))
+	}
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '=' || r == '"' || r == 0x7f }) != -1 {
+		return strconv.Quote(s)
 	}
+	return s
 }
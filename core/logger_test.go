@@ -0,0 +1,110 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mparaiso/gonews/core"
+)
+
+func TestLogger_JSON(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	logger, err := gonews.NewLogger(buffer, gonews.INFO, gonews.LogFormatJSON)
+	Expect(t, err, nil)
+	logger.With("request_id", "abc").Log(gonews.INFO, "request", "status", 200, "error", errors.New("boom"))
+	logger.Debug("filtered out")
+	record := map[string]interface{}{}
+	Expect(t, json.Unmarshal(buffer.Bytes(), &record), nil)
+	Expect(t, record["level"], "info")
+	Expect(t, record["msg"], "request")
+	Expect(t, record["request_id"], "abc")
+	Expect(t, record["status"], float64(200))
+	Expect(t, record["error"], "boom")
+}
+
+func TestLogger_Logfmt(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	logger, err := gonews.NewLogger(buffer, gonews.ALL, gonews.LogFormatLogfmt)
+	Expect(t, err, nil)
+	logger.Log(gonews.DEBUG, "user created", "username", "john doe", "id", 1)
+	line := buffer.String()
+	Expect(t, strings.Contains(line, ` level=debug msg="user created" username="john doe" id=1`+"\n"), true, line)
+	_, err = gonews.NewLogger(buffer, gonews.ALL, "xml")
+	Expect(t, err != nil, true)
+}
+
+// Scenario: IDENTIFYING A REQUEST
+// Given a server logging JSON records
+// When a request is sent with a X-Request-ID header
+// The request id should be echoed in the response
+// The request id should be added to the log records of the request
+// When a request is sent without X-Request-ID
+// A request id should be generated
+func TestRequestID(t *testing.T) {
+	buffer := &lockedBuffer{}
+	logger, err := gonews.NewLogger(buffer, gonews.INFO, gonews.LogFormatJSON)
+	Expect(t, err, nil)
+	db := GetDB(t)
+	options := GetContainerOptions(db)
+	options.LoggerFactory = func() (gonews.LoggerInterface, error) { return logger, nil }
+	server := GetServerWithOptions(t, db, options)
+	defer server.Close()
+
+	request, err := http.NewRequest("GET", server.URL+gonews.Route{}.NewStories(), nil)
+	Expect(t, err, nil)
+	request.Header.Set("X-Request-ID", "test-request-1")
+	response, err := http.DefaultClient.Do(request)
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.Header.Get("X-Request-ID"), "test-request-1")
+	record := map[string]interface{}{}
+	Expect(t, json.Unmarshal([]byte(buffer.String()), &record), nil, buffer.String())
+	Expect(t, record["request_id"], "test-request-1")
+	Expect(t, record["status"], float64(200))
+
+	request.Header.Set("X-Request-ID", "not a valid id")
+	response, err = http.DefaultClient.Do(request)
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, len(response.Header.Get("X-Request-ID")), 32)
+}
+
+// lockedBuffer is a buffer safe for concurrent use
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (buffer *lockedBuffer) Write(p []byte) (int, error) {
+	buffer.Lock()
+	defer buffer.Unlock()
+	return buffer.Buffer.Write(p)
+}
+
+func (buffer *lockedBuffer) String() string {
+	buffer.Lock()
+	defer buffer.Unlock()
+	return buffer.Buffer.String()
+}
@@ -0,0 +1,212 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// MailOptions configures the emails sent by the application
+type MailOptions struct {
+	// SMTPAddr is the host:port of the SMTP server, emails are only logged if empty
+	SMTPAddr,
+	SMTPUsername,
+	SMTPPassword,
+	From string
+	// SMTPTimeout bounds the time spent sending an email
+	SMTPTimeout time.Duration
+	// BaseURL is the public URL of the site, links in emails are built from it
+	BaseURL string
+	// QueueSize is the number of emails waiting to be sent above which
+	// notification emails are dropped
+	QueueSize int
+	// MailerFactory creates the mailer, if nil the mailer is created
+	// according to SMTPAddr
+	MailerFactory func() (Mailer, error) `yaml:"-"`
+	// Queue sends the emails of all containers in the background,
+	// the server drains it on shutdown
+	Queue *MailQueue `yaml:"-"`
+}
+
+// SMTPMailer sends plain text emails through an SMTP server,
+// with STARTTLS if the server supports it and PLAIN authentication if a username is set.
+// Sending an email fails after Timeout if Timeout is positive
+type SMTPMailer struct {
+	Addr, Username, Password, From string
+	Timeout                        time.Duration
+}
+
+// Send sends an email
+func (mailer *SMTPMailer) Send(to, subject, body string) error {
+	host, _, err := net.SplitHostPort(mailer.Addr)
+	if err != nil {
+		return err
+	}
+	connection, err := net.DialTimeout("tcp", mailer.Addr, mailer.Timeout)
+	if err != nil {
+		return err
+	}
+	if mailer.Timeout > 0 {
+		if err = connection.SetDeadline(time.Now().Add(mailer.Timeout)); err != nil {
+			connection.Close()
+			return err
+		}
+	}
+	client, err := smtp.NewClient(connection, host)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if mailer.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", mailer.Username, mailer.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(mailer.From); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(FormatMail(mailer.From, to, subject, body)); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// FormatMail returns a plain text email with its headers
+func FormatMail(from, to, subject, body string) []byte {
+	// header values must not contain line breaks
+	clean := strings.NewReplacer("\r", "", "\n", " ")
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		clean.Replace(from), clean.Replace(to), clean.Replace(subject), time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(body, "\n", "\r\n")))
+}
+
+// LogMailer logs emails instead of sending them, it is used
+// when no SMTP server is configured
+type LogMailer struct {
+	Logger LoggerInterface
+}
+
+// Send logs an email
+func (mailer *LogMailer) Send(to, subject, body string) error {
+	mailer.Logger.Info(fmt.Sprintf("mail to %s : %s", to, subject))
+	return nil
+}
+
+// ErrMailQueueFull is returned when an email is pushed to a full mail queue
+var ErrMailQueueFull = errors.New("the mail queue is full")
+
+// ErrMailQueueClosed is returned when an email is pushed to a closed mail queue
+var ErrMailQueueClosed = errors.New("the mail queue is closed")
+
+// MailQueue sends emails one at a time in the background. Pushing an email
+// to a full queue fails instead of blocking, Close waits for the queued emails
+type MailQueue struct {
+	emails  chan queuedMail
+	stopped chan struct{}
+	mutex   sync.RWMutex
+	closed  bool
+}
+
+type queuedMail struct {
+	mailer            Mailer
+	to, subject, body string
+	done              func(error)
+}
+
+// NewMailQueue returns a running mail queue holding at most size emails
+func NewMailQueue(size int) *MailQueue {
+	queue := &MailQueue{emails: make(chan queuedMail, size), stopped: make(chan struct{})}
+	go queue.work()
+	return queue
+}
+
+func (queue *MailQueue) work() {
+	defer close(queue.stopped)
+	for mail := range queue.emails {
+		mail.done(mail.mailer.Send(mail.to, mail.subject, mail.body))
+	}
+}
+
+// Push queues an email sent by mailer, done is called with the result of the sending.
+// A nil queue sends the email right away
+func (queue *MailQueue) Push(mailer Mailer, to, subject, body string, done func(error)) error {
+	if queue == nil {
+		done(mailer.Send(to, subject, body))
+		return nil
+	}
+	queue.mutex.RLock()
+	defer queue.mutex.RUnlock()
+	if queue.closed {
+		return ErrMailQueueClosed
+	}
+	select {
+	case queue.emails <- queuedMail{mailer, to, subject, body, done}:
+		return nil
+	default:
+		return ErrMailQueueFull
+	}
+}
+
+// Close stops accepting emails and waits until the queued emails
+// are sent or ctx is done
+func (queue *MailQueue) Close(ctx context.Context) error {
+	if queue == nil {
+		return nil
+	}
+	queue.mutex.Lock()
+	if !queue.closed {
+		queue.closed = true
+		close(queue.emails)
+	}
+	queue.mutex.Unlock()
+	select {
+	case <-queue.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued emails were not sent : %w", len(queue.emails), ctx.Err())
+	}
+}
@@ -0,0 +1,96 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+func TestSMTPMailer_Timeout(t *testing.T) {
+	// a server that accepts connections and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(t, err, nil)
+	defer listener.Close()
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer connection.Close()
+		}
+	}()
+	mailer := &gonews.SMTPMailer{Addr: listener.Addr().String(), From: "gonews@localhost", Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if err := mailer.Send("jane.doe@gonews.acme", "subject", "body"); err == nil {
+		t.Fatal("sending an email to a server that doesn't answer should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("sending an email should give up after the timeout, took %s", elapsed)
+	}
+}
+
+// slowMailer waits for a value on release before sending each email
+type slowMailer struct {
+	release chan struct{}
+	sent    chan string
+}
+
+func (mailer slowMailer) Send(to, subject, body string) error {
+	<-mailer.release
+	mailer.sent <- to
+	return nil
+}
+
+func TestMailQueue(t *testing.T) {
+	mailer := slowMailer{make(chan struct{}), make(chan string, 3)}
+	queue := gonews.NewMailQueue(1)
+	results := make(chan error, 3)
+	done := func(err error) { results <- err }
+	// the first email is being sent while the second one waits in the queue
+	Expect(t, queue.Push(mailer, "first@gonews.acme", "subject", "body", done), nil)
+	mailer.release <- struct{}{}
+	Expect(t, <-mailer.sent, "first@gonews.acme", "first email")
+	Expect(t, <-results, nil, "result of the first email")
+	Expect(t, queue.Push(mailer, "second@gonews.acme", "subject", "body", done), nil)
+	time.Sleep(50 * time.Millisecond)
+	Expect(t, queue.Push(mailer, "third@gonews.acme", "subject", "body", done), nil)
+	Expect(t, queue.Push(mailer, "fourth@gonews.acme", "subject", "body", done), gonews.ErrMailQueueFull)
+
+	// Close gives up at the end of its context and keeps refusing emails
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.Close(ctx); err == nil {
+		t.Fatal("Close should fail when the queued emails are not sent in time")
+	}
+	Expect(t, queue.Push(mailer, "fifth@gonews.acme", "subject", "body", done), gonews.ErrMailQueueClosed)
+
+	// Close waits for the queued emails
+	go func() {
+		mailer.release <- struct{}{}
+		mailer.release <- struct{}{}
+	}()
+	Expect(t, queue.Close(context.Background()), nil)
+	Expect(t, <-mailer.sent, "second@gonews.acme", "second email")
+	Expect(t, <-mailer.sent, "third@gonews.acme", "third email")
+}
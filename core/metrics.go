@@ -0,0 +1,301 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects counters, gauges and histograms and writes
+// them in the prometheus text format.
+// @see https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// All methods can be called on a nil *Metrics, which does nothing,
+// so components work without metrics (i.e. in tests)
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+	db       *sql.DB
+}
+
+type metricFamily struct {
+	name, help, kind string
+	buckets          []float64
+	series           map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string
+	value  float64
+	// histogram only
+	counts []uint64
+	count  uint64
+}
+
+// NewMetrics returns the metrics of the application
+func NewMetrics() *Metrics {
+	metrics := &Metrics{families: map[string]*metricFamily{}}
+	for _, family := range []metricFamily{
+		{name: "gonews_http_requests_total", help: "Number of HTTP requests by route, method and status", kind: "counter"},
+		{name: "gonews_http_request_duration_seconds", help: "HTTP request latency by route", kind: "histogram"},
+		{name: "gonews_db_query_duration_seconds", help: "Repository query latency by query", kind: "histogram"},
+		{name: "gonews_db_query_errors_total", help: "Number of failed repository queries by query", kind: "counter"},
+		{name: "gonews_template_render_duration_seconds", help: "Template rendering time by template", kind: "histogram"},
+		{name: "gonews_registrations_total", help: "Number of user registrations", kind: "counter"},
+		{name: "gonews_stories_total", help: "Number of submitted stories", kind: "counter"},
+		{name: "gonews_comments_total", help: "Number of submitted comments", kind: "counter"},
+		{name: "gonews_votes_total", help: "Number of votes by kind", kind: "counter"},
+		{name: "gonews_suspicious_votes", help: "Number of votes down-weighted by the last vote analysis by kind", kind: "gauge"},
+		{name: "gonews_db_open_connections", help: "Number of established database connections", kind: "gauge"},
+		{name: "gonews_db_in_use_connections", help: "Number of database connections in use", kind: "gauge"},
+		{name: "gonews_db_idle_connections", help: "Number of idle database connections", kind: "gauge"},
+		{name: "gonews_db_max_open_connections", help: "Maximum number of open database connections", kind: "gauge"},
+		{name: "gonews_db_wait_count_total", help: "Number of connections waited for", kind: "counter"},
+		{name: "gonews_db_wait_duration_seconds_total", help: "Time spent waiting for a connection", kind: "counter"},
+	} {
+		family := family
+		if family.kind == "histogram" {
+			family.buckets = DefaultBuckets
+		}
+		family.series = map[string]*metricSeries{}
+		metrics.families[family.name] = &family
+	}
+	return metrics
+}
+
+// SetDB sets the database which connection pool statistics are exported
+func (metrics *Metrics) SetDB(db *sql.DB) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.db = db
+}
+
+// Add adds value to a counter, labels are name/value pairs
+func (metrics *Metrics) Add(name string, value float64, labels ...string) {
+	metrics.update(name, labels, func(family *metricFamily, series *metricSeries) {
+		series.value += value
+	})
+}
+
+// Set sets the value of a gauge
+func (metrics *Metrics) Set(name string, value float64, labels ...string) {
+	metrics.update(name, labels, func(family *metricFamily, series *metricSeries) {
+		series.value = value
+	})
+}
+
+// Observe adds a value to a histogram
+func (metrics *Metrics) Observe(name string, value float64, labels ...string) {
+	metrics.update(name, labels, func(family *metricFamily, series *metricSeries) {
+		if series.counts == nil {
+			series.counts = make([]uint64, len(family.buckets))
+		}
+		for i, bound := range family.buckets {
+			if value <= bound {
+				series.counts[i]++
+			}
+		}
+		series.count++
+		series.value += value
+	})
+}
+
+// ObserveSince adds the seconds elapsed since start to a histogram
+func (metrics *Metrics) ObserveSince(name string, start time.Time, labels ...string) {
+	metrics.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// ObserveQuery records the duration of a repository query and
+// counts it as an error if *err is not nil, it is meant to be deferred :
+//
+//	defer repository.Metrics.ObserveQuery("UserRepository.Save", time.Now(), &err)
+func (metrics *Metrics) ObserveQuery(query string, start time.Time, err *error) {
+	metrics.ObserveSince("gonews_db_query_duration_seconds", start, "query", query)
+	if err != nil && *err != nil && *err != sql.ErrNoRows {
+		metrics.Add("gonews_db_query_errors_total", 1, "query", query)
+	}
+}
+
+func (metrics *Metrics) update(name string, labels []string, update func(*metricFamily, *metricSeries)) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	family, ok := metrics.families[name]
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not registered", name))
+	}
+	key := formatLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labels: key}
+		family.series[key] = series
+	}
+	update(family, series)
+}
+
+// WriteTo writes all metrics in the prometheus text format
+func (metrics *Metrics) WriteTo(writer io.Writer) (int64, error) {
+	if metrics == nil {
+		return 0, nil
+	}
+	metrics.collectDBStats()
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	buffer := &strings.Builder{}
+	names := make([]string, 0, len(metrics.families))
+	for name := range metrics.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := metrics.families[name]
+		fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		if len(family.series) == 0 && family.kind != "histogram" {
+			fmt.Fprintf(buffer, "%s 0\n", family.name)
+		}
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(buffer, "%s%s %s\n", family.name, braces(series.labels), formatFloat(series.value))
+				continue
+			}
+			for i, bound := range family.buckets {
+				fmt.Fprintf(buffer, "%s_bucket%s %d\n", family.name,
+					braces(joinLabels(series.labels, `le="`+formatFloat(bound)+`"`)), series.counts[i])
+			}
+			fmt.Fprintf(buffer, "%s_bucket%s %d\n", family.name, braces(joinLabels(series.labels, `le="+Inf"`)), series.count)
+			fmt.Fprintf(buffer, "%s_sum%s %s\n", family.name, braces(series.labels), formatFloat(series.value))
+			fmt.Fprintf(buffer, "%s_count%s %d\n", family.name, braces(series.labels), series.count)
+		}
+	}
+	n, err := io.WriteString(writer, buffer.String())
+	return int64(n), err
+}
+
+func (metrics *Metrics) collectDBStats() {
+	metrics.mutex.Lock()
+	db := metrics.db
+	metrics.mutex.Unlock()
+	if db == nil {
+		return
+	}
+	stats := db.Stats()
+	metrics.Set("gonews_db_open_connections", float64(stats.OpenConnections))
+	metrics.Set("gonews_db_in_use_connections", float64(stats.InUse))
+	metrics.Set("gonews_db_idle_connections", float64(stats.Idle))
+	metrics.Set("gonews_db_max_open_connections", float64(stats.MaxOpenConnections))
+	metrics.Set("gonews_db_wait_count_total", float64(stats.WaitCount))
+	metrics.Set("gonews_db_wait_duration_seconds_total", stats.WaitDuration.Seconds())
+}
+
+// MetricsHandler serves the metrics, if token is not empty
+// requests must have a "Authorization: Bearer <token>" header
+func MetricsHandler(metrics *Metrics, token string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			expected := []byte("Bearer " + token)
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(rw)
+	})
+}
+
+// MetricsMiddleware counts requests and measures their latency
+// by route name and status
+func MetricsMiddleware(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	start := time.Now()
+	next()
+	route := c.GetRoutes().Name(r.URL.Path)
+	status := c.ResponseWriter().Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	metrics := c.GetOptions().Metrics
+	metrics.Add("gonews_http_requests_total", 1, "route", route, "method", methodLabel(r.Method), "status", strconv.Itoa(status))
+	metrics.ObserveSince("gonews_http_request_duration_seconds", start, "route", route)
+}
+
+// methodLabel returns the standard http methods as is and "other" for any other
+// method, so that clients can't create new series
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// formatLabels formats name/value pairs as name="value",...
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(labels[i+1])
+		pairs = append(pairs, labels[i]+`="`+value+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
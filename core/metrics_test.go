@@ -0,0 +1,83 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mparaiso/gonews/core"
+)
+
+// Scenario: READING THE METRICS
+// Given a server with a metrics token
+// When the index is requested
+// And /metrics is requested without the token
+// It should respond with status 401
+// When /metrics is requested with the token
+// It should expose the request count, latency, queries and templates metrics
+func TestMetrics(t *testing.T) {
+	db := GetDB(t)
+	options := GetContainerOptions(db)
+	options.MetricsToken = "a-metrics-token"
+	server := GetServerWithOptions(t, db, options)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + gonews.Route{}.StoriesByScore())
+	Expect(t, err, nil)
+	response.Body.Close()
+	request, err := http.NewRequest("MADEUP", server.URL+gonews.Route{}.StoriesByScore(), nil)
+	Expect(t, err, nil)
+	response, err = http.DefaultClient.Do(request)
+	Expect(t, err, nil)
+	response.Body.Close()
+
+	response, err = http.Get(server.URL + gonews.Route{}.Metrics())
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusUnauthorized)
+
+	request, err = http.NewRequest("GET", server.URL+gonews.Route{}.Metrics(), nil)
+	Expect(t, err, nil)
+	request.Header.Set("Authorization", "Bearer a-metrics-token")
+	response, err = http.DefaultClient.Do(request)
+	Expect(t, err, nil)
+	defer response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusOK)
+	body, err := ioutil.ReadAll(response.Body)
+	Expect(t, err, nil)
+	for _, line := range []string{
+		`gonews_http_requests_total{route="StoriesByScore",method="GET",status="200"} 1`,
+		`gonews_http_requests_total{route="StoriesByScore",method="other",status="200"} 1`,
+		`gonews_http_request_duration_seconds_count{route="StoriesByScore"} 2`,
+		`gonews_db_query_duration_seconds_count{query="ThreadRepository.GetSortedByScore"} 2`,
+		`gonews_template_render_duration_seconds_count{template="thread_list.tpl.html"} 2`,
+		`# TYPE gonews_db_open_connections gauge`,
+	} {
+		Expect(t, strings.Contains(string(body), line), true, line)
+	}
+	Expect(t, strings.Contains(string(body), "MADEUP"), false, "method label of an unknown method")
+}
+
+func TestRoute_Name(t *testing.T) {
+	Expect(t, gonews.Route{}.Name("/newest"), "NewStories")
+	Expect(t, gonews.Route{}.Name("/public/css/main.css"), "Public")
+	Expect(t, gonews.Route{}.Name("/unknown"), "NotFound")
+}
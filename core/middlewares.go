@@ -19,11 +19,13 @@ package gonews
 
 import (
 	"bytes"
-
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"regexp"
 	"time"
 
 	"github.com/gorilla/context"
@@ -41,15 +43,33 @@ func AuthenticatedUserOnlyMiddleware(c *Container, rw http.ResponseWriter, r *ht
 	next()
 }
 
-// RefreshUserMiddleware keeps the application aware of the current user but does not authenticate or authorize
+// AdministratorOnlyMiddleware filters out users who are not administrators,
+// it expects an authenticated user
+func AdministratorOnlyMiddleware(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	if user := c.CurrentUser(); user == nil || !user.IsAdministrator() {
+		c.HTTPError(rw, r, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+	next()
+}
+
+// RefreshUserMiddleware keeps the application aware of the current user but does not authenticate or authorize,
+// users without session but with a "remember me" cookie are logged in again
 func RefreshUserMiddleware(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
 	session := c.MustGetSession()
 
-	if session.Has("user.ID") {
+	if !session.Has("user.ID") {
+		user, err := LoginWithRememberToken(c)
+		if err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		c.SetCurrentUser(user)
+	} else {
 		userID := c.MustGetSession().Get("user.ID").(int64)
 		user, err := c.MustGetUserRepository().GetByID(userID)
 		if err == nil {
-			if user != nil {
+			if user != nil && !user.Banned {
 				c.SetCurrentUser(user)
 			} else {
 				session.Delete("user.ID")
@@ -59,8 +79,6 @@ func RefreshUserMiddleware(c *Container, rw http.ResponseWriter, r *http.Request
 			c.HTTPError(rw, r, 500, err)
 			return
 		}
-	} else {
-		c.SetCurrentUser(nil)
 	}
 	next()
 
@@ -116,6 +134,27 @@ func SessionMiddleware(c *Container, rw http.ResponseWriter, r *http.Request, ne
 	next()
 }
 
+// requestIDPattern restricts client provided request ids to safe characters
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+// RequestIDMiddleware identifies each request, the id is taken from the X-Request-ID
+// header when valid or generated, echoed in the response and added to every log record
+func RequestIDMiddleware(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
+	id := r.Header.Get("X-Request-ID")
+	if !requestIDPattern.MatchString(id) {
+		buffer := make([]byte, 16)
+		if _, err := rand.Read(buffer); err != nil {
+			c.HTTPError(rw, r, 500, err)
+			return
+		}
+		id = hex.EncodeToString(buffer)
+	}
+	c.SetRequestID(id)
+	rw.Header().Set("X-Request-ID", id)
+	c.SetLogger(c.MustGetLogger().With("request_id", id))
+	next()
+}
+
 // StopWatchMiddleware logs the request duration
 func StopWatchMiddleware(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
 	start := time.Now()
@@ -125,40 +164,35 @@ func StopWatchMiddleware(c *Container, rw http.ResponseWriter, r *http.Request,
 	c.MustGetLogger().Debug(fmt.Sprintf("Request executed in %s", duration))
 }
 
-// LoggerMiddleware log each request using
-// comman log format
+// LoggerMiddleware logs each request with the fields
+// of the combined log format and the request duration
+// @see http://httpd.apache.org/docs/1.3/logs.html#combined
 func LoggerMiddleware(c *Container, rw http.ResponseWriter, r *http.Request, next func()) {
 	rw.(ResponseWriterExtra).SetLogger(c.MustGetLogger())
 	start := time.Now()
 	next()
 
-	// @see https://en.wikipedia.org/wiki/Common_Log_Format for log format
-	// @see http://httpd.apache.org/docs/1.3/logs.html#combined
-	c.MustGetLogger().Info(
-		fmt.Sprintf("%s %s %s [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"",
-			r.RemoteAddr,
-			func() string {
-				if c.CurrentUser() != nil {
-					return fmt.Sprintf("%d", c.CurrentUser().ID)
-				}
-				return "-"
-			}(),
-			func() string {
-				if c.CurrentUser() != nil {
-					return c.CurrentUser().Username
-				}
-				return "-"
-			}(),
-			start.Format("Jan/02/2006:15:04:05 -0700 MST"),
-			r.Method,
-			r.RequestURI,
-			r.Proto,
-			c.ResponseWriter().Status(),
-			rw.(ResponseWriterExtra).GetCurrentSize(),
-			r.Referer(),
-			r.UserAgent(),
-		))
-
+	userID, username := "-", "-"
+	if c.CurrentUser() != nil {
+		userID, username = fmt.Sprintf("%d", c.CurrentUser().ID), c.CurrentUser().Username
+	}
+	status := c.ResponseWriter().Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	c.MustGetLogger().Log(INFO, "request",
+		"remote_addr", r.RemoteAddr,
+		"user_id", userID,
+		"username", username,
+		"method", r.Method,
+		"uri", r.RequestURI,
+		"proto", r.Proto,
+		"status", status,
+		"size", rw.(ResponseWriterExtra).GetCurrentSize(),
+		"referer", r.Referer(),
+		"user_agent", r.UserAgent(),
+		"duration", time.Since(start),
+	)
 }
 
 // NotFoundMiddleware handles 404 responses
@@ -18,6 +18,15 @@
 package gonews
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"net/url"
@@ -25,19 +34,53 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Roles of the application
+const (
+	RoleAdministrator = "administrator"
+	RoleModerator     = "moderator"
+)
+
 // User is a forum user
 type User struct {
 	ID       int64
 	Username string
-	Password string
+	Password string `json:"-"`
 	Email    string
+	Banned   bool
+	// every new item of a shadowbanned user is dead
+	Shadowbanned bool
+	// ShowDead lists dead items for the user
+	ShowDead bool
+	// EmailNotifications sends replies to the user by email
+	EmailNotifications bool
+	// PublicFavorites lists the favorites of the user to everyone
+	PublicFavorites bool
+	// Karma is the sum of the votes on the stories and comments of the user,
+	// kept up to date by the database
+	Karma int
 
 	Created time.Time
 	Updated time.Time
 	// Virtual
-	Karma int
-	ThreadVotes
-	CommentVotes
+	UnreadNotifications int
+	Roles               []string
+	ThreadVotes         `json:"-"`
+	CommentVotes        `json:"-"`
+}
+
+// HasRole returns true if the user has the role
+func (u *User) HasRole(role string) bool {
+	for _, name := range u.Roles {
+		if name == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdministrator returns true if the user is an administrator
+func (u *User) IsAdministrator() bool {
+	return u.HasRole(RoleAdministrator)
 }
 
 // CreateSecurePassword generates a secure password from a string
@@ -102,16 +145,209 @@ type Role struct {
 	Name string
 }
 
+// SessionRecord is a session persisted by SQLStore
+type SessionRecord struct {
+	// ID is the sha256 of the session cookie value
+	ID        string
+	UserID    int64
+	Data      []byte `json:"-"`
+	UserAgent string
+	IP        string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+}
+
+// Device returns a short description of the browser and the platform of the session
+func (record *SessionRecord) Device() string {
+	return DescribeUserAgent(record.UserAgent)
+}
+
+// RememberToken is a persistent login token
+type RememberToken struct {
+	ID            int64
+	Selector      string
+	ValidatorHash string
+	// PreviousValidatorHash is the hash of the validator before the last rotation
+	PreviousValidatorHash string
+	UserID                int64
+	Created               time.Time
+	LastUsed              time.Time
+	Expires               time.Time
+}
+
+// Notification tells a user about a reply to one of the user's comments
+// or a comment on one of the user's stories
+type Notification struct {
+	ID        int64
+	UserID    int64
+	CommentID int64
+	Read      bool
+	Created   time.Time
+	// virtual
+	Comment *Comment
+}
+
+// IsReply returns true if the notification is about a reply to a comment
+func (n *Notification) IsReply() bool {
+	return n.Comment != nil && n.Comment.ParentID != 0
+}
+
+// ModerationLogEntry is a moderation action recorded in the moderation log
+type ModerationLogEntry struct {
+	ID int64
+	// ActorID is 0 for actions of the command line
+	ActorID    int64
+	ActorName  string
+	TargetType string
+	TargetID   int64
+	Action     string
+	Reason     string
+	// Before and After are JSON snapshots of the target, empty if it did not exist
+	Before  string
+	After   string
+	Created time.Time
+}
+
+// NewModerationLogEntry returns an entry with the JSON snapshots of the target before and after an action
+func NewModerationLogEntry(actorID int64, actorName, action, targetType string, targetID int64, reason string, before, after interface{}) (*ModerationLogEntry, error) {
+	entry := &ModerationLogEntry{ActorID: actorID, ActorName: actorName, Action: action,
+		TargetType: targetType, TargetID: targetID, Reason: reason}
+	for _, snapshot := range []struct {
+		value       interface{}
+		destination *string
+	}{{before, &entry.Before}, {after, &entry.After}} {
+		if value := reflect.ValueOf(snapshot.value); !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+			continue
+		}
+		data, err := json.Marshal(snapshot.value)
+		if err != nil {
+			return nil, err
+		}
+		*snapshot.destination = string(data)
+	}
+	return entry, nil
+}
+
+// Target types of actions on users and domain rules,
+// actions on stories and comments use the kinds of flagged items
+const (
+	ModerationTargetUser       = "user"
+	ModerationTargetDomainRule = "domain"
+)
+
+// ModerationLogFilter filters the moderation log, zero values match every entry
+type ModerationLogFilter struct {
+	ActorName  string `schema:"actor"`
+	Action     string `schema:"action"`
+	TargetType string `schema:"type"`
+	TargetID   int64  `schema:"id"`
+}
+
+// Domain rules, from the strongest to the weakest
+const (
+	DomainRuleBanned    = "banned"
+	DomainRuleDead      = "dead"
+	DomainRulePenalized = "penalized"
+)
+
+// domainRuleStrength orders rules when several rules match an url
+var domainRuleStrength = map[string]int{DomainRuleBanned: 3, DomainRuleDead: 2, DomainRulePenalized: 1}
+
+// DomainRule bans, kills or penalizes the stories of a domain and its subdomains,
+// or the stories which url matches a regular expression
+type DomainRule struct {
+	ID      int64
+	Pattern string
+	IsRegex bool
+	Rule    string
+	Reason  string
+	Created time.Time
+}
+
+// Validate returns an error if the rule cannot be applied
+func (rule *DomainRule) Validate() error {
+	if _, ok := domainRuleStrength[rule.Rule]; !ok {
+		return fmt.Errorf("rule '%s' should be banned, dead or penalized", rule.Rule)
+	}
+	if rule.IsRegex {
+		if rule.Rule == DomainRulePenalized {
+			return errors.New("only domains can be penalized")
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("not a valid regular expression : %s", err)
+		}
+		return nil
+	}
+	rule.Pattern = NormalizeDomain(rule.Pattern)
+	if rule.Pattern == "" || strings.ContainsAny(rule.Pattern, "/?#@ ") {
+		return fmt.Errorf("not a valid domain : '%s'", rule.Pattern)
+	}
+	return nil
+}
+
+// Matches returns true if the rule applies to an url
+func (rule *DomainRule) Matches(rawURL string) bool {
+	if rule.IsRegex {
+		matched, err := regexp.MatchString(rule.Pattern, rawURL)
+		return err == nil && matched
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	domain := NormalizeDomain(u.Host)
+	return domain == rule.Pattern || strings.HasSuffix(domain, "."+rule.Pattern)
+}
+
+// StrongerThan returns true if the rule takes precedence over another rule
+func (rule *DomainRule) StrongerThan(other *DomainRule) bool {
+	return other == nil || domainRuleStrength[rule.Rule] > domainRuleStrength[other.Rule]
+}
+
+// NormalizeDomain returns a lowercased host without port and without www.
+func NormalizeDomain(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.TrimPrefix(host, "www.")
+}
+
+// Story types
+const (
+	StoryTypeStory = "story"
+	StoryTypeAsk   = "ask"
+	StoryTypeShow  = "show"
+	StoryTypeJob   = "job"
+)
+
+// DetectStoryType returns the type of a story from its title prefix,
+// "Ask GN:" for ask stories and "Show GN:" for show stories
+func DetectStoryType(title string) string {
+	title = strings.ToLower(strings.TrimSpace(title))
+	switch {
+	case strings.HasPrefix(title, "ask gn:"):
+		return StoryTypeAsk
+	case strings.HasPrefix(title, "show gn:"):
+		return StoryTypeShow
+	}
+	return StoryTypeStory
+}
+
 // Thread is a forum thread
 type Thread struct {
 	// db columns
-	ID       int64
-	Title    string
-	URL      string
-	Content  string
-	Created  time.Time
-	Updated  time.Time
-	AuthorID int64
+	ID      int64
+	Title   string
+	URL     string
+	Type    string
+	Content string
+	// ContentHTML is the formatted content
+	ContentHTML template.HTML
+	Created     time.Time
+	Updated     time.Time
+	AuthorID    int64
 
 	// Author is the author of the thread
 	Author *User
@@ -123,11 +359,47 @@ type Thread struct {
 	AuthorName   string
 	CommentCount int
 	Score        int
+	// Flagged threads are hidden from listings
+	Flagged   bool
+	FlagCount int
+	// Dead threads are only listed for their author and users with showdead
+	Dead bool
+	// Domain is the normalized host of the url
+	Domain string
+	// Penalized threads are ranked after other threads
+	Penalized bool
+	// FavoriteCount is the number of users who saved the thread to their favorites
+	FavoriteCount int
 }
 
-// GetURLHost returns the host of the thread url
-func (t Thread) GetURLHost() (string, error) {
+// IsTextPost returns true if the thread has no url
+func (t Thread) IsTextPost() bool {
+	return t.URL == ""
+}
+
+// IsJob returns true if the thread is a job posting
+func (t Thread) IsJob() bool {
+	return t.Type == StoryTypeJob
+}
+
+// CommentsDisabled returns true if comments cannot be posted in the thread
+func (t Thread) CommentsDisabled() bool {
+	return t.IsJob()
+}
+
+// Link returns the url of the thread, or the url of the thread page for text posts
+func (t Thread) Link() string {
+	if t.IsTextPost() {
+		return fmt.Sprintf("%s?id=%d", Route{}.StoryByID(), t.ID)
+	}
+	return t.URL
+}
 
+// GetURLHost returns the host of the thread url, an empty string for text posts
+func (t Thread) GetURLHost() (string, error) {
+	if t.IsTextPost() {
+		return "", nil
+	}
 	u, err := url.Parse(t.URL)
 	if err == nil {
 		return u.Host, err
@@ -143,17 +415,70 @@ type Comment struct {
 
 	ThreadID     int64
 	Content      string
+	ContentHTML  template.HTML
 	CommentScore int
 	Created      time.Time
 	Updated      time.Time
+	// Flagged comments are displayed as [flagged]
+	Flagged   bool
+	FlagCount int
+	// Dead comments are only listed for their author and users with showdead
+	Dead bool
 
 	// virtual fields
-	AuthorName  string
+	AuthorName string
+	// Upvotes and Downvotes count the votes on the comment, the vote
+	// of the author included
+	Upvotes,
+	Downvotes int
+	// SuspiciousUpvotes and SuspiciousDownvotes are the weight suspicious votes
+	// lose in rankings, see VoteAnalyzer
+	SuspiciousUpvotes,
+	SuspiciousDownvotes float64
 	Depth       int
 	Children    Comments
 	ThreadTitle string
 }
 
+// CommentMaxFade is how much the most downvoted comments are greyed out
+const CommentMaxFade = 5
+
+// Fade returns how much a downvoted comment is greyed out, from 0 for comments
+// with a positive score to CommentMaxFade
+func (c *Comment) Fade() int {
+	if c.Downvotes == 0 || c.CommentScore > 0 {
+		return 0
+	}
+	if fade := 1 - c.CommentScore; fade < CommentMaxFade {
+		return fade
+	}
+	return CommentMaxFade
+}
+
+// CommentRankGravity is how fast comments sink with age when sorted by rank
+const CommentRankGravity = 0.5
+
+// Rank is the Wilson lower bound of the votes on the comment decayed by its age,
+// comments with many votes and few downvotes rank first but sink over time.
+// Suspicious votes only count for their weight
+func (c *Comment) Rank(now time.Time) float64 {
+	hours := math.Max(now.Sub(c.Created).Hours(), 0)
+	upvotes, downvotes := float64(c.Upvotes)-c.SuspiciousUpvotes, float64(c.Downvotes)-c.SuspiciousDownvotes
+	return WilsonLowerBound(upvotes, downvotes) / math.Pow(hours+2, CommentRankGravity)
+}
+
+// WilsonLowerBound returns the lower bound of the Wilson score interval of the
+// proportion of upvotes at a 95% confidence level, 0 without votes
+func WilsonLowerBound(upvotes, downvotes float64) float64 {
+	n := upvotes + downvotes
+	if n <= 0 {
+		return 0
+	}
+	const z = 1.96
+	p := upvotes / n
+	return (p + z*z/(2*n) - z*math.Sqrt((p*(1-p)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
 // HasChildren return true is the comment has child comments
 func (c *Comment) HasChildren() bool {
 	return len(c.Children) > 0
@@ -190,6 +515,46 @@ func (c Comments) GetTree() (commentTree []*Comment) {
 	return
 }
 
+// Comment sort orders of the item page
+const (
+	CommentSortTop = "top"
+	CommentSortNew = "new"
+	CommentSortOld = "old"
+)
+
+// IsCommentSort returns true if order is a comment sort order
+func IsCommentSort(order string) bool {
+	return order == CommentSortTop || order == CommentSortNew || order == CommentSortOld
+}
+
+// SortBy sorts comments by order: by rank for CommentSortTop, the newest first
+// for CommentSortNew and the oldest first for CommentSortOld
+func (c Comments) SortBy(order string, now time.Time) {
+	sort.SliceStable(c, func(i, j int) bool {
+		switch order {
+		case CommentSortNew:
+			return c[i].Created.After(c[j].Created)
+		case CommentSortOld:
+			return c[i].Created.Before(c[j].Created)
+		}
+		return c[i].Rank(now) > c[j].Rank(now)
+	})
+}
+
+// GetSortedTree builds a tree of comments, each group of siblings sorted by order
+func (c Comments) GetSortedTree(order string, now time.Time) Comments {
+	tree := Comments(c.GetTree())
+	var sortSiblings func(Comments)
+	sortSiblings = func(siblings Comments) {
+		siblings.SortBy(order, now)
+		for _, comment := range siblings {
+			sortSiblings(comment.Children)
+		}
+	}
+	sortSiblings(tree)
+	return tree
+}
+
 // CommentVote is a comment vote
 type CommentVote struct {
 	ID        int64
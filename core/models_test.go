@@ -18,7 +18,9 @@
 package gonews_test
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/mparaiso/gonews/core"
 )
@@ -35,6 +37,61 @@ func Test_Comments_GetTree(t *testing.T) {
 	}
 }
 
+func TestWilsonLowerBound(t *testing.T) {
+	Expect(t, gonews.WilsonLowerBound(0, 0), 0.0, "without votes")
+	Expect(t, gonews.WilsonLowerBound(10, 0) > gonews.WilsonLowerBound(1, 0), true, "more upvotes rank higher")
+	Expect(t, gonews.WilsonLowerBound(10, 5) < gonews.WilsonLowerBound(10, 0), true, "downvotes rank lower")
+	Expect(t, gonews.WilsonLowerBound(100, 100) < 0.5, true, "lower bound of an even split")
+}
+
+func TestComment_Fade(t *testing.T) {
+	for _, fixture := range []struct {
+		Score, Downvotes, Fade int
+	}{{1, 0, 0}, {0, 0, 0}, {1, 1, 0}, {0, 1, 1}, {-2, 4, 3}, {-20, 22, gonews.CommentMaxFade}} {
+		comment := &gonews.Comment{CommentScore: fixture.Score, Downvotes: fixture.Downvotes}
+		Expect(t, comment.Fade(), fixture.Fade, fmt.Sprintf("fade of a comment with a score of %d", fixture.Score))
+	}
+}
+
+func TestComments_GetSortedTree(t *testing.T) {
+	now := time.Now()
+	comments := gonews.Comments{
+		{ID: 1, Upvotes: 1, Created: now.Add(-3 * time.Hour)},
+		{ID: 2, Upvotes: 20, Created: now.Add(-2 * time.Hour)},
+		{ID: 3, Upvotes: 5, Downvotes: 5, Created: now.Add(-1 * time.Hour)},
+		{ID: 4, ParentID: 1, Upvotes: 1, Created: now.Add(-2 * time.Hour)},
+		{ID: 5, ParentID: 1, Upvotes: 1, Created: now.Add(-1 * time.Hour)},
+	}
+	ids := func(comments gonews.Comments) (ids []int64) {
+		for _, comment := range comments {
+			ids = append(ids, comment.ID)
+		}
+		return
+	}
+	for _, fixture := range []struct {
+		Order          string
+		Roots, Replies []int64
+	}{
+		{gonews.CommentSortTop, []int64{2, 3, 1}, []int64{5, 4}},
+		{gonews.CommentSortNew, []int64{3, 2, 1}, []int64{5, 4}},
+		{gonews.CommentSortOld, []int64{1, 2, 3}, []int64{4, 5}},
+	} {
+		for _, comment := range comments {
+			comment.Children = nil
+		}
+		tree := comments.GetSortedTree(fixture.Order, now)
+		Expect(t, fmt.Sprint(ids(tree)), fmt.Sprint(fixture.Roots), fixture.Order)
+		for _, root := range tree {
+			if root.ID == 1 {
+				Expect(t, fmt.Sprint(ids(root.Children)), fmt.Sprint(fixture.Replies), "replies sorted by "+fixture.Order)
+			}
+		}
+	}
+	older := &gonews.Comment{Upvotes: 10, Created: now.Add(-48 * time.Hour)}
+	newer := &gonews.Comment{Upvotes: 10, Created: now}
+	Expect(t, newer.Rank(now) > older.Rank(now), true, "rank decays with age")
+}
+
 func TestUser_CreateSecurePassword(t *testing.T) {
 	// Set up
 	user := &gonews.User{}
@@ -57,3 +114,53 @@ func TestUser_Authenticate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDetectStoryType(t *testing.T) {
+	Expect(t, gonews.DetectStoryType("Ask GN: how do you deploy go apps?"), gonews.StoryTypeAsk)
+	Expect(t, gonews.DetectStoryType("show gn: my new web framework"), gonews.StoryTypeShow)
+	Expect(t, gonews.DetectStoryType("A new computer language"), gonews.StoryTypeStory)
+}
+
+func TestThread_Link(t *testing.T) {
+	textPost := gonews.Thread{ID: 10, Title: "Ask GN: which database?"}
+	host, err := textPost.GetURLHost()
+	Expect(t, err, nil)
+	Expect(t, host, "", "text post host")
+	Expect(t, textPost.Link(), "/item?id=10", "text post link")
+	story := gonews.Thread{ID: 11, URL: "http://golang.acme/doc"}
+	Expect(t, story.Link(), story.URL, "story link")
+}
+
+func TestDomainRule_Matches(t *testing.T) {
+	for _, fixture := range []struct {
+		Rule    gonews.DomainRule
+		URL     string
+		Matches bool
+	}{
+		{gonews.DomainRule{Pattern: "spam.acme", Rule: gonews.DomainRuleBanned}, "http://spam.acme/offer", true},
+		{gonews.DomainRule{Pattern: "spam.acme", Rule: gonews.DomainRuleBanned}, "https://WWW.Spam.acme:8080/", true},
+		{gonews.DomainRule{Pattern: "spam.acme", Rule: gonews.DomainRuleBanned}, "http://blog.spam.acme/", true},
+		{gonews.DomainRule{Pattern: "spam.acme", Rule: gonews.DomainRuleBanned}, "http://notspam.acme/", false},
+		{gonews.DomainRule{Pattern: "spam.acme", Rule: gonews.DomainRuleBanned}, "http://acme.com/?u=spam.acme", false},
+		{gonews.DomainRule{Pattern: `^https?://[^/]+/free-money`, IsRegex: true, Rule: gonews.DomainRuleDead}, "http://any.acme/free-money/now", true},
+		{gonews.DomainRule{Pattern: `^https?://[^/]+/free-money`, IsRegex: true, Rule: gonews.DomainRuleDead}, "http://any.acme/money", false},
+	} {
+		Expect(t, fixture.Rule.Validate(), nil, "validating "+fixture.Rule.Pattern)
+		Expect(t, fixture.Rule.Matches(fixture.URL), fixture.Matches, fixture.Rule.Pattern+" matches "+fixture.URL)
+	}
+}
+
+func TestDomainRule_Validate(t *testing.T) {
+	rule := &gonews.DomainRule{Pattern: " WWW.Spam.acme ", Rule: gonews.DomainRulePenalized}
+	Expect(t, rule.Validate(), nil)
+	Expect(t, rule.Pattern, "spam.acme", "normalized domain")
+	for _, invalid := range []gonews.DomainRule{
+		{Pattern: "spam.acme", Rule: "hidden"},
+		{Pattern: "spam.acme/path", Rule: gonews.DomainRuleBanned},
+		{Pattern: "", Rule: gonews.DomainRuleBanned},
+		{Pattern: "(unclosed", IsRegex: true, Rule: gonews.DomainRuleBanned},
+		{Pattern: "spam", IsRegex: true, Rule: gonews.DomainRulePenalized},
+	} {
+		Expect(t, invalid.Validate() != nil, true, "validating an invalid rule "+invalid.Pattern)
+	}
+}
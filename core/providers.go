@@ -32,8 +32,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"html/template"
-	"log"
-	"os"
 
 	"github.com/gorilla/sessions"
 )
@@ -65,6 +63,7 @@ func (provider *DefaultFormDecoderProvider) GetFormDecoder() FormDecoder {
 type LoggerProvider interface {
 	GetLogger() (LoggerInterface, error)
 	MustGetLogger() LoggerInterface
+	SetLogger(LoggerInterface)
 }
 
 // DefaultLoggerProvider provides logging capabilies to a container
@@ -92,8 +91,6 @@ func (provider *DefaultLoggerProvider) GetLogger() (LoggerInterface, error) {
 			provider.logger = logger
 		} else {
 			// adhoc logger creation
-			logger := &log.Logger{}
-			logger.SetOutput(os.Stdout)
 			if provider.debug == true {
 				provider.logger = NewDefaultLogger(ALL)
 			} else {
@@ -105,6 +102,11 @@ func (provider *DefaultLoggerProvider) GetLogger() (LoggerInterface, error) {
 	return provider.logger, nil
 }
 
+// SetLogger replaces the logger, i.e. by a logger with request fields
+func (provider *DefaultLoggerProvider) SetLogger(logger LoggerInterface) {
+	provider.logger = logger
+}
+
 // MustGetLogger panics on error or return a LoggerInterface
 func (provider *DefaultLoggerProvider) MustGetLogger() LoggerInterface {
 	logger, err := provider.GetLogger()
@@ -172,13 +174,6 @@ func (provider *DefaultSessionProvider) GetSession() (SessionWrapper, error) {
 		}
 
 		provider.session = session
-		provider.session.SetOptions(&sessions.Options{
-			Path:     "/",
-			HttpOnly: true,
-			// Secure:   true,
-			MaxAge: 60 * 60 * 24,
-			Domain: provider.requestProvider.Request().URL.Host,
-		})
 		provider.responseWithExtraProvider.ResponseWriter().SetSession(provider.session)
 	}
 	return provider.session, nil
@@ -250,6 +245,8 @@ type DefaultTemplateProvider struct {
 	templateFileExtension string
 	isDebug bool
 	LoggerProvider
+	// Metrics measure the rendering time of templates
+	Metrics *Metrics
 }
 
 // NewDefaultTemplateProvider creates a new DefaultTemplateProvider
@@ -283,7 +280,7 @@ func (provider *DefaultTemplateProvider) GetTemplate() (TemplateEngine, error) {
 		if err != nil {
 			return nil, err
 		}
-		provider.template = &DefaultTemplateEngine{Template: tpl}
+		provider.template = &DefaultTemplateEngine{Template: tpl, metrics: provider.Metrics}
 	}
 	return provider.template, nil
 }
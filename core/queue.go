@@ -17,9 +17,11 @@
 
 package gonews
 
-import "net/http"
-import "runtime"
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
 
 // Next is a function that call the next middleware or the handler
 // if all middlewares have been called
@@ -96,11 +98,12 @@ func (s *MiddlewareQueue) Build() func(...Middleware) http.HandlerFunc {
 						}
 						return http.StatusText(http.StatusInternalServerError)
 					}()
+					container.MustGetLogger().Log(ERROR, "panic recovered",
+						"error", fmt.Sprint(err),
+						"method", r.Method,
+						"uri", r.RequestURI,
+						"stack", string(debug.Stack()))
 					container.HTTPError(container.ResponseWriter(), container.Request(), 500, message)
-					container.MustGetLogger().Error("recovered error \t", err)
-					b := make([]byte, 1000)
-					runtime.Stack(b, true)
-					fmt.Printf("%s", b)
 					return
 				}
 			}()
@@ -0,0 +1,164 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// rememberMeGracePeriod is how long the previous validator of a rotated token
+// is accepted, so concurrent requests sent with the same cookie are not taken for a theft
+const rememberMeGracePeriod = time.Minute
+
+// RememberMeCookieName returns the name of the "remember me" cookie
+func (options SessionOptions) RememberMeCookieName() string {
+	return options.Name + "-remember"
+}
+
+func hashRememberMeValidator(validator string) string {
+	sum := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRememberMeValidator() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// setRememberMeCookie writes the cookie, a nil token deletes it
+func setRememberMeCookie(c *Container, token *RememberToken, validator string) {
+	options := c.GetOptions().Session
+	cookie := &http.Cookie{
+		Name:     options.RememberMeCookieName(),
+		Path:     "/",
+		Domain:   options.Domain,
+		Secure:   options.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	}
+	if token != nil {
+		cookie.Value = token.Selector + ":" + validator
+		cookie.MaxAge = options.RememberMeMaxAge
+		cookie.Expires = time.Now().Add(time.Duration(options.RememberMeMaxAge) * time.Second)
+	}
+	http.SetCookie(c.ResponseWriter(), cookie)
+}
+
+// IssueRememberToken creates a "remember me" token for a user
+// and sends it to the client in a cookie
+func IssueRememberToken(c *Container, userID int64) error {
+	validator := newRememberMeValidator()
+	token := &RememberToken{
+		Selector:      base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(12)),
+		ValidatorHash: hashRememberMeValidator(validator),
+		UserID:        userID,
+	}
+	if err := c.MustGetRememberTokenRepository().Create(token, c.GetOptions().Session.RememberMeMaxAge); err != nil {
+		return err
+	}
+	setRememberMeCookie(c, token, validator)
+	return nil
+}
+
+// ForgetRememberToken deletes the token of the request and its cookie, i.e. on logout
+func ForgetRememberToken(c *Container) error {
+	cookie, err := c.Request().Cookie(c.GetOptions().Session.RememberMeCookieName())
+	if err != nil {
+		return nil
+	}
+	setRememberMeCookie(c, nil, "")
+	selector := strings.SplitN(cookie.Value, ":", 2)[0]
+	return c.MustGetRememberTokenRepository().DeleteBySelector(selector)
+}
+
+// LoginWithRememberToken authenticates the user of a valid "remember me" cookie and
+// rotates the token. A cookie with a known selector but a wrong validator means the
+// token was stolen and used : all tokens and sessions of the user are revoked.
+// It returns nil if the user could not be authenticated.
+func LoginWithRememberToken(c *Container) (*User, error) {
+	cookie, err := c.Request().Cookie(c.GetOptions().Session.RememberMeCookieName())
+	if err != nil {
+		return nil, nil
+	}
+	parts := strings.SplitN(cookie.Value, ":", 2)
+	if len(parts) != 2 {
+		setRememberMeCookie(c, nil, "")
+		return nil, nil
+	}
+	tokens := c.MustGetRememberTokenRepository()
+	token, err := tokens.GetBySelector(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		setRememberMeCookie(c, nil, "")
+		return nil, nil
+	}
+	hash := hashRememberMeValidator(parts[1])
+	isCurrent := subtle.ConstantTimeCompare([]byte(hash), []byte(token.ValidatorHash)) == 1
+	isPrevious := token.PreviousValidatorHash != "" &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(token.PreviousValidatorHash)) == 1 &&
+		time.Since(token.LastUsed) < rememberMeGracePeriod
+	if !isCurrent && !isPrevious {
+		c.MustGetLogger().Log(WARN, "remember me token reused, revoking all tokens and sessions of the user",
+			"user_id", token.UserID, "remote_addr", c.Request().RemoteAddr)
+		setRememberMeCookie(c, nil, "")
+		if err := tokens.DeleteByUserID(token.UserID); err != nil {
+			return nil, err
+		}
+		_, err := c.MustGetSessionRepository().DeleteByUserID(token.UserID)
+		return nil, err
+	}
+	if expired, err := tokens.IsExpired(token); err != nil {
+		return nil, err
+	} else if expired {
+		setRememberMeCookie(c, nil, "")
+		return nil, tokens.DeleteBySelector(token.Selector)
+	}
+	user, err := c.MustGetUserRepository().GetByID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Banned {
+		setRememberMeCookie(c, nil, "")
+		return nil, tokens.DeleteBySelector(token.Selector)
+	}
+	// the client which sent the previous validator during the grace period
+	// keeps the cookie set by the request which rotated the token
+	if isCurrent {
+		validator := newRememberMeValidator()
+		if err := tokens.Rotate(token, hashRememberMeValidator(validator), c.GetOptions().Session.RememberMeMaxAge); err != nil {
+			return nil, err
+		}
+		setRememberMeCookie(c, token, validator)
+	}
+	session := c.MustGetSession()
+	if err := session.Regenerate(); err != nil {
+		return nil, err
+	}
+	session.Set("user.ID", user.ID)
+	return user, nil
+}
@@ -0,0 +1,103 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mparaiso/gonews/core"
+)
+
+// Scenario: REMEMBER ME
+// Given a user who logged in with "remember me"
+// When the session cookie is lost
+// The user should be logged in again with the remember me cookie
+// And the token should be rotated
+// When the previous token is used again after the grace period
+// All tokens and sessions of the user should be revoked
+func TestRememberMe(t *testing.T) {
+	db := GetDB(t)
+	server := GetServer(t, db)
+	defer server.Close()
+	user := &gonews.User{Username: "mike_doe", Email: "mike_doe@acme.com"}
+	user.CreateSecurePassword("password")
+	result, err := db.Exec("INSERT INTO users(username,email,password) values(?,?,?);", user.Username, user.Email, user.Password)
+	Expect(t, err, nil)
+	user.ID, _ = result.LastInsertId()
+	serverURL, _ := url.Parse(server.URL)
+	cookieName := gonews.DefaultContainerOptions().Session.RememberMeCookieName()
+	rememberCookie := func(jar http.CookieJar) *http.Cookie {
+		for _, cookie := range jar.Cookies(serverURL) {
+			if cookie.Name == cookieName {
+				return cookie
+			}
+		}
+		return nil
+	}
+	// isLoggedIn requests the index with a client that only has the remember me cookie
+	isLoggedIn := func(cookie *http.Cookie) (bool, http.CookieJar) {
+		jar, _ := cookiejar.New(nil)
+		jar.SetCookies(serverURL, []*http.Cookie{{Name: cookie.Name, Value: cookie.Value}})
+		response, err := (&http.Client{Jar: jar}).Get(server.URL + gonews.Route{}.StoriesByScore())
+		Expect(t, err, nil)
+		doc, err := goquery.NewDocumentFromResponse(response)
+		Expect(t, err, nil)
+		return doc.Find(".current-user").Length() == 1, jar
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	response, err := client.Get(server.URL + gonews.Route{}.Login())
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='login_csrf']").First().Attr("value")
+	response, err = client.PostForm(server.URL+gonews.Route{}.Login(), url.Values{
+		"login_username": {user.Username}, "login_password": {"password"},
+		"login_csrf": {csrf}, "login_remember_me": {"true"},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	issued := rememberCookie(jar)
+	Expect(t, issued != nil, true, "remember me cookie issued")
+	var validatorHash string
+	Expect(t, db.QueryRow("SELECT validator_hash FROM remember_tokens WHERE user_id = ? ;", user.ID).Scan(&validatorHash), nil)
+	Expect(t, len(validatorHash), 64, "validator stored as a sha256 hash")
+
+	loggedIn, newJar := isLoggedIn(issued)
+	Expect(t, loggedIn, true, "logged in with the remember me cookie")
+	rotated := rememberCookie(newJar)
+	Expect(t, rotated != nil && rotated.Value != issued.Value, true, "token rotated")
+
+	// past the grace period, the previous validator is a stolen one
+	_, err = db.Exec("UPDATE remember_tokens SET last_used = datetime('now', '-1 hour') WHERE user_id = ? ;", user.ID)
+	Expect(t, err, nil)
+	loggedIn, _ = isLoggedIn(issued)
+	Expect(t, loggedIn, false, "logged in with a reused token")
+	var count int
+	Expect(t, db.QueryRow("SELECT COUNT(*) FROM remember_tokens WHERE user_id = ? ;", user.ID).Scan(&count), nil)
+	Expect(t, count, 0, "remember tokens of the user")
+	Expect(t, db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = ? ;", user.ID).Scan(&count), nil)
+	Expect(t, count, 0, "sessions of the user")
+	loggedIn, _ = isLoggedIn(rotated)
+	Expect(t, loggedIn, false, "logged in with the revoked token")
+}
@@ -21,8 +21,12 @@
 package gonews
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 // Query is an SQL Query
@@ -30,12 +34,14 @@ type Query string
 
 // UserRepository is a repository of users
 type UserRepository struct {
-	DB     *sql.DB
-	Logger LoggerInterface
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
 }
 
 // Save persists a user
-func (repository *UserRepository) Save(u *User) error {
+func (repository *UserRepository) Save(u *User) (err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.Save", time.Now(), &err)
 	if u.ID == 0 {
 		// user must be created
 		command := "INSERT INTO users(username,email,password) VALUES(?,?,?);"
@@ -48,20 +54,33 @@ func (repository *UserRepository) Save(u *User) error {
 		if err != nil {
 			return err
 		}
+		repository.Metrics.Add("gonews_registrations_total", 1)
 		return nil
 	}
 	// user must be updated
-
-	return fmt.Errorf("user update Not implemented ")
+	command := `UPDATE users SET username = ?, email = ?, password = ?, banned = ?, shadowbanned = ?, showdead = ?, email_notifications = ?, public_favorites = ?,
+	updated = datetime('now') WHERE id = ? ;`
+	repository.debug(command, u.ID)
+	result, err := repository.DB.Exec(command, u.Username, u.Email, u.Password, u.Banned, u.Shadowbanned, u.ShowDead, u.EmailNotifications, u.PublicFavorites, u.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRowAffected(result, fmt.Sprintf("user with id %d not found", u.ID))
 }
 
 // GetOneByEmail gets one user by his email
 func (repository *UserRepository) GetOneByEmail(email string) (user *User, err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.GetOneByEmail", time.Now(), &err)
 	query :=
 		`SELECT u.id,
   	u.username,
 	u.password,
 	u.email,
+	u.banned,
+	u.shadowbanned,
+	u.showdead,
+	u.email_notifications,
+	u.public_favorites,
 	u.created,
 	u.updated 
 	from users u
@@ -70,7 +89,7 @@ func (repository *UserRepository) GetOneByEmail(email string) (user *User, err e
 	repository.debug(query, email)
 	row := repository.DB.QueryRow(query, email)
 	user = new(User)
-	err = MapRowToStruct([]string{"ID", "Password", "Email", "Created", "Updated"}, row, user, true)
+	err = MapRowToStruct([]string{"ID", "Username", "Password", "Email", "Banned", "Shadowbanned", "ShowDead", "EmailNotifications", "PublicFavorites", "Created", "Updated"}, row, user, true)
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
@@ -84,10 +103,16 @@ func (repository *UserRepository) GetOneByEmail(email string) (user *User, err e
 
 // GetOneByUsername gets one user by his name
 func (repository *UserRepository) GetOneByUsername(username string) (user *User, err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.GetOneByUsername", time.Now(), &err)
 	query := `SELECT u.id,
   	u.username,
 	u.password,
 	u.email,
+	u.banned,
+	u.shadowbanned,
+	u.showdead,
+	u.email_notifications,
+	u.public_favorites,
 	u.created,
 	u.updated 
 	from users u
@@ -96,7 +121,7 @@ func (repository *UserRepository) GetOneByUsername(username string) (user *User,
 	repository.debug(query, username)
 	row := repository.DB.QueryRow(query, username)
 	user = new(User)
-	err = MapRowToStruct([]string{"ID", "Username", "Password", "Email", "Created", "Updated"}, row, user, true)
+	err = MapRowToStruct([]string{"ID", "Username", "Password", "Email", "Banned", "Shadowbanned", "ShowDead", "EmailNotifications", "PublicFavorites", "Created", "Updated"}, row, user, true)
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
@@ -105,16 +130,24 @@ func (repository *UserRepository) GetOneByUsername(username string) (user *User,
 			return nil, err
 		}
 	}
+	user.Roles, err = repository.GetRoles(user.ID)
 	return
 }
 
 // GetByID returns a user, an error on error or nil if user not found
 func (repository *UserRepository) GetByID(id int64) (user *User, err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.GetByID", time.Now(), &err)
 	query := `SELECT 
 	u.id AS ID,
 	u.username AS Username,
 	u.password AS Password,
 	u.email AS Email,
+	u.banned AS Banned,
+	u.shadowbanned AS Shadowbanned,
+	u.showdead AS ShowDead,
+	u.email_notifications AS EmailNotifications,
+	u.public_favorites AS PublicFavorites,
+	u.karma AS Karma,
 	u.created AS Created,
 	u.updated AS Updated
 	FROM users u 
@@ -122,46 +155,186 @@ func (repository *UserRepository) GetByID(id int64) (user *User, err error) {
 	repository.debug(query, id)
 	row := repository.DB.QueryRow(query, id)
 	user = new(User)
-	err = MapRowToStruct([]string{"ID", "Username", "Password", "Email", "Created", "Updated"}, row, user, true)
-	if err != nil {
-		return
-	}
+	err = MapRowToStruct([]string{"ID", "Username", "Password", "Email", "Banned", "Shadowbanned", "ShowDead", "EmailNotifications", "PublicFavorites", "Karma", "Created", "Updated"}, row, user, true)
 	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
-	var threadKarma, commentKarma int
-	query = `SELECT coalesce(SUM(comment_votes.score),0) as KarmaComments
-  	FROM comment_votes
-    JOIN
-    comments ON comments.id = comment_votes.comment_id
-    JOIN
-    users ON users.id = comments.author_id
- 	WHERE users.id = ?;
-	`
+	query = "SELECT COUNT(*) FROM notifications WHERE user_id = ? AND NOT read ;"
 	repository.debug(query, id)
-	row = repository.DB.QueryRow(query, id)
-
-	if err = row.Scan(&commentKarma); err != nil {
+	if err = repository.DB.QueryRow(query, id).Scan(&user.UnreadNotifications); err != nil {
 		return nil, err
 	}
-	query = `SELECT coalesce(SUM(thread_votes.score),0) as Karmathreads
-  	FROM thread_votes
-    JOIN
-    threads ON threads.id = thread_votes.thread_id
-    JOIN
-    users ON users.id = threads.author_id
- 	WHERE users.id = ?;
-	`
-	repository.debug(query, id)
-	row = repository.DB.QueryRow(query, id)
+	user.Roles, err = repository.GetRoles(user.ID)
+	return
+}
 
-	if err = row.Scan(&threadKarma); err != nil {
+// GetAll returns users ordered by id
+func (repository *UserRepository) GetAll(limit, offset int) (users []*User, err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.GetAll", time.Now(), &err)
+	query := `SELECT 
+	u.id AS ID,
+	u.username AS Username,
+	u.email AS Email,
+	u.banned AS Banned,
+	u.shadowbanned AS Shadowbanned,
+	u.created AS Created,
+	u.updated AS Updated,
+	coalesce(group_concat(r.name),'') AS RoleNames
+	FROM users u
+	LEFT JOIN users_roles ur ON ur.user_id = u.id
+	LEFT JOIN roles r ON r.id = ur.role_id
+	GROUP BY u.id
+	ORDER BY u.id
+	LIMIT ? OFFSET ? ;`
+	repository.debug(query, limit, offset)
+	rows, err := repository.DB.Query(query, limit, offset)
+	if err != nil {
 		return nil, err
 	}
-	user.Karma = threadKarma + commentKarma
+	defer rows.Close()
+	for rows.Next() {
+		var roleNames string
+		user := new(User)
+		if err = rows.Scan(&user.ID, &user.Username, &user.Email, &user.Banned, &user.Shadowbanned, &user.Created, &user.Updated, &roleNames); err != nil {
+			return nil, err
+		}
+		if roleNames != "" {
+			user.Roles = strings.Split(roleNames, ",")
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetLeaders returns the users with the most karma, banned and shadowbanned users excepted.
+// The karma is read from users.karma which triggers keep up to date
+func (repository *UserRepository) GetLeaders(limit, offset int) (users []*User, err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.GetLeaders", time.Now(), &err)
+	query := `SELECT id AS ID, username AS Username, karma AS Karma, created AS Created
+	FROM users
+	WHERE NOT banned AND NOT shadowbanned
+	ORDER BY karma DESC, id
+	LIMIT ? OFFSET ? ;`
+	repository.debug(query, limit, offset)
+	rows, err := repository.DB.Query(query, limit, offset)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &users, true)
+	}
 	return
 }
 
+// Delete deletes a user with the stories, comments and votes of the user. The comments
+// of other users on the stories of the user and the replies to the comments of the user
+// are deleted with their votes, the karma of their authors is updated by the vote triggers
+func (repository *UserRepository) Delete(id int64) (err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.Delete", time.Now(), &err)
+	tx, err := repository.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// the comments of the user, the comments on the stories of the user and their replies at any depth
+	const doomed = `WITH RECURSIVE doomed(id) AS (
+		SELECT id FROM comments WHERE author_id = ?1 OR thread_id IN (SELECT id FROM threads WHERE author_id = ?1)
+		UNION
+		SELECT comments.id FROM comments JOIN doomed ON comments.parent_id = doomed.id
+	) `
+	for _, command := range []string{
+		"DELETE FROM thread_votes WHERE author_id = ?1 OR thread_id IN (SELECT id FROM threads WHERE author_id = ?1);",
+		doomed + "DELETE FROM comment_votes WHERE author_id = ?1 OR comment_id IN (SELECT id FROM doomed);",
+		"DELETE FROM thread_flags WHERE user_id = ?1 OR thread_id IN (SELECT id FROM threads WHERE author_id = ?1);",
+		doomed + "DELETE FROM comment_flags WHERE user_id = ?1 OR comment_id IN (SELECT id FROM doomed);",
+		doomed + "DELETE FROM notifications WHERE user_id = ?1 OR comment_id IN (SELECT id FROM doomed);",
+		"DELETE FROM thread_favorites WHERE user_id = ?1 OR thread_id IN (SELECT id FROM threads WHERE author_id = ?1);",
+		"DELETE FROM hidden_threads WHERE user_id = ?1 OR thread_id IN (SELECT id FROM threads WHERE author_id = ?1);",
+		doomed + "DELETE FROM comment_favorites WHERE user_id = ?1 OR comment_id IN (SELECT id FROM doomed);",
+		doomed + "DELETE FROM comments WHERE id IN (SELECT id FROM doomed);",
+		"DELETE FROM threads WHERE author_id = ?1;",
+		"DELETE FROM users_roles WHERE user_id = ?1;",
+		"DELETE FROM sessions WHERE user_id = ?1;",
+		"DELETE FROM remember_tokens WHERE user_id = ?1;",
+	} {
+		repository.debug(command, id)
+		if _, err = tx.Exec(command, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	command := "DELETE FROM users WHERE id = ? ;"
+	repository.debug(command, id)
+	result, err := tx.Exec(command, id)
+	if err == nil {
+		err = expectOneRowAffected(result, fmt.Sprintf("user with id %d not found", id))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetRoles returns the role names of a user
+func (repository *UserRepository) GetRoles(userID int64) (roles []string, err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.GetRoles", time.Now(), &err)
+	query := `SELECT r.name FROM roles r JOIN users_roles ur ON ur.role_id = r.id WHERE ur.user_id = ? ORDER BY r.name ;`
+	repository.debug(query, userID)
+	rows, err := repository.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err = rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// AddRole grants a role to a user, the role must exist
+func (repository *UserRepository) AddRole(userID int64, role string) (err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.AddRole", time.Now(), &err)
+	command := `INSERT OR IGNORE INTO users_roles(user_id,role_id) SELECT ?, id FROM roles WHERE name = ? ;`
+	repository.debug(command, userID, role)
+	if _, err := repository.DB.Exec(command, userID, role); err != nil {
+		return err
+	}
+	if roles, err := repository.GetRoles(userID); err != nil {
+		return err
+	} else if !(&User{Roles: roles}).HasRole(role) {
+		return fmt.Errorf("role '%s' does not exist", role)
+	}
+	return nil
+}
+
+// RemoveRole revokes a role from a user
+func (repository *UserRepository) RemoveRole(userID int64, role string) (err error) {
+	defer repository.Metrics.ObserveQuery("UserRepository.RemoveRole", time.Now(), &err)
+	command := `DELETE FROM users_roles WHERE user_id = ? AND role_id IN (SELECT id FROM roles WHERE name = ?) ;`
+	repository.debug(command, userID, role)
+	result, err := repository.DB.Exec(command, userID, role)
+	if err != nil {
+		return err
+	}
+	return expectOneRowAffected(result, fmt.Sprintf("user with id %d does not have role '%s'", userID, role))
+}
+
+// expectOneRowAffected returns an error with message if no row was affected by a command
+func expectOneRowAffected(result sql.Result, message string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New(message)
+	}
+	return nil
+}
+
 func (repository UserRepository) debug(messages ...interface{}) {
 	if repository.Logger != nil {
 		repository.Logger.Debug(messages...)
@@ -171,10 +344,37 @@ func (repository UserRepository) debug(messages ...interface{}) {
 // RoleRepository is a repositorCreated y of roles
 type RoleRepository struct{}
 
+// visibleTo returns the condition on the Dead and AuthorID columns of a view
+// that hides dead items from a viewer, nil being an anonymous viewer.
+// Dead items are visible to their author and to viewers with showdead
+func visibleTo(viewer *User) (condition string, arguments []interface{}) {
+	switch {
+	case viewer == nil:
+		return "NOT Dead", nil
+	case viewer.ShowDead:
+		return "1", nil
+	}
+	return "(NOT Dead OR AuthorID = ?)", []interface{}{viewer.ID}
+}
+
+// notHiddenFrom returns the condition on the ID column of threads_view excluding
+// the threads the viewer hid
+func notHiddenFrom(viewer *User) (condition string, arguments []interface{}) {
+	if viewer == nil {
+		return "1", nil
+	}
+	return "ID NOT IN (SELECT thread_id FROM hidden_threads WHERE user_id = ?)", []interface{}{viewer.ID}
+}
+
 // ThreadRepository is a repository of threads
 type ThreadRepository struct {
-	DB     *sql.DB
-	Logger LoggerInterface
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+	// Viewer is the user listings are for, dead threads and comments are hidden from other users
+	Viewer *User
+	// FavoriteWeight is the number of points a favorite adds to a story in GetSortedByScore
+	FavoriteWeight int
 }
 
 func (repository ThreadRepository) log(messages ...interface{}) {
@@ -184,25 +384,43 @@ func (repository ThreadRepository) log(messages ...interface{}) {
 }
 
 // Create creates  an thread in the database
-func (repository ThreadRepository) Create(thread *Thread) error {
-	command := "INSERT INTO threads(title,url,content,author_id) values(?,?,?,?);"
+func (repository ThreadRepository) Create(thread *Thread) (err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.Create", time.Now(), &err)
+	// threads of shadowbanned users are dead
+	command := `INSERT INTO threads(title,url,type,content,content_html,author_id,domain,dead)
+		values(?1,?2,?3,?4,?5,?6,?7,?8 OR (SELECT shadowbanned FROM users WHERE id = ?6));`
+	if thread.Type == "" {
+		thread.Type = DetectStoryType(thread.Title)
+	}
+	thread.ContentHTML = RenderContent(thread.Content)
+	if host, err := thread.GetURLHost(); err == nil {
+		thread.Domain = NormalizeDomain(host)
+	}
 	repository.Logger.Debug(command, thread)
-	result, err := repository.DB.Exec(command, thread.Title, thread.URL, thread.Content, thread.AuthorID)
+	result, err := repository.DB.Exec(command, thread.Title, thread.URL, thread.Type, thread.Content, thread.ContentHTML,
+		thread.AuthorID, thread.Domain, thread.Dead)
 
 	if err == nil {
 		thread.ID, err = result.LastInsertId()
 		// a new thread_votes record is then automatically inserted in the db with a TRIGGER
 	}
+	if err == nil {
+		repository.Metrics.Add("gonews_stories_total", 1)
+	}
 
 	return err
 }
 
-// GetWhereURLLike returns threads where url like pattern
+// GetWhereURLLike returns threads where url like pattern, except the threads the viewer hid
 func (repository ThreadRepository) GetWhereURLLike(pattern string, limit, offset int) (threads Threads, err error) {
-	query := `SELECT * FROM threads_view WHERE URL LIKE ? LIMIT ? OFFSET ? ;`
-	repository.Logger.Debug(query, pattern, limit, offset)
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetWhereURLLike", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	notHidden, hiddenArguments := notHiddenFrom(repository.Viewer)
+	query := `SELECT * FROM threads_view WHERE URL LIKE ? AND NOT Flagged AND ` + visible + ` AND ` + notHidden + ` LIMIT ? OFFSET ? ;`
+	arguments = append(append(append([]interface{}{pattern}, arguments...), hiddenArguments...), limit, offset)
+	repository.Logger.Debug(query, arguments)
 	var rows *sql.Rows
-	rows, err = repository.DB.Query(query, pattern, limit, offset)
+	rows, err = repository.DB.Query(query, arguments...)
 	if err == nil {
 		err = MapRowsToSliceOfStruct(rows, &threads, true)
 		if err == nil {
@@ -218,12 +436,15 @@ func (repository ThreadRepository) GetWhereURLLike(pattern string, limit, offset
 
 // GetByAuthorID returns threads filtered by AuthorID
 func (repository ThreadRepository) GetByAuthorID(id int64, limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetByAuthorID", time.Now(), &err)
 	// we query the database, first by search threads by author_id with the commentcount
 	// then by aggregating the sum of thread_votes.score
 	// TODO refactor as a view in the database
-	query := `SELECT * FROM threads_view WHERE AuthorID = ? LIMIT ? OFFSET ? ;`
-	repository.log(query, id, limit, offset)
-	rows, err := repository.DB.Query(query, id, limit, offset)
+	visible, arguments := visibleTo(repository.Viewer)
+	query := `SELECT * FROM threads_view WHERE AuthorID = ? AND ` + visible + ` LIMIT ? OFFSET ? ;`
+	arguments = append(append([]interface{}{id}, arguments...), limit, offset)
+	repository.log(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
 	if err != nil {
 		return nil, err
 	}
@@ -236,19 +457,21 @@ func (repository ThreadRepository) GetByAuthorID(id int64, limit, offset int) (t
 
 // GetByIDWithComments gets a threas with its comments
 func (repository ThreadRepository) GetByIDWithComments(id int) (thread *Thread, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetByIDWithComments", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
 	// Thread
 	query := `
 	SELECT 
-		ID,Title,Created,URL,CommentCount,Score,AuthorID,AuthorName 
+		ID,Title,Created,URL,Type,Content,ContentHTML,CommentCount,Score,AuthorID,AuthorName,Flagged,FlagCount,Dead 
 	FROM 
 		threads_view t
 	WHERE 
-		t.ID  = ? `
-	repository.Logger.Debug(query, id)
-	row := repository.DB.QueryRow(query, id)
+		t.ID  = ? AND ` + visible
+	repository.Logger.Debug(query, append([]interface{}{id}, arguments...))
+	row := repository.DB.QueryRow(query, append([]interface{}{id}, arguments...)...)
 	thread = new(Thread)
-	err = MapRowToStruct([]string{"ID", "Title", "Created", "URL",
-		"CommentCount", "Score", "AuthorID", "AuthorName"}, row, thread, true)
+	err = MapRowToStruct([]string{"ID", "Title", "Created", "URL", "Type", "Content", "ContentHTML",
+		"CommentCount", "Score", "AuthorID", "AuthorName", "Flagged", "FlagCount", "Dead"}, row, thread, true)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -258,11 +481,11 @@ func (repository ThreadRepository) GetByIDWithComments(id int) (thread *Thread,
 
 	query3 := `
 		SELECT * FROM comments_view c
-		WHERE c.ThreadID = ?
+		WHERE c.ThreadID = ? AND ` + visible + `
 		GROUP BY c.ID
 		ORDER BY c.CommentScore DESC, c.Created DESC;`
-	repository.Logger.Debug(query3, id)
-	rows, err := repository.DB.Query(query3, id)
+	repository.Logger.Debug(query3, append([]interface{}{id}, arguments...))
+	rows, err := repository.DB.Query(query3, append([]interface{}{id}, arguments...)...)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -272,28 +495,72 @@ func (repository ThreadRepository) GetByIDWithComments(id int) (thread *Thread,
 	return
 }
 
-// GetSortedByScore returns threads ordered by thread vote count
+// GetByID returns a thread without its comments
+func (repository ThreadRepository) GetByID(id int64) (thread *Thread, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetByID", time.Now(), &err)
+	query := "SELECT * FROM threads_view WHERE ID = ? ;"
+	repository.log(query, id)
+	rows, err := repository.DB.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	threads := Threads{}
+	if err = MapRowsToSliceOfStruct(rows, &threads, true); err != nil || len(threads) == 0 {
+		return nil, err
+	}
+	return threads[0], nil
+}
+
+// GetByType returns threads of a type, the newest first
+func (repository ThreadRepository) GetByType(storyType string, limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetByType", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	query := "SELECT * FROM threads_view WHERE Type = ? AND NOT Flagged AND " + visible + " ORDER BY Created DESC, Score DESC LIMIT ? OFFSET ? ;"
+	arguments = append(append([]interface{}{storyType}, arguments...), limit, offset)
+	repository.log(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &threads, true)
+	}
+	return
+}
+
+// GetSortedByScore returns threads ordered by their weighted votes plus their favorites
+// weighted by FavoriteWeight, divided by the square of their age in hours plus 2 so that
+// new threads rise and old ones sink. Threads of penalized domains come last,
+// threads the viewer hid are left out
 func (repository ThreadRepository) GetSortedByScore(limit, offset int) (threads Threads, err error) {
-	query := "SELECT * FROM threads_view ORDER BY Created DESC, Score DESC LIMIT ? OFFSET ? ;"
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetSortedByScore", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	notHidden, hiddenArguments := notHiddenFrom(repository.Viewer)
+	// age in hours plus 2
+	age := "(max(0, julianday('now') - julianday(Created)) * 24 + 2)"
+	query := "SELECT * FROM threads_view WHERE NOT Flagged AND " + visible + " AND " + notHidden +
+		" ORDER BY Penalized, (RankingScore + ? * FavoriteCount) / (" + age + " * " + age + ") DESC, Created DESC LIMIT ? OFFSET ? ;"
+	arguments = append(append(arguments, hiddenArguments...), repository.FavoriteWeight, limit, offset)
 	var (
 		rows *sql.Rows
 	)
-	repository.Logger.Debug(query, limit, offset)
-	rows, err = repository.DB.Query(query, limit, offset)
+	repository.Logger.Debug(query, arguments)
+	rows, err = repository.DB.Query(query, arguments...)
 	if err == nil {
 		err = MapRowsToSliceOfStruct(rows, &threads, true)
 	}
 	return
 }
 
-// GetNewest returns threads ordered by age DESC
+// GetNewest returns threads ordered by age DESC, except the threads the viewer hid
 func (repository ThreadRepository) GetNewest(limit, offset int) (threads Threads, err error) {
-	query := "SELECT * FROM threads_view ORDER BY Created DESC LIMIT ? OFFSET ? ;"
-	repository.Logger.Debug(query, limit, offset)
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetNewest", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	notHidden, hiddenArguments := notHiddenFrom(repository.Viewer)
+	query := "SELECT * FROM threads_view WHERE NOT Flagged AND " + visible + " AND " + notHidden + " ORDER BY Created DESC LIMIT ? OFFSET ? ;"
+	arguments = append(append(arguments, hiddenArguments...), limit, offset)
+	repository.Logger.Debug(query, arguments)
 	var (
 		rows *sql.Rows
 	)
-	rows, err = repository.DB.Query(query, limit, offset)
+	rows, err = repository.DB.Query(query, arguments...)
 	if err == nil {
 		err = MapRowsToSliceOfStruct(rows, &threads, true)
 		if err == nil || err == sql.ErrNoRows {
@@ -304,27 +571,180 @@ func (repository ThreadRepository) GetNewest(limit, offset int) (threads Threads
 	return
 }
 
+// GetBest returns the threads submitted since a date with the highest scores
+func (repository ThreadRepository) GetBest(since time.Time, limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetBest", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	notHidden, hiddenArguments := notHiddenFrom(repository.Viewer)
+	query := "SELECT * FROM threads_view WHERE Created >= ? AND NOT Flagged AND " + visible + " AND " + notHidden +
+		" ORDER BY Penalized, RankingScore DESC, Created DESC LIMIT ? OFFSET ? ;"
+	arguments = append(append(append([]interface{}{since.UTC().Format("2006-01-02 15:04:05")}, arguments...), hiddenArguments...), limit, offset)
+	repository.log(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &threads, true)
+	}
+	return
+}
+
+// GetActive returns the threads commented since a date, the most recently commented first
+func (repository ThreadRepository) GetActive(since time.Time, limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetActive", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	notHidden, hiddenArguments := notHiddenFrom(repository.Viewer)
+	query := `SELECT threads_view.* FROM threads_view
+	JOIN (SELECT thread_id, MAX(created) AS LastCommented FROM comments WHERE created >= ? AND NOT dead GROUP BY thread_id) activity
+	ON activity.thread_id = threads_view.ID
+	WHERE NOT Flagged AND ` + visible + ` AND ` + notHidden + `
+	ORDER BY activity.LastCommented DESC LIMIT ? OFFSET ? ;`
+	arguments = append(append(append([]interface{}{since.UTC().Format("2006-01-02 15:04:05")}, arguments...), hiddenArguments...), limit, offset)
+	repository.log(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &threads, true)
+	}
+	return
+}
+
+// GetByDay returns the threads submitted on a day (UTC) ordered by their final score,
+// weighted by FavoriteWeight like the front page
+func (repository ThreadRepository) GetByDay(day time.Time, limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetByDay", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	notHidden, hiddenArguments := notHiddenFrom(repository.Viewer)
+	query := "SELECT * FROM threads_view WHERE Created >= ? AND Created < ? AND NOT Flagged AND " + visible + " AND " + notHidden +
+		" ORDER BY Penalized, RankingScore + ? * FavoriteCount DESC, Created LIMIT ? OFFSET ? ;"
+	start := day.UTC().Truncate(24 * time.Hour)
+	arguments = append(append(append([]interface{}{start.Format("2006-01-02 15:04:05"), start.AddDate(0, 0, 1).Format("2006-01-02 15:04:05")},
+		arguments...), hiddenArguments...), repository.FavoriteWeight, limit, offset)
+	repository.log(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &threads, true)
+	}
+	return
+}
+
+// GetFlagged returns the threads that have flags or are dead, the most flagged first
+func (repository ThreadRepository) GetFlagged(limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetFlagged", time.Now(), &err)
+	query := "SELECT * FROM threads_view WHERE FlagCount > 0 OR Dead ORDER BY Flagged DESC, FlagCount DESC, Created DESC LIMIT ? OFFSET ? ;"
+	repository.log(query, limit, offset)
+	rows, err := repository.DB.Query(query, limit, offset)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &threads, true)
+	}
+	return
+}
+
+// Delete deletes a thread with its comments, votes and flags
+func (repository ThreadRepository) Delete(id int64) (err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.Delete", time.Now(), &err)
+	tx, err := repository.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, command := range []string{
+		"DELETE FROM comment_votes WHERE comment_id IN (SELECT id FROM comments WHERE thread_id = ?1);",
+		"DELETE FROM comment_flags WHERE comment_id IN (SELECT id FROM comments WHERE thread_id = ?1);",
+		"DELETE FROM notifications WHERE comment_id IN (SELECT id FROM comments WHERE thread_id = ?1);",
+		"DELETE FROM comment_favorites WHERE comment_id IN (SELECT id FROM comments WHERE thread_id = ?1);",
+		"DELETE FROM thread_favorites WHERE thread_id = ?1;",
+		"DELETE FROM hidden_threads WHERE thread_id = ?1;",
+		"DELETE FROM comments WHERE thread_id = ?1;",
+		"DELETE FROM thread_votes WHERE thread_id = ?1;",
+		"DELETE FROM thread_flags WHERE thread_id = ?1;",
+	} {
+		repository.log(command, id)
+		if _, err = tx.Exec(command, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	command := "DELETE FROM threads WHERE id = ? ;"
+	repository.log(command, id)
+	result, err := tx.Exec(command, id)
+	if err == nil {
+		err = expectOneRowAffected(result, fmt.Sprintf("thread with id %d not found", id))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetDead kills or revives a thread
+func (repository ThreadRepository) SetDead(id int64, dead bool) (err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.SetDead", time.Now(), &err)
+	command := "UPDATE threads SET dead = ? WHERE id = ? ;"
+	repository.log(command, dead, id)
+	result, err := repository.DB.Exec(command, dead, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRowAffected(result, fmt.Sprintf("thread with id %d not found", id))
+}
+
+// Hide hides a thread from the listings of a user
+func (repository ThreadRepository) Hide(id, userID int64) (err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.Hide", time.Now(), &err)
+	command := "INSERT OR IGNORE INTO hidden_threads(thread_id,user_id) VALUES(?,?);"
+	repository.log(command, id, userID)
+	_, err = repository.DB.Exec(command, id, userID)
+	return err
+}
+
+// Unhide lists a thread hidden by a user again
+func (repository ThreadRepository) Unhide(id, userID int64) (err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.Unhide", time.Now(), &err)
+	command := "DELETE FROM hidden_threads WHERE thread_id = ? AND user_id = ? ;"
+	repository.log(command, id, userID)
+	_, err = repository.DB.Exec(command, id, userID)
+	return err
+}
+
+// GetHiddenByUserID returns the threads a user hid, the last hidden first
+func (repository ThreadRepository) GetHiddenByUserID(userID int64, limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadRepository.GetHiddenByUserID", time.Now(), &err)
+	query := `SELECT t.* FROM threads_view t JOIN hidden_threads h ON h.thread_id = t.ID
+	WHERE h.user_id = ? ORDER BY h.id DESC LIMIT ? OFFSET ? ;`
+	repository.log(query, userID, limit, offset)
+	rows, err := repository.DB.Query(query, userID, limit, offset)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &threads, true)
+	}
+	return
+}
+
 // CommentRepository is a repository of comments
 type CommentRepository struct {
 	*sql.DB
-	Logger LoggerInterface
+	Logger  LoggerInterface
+	Metrics *Metrics
+	// Viewer is the user listings are for, dead comments are hidden from other users
+	Viewer *User
 }
 
 // GetNewestComments returns comments sorted by date of creation
 func (repository *CommentRepository) GetNewestComments() (comments Comments, err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.GetNewestComments", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
 	query := `
 	SELECT 
 		* 
 	FROM 
 		comments_view  c
+	WHERE 
+		` + visible + `
 	ORDER BY 
 		c.Created DESC;`
 
-	repository.Logger.Debug(query)
+	repository.Logger.Debug(query, arguments)
 	var (
 		rows *sql.Rows
 	)
-	rows, err = repository.DB.Query(query)
+	rows, err = repository.DB.Query(query, arguments...)
 	if err == nil {
 		err = MapRowsToSliceOfStruct(rows, &comments, true)
 		if err == nil || err == sql.ErrNoRows {
@@ -335,8 +755,24 @@ func (repository *CommentRepository) GetNewestComments() (comments Comments, err
 	return
 }
 
+// GetBest returns the comments posted since a date with the highest scores
+func (repository *CommentRepository) GetBest(since time.Time, limit, offset int) (comments Comments, err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.GetBest", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	query := "SELECT * FROM comments_view WHERE Created >= ? AND NOT Flagged AND " + visible +
+		" ORDER BY RankingScore DESC, Created DESC LIMIT ? OFFSET ? ;"
+	arguments = append(append([]interface{}{since.UTC().Format("2006-01-02 15:04:05")}, arguments...), limit, offset)
+	repository.Logger.Debug(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &comments, true)
+	}
+	return
+}
+
 // GetByID gets a comment by ID
 func (repository *CommentRepository) GetByID(id int64) (comment *Comment, err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.GetByID", time.Now(), &err)
 	query := `
 	SELECT  
 		ID,
@@ -345,10 +781,18 @@ func (repository *CommentRepository) GetByID(id int64) (comment *Comment, err er
 		ThreadTitle,
 		AuthorID,
 		Content,
+		ContentHTML,
 		Created,
 		Updated,
 		CommentScore,
-		AuthorName 
+		Upvotes,
+		Downvotes,
+		SuspiciousUpvotes,
+		SuspiciousDownvotes,
+		AuthorName,
+		Flagged,
+		FlagCount,
+		Dead 
 	FROM 
 		comments_view c
 	WHERE 
@@ -358,8 +802,8 @@ func (repository *CommentRepository) GetByID(id int64) (comment *Comment, err er
 	row := repository.DB.QueryRow(query, id)
 	comment = new(Comment)
 	err = MapRowToStruct([]string{"ID", "ParentID", "ThreadID",
-		"ThreadTitle", "AuthorID", "Content", "Created", "Updated",
-		"CommentScore", "AuthorName"}, row, comment, true)
+		"ThreadTitle", "AuthorID", "Content", "ContentHTML", "Created", "Updated",
+		"CommentScore", "Upvotes", "Downvotes", "SuspiciousUpvotes", "SuspiciousDownvotes", "AuthorName", "Flagged", "FlagCount", "Dead"}, row, comment, true)
 	switch err {
 	case sql.ErrNoRows:
 		return nil, nil
@@ -369,26 +813,53 @@ func (repository *CommentRepository) GetByID(id int64) (comment *Comment, err er
 }
 
 // Create creates an new comment
-func (repository *CommentRepository) Create(comment *Comment) error {
-	command := `INSERT INTO comments(parent_id,thread_id,author_id,content)
-		VALUES(?,?,?,?);`
+func (repository *CommentRepository) Create(comment *Comment) (err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.Create", time.Now(), &err)
+	// comments of shadowbanned users are dead
+	command := `INSERT INTO comments(parent_id,thread_id,author_id,content,content_html,dead)
+		VALUES(?1,?2,?3,?4,?5,(SELECT shadowbanned FROM users WHERE id = ?3));`
+	comment.ContentHTML = RenderContent(comment.Content)
+	tx, err := repository.DB.Begin()
+	if err != nil {
+		return err
+	}
 	repository.Logger.Debug(command, comment)
-	result, err := repository.DB.Exec(command,
-		comment.ParentID, comment.ThreadID, comment.AuthorID, comment.Content,
+	result, err := tx.Exec(command,
+		comment.ParentID, comment.ThreadID, comment.AuthorID, comment.Content, comment.ContentHTML,
 	)
 	if err == nil {
-		if comment.ID, err = result.LastInsertId(); err == nil {
-			return nil
-		}
+		comment.ID, err = result.LastInsertId()
+	}
+	if err == nil {
+		// the author of the parent comment, or of the story for top-level comments,
+		// is notified unless replying to oneself or the comment is dead
+		command = `INSERT INTO notifications(user_id,comment_id)
+		SELECT coalesce(parent.author_id, threads.author_id), comments.id
+		FROM comments
+		JOIN threads ON threads.id = comments.thread_id
+		LEFT JOIN comments parent ON parent.id = comments.parent_id
+		WHERE comments.id = ?1 AND NOT comments.dead
+		AND coalesce(parent.author_id, threads.author_id) <> comments.author_id ;`
+		repository.Logger.Debug(command, comment.ID)
+		_, err = tx.Exec(command, comment.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err == nil {
+		repository.Metrics.Add("gonews_comments_total", 1)
 	}
 	return err
 }
 
 // GetCommentsByAuthorID returns comments by author_id
 func (repository *CommentRepository) GetCommentsByAuthorID(id int64) (comments Comments, err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.GetCommentsByAuthorID", time.Now(), &err)
 	var (
 		rows *sql.Rows
 	)
+	visible, arguments := visibleTo(repository.Viewer)
 	query := `SELECT 
 				ID,
 				ParentID,
@@ -396,31 +867,249 @@ func (repository *CommentRepository) GetCommentsByAuthorID(id int64) (comments C
 				AuthorName,
 				ThreadID,
 				Content,
+				ContentHTML,
 				Created,
 				Updated,
-				CommentScore
+				CommentScore,
+				Flagged,
+				Dead
 			FROM 
 				comments_view c
 			WHERE 
-				c.AuthorID = ? 
+				c.AuthorID = ? AND ` + visible + `
 			ORDER BY 
 				c.Created DESC;`
-	repository.Logger.Debug(query, id)
-	rows, err = repository.DB.Query(query, id)
+	arguments = append([]interface{}{id}, arguments...)
+	repository.Logger.Debug(query, arguments)
+	rows, err = repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &comments, true)
+	}
+	return
+}
+
+// GetThreadsByAuthorID returns the comments of an author, the newest first, with their replies
+// up to maxDepth levels below them. Subtrees are loaded with a single recursive query
+func (repository *CommentRepository) GetThreadsByAuthorID(id int64, maxDepth, limit, offset int) (comments Comments, err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.GetThreadsByAuthorID", time.Now(), &err)
+	visible, visibleArguments := visibleTo(repository.Viewer)
+	query := `WITH RECURSIVE
+	roots(comment_id, rank) AS (
+		SELECT ID, row_number() OVER (ORDER BY Created DESC, ID DESC) FROM comments_view
+		WHERE AuthorID = ? AND ` + visible + `
+		ORDER BY Created DESC, ID DESC LIMIT ? OFFSET ?
+	),
+	subtree(comment_id, rank, depth) AS (
+		SELECT comment_id, rank, 0 FROM roots
+		UNION ALL
+		SELECT comments.id, subtree.rank, subtree.depth + 1 FROM comments
+		JOIN subtree ON comments.parent_id = subtree.comment_id
+		WHERE subtree.depth < ?
+	)
+	SELECT c.*, subtree.depth AS Depth FROM subtree JOIN comments_view c ON c.ID = subtree.comment_id
+	WHERE ` + visible + `
+	ORDER BY subtree.rank, subtree.depth, c.CommentScore DESC, c.Created DESC ;`
+	arguments := append([]interface{}{id}, visibleArguments...)
+	arguments = append(append(arguments, limit, offset, maxDepth), visibleArguments...)
+	repository.Logger.Debug(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err != nil {
+		return nil, err
+	}
+	var flat Comments
+	if err = MapRowsToSliceOfStruct(rows, &flat, true); err != nil {
+		return nil, err
+	}
+	// rows of a subtree follow its root, parents before their replies.
+	// Replies of hidden comments are left out like on the story page
+	var subtree map[int64]*Comment
+	for _, comment := range flat {
+		if comment.Depth == 0 {
+			subtree = map[int64]*Comment{}
+			comments = append(comments, comment)
+		} else if parent, ok := subtree[comment.ParentID]; ok {
+			parent.Children = append(parent.Children, comment)
+		} else {
+			continue
+		}
+		subtree[comment.ID] = comment
+	}
+	return comments, nil
+}
+
+// GetFlagged returns the comments that have flags or are dead, the most flagged first
+func (repository *CommentRepository) GetFlagged(limit, offset int) (comments Comments, err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.GetFlagged", time.Now(), &err)
+	query := "SELECT * FROM comments_view WHERE FlagCount > 0 OR Dead ORDER BY Flagged DESC, FlagCount DESC, Created DESC LIMIT ? OFFSET ? ;"
+	repository.Logger.Debug(query, limit, offset)
+	rows, err := repository.DB.Query(query, limit, offset)
 	if err == nil {
 		err = MapRowsToSliceOfStruct(rows, &comments, true)
 	}
 	return
 }
 
+// Delete deletes a comment with its replies, their votes and flags
+func (repository *CommentRepository) Delete(id int64) (err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.Delete", time.Now(), &err)
+	tx, err := repository.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// the comment and its replies at any depth
+	const subtree = `WITH RECURSIVE subtree(id) AS (
+		SELECT id FROM comments WHERE id = ?1
+		UNION ALL
+		SELECT comments.id FROM comments JOIN subtree ON comments.parent_id = subtree.id
+	) `
+	for _, command := range []string{
+		subtree + "DELETE FROM comment_votes WHERE comment_id IN (SELECT id FROM subtree);",
+		subtree + "DELETE FROM comment_flags WHERE comment_id IN (SELECT id FROM subtree);",
+		subtree + "DELETE FROM notifications WHERE comment_id IN (SELECT id FROM subtree);",
+		subtree + "DELETE FROM comment_favorites WHERE comment_id IN (SELECT id FROM subtree);",
+		subtree + "DELETE FROM comments WHERE id IN (SELECT id FROM subtree);",
+	} {
+		repository.Logger.Debug(command, id)
+		if _, err = tx.Exec(command, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetDead kills or revives a comment
+func (repository *CommentRepository) SetDead(id int64, dead bool) (err error) {
+	defer repository.Metrics.ObserveQuery("CommentRepository.SetDead", time.Now(), &err)
+	command := "UPDATE comments SET dead = ? WHERE id = ? ;"
+	repository.Logger.Debug(command, dead, id)
+	result, err := repository.DB.Exec(command, dead, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRowAffected(result, fmt.Sprintf("comment with id %d not found", id))
+}
+
+// How users vote, VoteUp casts an upvote, VoteDown a downvote and VoteUn removes the vote
+const (
+	VoteUp   = "up"
+	VoteDown = "down"
+	VoteUn   = "un"
+)
+
+// Errors of votes that can't be cast, changed or removed
+var (
+	// ErrSelfVote is returned when users vote on their own items, the automatic vote of the author can't change
+	ErrSelfVote = errors.New("the vote of the author can't be changed")
+	// ErrVoteWindow is returned when a vote is changed or removed after the unvote window
+	ErrVoteWindow = errors.New("the vote can't be changed anymore")
+	// ErrNoVote is returned when removing a vote that doesn't exist
+	ErrNoVote = errors.New("there is no vote to remove")
+)
+
+// getVoteScore returns the score of the vote of a user on a story or a comment, 0 without vote
+func getVoteScore(db *sql.DB, logger LoggerInterface, kind string, itemID, userID int64) (score int, err error) {
+	tables := flagTables[kind]
+	query := fmt.Sprintf("SELECT score FROM %s WHERE %s = ? AND author_id = ? ;", tables.votes, tables.column)
+	logger.Debug(query, itemID, userID)
+	err = db.QueryRow(query, itemID, userID).Scan(&score)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return score, err
+}
+
+// castVote casts, changes or removes (score 0) the vote of a user on a story or a comment
+// in a transaction, the karma of the author is updated by triggers in the same transaction.
+// Votes can only be changed or removed during window, the vote of the author never.
+// created is true if a new vote was cast
+func castVote(db *sql.DB, logger LoggerInterface, kind string, itemID, userID int64, score int, window time.Duration) (created bool, err error) {
+	tables := flagTables[kind]
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	var authorID int64
+	query := fmt.Sprintf("SELECT author_id FROM %s WHERE id = ? ;", tables.items)
+	logger.Debug(query, itemID)
+	if err = tx.QueryRow(query, itemID).Scan(&authorID); err != nil {
+		return false, err
+	}
+	if authorID == userID {
+		return false, ErrSelfVote
+	}
+	var (
+		previous int
+		cast     time.Time
+	)
+	query = fmt.Sprintf("SELECT score, created FROM %s WHERE %s = ? AND author_id = ? ;", tables.votes, tables.column)
+	logger.Debug(query, itemID, userID)
+	switch err = tx.QueryRow(query, itemID, userID).Scan(&previous, &cast); {
+	case err == sql.ErrNoRows && score == 0:
+		return false, ErrNoVote
+	case err == sql.ErrNoRows:
+		command := fmt.Sprintf("INSERT INTO %s(%s,author_id,score) VALUES(?,?,?) ;", tables.votes, tables.column)
+		logger.Debug(command, itemID, userID, score)
+		_, err = tx.Exec(command, itemID, userID, score)
+		created = true
+	case err != nil:
+		return false, err
+	case previous == score:
+	case time.Since(cast) > window:
+		return false, ErrVoteWindow
+	case score == 0:
+		command := fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND author_id = ? ;", tables.votes, tables.column)
+		logger.Debug(command, itemID, userID)
+		_, err = tx.Exec(command, itemID, userID)
+	default:
+		command := fmt.Sprintf("UPDATE %s SET score = ?, updated = datetime('now') WHERE %s = ? AND author_id = ? ;", tables.votes, tables.column)
+		logger.Debug(command, score, itemID, userID)
+		_, err = tx.Exec(command, score, itemID, userID)
+	}
+	if err != nil {
+		return false, err
+	}
+	return created, tx.Commit()
+}
+
 // CommentVoteRepository is a repository of comment votes
 type CommentVoteRepository struct {
-	DB     *sql.DB
-	Logger LoggerInterface
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+// GetScore returns the score of the vote of a user on a comment, 0 if the user didn't vote
+func (repository *CommentVoteRepository) GetScore(commentID, userID int64) (score int, err error) {
+	defer repository.Metrics.ObserveQuery("CommentVoteRepository.GetScore", time.Now(), &err)
+	return getVoteScore(repository.DB, repository.Logger, FlagKindComment, commentID, userID)
+}
+
+// Vote casts or changes the vote of a user on a comment
+func (repository *CommentVoteRepository) Vote(commentID, userID int64, score int, window time.Duration) (err error) {
+	defer repository.Metrics.ObserveQuery("CommentVoteRepository.Vote", time.Now(), &err)
+	created, err := castVote(repository.DB, repository.Logger, FlagKindComment, commentID, userID, score, window)
+	if created {
+		repository.Metrics.Add("gonews_votes_total", 1, "kind", "comment")
+	}
+	return err
+}
+
+// Unvote removes the vote of a user on a comment cast less than window ago
+func (repository *CommentVoteRepository) Unvote(commentID, userID int64, window time.Duration) (err error) {
+	defer repository.Metrics.ObserveQuery("CommentVoteRepository.Unvote", time.Now(), &err)
+	_, err = castVote(repository.DB, repository.Logger, FlagKindComment, commentID, userID, 0, window)
+	return err
 }
 
 // GetByUser filters by user
 func (repository *CommentVoteRepository) GetByUser(user *User) (commentVotes CommentVotes, err error) {
+	defer repository.Metrics.ObserveQuery("CommentVoteRepository.GetByUser", time.Now(), &err)
 	var (
 		rows  *sql.Rows
 		query string
@@ -436,25 +1125,52 @@ func (repository *CommentVoteRepository) GetByUser(user *User) (commentVotes Com
 
 // ThreadVoteRepository is a repository of thread votes
 type ThreadVoteRepository struct {
-	DB     *sql.DB
-	Logger LoggerInterface
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
 }
 
 // Create creates a new thread vote
 func (repository *ThreadVoteRepository) Create(threadVote *ThreadVote) (i int64, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadVoteRepository.Create", time.Now(), &err)
 	query := "INSERT INTO thread_votes(thread_id,author_id,score) values(?,?,?)"
 	repository.Logger.Debug(query, threadVote)
 	result, err := repository.DB.Exec(query, threadVote.ThreadID, threadVote.AuthorID, threadVote.Score)
 	if err == nil {
 		if i, err = result.LastInsertId(); err == nil {
+			repository.Metrics.Add("gonews_votes_total", 1, "kind", "story")
 			return i, nil
 		}
 	}
 	return 0, err
 }
 
+// GetScore returns the score of the vote of a user on a thread, 0 if the user didn't vote
+func (repository *ThreadVoteRepository) GetScore(threadID, userID int64) (score int, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadVoteRepository.GetScore", time.Now(), &err)
+	return getVoteScore(repository.DB, repository.Logger, FlagKindStory, threadID, userID)
+}
+
+// Vote casts or changes the vote of a user on a thread
+func (repository *ThreadVoteRepository) Vote(threadID, userID int64, score int, window time.Duration) (err error) {
+	defer repository.Metrics.ObserveQuery("ThreadVoteRepository.Vote", time.Now(), &err)
+	created, err := castVote(repository.DB, repository.Logger, FlagKindStory, threadID, userID, score, window)
+	if created {
+		repository.Metrics.Add("gonews_votes_total", 1, "kind", "story")
+	}
+	return err
+}
+
+// Unvote removes the vote of a user on a thread cast less than window ago
+func (repository *ThreadVoteRepository) Unvote(threadID, userID int64, window time.Duration) (err error) {
+	defer repository.Metrics.ObserveQuery("ThreadVoteRepository.Unvote", time.Now(), &err)
+	_, err = castVote(repository.DB, repository.Logger, FlagKindStory, threadID, userID, 0, window)
+	return err
+}
+
 // GetByUser select thread votes bu user
 func (repository *ThreadVoteRepository) GetByUser(user *User) (threadVotes ThreadVotes, err error) {
+	defer repository.Metrics.ObserveQuery("ThreadVoteRepository.GetByUser", time.Now(), &err)
 	var (
 		rows  *sql.Rows
 		query string
@@ -467,3 +1183,701 @@ func (repository *ThreadVoteRepository) GetByUser(user *User) (threadVotes Threa
 	}
 	return
 }
+
+// SessionRepository is a repository of server side sessions
+type SessionRepository struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+func (repository *SessionRepository) debug(messages ...interface{}) {
+	if repository.Logger != nil {
+		repository.Logger.Debug(messages...)
+	}
+}
+
+// GetByID returns a session which has not expired or nil if not found
+func (repository *SessionRepository) GetByID(id string) (record *SessionRecord, err error) {
+	defer repository.Metrics.ObserveQuery("SessionRepository.GetByID", time.Now(), &err)
+	query := `SELECT id, coalesce(user_id,0), data, user_agent, ip, created, last_seen, expires
+	FROM sessions WHERE id = ? AND expires > datetime('now') ;`
+	repository.debug(query, id)
+	record = new(SessionRecord)
+	err = repository.DB.QueryRow(query, id).Scan(&record.ID, &record.UserID, &record.Data,
+		&record.UserAgent, &record.IP, &record.Created, &record.LastSeen, &record.Expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// GetByUserID returns the sessions of a user which have not expired, the most recently used first
+func (repository *SessionRepository) GetByUserID(userID int64) (records []*SessionRecord, err error) {
+	defer repository.Metrics.ObserveQuery("SessionRepository.GetByUserID", time.Now(), &err)
+	query := `SELECT id, user_agent, ip, created, last_seen, expires
+	FROM sessions WHERE user_id = ? AND expires > datetime('now') ORDER BY last_seen DESC ;`
+	repository.debug(query, userID)
+	rows, err := repository.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		record := &SessionRecord{UserID: userID}
+		if err = rows.Scan(&record.ID, &record.UserAgent, &record.IP, &record.Created, &record.LastSeen, &record.Expires); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Save inserts or updates a session which expires in maxAge seconds
+func (repository *SessionRepository) Save(record *SessionRecord, maxAge int) (err error) {
+	defer repository.Metrics.ObserveQuery("SessionRepository.Save", time.Now(), &err)
+	command := `INSERT INTO sessions(id, user_id, data, user_agent, ip, expires)
+	VALUES(?1, nullif(?2,0), ?3, ?4, ?5, datetime('now', '+' || ?6 || ' seconds'))
+	ON CONFLICT(id) DO UPDATE SET user_id = nullif(?2,0), data = ?3, user_agent = ?4, ip = ?5,
+	last_seen = datetime('now'), expires = datetime('now', '+' || ?6 || ' seconds') ;`
+	repository.debug(command, record.ID, record.UserID)
+	_, err = repository.DB.Exec(command, record.ID, record.UserID, record.Data, record.UserAgent, record.IP, maxAge)
+	return err
+}
+
+// Delete deletes a session
+func (repository *SessionRepository) Delete(id string) (err error) {
+	defer repository.Metrics.ObserveQuery("SessionRepository.Delete", time.Now(), &err)
+	command := "DELETE FROM sessions WHERE id = ? ;"
+	repository.debug(command, id)
+	_, err = repository.DB.Exec(command, id)
+	return err
+}
+
+// DeleteByUserID deletes the sessions of a user except the sessions which ids are in except
+func (repository *SessionRepository) DeleteByUserID(userID int64, except ...string) (n int64, err error) {
+	defer repository.Metrics.ObserveQuery("SessionRepository.DeleteByUserID", time.Now(), &err)
+	command := "DELETE FROM sessions WHERE user_id = ?"
+	arguments := []interface{}{userID}
+	if len(except) > 0 {
+		command += " AND id NOT IN (?" + strings.Repeat(",?", len(except)-1) + ")"
+		for _, id := range except {
+			arguments = append(arguments, id)
+		}
+	}
+	repository.debug(append([]interface{}{command}, arguments...)...)
+	result, err := repository.DB.Exec(command+" ;", arguments...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpired deletes expired sessions, unless ctx is done first
+func (repository *SessionRepository) DeleteExpired(ctx context.Context) (err error) {
+	defer repository.Metrics.ObserveQuery("SessionRepository.DeleteExpired", time.Now(), &err)
+	command := "DELETE FROM sessions WHERE expires <= datetime('now') ;"
+	repository.debug(command)
+	_, err = repository.DB.ExecContext(ctx, command)
+	return err
+}
+
+// RememberTokenRepository is a repository of "remember me" tokens
+type RememberTokenRepository struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+func (repository *RememberTokenRepository) debug(messages ...interface{}) {
+	if repository.Logger != nil {
+		repository.Logger.Debug(messages...)
+	}
+}
+
+// Create persists a token which expires in maxAge seconds
+func (repository *RememberTokenRepository) Create(token *RememberToken, maxAge int) (err error) {
+	defer repository.Metrics.ObserveQuery("RememberTokenRepository.Create", time.Now(), &err)
+	command := `INSERT INTO remember_tokens(selector, validator_hash, user_id, expires)
+	VALUES(?, ?, ?, datetime('now', '+' || ? || ' seconds')) ;`
+	repository.debug(command, token.Selector, token.UserID)
+	result, err := repository.DB.Exec(command, token.Selector, token.ValidatorHash, token.UserID, maxAge)
+	if err != nil {
+		return err
+	}
+	token.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetBySelector returns a token, expired or not, nil if not found
+func (repository *RememberTokenRepository) GetBySelector(selector string) (token *RememberToken, err error) {
+	defer repository.Metrics.ObserveQuery("RememberTokenRepository.GetBySelector", time.Now(), &err)
+	query := `SELECT id, selector, validator_hash, previous_validator_hash, user_id, created, last_used, expires
+	FROM remember_tokens WHERE selector = ? ;`
+	repository.debug(query, selector)
+	token = new(RememberToken)
+	err = repository.DB.QueryRow(query, selector).Scan(&token.ID, &token.Selector, &token.ValidatorHash,
+		&token.PreviousValidatorHash, &token.UserID, &token.Created, &token.LastUsed, &token.Expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// IsExpired returns true if a token has expired
+func (repository *RememberTokenRepository) IsExpired(token *RememberToken) (expired bool, err error) {
+	defer repository.Metrics.ObserveQuery("RememberTokenRepository.IsExpired", time.Now(), &err)
+	query := "SELECT expires <= datetime('now') FROM remember_tokens WHERE id = ? ;"
+	repository.debug(query, token.ID)
+	err = repository.DB.QueryRow(query, token.ID).Scan(&expired)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return expired, err
+}
+
+// Rotate replaces the validator of a token, the current validator becomes the
+// previous one, the token expires in maxAge seconds
+func (repository *RememberTokenRepository) Rotate(token *RememberToken, validatorHash string, maxAge int) (err error) {
+	defer repository.Metrics.ObserveQuery("RememberTokenRepository.Rotate", time.Now(), &err)
+	command := `UPDATE remember_tokens SET previous_validator_hash = validator_hash, validator_hash = ?,
+	last_used = datetime('now'), expires = datetime('now', '+' || ? || ' seconds') WHERE id = ? ;`
+	repository.debug(command, token.ID)
+	result, err := repository.DB.Exec(command, validatorHash, maxAge, token.ID)
+	if err != nil {
+		return err
+	}
+	if err = expectOneRowAffected(result, fmt.Sprintf("remember token with id %d not found", token.ID)); err != nil {
+		return err
+	}
+	token.PreviousValidatorHash, token.ValidatorHash = token.ValidatorHash, validatorHash
+	return nil
+}
+
+// DeleteBySelector deletes a token
+func (repository *RememberTokenRepository) DeleteBySelector(selector string) (err error) {
+	defer repository.Metrics.ObserveQuery("RememberTokenRepository.DeleteBySelector", time.Now(), &err)
+	command := "DELETE FROM remember_tokens WHERE selector = ? ;"
+	repository.debug(command, selector)
+	_, err = repository.DB.Exec(command, selector)
+	return err
+}
+
+// DeleteByUserID deletes all the tokens of a user, expired tokens
+// of other users are cleaned up as well
+func (repository *RememberTokenRepository) DeleteByUserID(userID int64) (err error) {
+	defer repository.Metrics.ObserveQuery("RememberTokenRepository.DeleteByUserID", time.Now(), &err)
+	command := "DELETE FROM remember_tokens WHERE user_id = ? OR expires <= datetime('now') ;"
+	repository.debug(command, userID)
+	_, err = repository.DB.Exec(command, userID)
+	return err
+}
+
+// Kinds of flagged items
+const (
+	FlagKindStory   = "story"
+	FlagKindComment = "comment"
+)
+
+// flagTables are the flag table, the item column, the item table and the vote table of each kind of item
+var flagTables = map[string]struct{ flags, column, items, votes string }{
+	FlagKindStory:   {"thread_flags", "thread_id", "threads", "thread_votes"},
+	FlagKindComment: {"comment_flags", "comment_id", "comments", "comment_votes"},
+}
+
+// FlagRepository is a repository of story and comment flags
+type FlagRepository struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+func (repository *FlagRepository) debug(messages ...interface{}) {
+	if repository.Logger != nil {
+		repository.Logger.Debug(messages...)
+	}
+}
+
+func (repository *FlagRepository) tables(kind string) (tables struct{ flags, column, items, votes string }, err error) {
+	tables, ok := flagTables[kind]
+	if !ok {
+		return tables, fmt.Errorf("not a valid kind of item : '%s'", kind)
+	}
+	return tables, nil
+}
+
+// HasFlagged returns true if a user flagged an item
+func (repository *FlagRepository) HasFlagged(kind string, itemID, userID int64) (flagged bool, err error) {
+	defer repository.Metrics.ObserveQuery("FlagRepository.HasFlagged", time.Now(), &err)
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return false, err
+	}
+	query := fmt.Sprintf("SELECT COUNT(*) > 0 FROM %s WHERE %s = ? AND user_id = ? ;", tables.flags, tables.column)
+	repository.debug(query, itemID, userID)
+	err = repository.DB.QueryRow(query, itemID, userID).Scan(&flagged)
+	return
+}
+
+// Flag flags an item for a user then updates the flagged state of the item
+func (repository *FlagRepository) Flag(kind string, itemID, userID int64, threshold int) (err error) {
+	defer repository.Metrics.ObserveQuery("FlagRepository.Flag", time.Now(), &err)
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf("INSERT OR IGNORE INTO %s(%s,user_id) VALUES(?,?);", tables.flags, tables.column)
+	repository.debug(command, itemID, userID)
+	if _, err = repository.DB.Exec(command, itemID, userID); err != nil {
+		return err
+	}
+	return repository.update(kind, itemID, threshold)
+}
+
+// Unflag removes the flag of a user then updates the flagged state of the item
+func (repository *FlagRepository) Unflag(kind string, itemID, userID int64, threshold int) (err error) {
+	defer repository.Metrics.ObserveQuery("FlagRepository.Unflag", time.Now(), &err)
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND user_id = ? ;", tables.flags, tables.column)
+	repository.debug(command, itemID, userID)
+	if _, err = repository.DB.Exec(command, itemID, userID); err != nil {
+		return err
+	}
+	return repository.update(kind, itemID, threshold)
+}
+
+// Restore deletes the flags of an item and shows it again
+func (repository *FlagRepository) Restore(kind string, itemID int64) (err error) {
+	defer repository.Metrics.ObserveQuery("FlagRepository.Restore", time.Now(), &err)
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf("DELETE FROM %s WHERE %s = ? ;", tables.flags, tables.column)
+	repository.debug(command, itemID)
+	if _, err = repository.DB.Exec(command, itemID); err != nil {
+		return err
+	}
+	command = fmt.Sprintf("UPDATE %s SET flagged = 0 WHERE id = ? ;", tables.items)
+	repository.debug(command, itemID)
+	_, err = repository.DB.Exec(command, itemID)
+	return err
+}
+
+// update flags an item when its flags reach the threshold and
+// at least half of its score, so well liked items need more flags
+func (repository *FlagRepository) update(kind string, itemID int64, threshold int) error {
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf(`UPDATE %[3]s SET flagged = (
+		SELECT flags >= ?2 AND flags * 2 >= score FROM (
+			SELECT (SELECT COUNT(*) FROM %[1]s WHERE %[2]s = ?1) AS flags,
+			       (SELECT coalesce(SUM(score), 0) FROM %[4]s WHERE %[2]s = ?1) AS score
+		)
+	) WHERE id = ?1 ;`, tables.flags, tables.column, tables.items, tables.votes)
+	repository.debug(command, itemID, threshold)
+	result, err := repository.DB.Exec(command, itemID, threshold)
+	if err != nil {
+		return err
+	}
+	return expectOneRowAffected(result, fmt.Sprintf("%s with id %d not found", kind, itemID))
+}
+
+// ModerationLogRepository is a repository of moderation actions,
+// entries can only be appended
+type ModerationLogRepository struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+func (repository *ModerationLogRepository) debug(messages ...interface{}) {
+	if repository.Logger != nil {
+		repository.Logger.Debug(messages...)
+	}
+}
+
+// Create appends an entry to the moderation log
+func (repository *ModerationLogRepository) Create(entry *ModerationLogEntry) (err error) {
+	defer repository.Metrics.ObserveQuery("ModerationLogRepository.Create", time.Now(), &err)
+	return repository.create(repository.DB, entry)
+}
+
+func (repository *ModerationLogRepository) create(db executor, entry *ModerationLogEntry) error {
+	command := `INSERT INTO moderation_log(actor_id,actor_name,target_type,target_id,action,reason,before,after)
+	VALUES(nullif(?,0),?,?,?,?,?,?,?);`
+	repository.debug(command, entry.ActorName, entry.Action, entry.TargetType, entry.TargetID)
+	result, err := db.Exec(command, entry.ActorID, entry.ActorName, entry.TargetType, entry.TargetID,
+		entry.Action, entry.Reason, entry.Before, entry.After)
+	if err != nil {
+		return err
+	}
+	entry.ID, err = result.LastInsertId()
+	return err
+}
+
+// Find returns the entries matching a filter, the newest first, every entry if limit is -1
+func (repository *ModerationLogRepository) Find(filter ModerationLogFilter, limit, offset int) (entries []*ModerationLogEntry, err error) {
+	defer repository.Metrics.ObserveQuery("ModerationLogRepository.Find", time.Now(), &err)
+	query := `SELECT id, coalesce(actor_id,0), actor_name, target_type, target_id, action, reason, before, after, created
+	FROM moderation_log WHERE (?1 = '' OR actor_name = ?1) AND (?2 = '' OR action = ?2)
+	AND (?3 = '' OR target_type = ?3) AND (?4 = 0 OR target_id = ?4)
+	ORDER BY id DESC LIMIT ?5 OFFSET ?6 ;`
+	repository.debug(query, filter, limit, offset)
+	rows, err := repository.DB.Query(query, filter.ActorName, filter.Action, filter.TargetType, filter.TargetID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := new(ModerationLogEntry)
+		if err = rows.Scan(&entry.ID, &entry.ActorID, &entry.ActorName, &entry.TargetType, &entry.TargetID,
+			&entry.Action, &entry.Reason, &entry.Before, &entry.After, &entry.Created); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// DomainRuleRepository is a repository of domain rules
+type DomainRuleRepository struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+func (repository *DomainRuleRepository) debug(messages ...interface{}) {
+	if repository.Logger != nil {
+		repository.Logger.Debug(messages...)
+	}
+}
+
+// GetAll returns the rules, domains first
+func (repository *DomainRuleRepository) GetAll() (rules []*DomainRule, err error) {
+	defer repository.Metrics.ObserveQuery("DomainRuleRepository.GetAll", time.Now(), &err)
+	query := "SELECT id, pattern, is_regex, rule, reason, created FROM domain_rules ORDER BY is_regex, pattern ;"
+	repository.debug(query)
+	rows, err := repository.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rule := new(DomainRule)
+		if err = rows.Scan(&rule.ID, &rule.Pattern, &rule.IsRegex, &rule.Rule, &rule.Reason, &rule.Created); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// GetByID returns a rule or nil if not found
+func (repository *DomainRuleRepository) GetByID(id int64) (rule *DomainRule, err error) {
+	defer repository.Metrics.ObserveQuery("DomainRuleRepository.GetByID", time.Now(), &err)
+	query := "SELECT id, pattern, is_regex, rule, reason, created FROM domain_rules WHERE id = ? ;"
+	repository.debug(query, id)
+	rule = new(DomainRule)
+	err = repository.DB.QueryRow(query, id).Scan(&rule.ID, &rule.Pattern, &rule.IsRegex, &rule.Rule, &rule.Reason, &rule.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// Save validates a rule then creates it, or replaces the rule with the same pattern
+func (repository *DomainRuleRepository) Save(rule *DomainRule) (err error) {
+	defer repository.Metrics.ObserveQuery("DomainRuleRepository.Save", time.Now(), &err)
+	return repository.save(repository.DB, rule)
+}
+
+// SaveAll saves rules in a single transaction, along with the moderation log entry
+// that logEntry returns for each saved rule. Either every rule is saved and logged or none is
+func (repository *DomainRuleRepository) SaveAll(rules []*DomainRule, moderationLog *ModerationLogRepository, logEntry func(*DomainRule) (*ModerationLogEntry, error)) (err error) {
+	defer repository.Metrics.ObserveQuery("DomainRuleRepository.SaveAll", time.Now(), &err)
+	tx, err := repository.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for _, rule := range rules {
+		if err = repository.save(tx, rule); err != nil {
+			return err
+		}
+		var entry *ModerationLogEntry
+		if entry, err = logEntry(rule); err != nil {
+			return err
+		}
+		if err = moderationLog.create(tx, entry); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (repository *DomainRuleRepository) save(db executor, rule *DomainRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	command := `INSERT INTO domain_rules(pattern, is_regex, rule, reason) VALUES(?, ?, ?, ?)
+	ON CONFLICT(is_regex, pattern) DO UPDATE SET rule = excluded.rule, reason = excluded.reason ;`
+	repository.debug(command, rule.Pattern, rule.IsRegex, rule.Rule)
+	if _, err := db.Exec(command, rule.Pattern, rule.IsRegex, rule.Rule, rule.Reason); err != nil {
+		return err
+	}
+	query := "SELECT id, created FROM domain_rules WHERE is_regex = ? AND pattern = ? ;"
+	return db.QueryRow(query, rule.IsRegex, rule.Pattern).Scan(&rule.ID, &rule.Created)
+}
+
+// Delete deletes a rule
+func (repository *DomainRuleRepository) Delete(id int64) (err error) {
+	defer repository.Metrics.ObserveQuery("DomainRuleRepository.Delete", time.Now(), &err)
+	return repository.delete(repository.DB, id)
+}
+
+// DeleteWithLog deletes a rule and records entry in the moderation log
+// in a single transaction
+func (repository *DomainRuleRepository) DeleteWithLog(id int64, moderationLog *ModerationLogRepository, entry *ModerationLogEntry) (err error) {
+	defer repository.Metrics.ObserveQuery("DomainRuleRepository.DeleteWithLog", time.Now(), &err)
+	tx, err := repository.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err = repository.delete(tx, id); err != nil {
+		return err
+	}
+	if err = moderationLog.create(tx, entry); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repository *DomainRuleRepository) delete(db executor, id int64) error {
+	command := "DELETE FROM domain_rules WHERE id = ? ;"
+	repository.debug(command, id)
+	result, err := db.Exec(command, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRowAffected(result, fmt.Sprintf("domain rule with id %d not found", id))
+}
+
+// Match returns the strongest rule applying to an url, nil if none applies
+func (repository *DomainRuleRepository) Match(url string) (match *DomainRule, err error) {
+	rules, err := repository.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Matches(url) && rule.StrongerThan(match) {
+			match = rule
+		}
+	}
+	return match, nil
+}
+
+// NotificationRepository is a repository of notifications
+type NotificationRepository struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+func (repository *NotificationRepository) debug(messages ...interface{}) {
+	if repository.Logger != nil {
+		repository.Logger.Debug(messages...)
+	}
+}
+
+// notificationQuery selects notifications with their comment
+const notificationQuery = `SELECT n.id, n.user_id, n.comment_id, n.read, n.created,
+	c.ID, c.AuthorID, c.AuthorName, c.ThreadID, c.ThreadTitle, c.ParentID, c.ContentHTML, c.Created
+	FROM notifications n JOIN comments_view c ON c.ID = n.comment_id `
+
+func (repository *NotificationRepository) find(query string, arguments ...interface{}) (notifications []*Notification, err error) {
+	repository.debug(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		notification := &Notification{Comment: new(Comment)}
+		comment := notification.Comment
+		if err = rows.Scan(&notification.ID, &notification.UserID, &notification.CommentID, &notification.Read, &notification.Created,
+			&comment.ID, &comment.AuthorID, &comment.AuthorName, &comment.ThreadID, &comment.ThreadTitle, &comment.ParentID,
+			&comment.ContentHTML, &comment.Created); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, rows.Err()
+}
+
+// GetByUserID returns the notifications of a user, the newest first
+func (repository *NotificationRepository) GetByUserID(userID int64, limit, offset int) (notifications []*Notification, err error) {
+	defer repository.Metrics.ObserveQuery("NotificationRepository.GetByUserID", time.Now(), &err)
+	return repository.find(notificationQuery+"WHERE n.user_id = ? ORDER BY n.id DESC LIMIT ? OFFSET ? ;", userID, limit, offset)
+}
+
+// GetByCommentID returns the notification created for a comment or nil if not found
+func (repository *NotificationRepository) GetByCommentID(commentID int64) (notification *Notification, err error) {
+	defer repository.Metrics.ObserveQuery("NotificationRepository.GetByCommentID", time.Now(), &err)
+	notifications, err := repository.find(notificationQuery+"WHERE n.comment_id = ? ;", commentID)
+	if err != nil || len(notifications) == 0 {
+		return nil, err
+	}
+	return notifications[0], nil
+}
+
+// CountUnread returns the number of unread notifications of a user
+func (repository *NotificationRepository) CountUnread(userID int64) (count int, err error) {
+	defer repository.Metrics.ObserveQuery("NotificationRepository.CountUnread", time.Now(), &err)
+	query := "SELECT COUNT(*) FROM notifications WHERE user_id = ? AND NOT read ;"
+	repository.debug(query, userID)
+	err = repository.DB.QueryRow(query, userID).Scan(&count)
+	return
+}
+
+// MarkAsRead marks a notification of a user as read
+func (repository *NotificationRepository) MarkAsRead(userID, id int64) (err error) {
+	defer repository.Metrics.ObserveQuery("NotificationRepository.MarkAsRead", time.Now(), &err)
+	command := "UPDATE notifications SET read = 1 WHERE id = ? AND user_id = ? ;"
+	repository.debug(command, id, userID)
+	result, err := repository.DB.Exec(command, id, userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRowAffected(result, fmt.Sprintf("notification with id %d not found", id))
+}
+
+// MarkAllAsRead marks every notification of a user as read
+func (repository *NotificationRepository) MarkAllAsRead(userID int64) (err error) {
+	defer repository.Metrics.ObserveQuery("NotificationRepository.MarkAllAsRead", time.Now(), &err)
+	command := "UPDATE notifications SET read = 1 WHERE user_id = ? AND NOT read ;"
+	repository.debug(command, userID)
+	_, err = repository.DB.Exec(command, userID)
+	return err
+}
+
+// favoriteTables are the favorite table and the item column of each kind of item
+var favoriteTables = map[string]struct{ favorites, column string }{
+	FlagKindStory:   {"thread_favorites", "thread_id"},
+	FlagKindComment: {"comment_favorites", "comment_id"},
+}
+
+// FavoriteRepository is a repository of favorite stories and comments
+type FavoriteRepository struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+	// Viewer is the user listings are for, dead items are hidden from other users
+	Viewer *User
+}
+
+func (repository *FavoriteRepository) debug(messages ...interface{}) {
+	if repository.Logger != nil {
+		repository.Logger.Debug(messages...)
+	}
+}
+
+func (repository *FavoriteRepository) tables(kind string) (tables struct{ favorites, column string }, err error) {
+	tables, ok := favoriteTables[kind]
+	if !ok {
+		return tables, fmt.Errorf("not a valid kind of item : '%s'", kind)
+	}
+	return tables, nil
+}
+
+// HasFavorited returns true if a user saved an item to the user's favorites
+func (repository *FavoriteRepository) HasFavorited(kind string, itemID, userID int64) (favorited bool, err error) {
+	defer repository.Metrics.ObserveQuery("FavoriteRepository.HasFavorited", time.Now(), &err)
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return false, err
+	}
+	query := fmt.Sprintf("SELECT COUNT(*) > 0 FROM %s WHERE %s = ? AND user_id = ? ;", tables.favorites, tables.column)
+	repository.debug(query, itemID, userID)
+	err = repository.DB.QueryRow(query, itemID, userID).Scan(&favorited)
+	return
+}
+
+// Favorite saves an item to the favorites of a user
+func (repository *FavoriteRepository) Favorite(kind string, itemID, userID int64) (err error) {
+	defer repository.Metrics.ObserveQuery("FavoriteRepository.Favorite", time.Now(), &err)
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf("INSERT OR IGNORE INTO %s(%s,user_id) VALUES(?,?);", tables.favorites, tables.column)
+	repository.debug(command, itemID, userID)
+	_, err = repository.DB.Exec(command, itemID, userID)
+	return err
+}
+
+// Unfavorite removes an item from the favorites of a user
+func (repository *FavoriteRepository) Unfavorite(kind string, itemID, userID int64) (err error) {
+	defer repository.Metrics.ObserveQuery("FavoriteRepository.Unfavorite", time.Now(), &err)
+	tables, err := repository.tables(kind)
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND user_id = ? ;", tables.favorites, tables.column)
+	repository.debug(command, itemID, userID)
+	_, err = repository.DB.Exec(command, itemID, userID)
+	return err
+}
+
+// GetStoriesByUserID returns the favorite stories of a user, the last saved first, every story if limit is -1
+func (repository *FavoriteRepository) GetStoriesByUserID(userID int64, limit, offset int) (threads Threads, err error) {
+	defer repository.Metrics.ObserveQuery("FavoriteRepository.GetStoriesByUserID", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	query := `SELECT t.* FROM threads_view t JOIN thread_favorites f ON f.thread_id = t.ID
+	WHERE f.user_id = ? AND ` + visible + ` ORDER BY f.id DESC LIMIT ? OFFSET ? ;`
+	arguments = append(append([]interface{}{userID}, arguments...), limit, offset)
+	repository.debug(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &threads, true)
+	}
+	return
+}
+
+// GetCommentsByUserID returns the favorite comments of a user, the last saved first, every comment if limit is -1
+func (repository *FavoriteRepository) GetCommentsByUserID(userID int64, limit, offset int) (comments Comments, err error) {
+	defer repository.Metrics.ObserveQuery("FavoriteRepository.GetCommentsByUserID", time.Now(), &err)
+	visible, arguments := visibleTo(repository.Viewer)
+	query := `SELECT c.* FROM comments_view c JOIN comment_favorites f ON f.comment_id = c.ID
+	WHERE f.user_id = ? AND ` + visible + ` ORDER BY f.id DESC LIMIT ? OFFSET ? ;`
+	arguments = append(append([]interface{}{userID}, arguments...), limit, offset)
+	repository.debug(query, arguments)
+	rows, err := repository.DB.Query(query, arguments...)
+	if err == nil {
+		err = MapRowsToSliceOfStruct(rows, &comments, true)
+	}
+	return
+}
@@ -17,7 +17,11 @@
 
 package gonews_test
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 import gonews "github.com/mparaiso/gonews/core"
 
 func TestThreadRepository_GetByAuthorID(t *testing.T) {
@@ -50,3 +54,625 @@ func TestCommentRepository_GetCommentsByAuthorID(t *testing.T) {
 	Expect(t, err, nil)
 	Expect(t, len(comments), count, "comments count")
 }
+
+func TestCommentRepository_GetThreadsByAuthorID(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	commentRepository := &gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	// jefinerdoe wrote 4, 6, 8 and 11, a reply to 10 which replies to 8
+	comments, err := commentRepository.GetThreadsByAuthorID(4, 5, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(comments), 4, "len(comments)")
+	Expect(t, comments[0].ID, int64(11), "newest comment first")
+	Expect(t, comments[1].ID, int64(8), "comments[1].ID")
+	Expect(t, len(comments[1].Children), 1, "replies to comment 8")
+	Expect(t, comments[1].Children[0].ID, int64(10), "reply to comment 8")
+	Expect(t, comments[1].Children[0].Depth, 1, "depth of the reply")
+	Expect(t, comments[1].Children[0].Children[0].ID, int64(11), "reply to the reply")
+	comments, err = commentRepository.GetThreadsByAuthorID(4, 1, 1, 1)
+	Expect(t, err, nil)
+	Expect(t, len(comments), 1, "len(comments) of the second page")
+	Expect(t, comments[0].ID, int64(8), "comment of the second page")
+	Expect(t, len(comments[0].Children[0].Children), 0, "replies below the maximum depth")
+	_, err = db.Exec("UPDATE comments SET dead = 1 WHERE id = 10 ;")
+	Expect(t, err, nil)
+	comments, err = commentRepository.GetThreadsByAuthorID(4, 5, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(comments[1].Children), 0, "replies of a dead reply")
+}
+
+func TestCommentRepository_Create(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	commentRepository := &gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	comment := &gonews.Comment{ThreadID: 1, AuthorID: 2, Content: "*great* <script>alert(1)</script>"}
+	Expect(t, commentRepository.Create(comment), nil)
+	comment, err := commentRepository.GetByID(comment.ID)
+	Expect(t, err, nil)
+	Expect(t, string(comment.ContentHTML), "<p><i>great</i> &lt;script&gt;alert(1)&lt;/script&gt;</p>", "comment.ContentHTML")
+}
+
+func TestThreadRepository_Viewer(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	threadRepository := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	commentRepository := &gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	_, err := db.Exec("UPDATE users SET shadowbanned = 1 WHERE id = 6 ;")
+	Expect(t, err, nil)
+	thread := &gonews.Thread{Title: "A story by a shadowbanned user", URL: "http://shadowbanned.acme", AuthorID: 6}
+	Expect(t, threadRepository.Create(thread), nil)
+	comment := &gonews.Comment{ThreadID: 1, AuthorID: 6, Content: "A comment by a shadowbanned user"}
+	Expect(t, commentRepository.Create(comment), nil)
+	for _, fixture := range []struct {
+		Name    string
+		Viewer  *gonews.User
+		Visible bool
+	}{
+		{"anonymous", nil, false},
+		{"another user", &gonews.User{ID: 1}, false},
+		{"the author", &gonews.User{ID: 6}, true},
+		{"showdead", &gonews.User{ID: 1, ShowDead: true}, true},
+	} {
+		threadRepository.Viewer, commentRepository.Viewer = fixture.Viewer, fixture.Viewer
+		threads, err := threadRepository.GetNewest(100, 0)
+		Expect(t, err, nil)
+		listed := false
+		for _, th := range threads {
+			listed = listed || th.ID == thread.ID
+		}
+		Expect(t, listed, fixture.Visible, "dead story listed for "+fixture.Name)
+		story, err := threadRepository.GetByIDWithComments(1)
+		Expect(t, err, nil)
+		listed = false
+		for _, c := range story.Comments {
+			listed = listed || c.ID == comment.ID
+		}
+		Expect(t, listed, fixture.Visible, "dead comment listed for "+fixture.Name)
+	}
+	Expect(t, threadRepository.SetDead(thread.ID, false), nil)
+	threadRepository.Viewer = nil
+	revived, err := threadRepository.GetByIDWithComments(int(thread.ID))
+	Expect(t, err, nil)
+	Expect(t, revived != nil, true, "revived story found")
+}
+
+func TestFlagRepository_Flag(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	flagRepository := &gonews.FlagRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	threadRepository := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	thread := &gonews.Thread{Title: "A well liked story", URL: "http://liked.acme", AuthorID: 1}
+	Expect(t, threadRepository.Create(thread), nil)
+	// 5 points with the vote of the author
+	_, err := db.Exec("INSERT INTO thread_votes(thread_id,author_id,score) VALUES(?1,2,1),(?1,3,1),(?1,4,1),(?1,5,1);", thread.ID)
+	Expect(t, err, nil)
+	isFlagged := func() bool {
+		thread, err := threadRepository.GetByID(thread.ID)
+		Expect(t, err, nil)
+		return thread.Flagged
+	}
+	Expect(t, flagRepository.Flag(gonews.FlagKindStory, thread.ID, 2, 2), nil)
+	Expect(t, flagRepository.Flag(gonews.FlagKindStory, thread.ID, 3, 2), nil)
+	Expect(t, isFlagged(), false, "flagged with 2 flags and 5 points")
+	Expect(t, flagRepository.Flag(gonews.FlagKindStory, thread.ID, 3, 2), nil)
+	Expect(t, isFlagged(), false, "flagged twice by the same user")
+	Expect(t, flagRepository.Flag(gonews.FlagKindStory, thread.ID, 4, 2), nil)
+	Expect(t, isFlagged(), true, "flagged with 3 flags and 5 points")
+	Expect(t, flagRepository.Unflag(gonews.FlagKindStory, thread.ID, 4, 2), nil)
+	Expect(t, isFlagged(), false, "flagged after an unflag")
+	Expect(t, flagRepository.Flag("unknown", thread.ID, 4, 2) != nil, true, "flagging an unknown kind of item should fail")
+}
+
+func TestUserRepository_AddRole_RemoveRole(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	userRepository := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	Expect(t, userRepository.AddRole(2, gonews.RoleModerator), nil)
+	user, err := userRepository.GetByID(2)
+	Expect(t, err, nil)
+	Expect(t, user.HasRole(gonews.RoleModerator), true, "user.HasRole(moderator)")
+	Expect(t, userRepository.AddRole(2, "unknown role") != nil, true, "AddRole with an unknown role should fail")
+	Expect(t, userRepository.RemoveRole(2, gonews.RoleModerator), nil)
+	user, err = userRepository.GetByID(2)
+	Expect(t, err, nil)
+	Expect(t, len(user.Roles), 0, "len(user.Roles)")
+}
+
+func TestUserRepository_Delete(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	userRepository := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	Expect(t, userRepository.Delete(1), nil)
+	user, err := userRepository.GetByID(1)
+	Expect(t, err, nil)
+	Expect(t, user == nil, true, "user should be deleted")
+	var count int
+	Expect(t, db.QueryRow("SELECT COUNT(id) FROM threads WHERE author_id = 1").Scan(&count), nil)
+	Expect(t, count, 0, "threads of the deleted user")
+	Expect(t, userRepository.Delete(1) != nil, true, "deleting a missing user should fail")
+}
+
+func TestUserRepository_Delete_CommentsOfOtherUsers(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	userRepository := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	// comment 1 of janedoe is on a story of johndoe, comment 14 of jefinerdoe replies to comment 5 of johndoe
+	_, err := db.Exec(`INSERT INTO comments(id,thread_id,author_id,content,parent_id) VALUES(14,2,4,"A reply to johndoe",5),(15,2,3,"A reply to the reply",14);
+	INSERT OR IGNORE INTO comment_votes(comment_id,author_id,score) VALUES(1,3,1),(1,4,1),(14,3,1),(15,2,1);
+	INSERT INTO comment_flags(comment_id,user_id) VALUES(1,5),(14,5);
+	INSERT INTO comment_favorites(comment_id,user_id) VALUES(1,6),(14,6);`)
+	Expect(t, err, nil)
+	var robertKarma int
+	Expect(t, db.QueryRow("SELECT karma FROM users WHERE id = 6 ;").Scan(&robertKarma), nil)
+
+	Expect(t, userRepository.Delete(1), nil)
+	for _, query := range []string{
+		"SELECT count(*) FROM comments WHERE id IN (1, 3, 14, 15)",
+		"SELECT count(*) FROM comments WHERE parent_id IS NOT NULL AND parent_id <> 0 AND parent_id NOT IN (SELECT id FROM comments)",
+		"SELECT count(*) FROM comments WHERE thread_id NOT IN (SELECT id FROM threads)",
+		"SELECT count(*) FROM comment_votes WHERE comment_id NOT IN (SELECT id FROM comments)",
+		"SELECT count(*) FROM comment_flags WHERE comment_id NOT IN (SELECT id FROM comments)",
+		"SELECT count(*) FROM comment_favorites WHERE comment_id NOT IN (SELECT id FROM comments)",
+		"SELECT count(*) FROM notifications WHERE comment_id NOT IN (SELECT id FROM comments)",
+		"SELECT count(*) FROM thread_votes WHERE thread_id NOT IN (SELECT id FROM threads)",
+		"SELECT count(*) FROM thread_flags WHERE thread_id NOT IN (SELECT id FROM threads)",
+		"SELECT count(*) FROM thread_favorites WHERE thread_id NOT IN (SELECT id FROM threads)",
+		"SELECT count(*) FROM hidden_threads WHERE thread_id NOT IN (SELECT id FROM threads)",
+		`SELECT count(*) FROM users u WHERE karma <>
+		(SELECT coalesce(SUM(v.score),0) FROM thread_votes v JOIN threads t ON t.id = v.thread_id WHERE t.author_id = u.id)
+		+ (SELECT coalesce(SUM(v.score),0) FROM comment_votes v JOIN comments c ON c.id = v.comment_id WHERE c.author_id = u.id)`,
+	} {
+		var count int
+		Expect(t, db.QueryRow(query).Scan(&count), nil)
+		Expect(t, count, 0, query)
+	}
+	var karma int
+	Expect(t, db.QueryRow("SELECT karma FROM users WHERE id = 6 ;").Scan(&karma), nil)
+	Expect(t, karma, robertKarma, "karma of a user without comments of the deleted user")
+}
+
+func TestModerationLogRepository(t *testing.T) {
+	db := MigrateUp(GetDB(t), t)
+	repository := &gonews.ModerationLogRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	before := &gonews.Thread{ID: 1, Title: "A story"}
+	after := &gonews.Thread{ID: 1, Title: "A story", Dead: true}
+	for _, fixture := range []struct {
+		actor, action, targetType string
+		before, after             *gonews.Thread
+	}{
+		{"admin", "kill", gonews.FlagKindStory, before, after},
+		{"admin", "restore", gonews.FlagKindComment, before, before},
+		{"moderator", "delete", gonews.FlagKindStory, before, nil},
+	} {
+		entry, err := gonews.NewModerationLogEntry(1, fixture.actor, fixture.action, fixture.targetType, 1, "spam", fixture.before, fixture.after)
+		Expect(t, err, nil)
+		Expect(t, repository.Create(entry), nil)
+	}
+	entries, err := repository.Find(gonews.ModerationLogFilter{}, -1, 0)
+	Expect(t, err, nil)
+	Expect(t, len(entries), 3, "len(entries)")
+	Expect(t, entries[0].Action, "delete", "newest entry first")
+	Expect(t, entries[0].After, "", "snapshot of a deleted target")
+	Expect(t, strings.Contains(entries[2].After, `"Dead":true`), true, "snapshot after a kill")
+	entries, err = repository.Find(gonews.ModerationLogFilter{ActorName: "admin", TargetType: gonews.FlagKindStory}, -1, 0)
+	Expect(t, err, nil)
+	Expect(t, len(entries), 1, "len(entries) filtered")
+	Expect(t, entries[0].Reason, "spam", "entries[0].Reason")
+	_, err = db.Exec("UPDATE moderation_log SET reason = '' ;")
+	Expect(t, err != nil, true, "updating the moderation log should fail")
+	_, err = db.Exec("DELETE FROM moderation_log ;")
+	Expect(t, err != nil, true, "deleting from the moderation log should fail")
+}
+
+func TestNotificationRepository(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	comments := &gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	users := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	notifications := &gonews.NotificationRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	_, err := db.Exec("UPDATE users SET shadowbanned = 1 WHERE id = 3 ;")
+	Expect(t, err, nil)
+	thread := &gonews.Thread{Title: "A story", URL: "http://story.acme", AuthorID: 1}
+	Expect(t, threads.Create(thread), nil)
+	comment := &gonews.Comment{ThreadID: thread.ID, AuthorID: 2, Content: "a comment on the story"}
+	Expect(t, comments.Create(comment), nil)
+	for _, reply := range []*gonews.Comment{
+		{ThreadID: thread.ID, ParentID: comment.ID, AuthorID: 1, Content: "a reply to the comment"},
+		{ThreadID: thread.ID, ParentID: comment.ID, AuthorID: 2, Content: "a reply to oneself"},
+		{ThreadID: thread.ID, AuthorID: 1, Content: "a comment on one's own story"},
+		{ThreadID: thread.ID, ParentID: comment.ID, AuthorID: 3, Content: "a dead reply"},
+	} {
+		Expect(t, comments.Create(reply), nil)
+	}
+	list, err := notifications.GetByUserID(1, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(list), 1, "notifications of the author of the story")
+	Expect(t, list[0].CommentID, comment.ID, "comment on the story")
+	Expect(t, list[0].IsReply(), false, "comment on the story is not a reply")
+	Expect(t, list[0].Comment.ThreadTitle, thread.Title, "title of the story")
+	list, err = notifications.GetByUserID(2, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(list), 1, "notifications of the author of the comment")
+	Expect(t, list[0].IsReply(), true, "reply to the comment")
+	user, err := users.GetByID(2)
+	Expect(t, err, nil)
+	Expect(t, user.UnreadNotifications, 1, "user.UnreadNotifications")
+	Expect(t, notifications.MarkAsRead(1, list[0].ID) != nil, true, "marking a notification of another user should fail")
+	Expect(t, notifications.MarkAsRead(2, list[0].ID), nil)
+	count, err := notifications.CountUnread(2)
+	Expect(t, err, nil)
+	Expect(t, count, 0, "unread notifications after MarkAsRead")
+	Expect(t, notifications.MarkAllAsRead(1), nil)
+	count, err = notifications.CountUnread(1)
+	Expect(t, err, nil)
+	Expect(t, count, 0, "unread notifications after MarkAllAsRead")
+	Expect(t, comments.Delete(comment.ID), nil)
+	list, err = notifications.GetByUserID(2, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(list), 0, "notifications of deleted comments")
+}
+
+func TestFavoriteRepository(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	favorites := &gonews.FavoriteRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	Expect(t, favorites.Favorite(gonews.FlagKindStory, 3, 2), nil)
+	Expect(t, favorites.Favorite(gonews.FlagKindStory, 3, 2), nil)
+	Expect(t, favorites.Favorite(gonews.FlagKindComment, 1, 2), nil)
+	Expect(t, favorites.Favorite("unknown", 1, 2) != nil, true, "saving an unknown kind of item should fail")
+	favorited, err := favorites.HasFavorited(gonews.FlagKindStory, 3, 2)
+	Expect(t, err, nil)
+	Expect(t, favorited, true, "HasFavorited")
+	thread, err := threads.GetByID(3)
+	Expect(t, err, nil)
+	Expect(t, thread.FavoriteCount, 1, "thread.FavoriteCount")
+	stories, err := favorites.GetStoriesByUserID(2, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(stories), 1, "len(stories)")
+	Expect(t, stories[0].ID, int64(3), "favorite story")
+	comments, err := favorites.GetCommentsByUserID(2, -1, 0)
+	Expect(t, err, nil)
+	Expect(t, len(comments), 1, "len(comments)")
+	Expect(t, favorites.Unfavorite(gonews.FlagKindStory, 3, 2), nil)
+	stories, err = favorites.GetStoriesByUserID(2, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(stories), 0, "len(stories) after Unfavorite")
+}
+
+func TestThreadRepository_GetSortedByScore_FavoriteWeight(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	favorites := &gonews.FavoriteRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF), FavoriteWeight: 2}
+	// the stories of the fixtures are a month old
+	_, err := db.Exec("UPDATE threads SET created = datetime('now', '-30 days') ;")
+	Expect(t, err, nil)
+	first := &gonews.Thread{Title: "A story with a vote", URL: "http://voted.acme", AuthorID: 1}
+	second := &gonews.Thread{Title: "A story saved to favorites", URL: "http://favorite.acme", AuthorID: 1}
+	Expect(t, threads.Create(first), nil)
+	Expect(t, threads.Create(second), nil)
+	_, err = db.Exec("UPDATE threads SET created = datetime('now', '-3 hours') WHERE id = ? ;", first.ID)
+	Expect(t, err, nil)
+	_, err = db.Exec("UPDATE threads SET created = datetime('now', '-5 hours') WHERE id = ? ;", second.ID)
+	Expect(t, err, nil)
+	_, err = db.Exec("INSERT INTO thread_votes(thread_id,author_id,score) VALUES(?,2,1);", first.ID)
+	Expect(t, err, nil)
+	Expect(t, favorites.Favorite(gonews.FlagKindStory, second.ID, 3), nil)
+	Expect(t, favorites.Favorite(gonews.FlagKindStory, second.ID, 4), nil)
+	sorted, err := threads.GetSortedByScore(2, 0)
+	Expect(t, err, nil)
+	Expect(t, sorted[0].ID, second.ID, "older story with weighted favorites first")
+	Expect(t, sorted[1].ID, first.ID, "newer story with a vote second")
+	threads.FavoriteWeight = 0
+	sorted, err = threads.GetSortedByScore(2, 0)
+	Expect(t, err, nil)
+	Expect(t, sorted[0].ID, first.ID, "story with a vote first when favorites are ignored")
+}
+
+func TestThreadRepository_GetSortedByScore_Age(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	_, err := db.Exec("UPDATE threads SET created = datetime('now', '-30 days') ;")
+	Expect(t, err, nil)
+	old := &gonews.Thread{Title: "A popular story of yesterday", URL: "http://old.acme", AuthorID: 1}
+	recent := &gonews.Thread{Title: "A story of this hour", URL: "http://recent.acme", AuthorID: 1}
+	Expect(t, threads.Create(old), nil)
+	Expect(t, threads.Create(recent), nil)
+	_, err = db.Exec("UPDATE threads SET created = datetime('now', '-20 hours') WHERE id = ? ;", old.ID)
+	Expect(t, err, nil)
+	_, err = db.Exec("INSERT INTO thread_votes(thread_id,author_id,score) VALUES(?,2,1),(?,3,1),(?,4,1),(?,2,1);",
+		old.ID, old.ID, old.ID, recent.ID)
+	Expect(t, err, nil)
+	sorted, err := threads.GetSortedByScore(3, 0)
+	Expect(t, err, nil)
+	Expect(t, sorted[0].ID, recent.ID, "recent story first")
+	Expect(t, sorted[1].ID, old.ID, "older story with more votes second")
+	_, err = db.Exec("UPDATE threads SET created = datetime('now', '-40 minutes') WHERE id = ? ;", old.ID)
+	Expect(t, err, nil)
+	sorted, err = threads.GetSortedByScore(3, 0)
+	Expect(t, err, nil)
+	Expect(t, sorted[0].ID, old.ID, "story with more votes first at the same age")
+}
+
+func TestThreadRepository_Hide(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	threadRepository := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF), Viewer: &gonews.User{ID: 2}}
+	newest, err := threadRepository.GetNewest(3, 0)
+	Expect(t, err, nil)
+	hidden := newest[0]
+	Expect(t, threadRepository.Hide(hidden.ID, 2), nil)
+	Expect(t, threadRepository.Hide(hidden.ID, 2), nil)
+	listed := func(threads gonews.Threads) bool {
+		for _, thread := range threads {
+			if thread.ID == hidden.ID {
+				return true
+			}
+		}
+		return false
+	}
+	for _, listing := range []struct {
+		Name string
+		Get  func() (gonews.Threads, error)
+	}{
+		{"newest", func() (gonews.Threads, error) { return threadRepository.GetNewest(3, 0) }},
+		{"front page", func() (gonews.Threads, error) { return threadRepository.GetSortedByScore(100, 0) }},
+		{"domain", func() (gonews.Threads, error) { return threadRepository.GetWhereURLLike("%"+hidden.Domain+"%", 100, 0) }},
+	} {
+		threads, err := listing.Get()
+		Expect(t, err, nil)
+		Expect(t, listed(threads), false, "hidden story listed on "+listing.Name)
+	}
+	newest, err = threadRepository.GetNewest(3, 0)
+	Expect(t, err, nil)
+	Expect(t, len(newest), 3, "page size with a hidden story")
+	threadRepository.Viewer = &gonews.User{ID: 3}
+	newest, err = threadRepository.GetNewest(3, 0)
+	Expect(t, err, nil)
+	Expect(t, listed(newest), true, "story hidden by another user listed")
+	threads, err := threadRepository.GetHiddenByUserID(2, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(threads), 1, "hidden stories")
+	Expect(t, threadRepository.Unhide(hidden.ID, 2), nil)
+	threads, err = threadRepository.GetHiddenByUserID(2, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(threads), 0, "hidden stories after Unhide")
+}
+
+func TestThreadRepository_GetByDay(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	_, err := db.Exec("UPDATE threads SET created = date('now','-1 day') || ' 12:00:00' WHERE id IN (2,3) ;")
+	Expect(t, err, nil)
+	threadRepository := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	threads, err := threadRepository.GetByDay(yesterday, 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(threads), 2, "stories of yesterday")
+	for i, thread := range threads {
+		Expect(t, thread.Created.Format("2006-01-02"), yesterday.Format("2006-01-02"), "day of the story")
+		if i > 0 && thread.Score > threads[i-1].Score {
+			t.Fatalf("stories should be ranked by score, got %d after %d", thread.Score, threads[i-1].Score)
+		}
+	}
+	threads, err = threadRepository.GetByDay(yesterday.AddDate(0, 0, -365), 10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(threads), 0, "stories of a day without stories")
+}
+
+func TestUserRepository_Karma(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	userRepository := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	karma := func(id int64) int {
+		var sum int
+		Expect(t, db.QueryRow(`SELECT
+		(SELECT coalesce(SUM(v.score),0) FROM thread_votes v JOIN threads t ON t.id = v.thread_id WHERE t.author_id = ?1)
+		+ (SELECT coalesce(SUM(v.score),0) FROM comment_votes v JOIN comments c ON c.id = v.comment_id WHERE c.author_id = ?1)`, id).Scan(&sum), nil)
+		return sum
+	}
+	user, err := userRepository.GetByID(2)
+	Expect(t, err, nil)
+	Expect(t, user.Karma, karma(2), "cached karma")
+	before := user.Karma
+	for _, fixture := range []struct {
+		Command string
+		Karma   int
+	}{
+		{"INSERT INTO thread_votes(thread_id,author_id,score) VALUES(7,5,1);", before + 1},
+		{"INSERT INTO comment_votes(comment_id,author_id,score) VALUES(7,5,1);", before + 2},
+		{"UPDATE comment_votes SET score = -1 WHERE comment_id = 7 AND author_id = 5;", before},
+		{"DELETE FROM thread_votes WHERE thread_id = 7 AND author_id = 5;", before - 1},
+	} {
+		_, err = db.Exec(fixture.Command)
+		Expect(t, err, nil)
+		user, err = userRepository.GetByID(2)
+		Expect(t, err, nil)
+		Expect(t, user.Karma, fixture.Karma, fixture.Command)
+		Expect(t, user.Karma, karma(2), "cached karma after "+fixture.Command)
+	}
+}
+
+func TestUserRepository_GetLeaders(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	userRepository := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	_, err := db.Exec("UPDATE users SET shadowbanned = 1 WHERE id = 2;")
+	Expect(t, err, nil)
+	leaders, err := userRepository.GetLeaders(10, 0)
+	Expect(t, err, nil)
+	Expect(t, len(leaders) > 0, true, "leaders")
+	for i, leader := range leaders {
+		Expect(t, leader.ID != 2, true, "shadowbanned user among the leaders")
+		if i > 0 && leader.Karma > leaders[i-1].Karma {
+			t.Fatalf("leaders should be ranked by karma, got %d after %d", leader.Karma, leaders[i-1].Karma)
+		}
+	}
+	leaders, err = userRepository.GetLeaders(2, 0)
+	Expect(t, err, nil)
+	Expect(t, len(leaders), 2, "page of leaders")
+}
+
+func TestThreadRepository_GetBest_GetActive(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	_, err := db.Exec(`UPDATE threads SET created = datetime('now','-10 days') WHERE id = 2;
+	UPDATE comments SET created = datetime('now','-10 days') WHERE thread_id = 2;
+	UPDATE comments SET created = datetime('now','-1 hour') WHERE thread_id = 4;`)
+	Expect(t, err, nil)
+	threadRepository := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	contains := func(threads gonews.Threads, id int64) bool {
+		for _, thread := range threads {
+			if thread.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	best, err := threadRepository.GetBest(time.Now().Add(-72*time.Hour), 100, 0)
+	Expect(t, err, nil)
+	Expect(t, contains(best, 2), false, "story older than the window among the best stories")
+	Expect(t, contains(best, 1), true, "story 1 among the best stories")
+	for i := 1; i < len(best); i++ {
+		if best[i].Score > best[i-1].Score {
+			t.Fatalf("best stories should be ranked by score, got %d after %d", best[i].Score, best[i-1].Score)
+		}
+	}
+	active, err := threadRepository.GetActive(time.Now().Add(-48*time.Hour), 100, 0)
+	Expect(t, err, nil)
+	Expect(t, contains(active, 2), false, "story without recent comments among the active stories")
+	Expect(t, contains(active, 3), false, "story without comments among the active stories")
+	Expect(t, len(active), 3, "active stories")
+	Expect(t, active[len(active)-1].ID, int64(4), "least recently commented story")
+}
+
+func TestCommentRepository_GetBest(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	_, err := db.Exec("UPDATE comments SET created = datetime('now','-10 days') WHERE id = 1;")
+	Expect(t, err, nil)
+	commentRepository := &gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	comments, err := commentRepository.GetBest(time.Now().Add(-48*time.Hour), 100, 0)
+	Expect(t, err, nil)
+	Expect(t, len(comments), 10, "comments of the window")
+	for i, comment := range comments {
+		Expect(t, comment.ID != 1, true, "comment older than the window among the best comments")
+		if i > 0 && comment.CommentScore > comments[i-1].CommentScore {
+			t.Fatalf("best comments should be ranked by score, got %d after %d", comment.CommentScore, comments[i-1].CommentScore)
+		}
+	}
+}
+
+func TestThreadVoteRepository_Vote_Unvote(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	threadVoteRepository := &gonews.ThreadVoteRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	userRepository := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	karma := func() int {
+		author, err := userRepository.GetByID(2)
+		Expect(t, err, nil)
+		return author.Karma
+	}
+	before := karma()
+	Expect(t, threadVoteRepository.Vote(7, 5, 1, time.Hour), nil)
+	Expect(t, threadVoteRepository.Vote(7, 5, 1, time.Hour), nil)
+	score, err := threadVoteRepository.GetScore(7, 5)
+	Expect(t, err, nil)
+	Expect(t, score, 1, "score of the vote")
+	Expect(t, karma(), before+1, "karma after a vote")
+	Expect(t, threadVoteRepository.Unvote(7, 5, time.Hour), nil)
+	Expect(t, karma(), before, "karma after an unvote")
+	Expect(t, threadVoteRepository.Unvote(7, 5, time.Hour), gonews.ErrNoVote)
+	Expect(t, threadVoteRepository.Unvote(7, 2, time.Hour), gonews.ErrSelfVote)
+	Expect(t, threadVoteRepository.Vote(7, 5, 1, time.Hour), nil)
+	_, err = db.Exec("UPDATE thread_votes SET created = datetime('now','-2 hours') WHERE thread_id = 7 AND author_id = 5;")
+	Expect(t, err, nil)
+	Expect(t, threadVoteRepository.Unvote(7, 5, time.Hour), gonews.ErrVoteWindow)
+	Expect(t, karma(), before+1, "karma after a failed unvote")
+}
+
+func TestCommentVoteRepository_Vote_Unvote(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	commentVoteRepository := &gonews.CommentVoteRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	Expect(t, commentVoteRepository.Vote(7, 5, 1, time.Hour), nil)
+	score, err := commentVoteRepository.GetScore(7, 5)
+	Expect(t, err, nil)
+	Expect(t, score, 1, "score of the vote")
+	Expect(t, commentVoteRepository.Vote(7, 2, 1, time.Hour), gonews.ErrSelfVote)
+	Expect(t, commentVoteRepository.Unvote(7, 5, time.Hour), nil)
+	score, err = commentVoteRepository.GetScore(7, 5)
+	Expect(t, err, nil)
+	Expect(t, score, 0, "score after an unvote")
+}
+
+func TestCommentVoteRepository_Downvote(t *testing.T) {
+	db := LoadFixtures(MigrateUp(GetDB(t), t), t)
+	commentVoteRepository := &gonews.CommentVoteRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	commentRepository := &gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	userRepository := &gonews.UserRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	author, err := userRepository.GetByID(2)
+	Expect(t, err, nil)
+	before := author.Karma
+	Expect(t, commentVoteRepository.Vote(7, 5, -1, time.Hour), nil)
+	Expect(t, commentVoteRepository.Vote(7, 4, -1, time.Hour), nil)
+	comment, err := commentRepository.GetByID(7)
+	Expect(t, err, nil)
+	Expect(t, comment.CommentScore, -1, "score of a downvoted comment")
+	Expect(t, comment.Downvotes, 2, "downvotes")
+	Expect(t, comment.Fade(), 2, "fade of a downvoted comment")
+	author, err = userRepository.GetByID(2)
+	Expect(t, err, nil)
+	Expect(t, author.Karma, before-2, "karma after downvotes")
+	Expect(t, commentVoteRepository.Vote(7, 5, 1, time.Hour), nil)
+	author, err = userRepository.GetByID(2)
+	Expect(t, err, nil)
+	Expect(t, author.Karma, before, "karma after a downvote changed to an upvote")
+}
+
+func TestDomainRuleRepository_SaveAll(t *testing.T) {
+	db := MigrateUp(GetDB(t), t)
+	repository := &gonews.DomainRuleRepository{DB: db}
+	moderationLog := &gonews.ModerationLogRepository{DB: db}
+	logEntry := func(rule *gonews.DomainRule) (*gonews.ModerationLogEntry, error) {
+		return gonews.NewModerationLogEntry(0, "test", "domain-rule-save", gonews.ModerationTargetDomainRule, rule.ID, rule.Reason, nil, rule)
+	}
+	rules := []*gonews.DomainRule{
+		{Rule: gonews.DomainRuleBanned, Pattern: "spam.example"},
+		{Rule: gonews.DomainRulePenalized, Pattern: "clickbait.example"},
+	}
+	Expect(t, repository.SaveAll(rules, moderationLog, logEntry), nil)
+	var count int
+	Expect(t, db.QueryRow("SELECT count(*) FROM domain_rules ;").Scan(&count), nil)
+	Expect(t, count, 2, "saved rules")
+	Expect(t, db.QueryRow("SELECT count(*) FROM moderation_log WHERE action = 'domain-rule-save' ;").Scan(&count), nil)
+	Expect(t, count, 2, "logged rules")
+
+	// a failure rolls back the rules saved before it
+	_, err := db.Exec("CREATE TRIGGER moderation_log_failure BEFORE INSERT ON moderation_log WHEN new.target_id > 2 BEGIN SELECT RAISE(ABORT, 'log unavailable'); END;")
+	Expect(t, err, nil)
+	rules = []*gonews.DomainRule{
+		{Rule: gonews.DomainRuleBanned, Pattern: "spam.example", Reason: "spam"},
+		{Rule: gonews.DomainRuleBanned, Pattern: "other.example"},
+	}
+	if err := repository.SaveAll(rules, moderationLog, logEntry); err == nil {
+		t.Fatal("SaveAll should fail when a rule can't be logged")
+	}
+	Expect(t, db.QueryRow("SELECT count(*) FROM domain_rules ;").Scan(&count), nil)
+	Expect(t, count, 2, "rules after a failed import")
+	var reason string
+	Expect(t, db.QueryRow("SELECT reason FROM domain_rules WHERE pattern = 'spam.example' ;").Scan(&reason), nil)
+	Expect(t, reason, "", "reason of a rule replaced by a failed import")
+}
+
+func TestDomainRuleRepository_DeleteWithLog(t *testing.T) {
+	db := MigrateUp(GetDB(t), t)
+	repository := &gonews.DomainRuleRepository{DB: db}
+	moderationLog := &gonews.ModerationLogRepository{DB: db}
+	rule := &gonews.DomainRule{Rule: gonews.DomainRuleBanned, Pattern: "spam.example"}
+	Expect(t, repository.Save(rule), nil)
+	entry, err := gonews.NewModerationLogEntry(0, "test", "domain-rule-delete", gonews.ModerationTargetDomainRule, rule.ID, "", rule, nil)
+	Expect(t, err, nil)
+
+	// a failure to log keeps the rule
+	_, err = db.Exec("CREATE TRIGGER moderation_log_failure BEFORE INSERT ON moderation_log BEGIN SELECT RAISE(ABORT, 'log unavailable'); END;")
+	Expect(t, err, nil)
+	if err := repository.DeleteWithLog(rule.ID, moderationLog, entry); err == nil {
+		t.Fatal("DeleteWithLog should fail when the deletion can't be logged")
+	}
+	var count int
+	Expect(t, db.QueryRow("SELECT count(*) FROM domain_rules ;").Scan(&count), nil)
+	Expect(t, count, 1, "rules after a failed deletion")
+
+	_, err = db.Exec("DROP TRIGGER moderation_log_failure ;")
+	Expect(t, err, nil)
+	Expect(t, repository.DeleteWithLog(rule.ID, moderationLog, entry), nil)
+	Expect(t, db.QueryRow("SELECT count(*) FROM domain_rules ;").Scan(&count), nil)
+	Expect(t, count, 0, "rules after a deletion")
+	Expect(t, db.QueryRow("SELECT count(*) FROM moderation_log WHERE action = 'domain-rule-delete' ;").Scan(&count), nil)
+	Expect(t, count, 1, "logged deletions")
+}
@@ -95,7 +95,8 @@ func (rw *DefaultResponseWriterExtra) Write(b []byte) (size int, err error) {
 				rw.error("Error saving the session ", err)
 			}
 		} else {
-			rw.error("Session not found, can't save... ")
+			// i.e. health checks do not use sessions
+			rw.debug("Session not found, can't save... ")
 		}
 	})
 
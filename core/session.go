@@ -40,6 +40,15 @@ type SessionWrapper interface {
 	Values() map[interface{}]interface{}
 	ValuesString() map[string]interface{}
 	Delete(interface{})
+	// ID is the id of the session in the store, empty for new sessions
+	ID() string
+	// Regenerate gives the session a new id when saved, i.e. on login
+	Regenerate() error
+}
+
+// SessionRegenerator is implemented by stores which can give a session a new id
+type SessionRegenerator interface {
+	Regenerate(*sessions.Session) error
 }
 
 // Session implementing SessionInterface
@@ -83,6 +92,20 @@ func (s *DefaultSessionWrapper) Delete(key interface{}) {
 	delete(s.Session.Values, key)
 }
 
+// ID returns the id of the session
+func (s *DefaultSessionWrapper) ID() string {
+	return s.Session.ID
+}
+
+// Regenerate gives the session a new id if the store supports it,
+// cookie stores rewrite the whole cookie anyway
+func (s *DefaultSessionWrapper) Regenerate() error {
+	if store, ok := s.Session.Store().(SessionRegenerator); ok {
+		return store.Regenerate(s.Session)
+	}
+	return nil
+}
+
 // Values return a map of session values
 func (s *DefaultSessionWrapper) Values() map[interface{}]interface{} {
 	return s.Session.Values
@@ -0,0 +1,181 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// SQLStore is a sessions.Store persisting sessions in the sessions table.
+// The cookie only holds a random token, the table holds the sha256 of the token
+// with the session values, so sessions can be listed and revoked server side.
+type SQLStore struct {
+	Repository *SessionRepository
+	Options    *sessions.Options
+}
+
+// NewSQLStore returns a SQLStore, options are the options of the session cookie
+func NewSQLStore(repository *SessionRepository, options *sessions.Options) *SQLStore {
+	return &SQLStore{Repository: repository, Options: options}
+}
+
+// HashSessionID returns the id under which a session is stored
+func HashSessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns a session cached for the request or a new one
+func (store *SQLStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(store, name)
+}
+
+// New loads the session referenced by the cookie or returns a new session
+func (store *SQLStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(store, name)
+	options := *store.Options
+	session.Options = &options
+	session.IsNew = true
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return session, nil
+	}
+	record, err := store.Repository.GetByID(HashSessionID(cookie.Value))
+	if err != nil || record == nil {
+		// unknown, expired or revoked sessions are replaced by a new one
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&session.Values); err != nil {
+		return session, nil
+	}
+	session.ID = cookie.Value
+	session.IsNew = false
+	return session, nil
+}
+
+// Save persists the session and writes the session cookie,
+// a session with a negative MaxAge is deleted
+func (store *SQLStore) Save(r *http.Request, rw http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := store.Repository.Delete(HashSessionID(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(rw, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		if len(session.Values) == 0 {
+			// empty new sessions, i.e. of crawlers, are not stored,
+			// the cookie of a deleted session is removed
+			if _, err := r.Cookie(session.Name()); err == nil {
+				options := *session.Options
+				options.MaxAge = -1
+				http.SetCookie(rw, sessions.NewCookie(session.Name(), "", &options))
+			}
+			return nil
+		}
+		session.ID = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+	buffer := new(bytes.Buffer)
+	if err := gob.NewEncoder(buffer).Encode(session.Values); err != nil {
+		return err
+	}
+	record := &SessionRecord{
+		ID:        HashSessionID(session.ID),
+		Data:      buffer.Bytes(),
+		UserAgent: truncate(r.UserAgent(), 255),
+		IP:        remoteIP(r),
+	}
+	if userID, ok := session.Values["user.ID"].(int64); ok {
+		record.UserID = userID
+	}
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		// browser session cookies still expire server side
+		maxAge = 86400
+	}
+	if err := store.Repository.Save(record, maxAge); err != nil {
+		return err
+	}
+	http.SetCookie(rw, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// Regenerate deletes the stored session and gives the session a new id
+// when it is saved, the values are kept. It prevents session fixation.
+func (store *SQLStore) Regenerate(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := store.Repository.Delete(HashSessionID(session.ID)); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return nil
+}
+
+// remoteIP returns the ip address of the client
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length]
+	}
+	return s
+}
+
+// DescribeUserAgent returns the browser and the platform of a user agent, i.e. "Firefox on Linux"
+func DescribeUserAgent(userAgent string) string {
+	find := func(candidates [][2]string) string {
+		for _, candidate := range candidates {
+			if strings.Contains(userAgent, candidate[0]) {
+				return candidate[1]
+			}
+		}
+		return ""
+	}
+	// order matters, i.e. Chrome user agents contain Safari
+	browser := find([][2]string{{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"}})
+	platform := find([][2]string{{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"}})
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "" || platform != "":
+		return browser + platform
+	}
+	return "Unknown device"
+}
@@ -0,0 +1,125 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mparaiso/gonews/core"
+)
+
+// Scenario: LOGGING OUT EVERYWHERE
+// Given a logged in user
+// The session should be stored in the database with the user id
+// When /sessions is requested
+// The active session should be listed
+// When all sessions are revoked
+// The sessions of the user should be deleted
+// And the user should be logged out
+func TestSessions_LogOutEverywhere(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	var count int
+	Expect(t, db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = ? ;", user.ID).Scan(&count), nil)
+	Expect(t, count, 1, "sessions of the user")
+
+	response, err := http.Get(server.URL + gonews.Route{}.Sessions())
+	Expect(t, err, nil)
+	Expect(t, response.StatusCode, http.StatusOK)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	Expect(t, doc.Find(".session").Length(), 1, ".session length")
+	csrf, _ := doc.Find("input[name='sessions_csrf']").First().Attr("value")
+
+	response, err = http.PostForm(server.URL+gonews.Route{}.Sessions(), url.Values{"sessions_csrf": {csrf}, "all": {"1"}})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = ? ;", user.ID).Scan(&count), nil)
+	Expect(t, count, 0, "sessions of the user")
+
+	response, err = http.Get(server.URL + gonews.Route{}.Sessions())
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, response.StatusCode, http.StatusUnauthorized)
+}
+
+// Scenario: SESSION FIXATION
+// Given a logged in user
+// When the user logs out
+// The session cookie should be replaced and the previous session deleted
+// When the user logs in again
+// The anonymous session cookie should be replaced
+func TestSessions_IDIsRotated(t *testing.T) {
+	db, server, user, err := LoginUser(t)
+	Expect(t, err, nil)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	sessionCookie := func() string { return http.DefaultClient.Jar.Cookies(serverURL)[0].Value }
+	loggedInCookie := sessionCookie()
+
+	response, err := http.Post(server.URL+gonews.Route{}.Logout(), FORM_MIME_TYPE, strings.NewReader(""))
+	Expect(t, err, nil)
+	response.Body.Close()
+	anonymousCookie := sessionCookie()
+	Expect(t, anonymousCookie != loggedInCookie, true, "cookie rotated on logout")
+	var count int
+	Expect(t, db.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = ? ;", gonews.HashSessionID(loggedInCookie)).Scan(&count), nil)
+	Expect(t, count, 0, "previous session deleted")
+
+	response, err = http.Get(server.URL + gonews.Route{}.Login())
+	Expect(t, err, nil)
+	doc, err := goquery.NewDocumentFromResponse(response)
+	Expect(t, err, nil)
+	csrf, _ := doc.Find("input[name='login_csrf']").First().Attr("value")
+	response, err = http.PostForm(server.URL+gonews.Route{}.Login(), url.Values{
+		"login_username": {user.Username}, "login_password": {"password"}, "login_csrf": {csrf},
+	})
+	Expect(t, err, nil)
+	response.Body.Close()
+	Expect(t, sessionCookie() != anonymousCookie, true, "cookie rotated on login")
+}
+
+// Scenario: CRAWLING
+// Given an anonymous visitor without cookies
+// When pages are requested
+// No session should be stored
+func TestSessions_AnonymousVisitorsAreNotStored(t *testing.T) {
+	db := GetDB(t)
+	server := GetServer(t, db)
+	defer server.Close()
+	for i := 0; i < 5; i++ {
+		response, err := http.Get(server.URL)
+		Expect(t, err, nil)
+		response.Body.Close()
+		Expect(t, len(response.Cookies()), 0, "session cookie of an anonymous visitor")
+	}
+	var count int
+	Expect(t, db.QueryRow("SELECT COUNT(*) FROM sessions ;").Scan(&count), nil)
+	Expect(t, count, 0, "stored sessions")
+}
+
+func TestDescribeUserAgent(t *testing.T) {
+	Expect(t, gonews.DescribeUserAgent("Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"), "Firefox on Linux")
+	Expect(t, gonews.DescribeUserAgent("Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Version/17.0 Mobile/15E148 Safari/604.1"), "Safari on iPhone")
+	Expect(t, gonews.DescribeUserAgent(""), "Unknown device")
+}
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"html/template"
 	"io"
+	"time"
 )
 
 // TemplateEnvironment is used to store
@@ -47,6 +48,7 @@ type TemplateEngine interface {
 type DefaultTemplateEngine struct {
 	*template.Template
 	environment Any
+	metrics     *Metrics
 }
 
 // Environment returns the environement used in
@@ -66,6 +68,7 @@ func (t *DefaultTemplateEngine) ExecuteTemplate(writer io.Writer, name string, d
 	// We need to use a temporary buffer.
 	// The reason is that ExecuteTemplate may return an error,
 	// We want to be able to catch it and return status 500 if needed
+	defer t.metrics.ObserveSince("gonews_template_render_duration_seconds", time.Now(), "template", name)
 	templateBuffer := new(bytes.Buffer)
 	err := t.Template.ExecuteTemplate(templateBuffer, name, struct {
 		Data        Any
@@ -34,6 +34,7 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mparaiso/gonews/core"
+	"github.com/mparaiso/gonews/migrations"
 	"github.com/rubenv/sql-migrate"
 
 	"flag"
@@ -84,7 +85,11 @@ func GetDB(t *testing.T) *sql.DB {
 
 // MigrateUp executes db migrations
 func MigrateUp(db *sql.DB, t *testing.T) *sql.DB {
-	_, err := migrate.Exec(db, DRIVER, migrate.FileMigrationSource{"./../migrations/development/" + DRIVER}, migrate.Up)
+	source, err := migrations.Source(DRIVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrate.Exec(db, DRIVER, source, migrate.Up)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,9 +135,14 @@ func GetServer(t *testing.T, dbs ...*sql.DB) *httptest.Server {
 	} else {
 		db = dbs[0]
 	}
+	return GetServerWithOptions(t, db, GetContainerOptions(db))
+}
+
+// GetServerWithOptions sets up the test server with custom container options
+func GetServerWithOptions(t *testing.T, db *sql.DB, options gonews.ContainerOptions) *httptest.Server {
 	MigrateUp(db, t)
 	LoadFixtures(db, t)
-	app := gonews.GetApp(gonews.AppOptions{ContainerOptions: GetContainerOptions(db)})
+	app := gonews.GetApp(gonews.AppOptions{ContainerOptions: options})
 	server := httptest.NewServer(app)
 
 	logger := &log.Logger{}
@@ -147,7 +157,11 @@ func GetServer(t *testing.T, dbs ...*sql.DB) *httptest.Server {
 func LoginUser(t *testing.T) (*sql.DB, *httptest.Server, *gonews.User, error) {
 	// GetServer
 	db := GetDB(t)
-	server := GetServer(t, db)
+	return LoginUserOnServer(t, db, GetServer(t, db))
+}
+
+// LoginUserOnServer logs a user on a server set up with GetServerWithOptions
+func LoginUserOnServer(t *testing.T, db *sql.DB, server *httptest.Server) (*sql.DB, *httptest.Server, *gonews.User, error) {
 	unencryptedPassword := "password"
 	user := &gonews.User{Username: "mike_doe", Email: "mike_doe@acme.com"}
 	user.CreateSecurePassword(unencryptedPassword)
@@ -169,6 +169,12 @@ func (validator *LoginFormValidator) Validate(form *LoginForm) ValidationError {
 
 type SubmissionFormValidator struct {
 	CSRFGenerator
+	// CanPostJobs is true for administrators
+	CanPostJobs bool
+	// DomainRules reject urls of banned domains, the rule applying to
+	// the url is then available in DomainRule
+	DomainRules DomainRuleMatcher
+	DomainRule  *DomainRule
 }
 
 // Validate validates a submission form
@@ -180,6 +186,9 @@ func (validator *SubmissionFormValidator) Validate(form *SubmissionForm) Validat
 	StringNotEmptyValidator("Title", form.Title, &errors)
 	StringMaxLengthValidator("Title", form.Title, 100, &errors)
 	StringMinLengthValidator("Title", form.Title, 5, &errors)
+	if form.Job && !validator.CanPostJobs {
+		errors.Append("Job", "Only administrators can post jobs")
+	}
 
 	switch {
 	case len(strings.Trim(form.Content, " ")) == 0:
@@ -199,6 +208,16 @@ func (validator *SubmissionFormValidator) Validate(form *SubmissionForm) Validat
 		StringMaxLengthValidator("Content", form.Content, 500, &errors)
 		StringMinLengthValidator("Content", form.Content, 30, &errors)
 	}
+	if validator.DomainRules != nil && len(strings.Trim(form.URL, " ")) > 0 {
+		rule, err := validator.DomainRules.Match(form.URL)
+		switch {
+		case err != nil:
+			errors.Append("URL", "could not be checked, please try again later")
+		case rule != nil && rule.Rule == DomainRuleBanned:
+			errors.Append("URL", "submissions from this site are not allowed")
+		}
+		validator.DomainRule = rule
+	}
 
 	if errors.HasErrors() {
 		form.Errors = errors
@@ -0,0 +1,407 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reasons why the vote analysis finds a vote suspicious
+const (
+	SuspiciousVoteRing       = "ring"
+	SuspiciousVoteSockpuppet = "sockpuppet"
+)
+
+// VoteAnalysisOptions configures the detection of vote manipulation
+type VoteAnalysisOptions struct {
+	// Interval is how often the server analyzes the votes, votes are only
+	// analyzed on demand if 0
+	Interval time.Duration
+	// Only the votes cast during the last Window are analyzed, older votes keep
+	// the weight given by the analyses that saw them
+	Window time.Duration
+	// Users voting the same way on an item less than RingWindow apart co-vote,
+	// users co-voting on at least RingMinItems items belong to the same ring
+	RingWindow   time.Duration
+	RingMinItems int
+	// Accounts casting at least SockpuppetMinVotes upvotes during their first
+	// NewAccountAge, all for the same author, are sockpuppets
+	NewAccountAge      time.Duration
+	SockpuppetMinVotes int
+	// SuspiciousVoteWeight is how much a suspicious vote counts in rankings, from 0 to 1
+	SuspiciousVoteWeight float64
+}
+
+// SuspiciousVote is a vote on a story or a comment found by the vote analysis
+type SuspiciousVote struct {
+	Kind   string
+	ID     int64
+	Reason string
+}
+
+// VoteRing is a group of users who repeatedly vote on the same items at the same time
+type VoteRing struct {
+	UserIDs   []int64
+	Usernames []string
+	// Items is the number of items the ring co-voted on, Votes the number of votes of the ring on them
+	Items,
+	Votes int
+}
+
+// Sockpuppet is a new account voting for a single author
+type Sockpuppet struct {
+	UserID     int64
+	Username   string
+	AuthorID   int64
+	AuthorName string
+	Votes      int
+}
+
+// VoteReport is the result of a vote analysis
+type VoteReport struct {
+	Created time.Time
+	// Since is the start of the analyzed votes
+	Since       time.Time
+	Rings       []*VoteRing
+	Sockpuppets []*Sockpuppet
+	Votes       []*SuspiciousVote
+	found       map[SuspiciousVote]bool
+}
+
+// addVote adds a suspicious vote to the report, once
+func (report *VoteReport) addVote(kind string, id int64, reason string) {
+	if report.found == nil {
+		report.found = map[SuspiciousVote]bool{}
+	}
+	key := SuspiciousVote{Kind: kind, ID: id}
+	if !report.found[key] {
+		report.found[key] = true
+		report.Votes = append(report.Votes, &SuspiciousVote{kind, id, reason})
+	}
+}
+
+// CountVotes returns the number of suspicious votes on a kind of item
+func (report *VoteReport) CountVotes(kind string) (count int) {
+	for _, vote := range report.Votes {
+		if vote.Kind == kind {
+			count++
+		}
+	}
+	return
+}
+
+// VoteAnalyzer looks for voting rings and sockpuppets in the votes on stories
+// and comments. The analysis only depends on the votes and the accounts, the
+// same votes always give the same report
+type VoteAnalyzer struct {
+	DB      *sql.DB
+	Logger  LoggerInterface
+	Metrics *Metrics
+}
+
+func (analyzer *VoteAnalyzer) debug(messages ...interface{}) {
+	if analyzer.Logger != nil {
+		analyzer.Logger.Debug(messages...)
+	}
+}
+
+// analyzedVotes is a common table expression of the votes on stories and
+// comments cast since its first parameter, except the votes of the authors
+func analyzedVotes() string {
+	var selects []string
+	for _, kind := range []string{FlagKindStory, FlagKindComment} {
+		tables := flagTables[kind]
+		selects = append(selects, fmt.Sprintf(`SELECT '%[1]s', v.id, v.%[2]s, v.author_id, i.author_id, v.score, v.created
+		FROM %[3]s v JOIN %[4]s i ON i.id = v.%[2]s WHERE v.created >= ?1 AND v.author_id <> i.author_id`, kind, tables.column, tables.votes, tables.items))
+	}
+	return "WITH votes(kind, id, item_id, voter_id, author_id, score, created) AS (\n\t\t" +
+		strings.Join(selects, "\n\t\tUNION ALL\n\t\t") + "\n\t)\n\t"
+}
+
+// Analyze returns the voting rings, the sockpuppets and their votes,
+// the analysis stops when ctx is done
+func (analyzer *VoteAnalyzer) Analyze(ctx context.Context, options VoteAnalysisOptions) (report *VoteReport, err error) {
+	defer analyzer.Metrics.ObserveQuery("VoteAnalyzer.Analyze", time.Now(), &err)
+	report = &VoteReport{Created: time.Now().UTC()}
+	report.Since = report.Created.Add(-options.Window)
+	if err = analyzer.findRings(ctx, report, options); err == nil {
+		err = analyzer.findSockpuppets(ctx, report, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// findRings links the users co-voting on at least RingMinItems items,
+// each group of linked users is a ring and their co-votes are suspicious
+func (analyzer *VoteAnalyzer) findRings(ctx context.Context, report *VoteReport, options VoteAnalysisOptions) error {
+	query := analyzedVotes() + `SELECT a.voter_id, ua.username, b.voter_id, ub.username, a.kind, a.item_id, a.id, b.id
+	FROM votes a
+	JOIN votes b ON b.kind = a.kind AND b.item_id = a.item_id AND b.voter_id > a.voter_id AND b.score = a.score
+		AND abs(julianday(b.created) - julianday(a.created)) * 86400 <= ?2
+	JOIN users ua ON ua.id = a.voter_id
+	JOIN users ub ON ub.id = b.voter_id
+	ORDER BY a.voter_id, b.voter_id, a.kind, a.item_id, a.id, b.id ;`
+	since := report.Since.Format("2006-01-02 15:04:05")
+	analyzer.debug(query, since, options.RingWindow.Seconds())
+	rows, err := analyzer.DB.QueryContext(ctx, query, since, options.RingWindow.Seconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type pair struct{ a, b int64 }
+	type coVote struct {
+		kind  string
+		item  int64
+		votes [2]int64
+	}
+	var (
+		pairs     []pair
+		coVotes   = map[pair][]coVote{}
+		usernames = map[int64]string{}
+	)
+	for rows.Next() {
+		var (
+			p            pair
+			v            coVote
+			nameA, nameB string
+		)
+		if err = rows.Scan(&p.a, &nameA, &p.b, &nameB, &v.kind, &v.item, &v.votes[0], &v.votes[1]); err != nil {
+			return err
+		}
+		if _, ok := coVotes[p]; !ok {
+			pairs = append(pairs, p)
+		}
+		coVotes[p] = append(coVotes[p], v)
+		usernames[p.a], usernames[p.b] = nameA, nameB
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	// rings are the connected components of the linked users,
+	// the root of a ring is its user with the lowest id
+	roots := map[int64]int64{}
+	var root func(id int64) int64
+	root = func(id int64) int64 {
+		if parent, ok := roots[id]; ok && parent != id {
+			roots[id] = root(parent)
+			return roots[id]
+		}
+		return id
+	}
+	var linked []pair
+	for _, p := range pairs {
+		items := map[string]bool{}
+		for _, v := range coVotes[p] {
+			items[fmt.Sprint(v.kind, v.item)] = true
+		}
+		if len(items) < options.RingMinItems {
+			continue
+		}
+		linked = append(linked, p)
+		if a, b := root(p.a), root(p.b); a < b {
+			roots[b] = a
+		} else {
+			roots[a] = b
+		}
+	}
+	type ring struct {
+		*VoteRing
+		items, votes map[string]bool
+	}
+	var (
+		ringRoots []int64
+		rings     = map[int64]*ring{}
+	)
+	for _, p := range linked {
+		id := root(p.a)
+		r, ok := rings[id]
+		if !ok {
+			r = &ring{&VoteRing{}, map[string]bool{}, map[string]bool{}}
+			rings[id], ringRoots = r, append(ringRoots, id)
+		}
+		for _, userID := range []int64{p.a, p.b} {
+			if !containsID(r.UserIDs, userID) {
+				r.UserIDs = append(r.UserIDs, userID)
+			}
+		}
+		for _, v := range coVotes[p] {
+			r.items[fmt.Sprint(v.kind, v.item)] = true
+			for _, id := range v.votes {
+				r.votes[fmt.Sprint(v.kind, id)] = true
+				report.addVote(v.kind, id, SuspiciousVoteRing)
+			}
+		}
+	}
+	sort.Slice(ringRoots, func(i, j int) bool { return ringRoots[i] < ringRoots[j] })
+	for _, id := range ringRoots {
+		r := rings[id]
+		sort.Slice(r.UserIDs, func(i, j int) bool { return r.UserIDs[i] < r.UserIDs[j] })
+		for _, userID := range r.UserIDs {
+			r.Usernames = append(r.Usernames, usernames[userID])
+		}
+		r.Items, r.Votes = len(r.items), len(r.votes)
+		report.Rings = append(report.Rings, r.VoteRing)
+	}
+	return nil
+}
+
+// findSockpuppets finds the new accounts upvoting a single author,
+// their upvotes are suspicious
+func (analyzer *VoteAnalyzer) findSockpuppets(ctx context.Context, report *VoteReport, options VoteAnalysisOptions) error {
+	query := analyzedVotes() + `SELECT v.voter_id, voter.username, v.author_id, author.username, v.kind, v.id
+	FROM votes v
+	JOIN users voter ON voter.id = v.voter_id
+	JOIN users author ON author.id = v.author_id
+	WHERE v.score > 0 AND julianday(v.created) - julianday(voter.created) <= ?2
+	ORDER BY v.voter_id, v.kind, v.id ;`
+	since, age := report.Since.Format("2006-01-02 15:04:05"), options.NewAccountAge.Hours()/24
+	analyzer.debug(query, since, age)
+	rows, err := analyzer.DB.QueryContext(ctx, query, since, age)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var (
+		current *Sockpuppet
+		single  bool
+		votes   []*SuspiciousVote
+	)
+	flush := func() {
+		if current != nil && single && current.Votes >= options.SockpuppetMinVotes {
+			report.Sockpuppets = append(report.Sockpuppets, current)
+			for _, vote := range votes {
+				report.addVote(vote.Kind, vote.ID, SuspiciousVoteSockpuppet)
+			}
+		}
+	}
+	for rows.Next() {
+		var (
+			row  Sockpuppet
+			vote = &SuspiciousVote{Reason: SuspiciousVoteSockpuppet}
+		)
+		if err = rows.Scan(&row.UserID, &row.Username, &row.AuthorID, &row.AuthorName, &vote.Kind, &vote.ID); err != nil {
+			return err
+		}
+		if current == nil || current.UserID != row.UserID {
+			flush()
+			current, single, votes = &row, true, nil
+		}
+		single = single && current.AuthorID == row.AuthorID
+		current.Votes++
+		votes = append(votes, vote)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// Apply gives weight to the suspicious votes of a report in rankings, the
+// other votes cast since the start of the report count fully again, and saves
+// the report as the latest one
+func (analyzer *VoteAnalyzer) Apply(ctx context.Context, report *VoteReport, weight float64) (err error) {
+	defer analyzer.Metrics.ObserveQuery("VoteAnalyzer.Apply", time.Now(), &err)
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	tx, err := analyzer.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	kinds := []string{FlagKindStory, FlagKindComment}
+	since := report.Since.Format("2006-01-02 15:04:05")
+	for _, kind := range kinds {
+		command := fmt.Sprintf("UPDATE %s SET weight = 1 WHERE weight <> 1 AND created >= ? ;", flagTables[kind].votes)
+		analyzer.debug(command, since)
+		if _, err = tx.ExecContext(ctx, command, since); err != nil {
+			return err
+		}
+	}
+	for _, vote := range report.Votes {
+		command := fmt.Sprintf("UPDATE %s SET weight = ? WHERE id = ? ;", flagTables[vote.Kind].votes)
+		analyzer.debug(command, weight, vote.ID)
+		if _, err = tx.ExecContext(ctx, command, weight, vote.ID); err != nil {
+			return err
+		}
+	}
+	command := "DELETE FROM vote_reports ;"
+	analyzer.debug(command)
+	if _, err = tx.ExecContext(ctx, command); err != nil {
+		return err
+	}
+	command, created := "INSERT INTO vote_reports(report, created) VALUES(?, ?) ;", report.Created.Format("2006-01-02 15:04:05")
+	analyzer.debug(command, string(data), created)
+	if _, err = tx.ExecContext(ctx, command, string(data), created); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err == nil {
+		for _, kind := range kinds {
+			analyzer.Metrics.Set("gonews_suspicious_votes", float64(report.CountVotes(kind)), "kind", kind)
+		}
+	}
+	return err
+}
+
+// Run analyzes the votes and applies the report
+func (analyzer *VoteAnalyzer) Run(ctx context.Context, options VoteAnalysisOptions) (*VoteReport, error) {
+	report, err := analyzer.Analyze(ctx, options)
+	if err == nil {
+		err = analyzer.Apply(ctx, report, options.SuspiciousVoteWeight)
+	}
+	return report, err
+}
+
+// GetLatestReport returns the report of the last analysis, nil if votes were never analyzed
+func (analyzer *VoteAnalyzer) GetLatestReport() (report *VoteReport, err error) {
+	defer analyzer.Metrics.ObserveQuery("VoteAnalyzer.GetLatestReport", time.Now(), &err)
+	query := "SELECT report FROM vote_reports ORDER BY id DESC LIMIT 1 ;"
+	analyzer.debug(query)
+	var data string
+	if err = analyzer.DB.QueryRow(query).Scan(&data); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	report = new(VoteReport)
+	err = json.Unmarshal([]byte(data), report)
+	return report, err
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
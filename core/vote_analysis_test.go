@@ -0,0 +1,173 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gonews_test
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+// LoadVoteFixtures loads synthetic votes : ring1, ring2 and ring3 vote together on two
+// stories and a comment of author, honest co-votes with them once, puppet is a new
+// account upvoting only author and newbie a new account upvoting two authors
+func LoadVoteFixtures(db *sql.DB, t *testing.T) *sql.DB {
+	_, err := db.Exec(`
+	INSERT INTO users(id,username,password,email,created) VALUES
+		(1,'author','x','author@acme.com','2024-01-01 00:00:00'),
+		(2,'ring1','x','ring1@acme.com','2024-01-01 00:00:00'),
+		(3,'ring2','x','ring2@acme.com','2024-01-01 00:00:00'),
+		(4,'ring3','x','ring3@acme.com','2024-01-01 00:00:00'),
+		(5,'honest','x','honest@acme.com','2024-01-01 00:00:00'),
+		(6,'puppet','x','puppet@acme.com','2024-01-10 00:00:00'),
+		(7,'newbie','x','newbie@acme.com','2024-01-10 00:00:00'),
+		(8,'other','x','other@acme.com','2024-01-01 00:00:00');
+	INSERT INTO threads(id,title,url,author_id,created) VALUES
+		(1,'story 1','http://1.acme.com',1,'2024-01-10 11:00:00'),
+		(2,'story 2','http://2.acme.com',1,'2024-01-10 11:00:00'),
+		(3,'story 3','http://3.acme.com',1,'2024-01-10 11:00:00'),
+		(4,'story 4','http://4.acme.com',1,'2024-01-10 11:00:00'),
+		(5,'story 5','http://5.acme.com',1,'2024-01-10 11:00:00'),
+		(6,'story 6','http://6.acme.com',8,'2024-01-10 11:00:00');
+	INSERT INTO comments(id,thread_id,author_id,content,created) VALUES
+		(1,1,1,'comment 1','2024-01-10 11:00:00');
+	INSERT INTO thread_votes(thread_id,author_id,score,created) VALUES
+		(1,2,1,'2024-01-10 12:00:00'),(1,3,1,'2024-01-10 12:01:00'),(1,4,1,'2024-01-10 12:02:00'),
+		(2,2,1,'2024-01-10 12:10:00'),(2,3,1,'2024-01-10 12:11:00'),(2,4,1,'2024-01-10 12:12:00'),
+		(1,5,1,'2024-01-10 12:05:00'),(6,5,1,'2024-01-10 12:30:00'),
+		(3,6,1,'2024-01-10 13:00:00'),(4,6,1,'2024-01-10 14:00:00'),(5,6,1,'2024-01-10 15:00:00'),
+		(3,7,1,'2024-01-10 18:00:00'),(6,7,1,'2024-01-10 19:00:00');
+	INSERT INTO comment_votes(comment_id,author_id,score,created) VALUES
+		(1,2,1,'2024-01-10 12:20:00'),(1,3,1,'2024-01-10 12:21:00'),(1,4,1,'2024-01-10 12:22:00');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// voteFixturesWindow is an analysis window including every vote of the vote fixtures
+func voteFixturesWindow() time.Duration {
+	return time.Since(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+}
+
+func TestVoteAnalyzer_Analyze(t *testing.T) {
+	db := LoadVoteFixtures(MigrateUp(GetDB(t), t), t)
+	analyzer := &gonews.VoteAnalyzer{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	options := gonews.DefaultContainerOptions().VoteAnalysis
+	options.Window = voteFixturesWindow()
+	report, err := analyzer.Analyze(context.Background(), options)
+	Expect(t, err, nil)
+	Expect(t, len(report.Rings), 1, "rings")
+	ring := report.Rings[0]
+	Expect(t, strings.Join(ring.Usernames, ","), "ring1,ring2,ring3", "ring members")
+	Expect(t, ring.Items, 3, "items of the ring")
+	Expect(t, ring.Votes, 9, "votes of the ring")
+	Expect(t, len(report.Sockpuppets), 1, "sockpuppets")
+	Expect(t, *report.Sockpuppets[0], gonews.Sockpuppet{UserID: 6, Username: "puppet", AuthorID: 1, AuthorName: "author", Votes: 3})
+	Expect(t, report.CountVotes(gonews.FlagKindStory), 9, "suspicious votes on stories")
+	Expect(t, report.CountVotes(gonews.FlagKindComment), 3, "suspicious votes on comments")
+
+	options.RingMinItems = 4
+	options.SockpuppetMinVotes = 4
+	report, err = analyzer.Analyze(context.Background(), options)
+	Expect(t, err, nil)
+	Expect(t, len(report.Votes), 0, "suspicious votes with higher thresholds")
+}
+
+func TestVoteAnalyzer_Run(t *testing.T) {
+	db := LoadVoteFixtures(MigrateUp(GetDB(t), t), t)
+	analyzer := &gonews.VoteAnalyzer{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	threads := &gonews.ThreadRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	comments := &gonews.CommentRepository{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	report, err := analyzer.GetLatestReport()
+	Expect(t, err, nil)
+	Expect(t, report == nil, true, "no report before the first analysis")
+	since, now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)
+	best, err := threads.GetBest(since, 1, 0)
+	Expect(t, err, nil)
+	Expect(t, best[0].ID, int64(1), "best story before the analysis")
+	front, err := threads.GetSortedByScore(1, 0)
+	Expect(t, err, nil)
+	Expect(t, front[0].ID, int64(1), "first story of the front page before the analysis")
+	comment, err := comments.GetByID(1)
+	Expect(t, err, nil)
+	rank := comment.Rank(now)
+
+	options := gonews.DefaultContainerOptions().VoteAnalysis
+	options.Window = voteFixturesWindow()
+	options.SuspiciousVoteWeight = 0
+	report, err = analyzer.Run(context.Background(), options)
+	Expect(t, err, nil)
+	best, err = threads.GetBest(since, 1, 0)
+	Expect(t, err, nil)
+	Expect(t, best[0].ID, int64(6), "best story once the votes of the ring are ignored")
+	front, err = threads.GetSortedByScore(1, 0)
+	Expect(t, err, nil)
+	Expect(t, front[0].ID, int64(6), "first story of the front page once the votes of the ring are ignored")
+	story, err := threads.GetByID(1)
+	Expect(t, err, nil)
+	Expect(t, story.Score, 5, "scores count every vote")
+	comment, err = comments.GetByID(1)
+	Expect(t, err, nil)
+	Expect(t, comment.SuspiciousUpvotes, 3.0, "suspicious upvotes of a comment")
+	Expect(t, comment.Rank(now) < rank, true, "rank of a comment upvoted by a ring")
+
+	latest, err := analyzer.GetLatestReport()
+	Expect(t, err, nil)
+	Expect(t, len(latest.Votes), len(report.Votes), "latest report")
+	Expect(t, latest.Sockpuppets[0].Username, "puppet")
+
+	// votes count fully again once they are not suspicious anymore
+	options.RingMinItems, options.SockpuppetMinVotes = 10, 10
+	_, err = analyzer.Run(context.Background(), options)
+	Expect(t, err, nil)
+	best, err = threads.GetBest(since, 1, 0)
+	Expect(t, err, nil)
+	Expect(t, best[0].ID, int64(1), "best story without suspicious votes")
+}
+
+func TestVoteAnalyzer_Window(t *testing.T) {
+	db := LoadVoteFixtures(MigrateUp(GetDB(t), t), t)
+	analyzer := &gonews.VoteAnalyzer{DB: db, Logger: gonews.NewDefaultLogger(gonews.OFF)}
+	options := gonews.DefaultContainerOptions().VoteAnalysis
+	options.Window, options.SuspiciousVoteWeight = voteFixturesWindow(), 0
+	_, err := analyzer.Run(context.Background(), options)
+	Expect(t, err, nil)
+
+	// the co-votes of the ring on story 1 are older than the window
+	options.Window = time.Since(time.Date(2024, 1, 10, 12, 15, 0, 0, time.UTC))
+	report, err := analyzer.Run(context.Background(), options)
+	Expect(t, err, nil)
+	Expect(t, report.Since.Before(time.Date(2024, 1, 10, 12, 16, 0, 0, time.UTC)), true, "start of the analyzed votes")
+	Expect(t, len(report.Rings), 0, "rings co-voting on 2 items of the window")
+	Expect(t, len(report.Sockpuppets), 1, "sockpuppets")
+	weight := func(threadID, userID int64) (weight float64) {
+		Expect(t, db.QueryRow("SELECT weight FROM thread_votes WHERE thread_id = ? AND author_id = ? ;", threadID, userID).Scan(&weight), nil)
+		return weight
+	}
+	Expect(t, weight(1, 2), 0.0, "weight of a suspicious vote older than the window")
+	Expect(t, weight(3, 6), 0.0, "weight of a suspicious vote of the window")
+	var commentWeight float64
+	Expect(t, db.QueryRow("SELECT weight FROM comment_votes WHERE comment_id = 1 AND author_id = 2 ;").Scan(&commentWeight), nil)
+	Expect(t, commentWeight, 1.0, "weight of a vote of the window that is not suspicious anymore")
+}
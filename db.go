@@ -0,0 +1,206 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mparaiso/gonews/migrations"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+const databaseDocumentation = `
+Usage:
+gonews db <command> [<arguments>] [<options>]
+
+Commands:
+	migrate up [n] 		Applies all or n pending migrations
+	migrate down [n] 	Rolls back the last or the n last migrations, n > 0
+	status 			Lists migrations and when they were applied
+	new <name> 		Creates a new migration file in <migrationpath>/<driver>
+	reset 			Rolls back all migrations then applies them again
+	seed 			Loads the seed data of the current environment
+`
+
+// DatabaseCommand executes the db command group, arguments are
+// the positional arguments followed by the configuration options
+func DatabaseCommand(flagSet *flag.FlagSet, arguments []string) error {
+	var positionals []string
+	for len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		positionals, arguments = append(positionals, arguments[0]), arguments[1:]
+	}
+	if len(positionals) == 0 {
+		return fmt.Errorf("missing db command\n%s", databaseDocumentation)
+	}
+	configuration, err := LoadConfiguration(flagSet, arguments)
+	if err != nil {
+		return err
+	}
+	options := configuration.ContainerOptions
+	if positionals[0] == "new" {
+		if len(positionals) != 2 {
+			return fmt.Errorf("usage: gonews db new <name>")
+		}
+		return NewMigration(path.Join(configuration.Server.MigrationPath, options.Driver), positionals[1])
+	}
+	db, err := sql.Open(options.Driver, options.DataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch positionals[0] {
+	case "migrate":
+		if len(positionals) < 2 || len(positionals) > 3 {
+			return fmt.Errorf("usage: gonews db migrate up|down [n]")
+		}
+		var direction sqlmigrate.MigrationDirection
+		max := 0
+		switch positionals[1] {
+		case "up":
+			direction = sqlmigrate.Up
+		case "down":
+			direction, max = sqlmigrate.Down, 1
+		default:
+			return fmt.Errorf("not a valid migration direction : %s", positionals[1])
+		}
+		if len(positionals) == 3 {
+			// 0 would mean every migration, which reset does explicitly
+			if max, err = strconv.Atoi(positionals[2]); err != nil || max <= 0 {
+				return fmt.Errorf("not a valid number of migrations : %s", positionals[2])
+			}
+		}
+		n, err := Migrate(db, options.Driver, direction, max)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migrations executed\n", n)
+	case "status":
+		return MigrationStatus(db, options.Driver, os.Stdout)
+	case "reset":
+		n, err := Migrate(db, options.Driver, sqlmigrate.Down, 0)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migrations rolled back\n", n)
+		if n, err = Migrate(db, options.Driver, sqlmigrate.Up, 0); err != nil {
+			return err
+		}
+		fmt.Printf("%d migrations executed\n", n)
+	case "seed":
+		if err := Seed(db, options.Environment, options.Driver); err != nil {
+			return err
+		}
+		fmt.Printf("seed data for '%s' environment loaded\n", options.Environment)
+	default:
+		return fmt.Errorf("not a valid db command : %s\n%s", positionals[0], databaseDocumentation)
+	}
+	return nil
+}
+
+// Migrate executes at most max migrations in a direction, all of them if max is 0
+func Migrate(db *sql.DB, driver string, direction sqlmigrate.MigrationDirection, max int) (int, error) {
+	source, err := migrations.Source(driver)
+	if err != nil {
+		return 0, err
+	}
+	return sqlmigrate.ExecMax(db, driver, source, direction, max)
+}
+
+// MigrationStatus writes the list of migrations and when they were applied
+func MigrationStatus(db *sql.DB, driver string, out io.Writer) error {
+	source, err := migrations.Source(driver)
+	if err != nil {
+		return err
+	}
+	all, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+	records, err := sqlmigrate.GetMigrationRecords(db, driver)
+	if err != nil {
+		return err
+	}
+	applied := map[string]string{}
+	for _, record := range records {
+		applied[record.Id] = record.AppliedAt.Format("2006-01-02 15:04:05")
+	}
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "MIGRATION\tAPPLIED")
+	for _, migration := range all {
+		appliedAt, ok := applied[migration.Id]
+		if !ok {
+			appliedAt = "pending"
+		}
+		fmt.Fprintf(writer, "%s\t%s\n", migration.Id, appliedAt)
+	}
+	return writer.Flush()
+}
+
+// Seed loads the seed data of an environment in a transaction
+func Seed(db *sql.DB, environment, driver string) error {
+	seed, err := migrations.Seed(environment, driver)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(seed); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error loading seed data, %s", err)
+	}
+	return tx.Commit()
+}
+
+// NewMigration creates an empty migration file named after the next migration number
+func NewMigration(directory, name string) error {
+	name = strings.Trim(regexp.MustCompile(`[^a-zA-Z0-9_]+`).ReplaceAllString(name, "-"), "-")
+	if name == "" {
+		return fmt.Errorf("not a valid migration name")
+	}
+	existing, err := filepath.Glob(filepath.Join(directory, "*.sql"))
+	if err != nil {
+		return err
+	}
+	next := 1
+	for _, file := range existing {
+		if number, err := strconv.Atoi(strings.SplitN(filepath.Base(file), "-", 2)[0]); err == nil && number >= next {
+			next = number + 1
+		}
+	}
+	file := filepath.Join(directory, fmt.Sprintf("%03d-%s.sql", next, name))
+	err = ioutil.WriteFile(file, []byte("-- +migrate Up\n\n\n-- +migrate Down\n\n"), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s created, rebuild gonews to embed it\n", file)
+	return nil
+}
@@ -0,0 +1,198 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+const domainDocumentation = `
+Usage:
+gonews domain <command> [<arguments>] [<options>]
+
+Commands:
+	list 			Lists domain rules
+	import [<file>] 	Creates or replaces domain rules read from a file or the standard input
+	delete <pattern> 	Deletes the rule of a domain or of a /regular expression/
+
+Each imported line is a rule (banned, dead or penalized), a pattern and an optional reason.
+Patterns are domains, which match their subdomains, or regular expressions between slashes
+matched against the whole url. Blank lines and lines starting with # are ignored.
+
+	banned spam.example.com link farm
+	dead /^https?://[^/]+/free-money/ scam
+	penalized clickbait.example.org
+
+example: gonews domain import blocklist.txt
+`
+
+// DomainCommand executes the domain command group
+type DomainCommand struct {
+	Repository    *gonews.DomainRuleRepository
+	ModerationLog *gonews.ModerationLogRepository
+	Stdin         io.Reader
+	Out           io.Writer
+}
+
+// RunDomainCommand parses arguments and executes a domain command
+func RunDomainCommand(flagSet *flag.FlagSet, arguments []string) error {
+	var positionals []string
+	for len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		positionals, arguments = append(positionals, arguments[0]), arguments[1:]
+	}
+	if len(positionals) == 0 {
+		return fmt.Errorf("missing domain command\n%s", domainDocumentation)
+	}
+	configuration, err := LoadConfiguration(flagSet, arguments)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(configuration.Driver, configuration.DataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	command := &DomainCommand{Repository: &gonews.DomainRuleRepository{DB: db},
+		ModerationLog: &gonews.ModerationLogRepository{DB: db}, Stdin: os.Stdin, Out: os.Stdout}
+	return command.Execute(positionals[0], positionals[1:])
+}
+
+// Execute executes a domain command with its arguments
+func (command *DomainCommand) Execute(name string, arguments []string) error {
+	switch {
+	case name == "list" && len(arguments) == 0:
+		return command.List()
+	case name == "import" && len(arguments) <= 1:
+		input := command.Stdin
+		if len(arguments) == 1 {
+			file, err := os.Open(arguments[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			input = file
+		}
+		return command.Import(input)
+	case name == "delete" && len(arguments) == 1:
+		return command.Delete(arguments[0])
+	}
+	return fmt.Errorf("not a valid domain command : %s %s\n%s", name, strings.Join(arguments, " "), domainDocumentation)
+}
+
+// List lists domain rules
+func (command *DomainCommand) List() error {
+	rules, err := command.Repository.GetAll()
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(command.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tRULE\tPATTERN\tREASON")
+	for _, rule := range rules {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\n", rule.ID, rule.Rule, formatPattern(rule), rule.Reason)
+	}
+	return writer.Flush()
+}
+
+// Import creates or replaces rules, one rule per line. Lines are all
+// validated before any rule is saved, rules are saved in a single transaction
+func (command *DomainCommand) Import(input io.Reader) error {
+	var rules []*gonews.DomainRule
+	scanner := bufio.NewScanner(input)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d : expected a rule and a pattern", number)
+		}
+		rule := &gonews.DomainRule{Rule: fields[0]}
+		rule.Pattern, rule.IsRegex = parsePattern(fields[1])
+		if len(fields) == 3 {
+			rule.Reason = strings.TrimSpace(fields[2])
+		}
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("line %d : %s", number, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	err := command.Repository.SaveAll(rules, command.ModerationLog, func(rule *gonews.DomainRule) (*gonews.ModerationLogEntry, error) {
+		return gonews.NewModerationLogEntry(0, "cli", "domain-rule-save", gonews.ModerationTargetDomainRule, rule.ID, rule.Reason, nil, rule)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(command.Out, "%d domain rules imported\n", len(rules))
+	return err
+}
+
+// Delete deletes the rule of a pattern
+func (command *DomainCommand) Delete(pattern string) error {
+	rules, err := command.Repository.GetAll()
+	if err != nil {
+		return err
+	}
+	target := &gonews.DomainRule{}
+	target.Pattern, target.IsRegex = parsePattern(pattern)
+	if !target.IsRegex {
+		target.Pattern = gonews.NormalizeDomain(target.Pattern)
+	}
+	for _, rule := range rules {
+		if rule.Pattern == target.Pattern && rule.IsRegex == target.IsRegex {
+			entry, err := gonews.NewModerationLogEntry(0, "cli", "domain-rule-delete", gonews.ModerationTargetDomainRule, rule.ID, "", rule, nil)
+			if err != nil {
+				return err
+			}
+			if err := command.Repository.DeleteWithLog(rule.ID, command.ModerationLog, entry); err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(command.Out, "domain rule %s deleted\n", formatPattern(rule))
+			return err
+		}
+	}
+	return fmt.Errorf("domain rule '%s' not found", pattern)
+}
+
+// parsePattern returns the regular expression of a /pattern/ or a domain
+func parsePattern(pattern string) (string, bool) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return pattern[1 : len(pattern)-1], true
+	}
+	return pattern, false
+}
+
+// formatPattern writes regular expressions between slashes
+func formatPattern(rule *gonews.DomainRule) string {
+	if rule.IsRegex {
+		return "/" + rule.Pattern + "/"
+	}
+	return rule.Pattern
+}
@@ -18,21 +18,16 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
-	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"path"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	gonews "github.com/mparaiso/gonews/core"
 	sqlmigrate "github.com/rubenv/sql-migrate"
-
-	"gopkg.in/yaml.v2"
 )
 
 // Version is the gonews server version
@@ -48,19 +43,32 @@ go-news <command> [<options>]
 
 Commands: 
 	start 	Starts go-news server
+	config 	print|check : Prints or validates the configuration
+	db 	Manages the database, see gonews db for details
+	user 	Manages user accounts, see gonews user for details
+	moderation 	Exports the moderation log, see gonews moderation for details
+	domain 	Manages domain rules of submissions, see gonews domain for details
+	votes 	Looks for voting rings and sockpuppets, see gonews votes for details
 	version Prints the current version
 	help 	Prints the documentation
+
+Configuration values are read, by order of precedence, from command line options,
+GONEWS_* environment variables (i.e. GONEWS_PORT for -port), the YAML configuration file
+and the defaults. Any value starting with $ is read from the environment variable it names (i.e. -port=$PORT)
 `
 
 func main() {
 
-	startOptions, startFlagSet := DeclareStartOptions()
+	startFlagSet := NewConfigurationFlagSet("start")
 
 	printDocumentation := func() {
 		print(documentation)
-		print("\nstart command options :\n\n")
+		print("\nstart and config command options :\n\n")
 		startFlagSet.PrintDefaults()
 		print("\nexample: gonews start -debug -port 8080 -host localhost\n")
+		print("example: gonews start -port 443 -tlscert cert.pem -tlskey key.pem -httpredirect :80\n")
+		print("example: gonews config check -env production\n")
+		print("example: gonews db migrate up -datasource db.sqlite3\n")
 	}
 	if len(os.Args) == 1 {
 		printDocumentation()
@@ -69,71 +77,125 @@ func main() {
 	switch os.Args[1] {
 	case "start":
 		// configuration
-
-		startFlagSet.Parse(os.Args[2:])
-
-		// if port is an env variable, get env variable
-		if len(startOptions.Port) > 0 && startOptions.Port[0] == '$' {
-			startOptions.Port = os.Getenv(string(startOptions.Port[1:]))
+		configuration, err := LoadConfiguration(startFlagSet, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		errors, warnings := configuration.Validate()
+		if len(errors) > 0 {
+			log.Fatalf("Invalid configuration :\n\t%s", strings.Join(errors, "\n\t"))
+		}
+		startOptions, containerOptions := &configuration.Server, configuration.ContainerOptions
+		// the server, the jobs and the requests share the logger
+		level := containerOptions.LogLevel
+		if containerOptions.Debug {
+			level = gonews.ALL
+		}
+		logger, err := gonews.NewLogger(os.Stdout, level, containerOptions.LogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configuration.ContainerOptions.LoggerFactory = func() (gonews.LoggerInterface, error) {
+			return logger, nil
+		}
+		for _, warning := range warnings {
+			logger.Log(gonews.WARN, warning)
 		}
 
-		connection, connectionErr := sql.Open(startOptions.Driver, startOptions.DataSource)
+		connection, connectionErr := sql.Open(containerOptions.Driver, containerOptions.DataSource)
 		if connectionErr != nil {
 			log.Fatal(connectionErr)
 		}
 
-		// warnings
-		if startOptions.Env != "production" {
-			log.Printf("You are using '%s' environment, please use option -env=production in production", startOptions.Env)
-		}
-		if startOptions.Secret == defaultSecret {
-			log.Printf("You are using the default secret key which is unsecure, please generate a strong secret key, and set is with -secret argument")
-		}
 		// migration
 		if startOptions.Migrate {
-			migrationSource := sqlmigrate.FileMigrationSource{Dir: path.Join(startOptions.MigrationPath, startOptions.Env, startOptions.Driver)}
-			i, err := sqlmigrate.Exec(connection, startOptions.Driver, migrationSource, sqlmigrate.Up)
+			i, err := Migrate(connection, containerOptions.Driver, sqlmigrate.Up, 0)
 			if err != nil {
 				log.Fatal(err)
 			}
-			log.Printf("%d migrations executed", i)
-		}
-		// loading fixtures
-		if startOptions.LoadFixtures {
-			log.Println("loading fixtures ... ")
-			LoadFixtures(connection, startOptions.Driver)
-			log.Println("done loading fixtures.")
+			logger.Log(gonews.INFO, "migrations executed", "count", i)
 		}
 		// start server
-		containerOptions := gonews.DefaultContainerOptions()
-		containerOptions.LogLevel = gonews.LogLevel(startOptions.LogLevel)
-		containerOptions.Debug = startOptions.Debug
-		containerOptions.ConnectionFactory = func() (*sql.DB, error) {
+		configuration.ContainerOptions.ConnectionFactory = func() (*sql.DB, error) {
 			return connection, connectionErr
 		}
-		appOptions := gonews.AppOptions{ContainerOptions: containerOptions}
-		// configuration file
-		if startOptions.ConfigurationFilePath != "" {
-			fileBytes, err := ioutil.ReadFile(startOptions.ConfigurationFilePath)
-			if err != nil && startOptions.ConfigurationFilePath != "gonews.yml" {
-				log.Printf("Error loading configuration file %s : %s \n", startOptions.ConfigurationFilePath, err)
-			} else {
-				err = yaml.Unmarshal(fileBytes, &appOptions)
-				if err != nil {
-					log.Fatalf("Error reading configuration file %s : %s \n", startOptions.ConfigurationFilePath, err)
-				} else {
-					log.Printf("Config loaded : %#v", appOptions)
-				}
-			}
+		metrics, metricsToken := gonews.NewMetrics(), configuration.ContainerOptions.MetricsToken
+		configuration.ContainerOptions.Metrics = metrics
+		readiness := &gonews.Readiness{}
+		configuration.ContainerOptions.Readiness = readiness
+		mailQueue := gonews.NewMailQueue(configuration.ContainerOptions.Mail.QueueSize)
+		configuration.ContainerOptions.Mail.Queue = mailQueue
+		if startOptions.MetricsAddr != "" {
+			// metrics are only served by the metrics listener
+			configuration.ContainerOptions.MetricsToken = ""
 		}
-		app := gonews.GetApp(appOptions)
-		addr := startOptions.Host + ":" + startOptions.Port
-		fmt.Printf("Server Listening On: %s\n", addr)
-		err := http.ListenAndServe(addr, app)
-		if err != nil {
+		app := gonews.GetApp(configuration.AppOptions)
+		server := NewServer(app, connection, startOptions)
+		server.Logger = logger
+		server.ServeMetrics(gonews.MetricsHandler(metrics, metricsToken))
+		server.Readiness = readiness
+		server.MailQueue = mailQueue
+		server.Jobs = NewJobs(connection, configuration.ContainerOptions, logger)
+		if err := server.ListenAndServe(); err != nil {
 			log.Fatal(err)
 		}
 		return
+	case "config":
+		if len(os.Args) < 3 {
+			print("usage: gonews config print|check [<options>]\n")
+			os.Exit(2)
+		}
+		configuration, err := LoadConfiguration(startFlagSet, os.Args[3:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		switch os.Args[2] {
+		case "print":
+			fmt.Print(configuration)
+		case "check":
+			errors, warnings := configuration.Validate()
+			for _, warning := range warnings {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+			}
+			for _, err := range errors {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			}
+			if len(errors) > 0 {
+				os.Exit(1)
+			}
+			fmt.Println("configuration is valid")
+		default:
+			print("not a valid config command : ", os.Args[2], "\n")
+			os.Exit(2)
+		}
+	case "db":
+		if err := DatabaseCommand(startFlagSet, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "user":
+		if err := RunUserCommand(startFlagSet, os.Args[2:]); err != nil {
+			if err != errReported {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+	case "domain":
+		if err := RunDomainCommand(startFlagSet, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "moderation":
+		if err := RunModerationCommand(startFlagSet, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "votes":
+		if err := RunVotesCommand(startFlagSet, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	case "version":
 		print(Version)
 	case "help":
@@ -146,64 +208,19 @@ func main() {
 
 }
 
-// DeclareStartOptions declare start options to be parsed from command line arguments
-func DeclareStartOptions() (*StartOptions, *flag.FlagSet) {
-	startOptions := &StartOptions{}
-	startFlagSet := flag.NewFlagSet("start", flag.ExitOnError)
-	startFlagSet.StringVar(&startOptions.ConfigurationFilePath, "config", "gonews.yml", "Configuration file path")
-	startFlagSet.BoolVar(&startOptions.Debug, "debug", false, "Starts the application in Debug mode.")
-	startFlagSet.BoolVar(&startOptions.LoadFixtures, "loadfixtures", false, "Load sample datas into the database, should obviously be executed only once.")
-	startFlagSet.StringVar(&startOptions.Host, "host", "0.0.0.0", "Host address of the server, example : localhost")
-	startFlagSet.StringVar(&startOptions.Port, "port", "8080", "Server port, example: 8080")
-	startFlagSet.StringVar(&startOptions.Env, "env", "development", "Current environment, examples: -env=developement , -env=test ")
-	startFlagSet.StringVar(&startOptions.Secret, "secret", defaultSecret, "Secret key used for encryption, example -secret=\"my-secret-key\"")
-	startFlagSet.BoolVar(&startOptions.Migrate, "migrate", false, "migrate will execute an upward database migration when the application starts")
-	startFlagSet.StringVar(&startOptions.MigrationPath, "migrationpath", "migrations", "Sets the migration path from where migrations are executed")
-	startFlagSet.StringVar(&startOptions.Driver, "driver", "sqlite3", "Sets the database driver. Example : -driver=sqlite3")
-	startFlagSet.StringVar(&startOptions.DataSource, "datasource", "db.sqlite3", "Sets the datasource. Example: -datasource=db.sqlite3")
-	startFlagSet.IntVar(&startOptions.LogLevel, "loglevel", 1, "A value between 0 and 6. Sets the logger verbosity level. Example: -loglevel 0 ")
-
-	return startOptions, startFlagSet
-}
-
 // StartOptions are arguments passed to the commandline
 // when start action is invoked
 type StartOptions struct {
-	Debug, Migrate, LoadFixtures bool
+	Migrate bool
 	Host, Port,
-	Env, Driver,
-	DataSource, MigrationPath,
-	ConfigurationFilePath,
-	Secret string
-	LogLevel int
-}
-
-// LoadFixtures loads test fixtures in a transaction
-// if the transaction fails, no fatal error is triggered
-func LoadFixtures(db *sql.DB, driver string) *sql.DB {
-
-	migrationFile, err := os.Open("./testdata/fixtures/" + driver + "/fixtures.sql")
-	if err != nil {
-		log.Fatal(err)
-	}
-	buffer := new(bytes.Buffer)
-	_, err = buffer.ReadFrom(migrationFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = tx.Exec(buffer.String())
-	if err != nil {
-		log.Printf("Error loading fixtures, %s", err)
-		tx.Rollback()
-	} else {
-		err = tx.Commit()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	return db
+	MigrationPath string
+	ConfigurationFilePath string `yaml:"-"`
+	// Server lifecycle
+	Socket,
+	TLSCertFile, TLSKeyFile,
+	HTTPRedirectAddr,
+	MetricsAddr string
+	ReadTimeout, WriteTimeout,
+	IdleTimeout, ShutdownTimeout,
+	ShutdownDelay time.Duration
 }
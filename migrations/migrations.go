@@ -0,0 +1,57 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package migrations embeds the database schema migrations and the seed data
+// in the binary, so deployments do not need the migrations directory.
+//
+// Schema migrations are environment independent and live in <driver>/*.sql ,
+// seed data are environment specific and live in seeds/<environment>/<driver>.sql
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+//go:embed sqlite3/*.sql seeds
+var files embed.FS
+
+// Source returns the schema migrations of a driver
+func Source(driver string) (migrate.MigrationSource, error) {
+	directory, err := fs.Sub(files, driver)
+	if err != nil {
+		return nil, err
+	}
+	if matches, _ := fs.Glob(directory, "*.sql"); len(matches) == 0 {
+		return nil, fmt.Errorf("no migration found for driver '%s'", driver)
+	}
+	return migrate.HttpFileSystemMigrationSource{FileSystem: http.FS(directory)}, nil
+}
+
+// Seed returns the seed data of an environment for a driver
+func Seed(environment, driver string) (string, error) {
+	content, err := files.ReadFile(path.Join("seeds", environment, driver+".sql"))
+	if err != nil {
+		return "", fmt.Errorf("no seed data found for environment '%s' and driver '%s'", environment, driver)
+	}
+	return string(content), nil
+}
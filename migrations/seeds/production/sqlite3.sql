@@ -0,0 +1,3 @@
+-- production seed data
+-- only data required by a new production instance should be inserted here ,
+-- roles are created by migrations, administrators by gonews user grant-role
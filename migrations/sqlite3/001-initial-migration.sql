@@ -9,4 +9,4 @@ CREATE TABLE users(
 );
 
 -- +migrate Down
-DELETE TABLE users;
+DROP TABLE users;
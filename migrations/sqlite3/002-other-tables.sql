@@ -70,6 +70,7 @@ END;
 
 -- +migrate Down
 
+DROP TRIGGER IF EXISTS thread_inserted;
 DROP TABLE roles;
 DROP TABLE users_roles;
 DROP INDEX IF EXISTS users_roles_index;
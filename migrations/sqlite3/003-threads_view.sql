@@ -33,4 +33,4 @@ CREATE VIEW IF NOT EXISTS threads_view AS
 		
 			
 -- +migrate Down
-DROP VIEW IF EXISTS threads_view
\ No newline at end of file
+DROP VIEW IF EXISTS threads_view;
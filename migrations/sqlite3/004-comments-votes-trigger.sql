@@ -10,3 +10,5 @@ BEGIN
 END;
 -- +migrate StatementEnd
 
+-- +migrate Down
+DROP TRIGGER IF EXISTS comment_inserted;
@@ -28,4 +28,4 @@ CREATE VIEW IF NOT EXISTS comments_view AS
 		
 			
 -- +migrate Down
-DROP VIEW IF EXISTS comments_view
\ No newline at end of file
+DROP VIEW IF EXISTS comments_view;
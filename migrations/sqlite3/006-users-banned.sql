@@ -0,0 +1,9 @@
+-- +migrate Up
+
+-- banned users can't login anymore
+
+ALTER TABLE users ADD COLUMN banned boolean not null default(0);
+
+-- +migrate Down
+
+ALTER TABLE users DROP COLUMN banned;
@@ -0,0 +1,12 @@
+-- +migrate Up
+
+-- roles required by the application
+
+CREATE UNIQUE INDEX roles_name_index ON roles(name);
+INSERT INTO roles(name) VALUES('administrator');
+INSERT INTO roles(name) VALUES('moderator');
+
+-- +migrate Down
+
+DELETE FROM roles WHERE name IN ('administrator','moderator');
+DROP INDEX IF EXISTS roles_name_index;
@@ -0,0 +1,22 @@
+-- +migrate Up
+
+-- server side sessions, id is the sha256 of the session cookie value
+
+CREATE TABLE sessions(
+	id varchar(64) primary key not null,
+	user_id integer null references users(id) on delete cascade,
+	data blob not null,
+	user_agent varchar(255) not null default '',
+	ip varchar(64) not null default '',
+	created datetime not null default(datetime('now')),
+	last_seen datetime not null default(datetime('now')),
+	expires datetime not null
+);
+CREATE INDEX sessions_user_id_index ON sessions(user_id);
+CREATE INDEX sessions_expires_index ON sessions(expires);
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS sessions_expires_index;
+DROP INDEX IF EXISTS sessions_user_id_index;
+DROP TABLE sessions;
@@ -0,0 +1,22 @@
+-- +migrate Up
+
+-- "remember me" tokens, the cookie holds selector:validator,
+-- only the sha256 of the validator is stored. The previous validator
+-- is kept to tell concurrent requests from the reuse of a stolen token
+
+CREATE TABLE remember_tokens(
+	id integer primary key autoincrement not null,
+	selector varchar(32) unique not null,
+	validator_hash varchar(64) not null,
+	previous_validator_hash varchar(64) not null default '',
+	user_id integer not null references users(id) on delete cascade,
+	created datetime not null default(datetime('now')),
+	last_used datetime not null default(datetime('now')),
+	expires datetime not null
+);
+CREATE INDEX remember_tokens_user_id_index ON remember_tokens(user_id);
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS remember_tokens_user_id_index;
+DROP TABLE remember_tokens;
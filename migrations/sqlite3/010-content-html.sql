@@ -0,0 +1,134 @@
+-- +migrate Up
+
+-- content_html caches the formatted and sanitized html of a content, it is rendered when the content is written.
+-- Existing contents are escaped and rendered as a single paragraph.
+
+ALTER TABLE threads ADD COLUMN content_html text not null default '';
+ALTER TABLE comments ADD COLUMN content_html text not null default '';
+
+UPDATE threads SET content_html = '<p>' || replace(replace(replace(replace(replace(content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;') || '</p>'
+ WHERE coalesce(content, '') != '';
+UPDATE comments SET content_html = '<p>' || replace(replace(replace(replace(replace(content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;') || '</p>'
+ WHERE content != '';
+
+DROP VIEW IF EXISTS threads_view;
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS threads_view;
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Score,
+	           t.AuthorName,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      u.username AS AuthorName,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+ALTER TABLE comments DROP COLUMN content_html;
+ALTER TABLE threads DROP COLUMN content_html;
@@ -0,0 +1,91 @@
+-- +migrate Up
+
+-- story types : story, ask, show or job. Text posts whose title starts with "Ask GN:" are ask stories,
+-- stories whose title starts with "Show GN:" are show stories, jobs are posted by administrators.
+
+ALTER TABLE threads ADD COLUMN type varchar(16) not null default 'story';
+CREATE INDEX threads_type_index ON threads(type);
+
+UPDATE threads SET type = 'ask' WHERE lower(title) LIKE 'ask gn:%';
+UPDATE threads SET type = 'show' WHERE lower(title) LIKE 'show gn:%';
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+DROP INDEX IF EXISTS threads_type_index;
+ALTER TABLE threads DROP COLUMN type;
@@ -0,0 +1,164 @@
+-- +migrate Up
+
+-- flags are stored per user, an item is flagged, i.e. hidden from listings,
+-- when its flags reach a threshold relative to its score
+
+CREATE TABLE thread_flags(
+	id integer primary key autoincrement,
+	thread_id integer not null references threads(id) ON DELETE CASCADE,
+	user_id integer not null references users(id) ON DELETE CASCADE,
+	created timestamp not null default(datetime('now'))
+);
+CREATE UNIQUE INDEX thread_flags_index ON thread_flags(thread_id,user_id);
+
+CREATE TABLE comment_flags(
+	id integer primary key autoincrement,
+	comment_id integer not null references comments(id) ON DELETE CASCADE,
+	user_id integer not null references users(id) ON DELETE CASCADE,
+	created timestamp not null default(datetime('now'))
+);
+CREATE UNIQUE INDEX comment_flags_index ON comment_flags(comment_id,user_id);
+
+ALTER TABLE threads ADD COLUMN flagged boolean not null default(0);
+ALTER TABLE comments ADD COLUMN flagged boolean not null default(0);
+
+DROP VIEW IF EXISTS threads_view;
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       c.flagged AS Flagged,
+	       (SELECT COUNT(*) FROM comment_flags WHERE comment_flags.comment_id = c.id) AS FlagCount,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS threads_view;
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+ALTER TABLE comments DROP COLUMN flagged;
+ALTER TABLE threads DROP COLUMN flagged;
+DROP INDEX IF EXISTS comment_flags_index;
+DROP TABLE comment_flags;
+DROP INDEX IF EXISTS thread_flags_index;
+DROP TABLE thread_flags;
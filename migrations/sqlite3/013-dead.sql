@@ -0,0 +1,157 @@
+-- +migrate Up
+
+-- dead items are only listed for their author and the users who enable showdead,
+-- every new item of a shadowbanned user is dead
+
+ALTER TABLE threads ADD COLUMN dead boolean not null default(0);
+ALTER TABLE comments ADD COLUMN dead boolean not null default(0);
+ALTER TABLE users ADD COLUMN shadowbanned boolean not null default(0);
+ALTER TABLE users ADD COLUMN showdead boolean not null default(0);
+
+DROP VIEW IF EXISTS threads_view;
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           t.Dead,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      threads.dead AS Dead,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       c.flagged AS Flagged,
+	       (SELECT COUNT(*) FROM comment_flags WHERE comment_flags.comment_id = c.id) AS FlagCount,
+	       c.dead AS Dead,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS threads_view;
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       c.flagged AS Flagged,
+	       (SELECT COUNT(*) FROM comment_flags WHERE comment_flags.comment_id = c.id) AS FlagCount,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+ALTER TABLE users DROP COLUMN showdead;
+ALTER TABLE users DROP COLUMN shadowbanned;
+ALTER TABLE comments DROP COLUMN dead;
+ALTER TABLE threads DROP COLUMN dead;
@@ -0,0 +1,41 @@
+-- +migrate Up
+
+-- moderation actions are append-only, actors and targets are not
+-- foreign keys so entries outlive deleted users, stories and comments
+
+CREATE TABLE moderation_log(
+	id integer primary key autoincrement,
+	actor_id integer,
+	actor_name varchar(255) not null,
+	target_type varchar(20) not null,
+	target_id integer not null,
+	action varchar(50) not null,
+	reason text not null default(''),
+	before text not null default(''),
+	after text not null default(''),
+	created timestamp not null default(datetime('now'))
+);
+CREATE INDEX moderation_log_target_index ON moderation_log(target_type,target_id);
+CREATE INDEX moderation_log_actor_index ON moderation_log(actor_name);
+
+-- +migrate StatementBegin
+CREATE TRIGGER moderation_log_no_update BEFORE UPDATE ON moderation_log
+BEGIN
+	SELECT RAISE(ABORT, 'the moderation log is append-only');
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER moderation_log_no_delete BEFORE DELETE ON moderation_log
+BEGIN
+	SELECT RAISE(ABORT, 'the moderation log is append-only');
+END;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP TRIGGER IF EXISTS moderation_log_no_delete;
+DROP TRIGGER IF EXISTS moderation_log_no_update;
+DROP INDEX IF EXISTS moderation_log_actor_index;
+DROP INDEX IF EXISTS moderation_log_target_index;
+DROP TABLE moderation_log;
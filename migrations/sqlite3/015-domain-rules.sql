@@ -0,0 +1,127 @@
+-- +migrate Up
+
+-- domain rules ban, kill or penalize the stories of a domain and its subdomains,
+-- or the stories which url matches a regular expression. Penalties only apply to domains
+
+CREATE TABLE domain_rules(
+	id integer primary key autoincrement,
+	pattern varchar(255) not null,
+	is_regex boolean not null default(0),
+	rule varchar(20) not null,
+	reason text not null default(''),
+	created timestamp not null default(datetime('now'))
+);
+CREATE UNIQUE INDEX domain_rules_pattern_index ON domain_rules(is_regex,pattern);
+
+-- domains are lowercased hosts without www. and without port
+ALTER TABLE threads ADD COLUMN domain varchar(255) not null default('');
+CREATE INDEX threads_domain_index ON threads(domain);
+UPDATE threads SET domain = lower(substr(url, instr(url, '://') + 3)) WHERE instr(url, '://') > 0;
+UPDATE threads SET domain = substr(domain, 1, instr(domain, '/') - 1) WHERE instr(domain, '/') > 0;
+UPDATE threads SET domain = substr(domain, 1, instr(domain, '?') - 1) WHERE instr(domain, '?') > 0;
+UPDATE threads SET domain = substr(domain, 1, instr(domain, '#') - 1) WHERE instr(domain, '#') > 0;
+UPDATE threads SET domain = substr(domain, instr(domain, '@') + 1) WHERE instr(domain, '@') > 0;
+UPDATE threads SET domain = substr(domain, 1, instr(domain, ':') - 1) WHERE instr(domain, ':') > 0;
+UPDATE threads SET domain = substr(domain, 5) WHERE domain LIKE 'www.%';
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           t.Dead,
+	           t.Domain,
+	           t.Penalized,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      threads.dead AS Dead,
+	                      threads.domain AS Domain,
+	                      EXISTS (SELECT 1 FROM domain_rules r WHERE r.rule = 'penalized' AND NOT r.is_regex
+	                              AND (threads.domain = r.pattern OR threads.domain LIKE '%.' || r.pattern)) AS Penalized,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           t.Dead,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      threads.dead AS Dead,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+DROP INDEX IF EXISTS threads_domain_index;
+ALTER TABLE threads DROP COLUMN domain;
+DROP INDEX IF EXISTS domain_rules_pattern_index;
+DROP TABLE domain_rules;
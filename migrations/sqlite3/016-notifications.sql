@@ -0,0 +1,23 @@
+-- +migrate Up
+
+-- a notification is created for the author of a comment when someone replies to it,
+-- or for the author of a story when someone comments on it
+
+CREATE TABLE notifications(
+	id integer primary key autoincrement,
+	user_id integer not null references users(id) ON DELETE CASCADE,
+	comment_id integer not null references comments(id) ON DELETE CASCADE,
+	read boolean not null default(0),
+	created timestamp not null default(datetime('now'))
+);
+CREATE INDEX notifications_user_index ON notifications(user_id,read);
+CREATE UNIQUE INDEX notifications_comment_index ON notifications(comment_id,user_id);
+
+ALTER TABLE users ADD COLUMN email_notifications boolean not null default(0);
+
+-- +migrate Down
+
+ALTER TABLE users DROP COLUMN email_notifications;
+DROP INDEX IF EXISTS notifications_comment_index;
+DROP INDEX IF EXISTS notifications_user_index;
+DROP TABLE notifications;
@@ -0,0 +1,136 @@
+-- +migrate Up
+
+-- users save stories and comments to their favorites, which are public unless
+-- the user makes them private
+
+CREATE TABLE thread_favorites(
+	id integer primary key autoincrement,
+	thread_id integer not null references threads(id) ON DELETE CASCADE,
+	user_id integer not null references users(id) ON DELETE CASCADE,
+	created timestamp not null default(datetime('now'))
+);
+CREATE UNIQUE INDEX thread_favorites_index ON thread_favorites(thread_id,user_id);
+CREATE INDEX thread_favorites_user_index ON thread_favorites(user_id);
+
+CREATE TABLE comment_favorites(
+	id integer primary key autoincrement,
+	comment_id integer not null references comments(id) ON DELETE CASCADE,
+	user_id integer not null references users(id) ON DELETE CASCADE,
+	created timestamp not null default(datetime('now'))
+);
+CREATE UNIQUE INDEX comment_favorites_index ON comment_favorites(comment_id,user_id);
+CREATE INDEX comment_favorites_user_index ON comment_favorites(user_id);
+
+ALTER TABLE users ADD COLUMN public_favorites boolean not null default(1);
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           t.Dead,
+	           t.Domain,
+	           t.Penalized,
+	           t.FavoriteCount,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      threads.dead AS Dead,
+	                      threads.domain AS Domain,
+	                      EXISTS (SELECT 1 FROM domain_rules r WHERE r.rule = 'penalized' AND NOT r.is_regex
+	                              AND (threads.domain = r.pattern OR threads.domain LIKE '%.' || r.pattern)) AS Penalized,
+	                      (SELECT COUNT(*) FROM thread_favorites WHERE thread_favorites.thread_id = threads.id) AS FavoriteCount,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           t.Dead,
+	           t.Domain,
+	           t.Penalized,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      threads.dead AS Dead,
+	                      threads.domain AS Domain,
+	                      EXISTS (SELECT 1 FROM domain_rules r WHERE r.rule = 'penalized' AND NOT r.is_regex
+	                              AND (threads.domain = r.pattern OR threads.domain LIKE '%.' || r.pattern)) AS Penalized,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+ALTER TABLE users DROP COLUMN public_favorites;
+DROP INDEX IF EXISTS comment_favorites_user_index;
+DROP INDEX IF EXISTS comment_favorites_index;
+DROP TABLE comment_favorites;
+DROP INDEX IF EXISTS thread_favorites_user_index;
+DROP INDEX IF EXISTS thread_favorites_index;
+DROP TABLE thread_favorites;
@@ -0,0 +1,16 @@
+-- +migrate Up
+
+-- users hide stories from their front page, newest and domain listings
+
+CREATE TABLE hidden_threads(
+	id integer primary key autoincrement,
+	thread_id integer not null references threads(id) ON DELETE CASCADE,
+	user_id integer not null references users(id) ON DELETE CASCADE,
+	created timestamp not null default(datetime('now'))
+);
+CREATE UNIQUE INDEX hidden_threads_index ON hidden_threads(user_id,thread_id);
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS hidden_threads_index;
+DROP TABLE hidden_threads;
@@ -0,0 +1,66 @@
+-- +migrate Up
+
+-- the karma of a user is the sum of the votes on the user's stories and comments,
+-- it is cached in users.karma and kept up to date by triggers on the votes so
+-- that users can be ranked by karma (/leaders) without summing all the votes
+
+ALTER TABLE users ADD COLUMN karma integer not null default(0);
+
+UPDATE users SET karma =
+	(SELECT coalesce(SUM(thread_votes.score), 0) FROM thread_votes JOIN threads ON threads.id = thread_votes.thread_id WHERE threads.author_id = users.id)
+	+ (SELECT coalesce(SUM(comment_votes.score), 0) FROM comment_votes JOIN comments ON comments.id = comment_votes.comment_id WHERE comments.author_id = users.id);
+
+CREATE INDEX users_karma_index ON users(karma);
+
+-- +migrate StatementBegin
+CREATE TRIGGER thread_vote_inserted AFTER INSERT ON thread_votes
+BEGIN
+	UPDATE users SET karma = karma + new.score WHERE id = (SELECT author_id FROM threads WHERE id = new.thread_id);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER thread_vote_updated AFTER UPDATE OF score ON thread_votes
+BEGIN
+	UPDATE users SET karma = karma - old.score + new.score WHERE id = (SELECT author_id FROM threads WHERE id = new.thread_id);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER thread_vote_deleted AFTER DELETE ON thread_votes
+BEGIN
+	UPDATE users SET karma = karma - old.score WHERE id = (SELECT author_id FROM threads WHERE id = old.thread_id);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER comment_vote_inserted AFTER INSERT ON comment_votes
+BEGIN
+	UPDATE users SET karma = karma + new.score WHERE id = (SELECT author_id FROM comments WHERE id = new.comment_id);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER comment_vote_updated AFTER UPDATE OF score ON comment_votes
+BEGIN
+	UPDATE users SET karma = karma - old.score + new.score WHERE id = (SELECT author_id FROM comments WHERE id = new.comment_id);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER comment_vote_deleted AFTER DELETE ON comment_votes
+BEGIN
+	UPDATE users SET karma = karma - old.score WHERE id = (SELECT author_id FROM comments WHERE id = old.comment_id);
+END;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP TRIGGER IF EXISTS comment_vote_deleted;
+DROP TRIGGER IF EXISTS comment_vote_updated;
+DROP TRIGGER IF EXISTS comment_vote_inserted;
+DROP TRIGGER IF EXISTS thread_vote_deleted;
+DROP TRIGGER IF EXISTS thread_vote_updated;
+DROP TRIGGER IF EXISTS thread_vote_inserted;
+DROP INDEX IF EXISTS users_karma_index;
+ALTER TABLE users DROP COLUMN karma;
@@ -0,0 +1,64 @@
+-- +migrate Up
+
+-- comments_view counts the upvotes and the downvotes of comments,
+-- the item page ranks comments by the Wilson lower bound of their votes
+
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       coalesce(SUM(cv.score > 0), 0) AS Upvotes,
+	       coalesce(SUM(cv.score < 0), 0) AS Downvotes,
+	       c.flagged AS Flagged,
+	       (SELECT COUNT(*) FROM comment_flags WHERE comment_flags.comment_id = c.id) AS FlagCount,
+	       c.dead AS Dead,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       COUNT(cv.score) AS CommentScore,
+	       c.flagged AS Flagged,
+	       (SELECT COUNT(*) FROM comment_flags WHERE comment_flags.comment_id = c.id) AS FlagCount,
+	       c.dead AS Dead,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
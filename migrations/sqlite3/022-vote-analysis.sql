@@ -0,0 +1,190 @@
+-- +migrate Up
+
+-- votes found suspicious by the vote analysis (voting rings, new accounts voting
+-- for a single author) get a weight lower than 1. The scores displayed still count
+-- every vote but rankings use RankingScore, the sum of the weighted votes.
+-- The latest report of the analysis is kept for administrators
+
+ALTER TABLE thread_votes ADD COLUMN weight real not null default(1);
+ALTER TABLE comment_votes ADD COLUMN weight real not null default(1);
+
+CREATE TABLE vote_reports(
+	id integer primary key autoincrement,
+	report text not null,
+	created timestamp not null default(datetime('now'))
+);
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           t.Dead,
+	           t.Domain,
+	           t.Penalized,
+	           t.FavoriteCount,
+	           t.RankingScore,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      threads.dead AS Dead,
+	                      threads.domain AS Domain,
+	                      EXISTS (SELECT 1 FROM domain_rules r WHERE r.rule = 'penalized' AND NOT r.is_regex
+	                              AND (threads.domain = r.pattern OR threads.domain LIKE '%.' || r.pattern)) AS Penalized,
+	                      (SELECT COUNT(*) FROM thread_favorites WHERE thread_favorites.thread_id = threads.id) AS FavoriteCount,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score,
+	                      coalesce(SUM(thread_votes.score * thread_votes.weight), 0) AS RankingScore
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       coalesce(SUM(cv.score), 0) AS CommentScore,
+	       coalesce(SUM(cv.score > 0), 0) AS Upvotes,
+	       coalesce(SUM(cv.score < 0), 0) AS Downvotes,
+	       coalesce(SUM(cv.score * cv.weight), 0) AS RankingScore,
+	       coalesce(SUM((cv.score > 0) * (1 - cv.weight)), 0) AS SuspiciousUpvotes,
+	       coalesce(SUM((cv.score < 0) * (1 - cv.weight)), 0) AS SuspiciousDownvotes,
+	       c.flagged AS Flagged,
+	       (SELECT COUNT(*) FROM comment_flags WHERE comment_flags.comment_id = c.id) AS FlagCount,
+	       c.dead AS Dead,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP VIEW IF EXISTS comments_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS comments_view AS 
+	SELECT c.id AS ID,
+	       c.content AS Content,
+	       c.content_html AS ContentHTML,
+	       c.author_id AS AuthorID,
+	       u.username AS AuthorName,
+	       c.created AS Created,
+		   c.updated AS Updated,
+	       c.thread_id AS ThreadID,
+	       c.parent_id AS ParentID,
+	       coalesce(SUM(cv.score), 0) AS CommentScore,
+	       coalesce(SUM(cv.score > 0), 0) AS Upvotes,
+	       coalesce(SUM(cv.score < 0), 0) AS Downvotes,
+	       c.flagged AS Flagged,
+	       (SELECT COUNT(*) FROM comment_flags WHERE comment_flags.comment_id = c.id) AS FlagCount,
+	       c.dead AS Dead,
+	       t.Title AS ThreadTitle
+	  FROM comments c
+	       JOIN
+	       users u ON u.id = c.author_id
+	       JOIN
+	       threads t ON t.id = c.thread_id
+	       LEFT JOIN
+	       comment_votes cv ON cv.comment_id = c.id
+	 GROUP BY c.id ;
+-- +migrate StatementEnd
+
+DROP VIEW IF EXISTS threads_view;
+
+-- +migrate StatementBegin
+CREATE VIEW IF NOT EXISTS threads_view AS 
+	SELECT t.ID,
+	           t.AuthorID,
+	           t.Title,
+	           t.Created,
+	           t.URL,
+	           t.Type,
+	           t.Content,
+	           t.ContentHTML,
+	           t.Score,
+	           t.AuthorName,
+	           t.Flagged,
+	           t.FlagCount,
+	           t.Dead,
+	           t.Domain,
+	           t.Penalized,
+	           t.FavoriteCount,
+	           coalesce(COUNT(c.id), 0) AS CommentCount
+	      FROM (
+	               SELECT threads.id AS ID,
+	                      threads.author_id AS AuthorID,
+	                      threads.title AS Title,
+	                      threads.created AS Created,
+	                      threads.url AS URL,
+	                      threads.type AS Type,
+	                      coalesce(threads.content, '') AS Content,
+	                      threads.content_html AS ContentHTML,
+	                      u.username AS AuthorName,
+	                      threads.flagged AS Flagged,
+	                      (SELECT COUNT(*) FROM thread_flags WHERE thread_flags.thread_id = threads.id) AS FlagCount,
+	                      threads.dead AS Dead,
+	                      threads.domain AS Domain,
+	                      EXISTS (SELECT 1 FROM domain_rules r WHERE r.rule = 'penalized' AND NOT r.is_regex
+	                              AND (threads.domain = r.pattern OR threads.domain LIKE '%.' || r.pattern)) AS Penalized,
+	                      (SELECT COUNT(*) FROM thread_favorites WHERE thread_favorites.thread_id = threads.id) AS FavoriteCount,
+	                      coalesce(SUM(thread_votes.score), 0) AS Score
+	                 FROM threads
+	                      JOIN
+	                      users u ON u.id = threads.author_id
+	                      LEFT JOIN
+	                      thread_votes ON thread_votes.thread_id = threads.id
+	                GROUP BY threads.id
+	           )
+	           t
+	           LEFT JOIN
+	           comments c ON c.thread_id = t.ID
+	           GROUP BY t.id
+-- +migrate StatementEnd
+
+DROP TABLE vote_reports;
+ALTER TABLE comment_votes DROP COLUMN weight;
+ALTER TABLE thread_votes DROP COLUMN weight;
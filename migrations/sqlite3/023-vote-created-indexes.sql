@@ -0,0 +1,11 @@
+-- +migrate Up
+
+-- the vote analysis only reads the votes cast during its window
+
+CREATE INDEX thread_votes_created_index ON thread_votes(created);
+CREATE INDEX comment_votes_created_index ON comment_votes(created);
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS comment_votes_created_index;
+DROP INDEX IF EXISTS thread_votes_created_index;
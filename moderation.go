@@ -0,0 +1,136 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+const moderationDocumentation = `
+Usage:
+gonews moderation export [<filter>...] [-json] [<options>]
+
+Commands:
+	export 		Writes the moderation log as CSV, the newest actions first
+
+Filters:
+	actor=<username> 	Actions of an actor, cli for the actions of the user command
+	action=<action> 	Actions by name, i.e. kill, delete, shadowban
+	type=<type> 		Actions on a type of target : story, comment or user
+	id=<id> 		Actions on the target with an id
+
+With -json, entries are written as JSON, one entry per line.
+
+example: gonews moderation export type=user action=ban -json
+`
+
+// RunModerationCommand parses arguments and executes a moderation command
+func RunModerationCommand(flagSet *flag.FlagSet, arguments []string) error {
+	var (
+		positionals, options []string
+		asJSON               bool
+	)
+	for _, argument := range arguments {
+		switch {
+		case argument == "-json" || argument == "--json":
+			asJSON = true
+		case len(options) == 0 && !strings.HasPrefix(argument, "-"):
+			positionals = append(positionals, argument)
+		default:
+			options = append(options, argument)
+		}
+	}
+	if len(positionals) == 0 || positionals[0] != "export" {
+		return fmt.Errorf("not a valid moderation command\n%s", moderationDocumentation)
+	}
+	filter, err := ParseModerationLogFilter(positionals[1:])
+	if err != nil {
+		return err
+	}
+	configuration, err := LoadConfiguration(flagSet, options)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(configuration.Driver, configuration.DataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return ExportModerationLog(&gonews.ModerationLogRepository{DB: db}, filter, asJSON, os.Stdout)
+}
+
+// ParseModerationLogFilter parses key=value filters
+func ParseModerationLogFilter(arguments []string) (filter gonews.ModerationLogFilter, err error) {
+	for _, argument := range arguments {
+		parts := strings.SplitN(argument, "=", 2)
+		if len(parts) != 2 {
+			return filter, fmt.Errorf("not a valid filter : %s", argument)
+		}
+		switch parts[0] {
+		case "actor":
+			filter.ActorName = parts[1]
+		case "action":
+			filter.Action = parts[1]
+		case "type":
+			filter.TargetType = parts[1]
+		case "id":
+			if filter.TargetID, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+				return filter, fmt.Errorf("not a valid target id : %s", parts[1])
+			}
+		default:
+			return filter, fmt.Errorf("not a valid filter : %s", argument)
+		}
+	}
+	return filter, nil
+}
+
+// ExportModerationLog writes the entries matching a filter as CSV or as JSON lines
+func ExportModerationLog(repository *gonews.ModerationLogRepository, filter gonews.ModerationLogFilter, asJSON bool, out io.Writer) error {
+	entries, err := repository.Find(filter, -1, 0)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"id", "created", "actor_id", "actor_name", "action", "target_type", "target_id", "reason", "before", "after"})
+	for _, entry := range entries {
+		writer.Write([]string{strconv.FormatInt(entry.ID, 10), entry.Created.Format("2006-01-02 15:04:05"),
+			strconv.FormatInt(entry.ActorID, 10), entry.ActorName, entry.Action, entry.TargetType,
+			strconv.FormatInt(entry.TargetID, 10), entry.Reason, entry.Before, entry.After})
+	}
+	writer.Flush()
+	return writer.Error()
+}
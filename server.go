@@ -0,0 +1,281 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+// DefaultShutdownTimeout is how long the server waits for in-flight requests on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Server handles the lifecycle of the gonews http server :
+// listening on tcp or on a unix socket, serving over TLS
+// and shutting down gracefully when SIGINT or SIGTERM are received
+type Server struct {
+	*http.Server
+	// RedirectServer redirects http requests to https when TLS is enabled
+	RedirectServer *http.Server
+	// MetricsServer serves the metrics when a metrics address is configured
+	MetricsServer *http.Server
+	// Readiness is turned off as soon as the shutdown starts
+	Readiness *gonews.Readiness
+	// MailQueue is drained on shutdown once the servers stopped
+	MailQueue *gonews.MailQueue
+	Options   *StartOptions
+	DB        *sql.DB
+	// Logger logs the lifecycle of the server and the errors of the jobs
+	Logger gonews.LoggerInterface
+	// Jobs run in the background while the server runs
+	Jobs []Job
+	// stopJobs cancels the context of the background jobs on shutdown
+	jobsContext context.Context
+	stopJobs    context.CancelFunc
+	jobs        sync.WaitGroup
+}
+
+// Job is a task the server runs in the background, a job with
+// an Interval of 0 is disabled. The context of Run is cancelled on shutdown
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// NewJobs returns the background jobs of the application : the vote analysis
+// and the cleanup of expired sessions when sessions are stored in the database
+func NewJobs(db *sql.DB, options gonews.ContainerOptions, logger gonews.LoggerInterface) []Job {
+	analyzer := &gonews.VoteAnalyzer{DB: db, Metrics: options.Metrics}
+	jobs := []Job{{
+		Name:     "vote analysis",
+		Interval: options.VoteAnalysis.Interval,
+		Run: func(ctx context.Context) error {
+			report, err := analyzer.Run(ctx, options.VoteAnalysis)
+			if err == nil && len(report.Votes) > 0 {
+				logger.Log(gonews.INFO, "vote analysis", "rings", len(report.Rings),
+					"sockpuppets", len(report.Sockpuppets), "suspicious_votes", len(report.Votes))
+			}
+			return err
+		},
+	}}
+	if options.Session.Store == "sql" {
+		sessions := &gonews.SessionRepository{DB: db, Metrics: options.Metrics}
+		jobs = append(jobs, Job{Name: "expired sessions cleanup", Interval: options.Session.CleanupInterval, Run: sessions.DeleteExpired})
+	}
+	return jobs
+}
+
+// NewServer returns a new server configured with the start options
+func NewServer(handler http.Handler, db *sql.DB, options *StartOptions) *Server {
+	server := &Server{
+		Server: &http.Server{
+			Addr:         options.Host + ":" + options.Port,
+			Handler:      handler,
+			ReadTimeout:  options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+			IdleTimeout:  options.IdleTimeout,
+		},
+		Options: options,
+		DB:      db,
+		Logger:  gonews.NewDefaultLogger(gonews.INFO),
+	}
+	server.jobsContext, server.stopJobs = context.WithCancel(context.Background())
+	if server.IsTLS() && options.HTTPRedirectAddr != "" {
+		server.RedirectServer = &http.Server{
+			Addr:         options.HTTPRedirectAddr,
+			Handler:      http.HandlerFunc(server.redirectToHTTPS),
+			ReadTimeout:  options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+			IdleTimeout:  options.IdleTimeout,
+		}
+	}
+	return server
+}
+
+// ServeMetrics serves metrics on Options.MetricsAddr at /metrics, if the address is not empty
+func (server *Server) ServeMetrics(handler http.Handler) {
+	if server.Options.MetricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(gonews.Route{}.Metrics(), handler)
+	server.MetricsServer = &http.Server{
+		Addr:         server.Options.MetricsAddr,
+		Handler:      mux,
+		ReadTimeout:  server.Options.ReadTimeout,
+		WriteTimeout: server.Options.WriteTimeout,
+		IdleTimeout:  server.Options.IdleTimeout,
+	}
+}
+
+// IsTLS returns true if a certificate and a key were provided
+func (server *Server) IsTLS() bool {
+	return server.Options.TLSCertFile != "" && server.Options.TLSKeyFile != ""
+}
+
+// Listen returns a listener on a unix socket if a socket path was provided
+// or a tcp listener on Server.Addr
+func (server *Server) Listen() (net.Listener, error) {
+	if server.Options.Socket == "" {
+		return net.Listen("tcp", server.Addr)
+	}
+	// remove a stale socket left by a previous process
+	if err := os.Remove(server.Options.Socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", server.Options.Socket)
+}
+
+// ListenAndServe serves requests until a SIGINT or SIGTERM is received,
+// then drains in-flight connections and closes the database
+func (server *Server) ListenAndServe() error {
+	listener, err := server.Listen()
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, 3)
+	go func() {
+		if server.IsTLS() {
+			errs <- server.ServeTLS(listener, server.Options.TLSCertFile, server.Options.TLSKeyFile)
+		} else {
+			errs <- server.Serve(listener)
+		}
+	}()
+	server.Logger.Log(gonews.INFO, "server listening", "address", listener.Addr().String())
+	if server.RedirectServer != nil {
+		go func() {
+			errs <- server.RedirectServer.ListenAndServe()
+		}()
+		server.Logger.Log(gonews.INFO, "redirecting http requests to https", "address", server.RedirectServer.Addr)
+	}
+	if server.MetricsServer != nil {
+		go func() {
+			errs <- server.MetricsServer.ListenAndServe()
+		}()
+		server.Logger.Log(gonews.INFO, "serving metrics", "address", server.MetricsServer.Addr)
+	}
+	for _, job := range server.Jobs {
+		if job.Interval > 0 {
+			server.jobs.Add(1)
+			go server.runJob(job)
+			server.Logger.Log(gonews.INFO, "running job", "job", job.Name, "interval", job.Interval.String())
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err = <-errs:
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		if shutdownErr := server.Shutdown(); err == nil {
+			err = shutdownErr
+		}
+		return err
+	case sig := <-signals:
+		server.Logger.Log(gonews.INFO, "shutting down", "signal", sig.String())
+		return server.Shutdown()
+	}
+}
+
+// runJob runs a job when the server starts then every job.Interval,
+// until the server shuts down
+func (server *Server) runJob(job Job) {
+	defer server.jobs.Done()
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		if err := job.Run(server.jobsContext); err != nil && server.jobsContext.Err() == nil {
+			server.Logger.Log(gonews.ERROR, "job failed", "job", job.Name, "error", err.Error())
+		}
+		select {
+		case <-server.jobsContext.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown gracefully stops the servers : the background jobs are cancelled, /readyz
+// reports not ready during Options.ShutdownDelay so load balancers stop sending traffic,
+// then the servers wait at most Options.ShutdownTimeout for in-flight requests,
+// the jobs to stop and the queued emails to be sent, and the database connection is closed
+func (server *Server) Shutdown() error {
+	server.stopJobs()
+	server.Readiness.SetShuttingDown()
+	if server.Options.ShutdownDelay > 0 {
+		server.Logger.Log(gonews.INFO, "not ready, waiting before shutting down", "delay", server.Options.ShutdownDelay.String())
+		time.Sleep(server.Options.ShutdownDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), server.Options.ShutdownTimeout)
+	defer cancel()
+	var errs []error
+	if server.RedirectServer != nil {
+		errs = append(errs, server.RedirectServer.Shutdown(ctx))
+	}
+	if server.MetricsServer != nil {
+		errs = append(errs, server.MetricsServer.Shutdown(ctx))
+	}
+	errs = append(errs, server.Server.Shutdown(ctx))
+	stopped := make(chan struct{})
+	go func() {
+		server.jobs.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		errs = append(errs, errors.New("background jobs did not stop before the shutdown timeout"))
+	}
+	errs = append(errs, server.MailQueue.Close(ctx))
+	if server.DB != nil {
+		errs = append(errs, server.DB.Close())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	server.Logger.Log(gonews.INFO, "server stopped")
+	return nil
+}
+
+// redirectToHTTPS redirects a request to the same url using the https scheme
+func (server *Server) redirectToHTTPS(rw http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if server.Options.Port != "443" {
+		host = net.JoinHostPort(host, server.Options.Port)
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(rw, r, target, http.StatusMovedPermanently)
+}
@@ -0,0 +1,86 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+func TestServer_Shutdown_Jobs(t *testing.T) {
+	for _, fixture := range []struct {
+		Name    string
+		Run     func(ctx context.Context) error
+		Stopped bool
+	}{
+		{"job stopping when cancelled", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, true},
+		{"job ignoring the cancellation", func(ctx context.Context) error {
+			time.Sleep(time.Minute)
+			return nil
+		}, false},
+	} {
+		server := NewServer(http.NotFoundHandler(), nil, &StartOptions{Host: "127.0.0.1", Port: "0", ShutdownTimeout: 100 * time.Millisecond})
+		server.Logger = gonews.NewDefaultLogger(gonews.OFF)
+		server.jobs.Add(1)
+		go server.runJob(Job{Name: fixture.Name, Interval: time.Hour, Run: fixture.Run})
+		start := time.Now()
+		err := server.Shutdown()
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("%s : shutdown took %s", fixture.Name, elapsed)
+		}
+		if (err == nil) != fixture.Stopped {
+			t.Fatalf("%s : shutdown error %v", fixture.Name, err)
+		}
+	}
+}
+
+// mailerStub records the recipients of the emails it sends after a delay
+type mailerStub struct {
+	sent chan string
+}
+
+func (mailer mailerStub) Send(to, subject, body string) error {
+	time.Sleep(10 * time.Millisecond)
+	mailer.sent <- to
+	return nil
+}
+
+func TestServer_Shutdown_MailQueue(t *testing.T) {
+	server := NewServer(http.NotFoundHandler(), nil, &StartOptions{Host: "127.0.0.1", Port: "0", ShutdownTimeout: 5 * time.Second})
+	server.Logger = gonews.NewDefaultLogger(gonews.OFF)
+	server.MailQueue = gonews.NewMailQueue(10)
+	mailer := mailerStub{make(chan string, 10)}
+	for i := 0; i < 3; i++ {
+		if err := server.MailQueue.Push(mailer, "jane.doe@gonews.acme", "subject", "body", func(error) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if sent := len(mailer.sent); sent != 3 {
+		t.Fatalf("emails sent before the shutdown : %d", sent)
+	}
+}
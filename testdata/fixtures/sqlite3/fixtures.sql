@@ -57,3 +57,10 @@ INSERT INTO comments(id,thread_id,author_id,content,parent_id) VALUES(9,5,5,"It
 INSERT INTO comments(id,thread_id,author_id,content,parent_id) VALUES(10,5,5,"GPL-3.0 for non commercial use, there is also a commercial license.",8);
 INSERT INTO comments(id,thread_id,author_id,content,parent_id) VALUES(11,5,4,"Nice thank you",10);
 
+-- cached html of the comments, the sample contents contain no html special characters
+UPDATE comments SET content_html = '<p>' || content || '</p>';
+
+-- cached karma of the users, the comment votes are inserted before their comments
+UPDATE users SET karma =
+	(SELECT coalesce(SUM(thread_votes.score), 0) FROM thread_votes JOIN threads ON threads.id = thread_votes.thread_id WHERE threads.author_id = users.id)
+	+ (SELECT coalesce(SUM(comment_votes.score), 0) FROM comment_votes JOIN comments ON comments.id = comment_votes.comment_id WHERE comments.author_id = users.id);
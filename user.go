@@ -0,0 +1,410 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+const userDocumentation = `
+Usage:
+gonews user <command> [<arguments>] [-json] [<options>]
+
+Commands:
+	create <username> <email> 		Creates a user, the password is read from the standard input
+	list 					Lists users
+	set-password <user> 			Changes the password of a user and logs the user out everywhere, the password is read from the standard input
+	grant-role <user> <role> 		Grants a role (administrator, moderator) to a user
+	revoke-role <user> <role> 		Revokes a role from a user
+	ban <user> 				Prevents a user from logging in
+	unban <user> 				Allows a banned user to log in again
+	shadowban <user> 			Makes every new story and comment of a user dead
+	unshadowban <user> 			Lifts the shadowban of a user
+	delete <user> 				Deletes a user with all the stories, comments and votes of the user
+
+<user> is a username or a user id. With -json, results and errors are written as JSON.
+Changes to users are recorded in the moderation log, with a reason given by -reason="...".
+
+example: echo "my password" | gonews user create johndoe john@example.com -json
+`
+
+// errReported is returned when an error has already been written to the output
+var errReported = errors.New("error reported")
+
+// UserCommand executes the user command group. It shares the configuration
+// loading of the start command, with an additional -json option
+type UserCommand struct {
+	Repository *gonews.UserRepository
+	// Sessions are revoked when a password is changed or a user banned
+	Sessions *gonews.SessionRepository
+	// RememberTokens are revoked along with sessions
+	RememberTokens *gonews.RememberTokenRepository
+	// ModerationLog records the changes to users
+	ModerationLog *gonews.ModerationLogRepository
+	Reason        string
+	// Stdin is where passwords are read from
+	Stdin io.Reader
+	Out   io.Writer
+	JSON  bool
+}
+
+// RunUserCommand parses arguments and executes a user command
+func RunUserCommand(flagSet *flag.FlagSet, arguments []string) error {
+	var positionals, options []string
+	command := &UserCommand{Stdin: os.Stdin, Out: os.Stdout}
+	for _, argument := range arguments {
+		switch {
+		case argument == "-json" || argument == "--json":
+			command.JSON = true
+		case strings.HasPrefix(argument, "-reason=") || strings.HasPrefix(argument, "--reason="):
+			command.Reason = argument[strings.Index(argument, "=")+1:]
+		case len(options) == 0 && !strings.HasPrefix(argument, "-"):
+			positionals = append(positionals, argument)
+		default:
+			options = append(options, argument)
+		}
+	}
+	if len(positionals) == 0 {
+		return fmt.Errorf("missing user command\n%s", userDocumentation)
+	}
+	err := func() error {
+		configuration, err := LoadConfiguration(flagSet, options)
+		if err != nil {
+			return err
+		}
+		db, err := sql.Open(configuration.Driver, configuration.DataSource)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		command.Repository = &gonews.UserRepository{DB: db}
+		command.Sessions = &gonews.SessionRepository{DB: db}
+		command.RememberTokens = &gonews.RememberTokenRepository{DB: db}
+		command.ModerationLog = &gonews.ModerationLogRepository{DB: db}
+		return command.Execute(positionals[0], positionals[1:])
+	}()
+	if err != nil && command.JSON {
+		command.write(map[string]string{"error": err.Error()}, "")
+		return errReported
+	}
+	return err
+}
+
+// Execute executes a user command with its arguments
+func (command *UserCommand) Execute(name string, arguments []string) error {
+	expect := func(n int, usage string) error {
+		if len(arguments) != n {
+			return fmt.Errorf("usage: gonews user %s %s", name, usage)
+		}
+		return nil
+	}
+	switch name {
+	case "create":
+		if err := expect(2, "<username> <email>"); err != nil {
+			return err
+		}
+		return command.Create(arguments[0], arguments[1])
+	case "list":
+		if err := expect(0, ""); err != nil {
+			return err
+		}
+		return command.List()
+	case "set-password":
+		if err := expect(1, "<user>"); err != nil {
+			return err
+		}
+		return command.SetPassword(arguments[0])
+	case "grant-role", "revoke-role":
+		if err := expect(2, "<user> <role>"); err != nil {
+			return err
+		}
+		return command.SetRole(arguments[0], arguments[1], name == "grant-role")
+	case "ban", "unban":
+		if err := expect(1, "<user>"); err != nil {
+			return err
+		}
+		return command.SetBanned(arguments[0], name == "ban")
+	case "shadowban", "unshadowban":
+		if err := expect(1, "<user>"); err != nil {
+			return err
+		}
+		return command.SetShadowbanned(arguments[0], name == "shadowban")
+	case "delete":
+		if err := expect(1, "<user>"); err != nil {
+			return err
+		}
+		return command.Delete(arguments[0])
+	}
+	return fmt.Errorf("not a valid user command : %s\n%s", name, userDocumentation)
+}
+
+// Create creates a new user
+func (command *UserCommand) Create(username, email string) error {
+	password, err := command.readPassword()
+	if err != nil {
+		return err
+	}
+	user := &gonews.User{Username: username, Email: email, Password: password}
+	if err := (gonews.UserValidator{}).Validate(user); err != nil {
+		return fmt.Errorf("invalid user : %s", err)
+	}
+	if existing, err := command.Repository.GetOneByUsername(username); err != nil {
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("username '%s' is already taken", username)
+	}
+	if existing, err := command.Repository.GetOneByEmail(email); err != nil {
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("email '%s' is already taken", email)
+	}
+	if err := user.CreateSecurePassword(password); err != nil {
+		return err
+	}
+	if err := command.Repository.Save(user); err != nil {
+		return err
+	}
+	if user, err = command.Repository.GetByID(user.ID); err != nil {
+		return err
+	}
+	return command.printUser(user, "user %s created with id %d", user.Username, user.ID)
+}
+
+// List lists all users
+func (command *UserCommand) List() error {
+	users, err := command.Repository.GetAll(-1, 0)
+	if err != nil {
+		return err
+	}
+	if command.JSON {
+		if users == nil {
+			users = []*gonews.User{}
+		}
+		return command.write(users, "")
+	}
+	writer := tabwriter.NewWriter(command.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tUSERNAME\tEMAIL\tROLES\tBANNED\tSHADOWBANNED\tCREATED")
+	for _, user := range users {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%t\t%t\t%s\n", user.ID, user.Username, user.Email,
+			strings.Join(user.Roles, ","), user.Banned, user.Shadowbanned, user.Created.Format("2006-01-02 15:04:05"))
+	}
+	return writer.Flush()
+}
+
+// SetPassword changes the password of a user
+func (command *UserCommand) SetPassword(identifier string) error {
+	user, err := command.find(identifier)
+	if err != nil {
+		return err
+	}
+	before := *user
+	password, err := command.readPassword()
+	if err != nil {
+		return err
+	}
+	errs := gonews.ConcreteValidationError{}
+	gonews.StringMinLengthValidator("Password", password, 8, errs)
+	gonews.StringMaxLengthValidator("Password", password, 255, errs)
+	if errs.HasErrors() {
+		return fmt.Errorf("invalid password : %s", errs)
+	}
+	if err := user.CreateSecurePassword(password); err != nil {
+		return err
+	}
+	if err := command.logModeration("set-password", &before, user); err != nil {
+		return err
+	}
+	if err := command.Repository.Save(user); err != nil {
+		return err
+	}
+	if err := command.logOutEverywhere(user.ID); err != nil {
+		return err
+	}
+	return command.printUser(user, "password of user %s changed", user.Username)
+}
+
+// SetRole grants or revokes a role
+func (command *UserCommand) SetRole(identifier, role string, grant bool) error {
+	user, err := command.find(identifier)
+	if err != nil {
+		return err
+	}
+	if role != gonews.RoleAdministrator && role != gonews.RoleModerator {
+		return fmt.Errorf("role '%s' does not exist", role)
+	}
+	if !grant && !user.HasRole(role) {
+		return fmt.Errorf("user with id %d does not have role '%s'", user.ID, role)
+	}
+	before := *user
+	user.Roles = []string{}
+	for _, name := range before.Roles {
+		if name != role {
+			user.Roles = append(user.Roles, name)
+		}
+	}
+	if grant {
+		user.Roles = append(user.Roles, role)
+		sort.Strings(user.Roles)
+	}
+	if err := command.logModeration(map[bool]string{true: "grant-role", false: "revoke-role"}[grant], &before, user); err != nil {
+		return err
+	}
+	if grant {
+		err = command.Repository.AddRole(user.ID, role)
+	} else {
+		err = command.Repository.RemoveRole(user.ID, role)
+	}
+	if err != nil {
+		return err
+	}
+	return command.printUser(user, "roles of user %s : %s", user.Username, strings.Join(user.Roles, ","))
+}
+
+// SetBanned bans or unbans a user
+func (command *UserCommand) SetBanned(identifier string, banned bool) error {
+	user, err := command.find(identifier)
+	if err != nil {
+		return err
+	}
+	before := *user
+	user.Banned = banned
+	if err := command.logModeration(map[bool]string{true: "ban", false: "unban"}[banned], &before, user); err != nil {
+		return err
+	}
+	if err := command.Repository.Save(user); err != nil {
+		return err
+	}
+	if banned {
+		if err := command.logOutEverywhere(user.ID); err != nil {
+			return err
+		}
+	}
+	return command.printUser(user, "user %s banned : %t", user.Username, user.Banned)
+}
+
+// SetShadowbanned shadowbans or lifts the shadowban of a user
+func (command *UserCommand) SetShadowbanned(identifier string, shadowbanned bool) error {
+	user, err := command.find(identifier)
+	if err != nil {
+		return err
+	}
+	before := *user
+	user.Shadowbanned = shadowbanned
+	if err := command.logModeration(map[bool]string{true: "shadowban", false: "unshadowban"}[shadowbanned], &before, user); err != nil {
+		return err
+	}
+	if err := command.Repository.Save(user); err != nil {
+		return err
+	}
+	return command.printUser(user, "user %s shadowbanned : %t", user.Username, user.Shadowbanned)
+}
+
+// Delete deletes a user
+func (command *UserCommand) Delete(identifier string) error {
+	user, err := command.find(identifier)
+	if err != nil {
+		return err
+	}
+	if err := command.logModeration("delete", user, nil); err != nil {
+		return err
+	}
+	if err := command.Repository.Delete(user.ID); err != nil {
+		return err
+	}
+	return command.printUser(user, "user %s deleted", user.Username)
+}
+
+// logOutEverywhere revokes the sessions and "remember me" tokens of a user
+func (command *UserCommand) logOutEverywhere(userID int64) error {
+	if _, err := command.Sessions.DeleteByUserID(userID); err != nil {
+		return err
+	}
+	return command.RememberTokens.DeleteByUserID(userID)
+}
+
+// logModeration records a change to a user in the moderation log,
+// commands call it before applying the change so that no change goes unlogged
+func (command *UserCommand) logModeration(action string, before, after *gonews.User) error {
+	if command.ModerationLog == nil {
+		return nil
+	}
+	entry, err := gonews.NewModerationLogEntry(0, "cli", action, gonews.ModerationTargetUser, before.ID, command.Reason, before, after)
+	if err != nil {
+		return err
+	}
+	return command.ModerationLog.Create(entry)
+}
+
+// find finds a user by id or by username
+func (command *UserCommand) find(identifier string) (user *gonews.User, err error) {
+	if id, parseErr := strconv.ParseInt(identifier, 10, 64); parseErr == nil {
+		user, err = command.Repository.GetByID(id)
+	} else {
+		user, err = command.Repository.GetOneByUsername(identifier)
+	}
+	if err == nil && user == nil {
+		err = fmt.Errorf("user '%s' not found", identifier)
+	}
+	return
+}
+
+// readPassword reads the first line of the standard input
+func (command *UserCommand) readPassword() (string, error) {
+	if file, ok := command.Stdin.(*os.File); ok {
+		if stat, err := file.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(os.Stderr, "password: ")
+		}
+	}
+	line, err := bufio.NewReader(command.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password should be provided on the standard input")
+	}
+	return password, nil
+}
+
+func (command *UserCommand) printUser(user *gonews.User, format string, arguments ...interface{}) error {
+	return command.write(user, fmt.Sprintf(format, arguments...))
+}
+
+// write writes value as JSON if the -json option is set or message otherwise
+func (command *UserCommand) write(value interface{}, message string) error {
+	if command.JSON {
+		encoder := json.NewEncoder(command.Out)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(value)
+	}
+	_, err := fmt.Fprintln(command.Out, message)
+	return err
+}
@@ -0,0 +1,167 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+
+	gonews "github.com/mparaiso/gonews/core"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// newUserCommand returns a user command on a migrated in-memory database
+func newUserCommand(t *testing.T) (*UserCommand, *sql.DB, *bytes.Buffer) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: opens a new database
+	db.SetMaxOpenConns(1)
+	if _, err = Migrate(db, "sqlite3", sqlmigrate.Up, 0); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	return &UserCommand{
+		Repository:     &gonews.UserRepository{DB: db},
+		Sessions:       &gonews.SessionRepository{DB: db},
+		RememberTokens: &gonews.RememberTokenRepository{DB: db},
+		ModerationLog:  &gonews.ModerationLogRepository{DB: db},
+		Reason:         "test",
+		Out:            out,
+	}, db, out
+}
+
+func TestUserCommand(t *testing.T) {
+	command, db, out := newUserCommand(t)
+	defer db.Close()
+	command.Stdin = strings.NewReader("a long password\n")
+	if err := command.Execute("create", []string{"johndoe", "john@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "user johndoe created") {
+		t.Fatalf("unexpected output of create : %s", out)
+	}
+	command.Stdin = strings.NewReader("another password\n")
+	if err := command.Execute("create", []string{"johndoe", "other@example.com"}); err == nil {
+		t.Fatal("creating a user with a taken username should fail")
+	}
+	for _, fixture := range []struct {
+		Command string
+		Column  string
+		Value   bool
+	}{
+		{"ban", "banned", true},
+		{"unban", "banned", false},
+		{"shadowban", "shadowbanned", true},
+		{"unshadowban", "shadowbanned", false},
+	} {
+		if err := command.Execute(fixture.Command, []string{"johndoe"}); err != nil {
+			t.Fatal(fixture.Command, err)
+		}
+		var value bool
+		if err := db.QueryRow("SELECT " + fixture.Column + " FROM users WHERE username = 'johndoe' ;").Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		if value != fixture.Value {
+			t.Fatalf("%s : %s is %t", fixture.Command, fixture.Column, value)
+		}
+	}
+	if err := command.Execute("delete", []string{"johndoe"}); err != nil {
+		t.Fatal(err)
+	}
+	var users int
+	if err := db.QueryRow("SELECT count(*) FROM users ;").Scan(&users); err != nil || users != 0 {
+		t.Fatalf("users after delete : %d, %v", users, err)
+	}
+	if err := command.Execute("ban", []string{"johndoe"}); err == nil {
+		t.Fatal("banning a missing user should fail")
+	}
+	entries, err := command.ModerationLog.Find(gonews.ModerationLogFilter{TargetType: gonews.ModerationTargetUser}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	if got := strings.Join(actions, ","); got != "delete,unshadowban,shadowban,unban,ban" {
+		t.Fatalf("moderation log : %s", got)
+	}
+}
+
+func TestUserCommand_SetRole(t *testing.T) {
+	command, db, _ := newUserCommand(t)
+	defer db.Close()
+	command.Stdin = strings.NewReader("a long password\n")
+	if err := command.Execute("create", []string{"johndoe", "john@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := command.Execute("grant-role", []string{"johndoe", "emperor"}); err == nil {
+		t.Fatal("granting a missing role should fail")
+	}
+	if err := command.Execute("revoke-role", []string{"johndoe", gonews.RoleModerator}); err == nil {
+		t.Fatal("revoking a role the user does not have should fail")
+	}
+	if err := command.Execute("grant-role", []string{"johndoe", gonews.RoleModerator}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := command.ModerationLog.Find(gonews.ModerationLogFilter{TargetType: gonews.ModerationTargetUser}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != "grant-role" || !strings.Contains(entries[0].After, gonews.RoleModerator) {
+		t.Fatalf("moderation log : %+v", entries)
+	}
+}
+
+func TestUserCommand_UnloggedActionsAreNotApplied(t *testing.T) {
+	command, db, _ := newUserCommand(t)
+	defer db.Close()
+	command.Stdin = strings.NewReader("a long password\n")
+	if err := command.Execute("create", []string{"johndoe", "john@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TRIGGER moderation_log_down BEFORE INSERT ON moderation_log
+		BEGIN SELECT RAISE(ABORT, 'moderation log is down'); END ;`); err != nil {
+		t.Fatal(err)
+	}
+	for _, arguments := range [][]string{
+		{"ban", "johndoe"},
+		{"shadowban", "johndoe"},
+		{"grant-role", "johndoe", gonews.RoleModerator},
+		{"delete", "johndoe"},
+	} {
+		if err := command.Execute(arguments[0], arguments[1:]); err == nil {
+			t.Fatalf("%s should fail when the moderation log cannot be written", arguments[0])
+		}
+	}
+	var banned, shadowbanned bool
+	if err := db.QueryRow("SELECT banned, shadowbanned FROM users WHERE username = 'johndoe' ;").Scan(&banned, &shadowbanned); err != nil {
+		t.Fatal(err)
+	}
+	if banned || shadowbanned {
+		t.Fatalf("banned : %t, shadowbanned : %t", banned, shadowbanned)
+	}
+	var roles int
+	if err := db.QueryRow("SELECT count(*) FROM users_roles ;").Scan(&roles); err != nil || roles != 0 {
+		t.Fatalf("roles : %d, %v", roles, err)
+	}
+}
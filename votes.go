@@ -0,0 +1,110 @@
+//    Gonews is a webapp that provides a forum where users can post and discuss links
+//
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU Affero General Public License as published
+//    by the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU Affero General Public License for more details.
+//
+//    You should have received a copy of the GNU Affero General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	gonews "github.com/mparaiso/gonews/core"
+)
+
+const votesDocumentation = `
+Usage:
+gonews votes <command> [<options>]
+
+Commands:
+	analyze 	Looks for voting rings and sockpuppets, down-weights their votes and prints the report
+	report 		Prints the report of the last analysis
+
+The analysis is configured with the -voteanalysiswindow, -voteringwindow, -voteringminitems, -newaccountage,
+-sockpuppetminvotes and -suspiciousvoteweight options of gonews start.
+
+example: gonews votes analyze -datasource db.sqlite3
+`
+
+// VotesCommand executes the votes command group
+type VotesCommand struct {
+	Analyzer *gonews.VoteAnalyzer
+	Options  gonews.VoteAnalysisOptions
+	Out      io.Writer
+}
+
+// RunVotesCommand parses arguments and executes a votes command
+func RunVotesCommand(flagSet *flag.FlagSet, arguments []string) error {
+	if len(arguments) == 0 || strings.HasPrefix(arguments[0], "-") {
+		return fmt.Errorf("missing votes command\n%s", votesDocumentation)
+	}
+	name, arguments := arguments[0], arguments[1:]
+	configuration, err := LoadConfiguration(flagSet, arguments)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(configuration.Driver, configuration.DataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	command := &VotesCommand{Analyzer: &gonews.VoteAnalyzer{DB: db}, Options: configuration.VoteAnalysis, Out: os.Stdout}
+	return command.Execute(name)
+}
+
+// Execute executes a votes command
+func (command *VotesCommand) Execute(name string) error {
+	switch name {
+	case "analyze":
+		report, err := command.Analyzer.Run(context.Background(), command.Options)
+		if err != nil {
+			return err
+		}
+		return command.Print(report)
+	case "report":
+		report, err := command.Analyzer.GetLatestReport()
+		if err != nil {
+			return err
+		}
+		if report == nil {
+			_, err = fmt.Fprintln(command.Out, "The votes have not been analyzed yet")
+			return err
+		}
+		return command.Print(report)
+	}
+	return fmt.Errorf("not a valid votes command : %s\n%s", name, votesDocumentation)
+}
+
+// Print prints the voting rings and the sockpuppets of a report
+func (command *VotesCommand) Print(report *gonews.VoteReport) error {
+	writer := tabwriter.NewWriter(command.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "Analyzed on %s the votes since %s, %d suspicious votes on stories and %d on comments\n\n",
+		report.Created.Format("2006-01-02 15:04:05"), report.Since.Format("2006-01-02 15:04:05"), report.CountVotes(gonews.FlagKindStory), report.CountVotes(gonews.FlagKindComment))
+	fmt.Fprintln(writer, "RING\tUSERS\tITEMS\tVOTES")
+	for i, ring := range report.Rings {
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%d\n", i+1, strings.Join(ring.Usernames, ","), ring.Items, ring.Votes)
+	}
+	fmt.Fprintln(writer, "\nSOCKPUPPET\tVOTES FOR\tVOTES")
+	for _, sockpuppet := range report.Sockpuppets {
+		fmt.Fprintf(writer, "%s\t%s\t%d\n", sockpuppet.Username, sockpuppet.AuthorName, sockpuppet.Votes)
+	}
+	return writer.Flush()
+}